@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alphagov/router/logger"
+)
+
+// backendGrace keeps routes working when a reload removes a backend which
+// they still use, which usually means the backends and routes were
+// published out of step. For up to period after the backend first goes
+// missing, its routes keep using the backend's previous handlers, and an
+// alert is raised. After that, the routes are skipped as they would be
+// without a grace period: so that this doesn't wait for the next publish,
+// expire is called, if it's set, to reload the routes when the period ends.
+type backendGrace struct {
+	period time.Duration
+	now    func() time.Time
+	expire func()
+
+	mu       sync.Mutex
+	previous map[string]graceBackend
+	missing  map[string]time.Time
+	timer    *time.Timer
+	expiry   time.Time
+}
+
+// graceBackend is what's kept of a backend from the last reload.
+type graceBackend struct {
+	backend            Backend
+	handler, grpcProxy http.Handler
+}
+
+// graceUpdate is how a reload changes which backends are missing. It's only
+// applied, by retain, once the reload's routes are in use, so that a reload
+// which fails doesn't leave the grace periods out of step with the routes.
+type graceUpdate struct {
+	now                 time.Time
+	missing             map[string]time.Time
+	kept, back, expired []string
+}
+
+func newBackendGrace(period time.Duration) *backendGrace {
+	return &backendGrace{
+		period:   period,
+		now:      time.Now,
+		previous: make(map[string]graceBackend),
+		missing:  make(map[string]time.Time),
+	}
+}
+
+// apply adds the previous handlers to backends and grpcBackends for each
+// backend which table's routes use but which is missing from the table,
+// if it's still within its grace period. It returns the table to build the
+// routes from, which includes the backends being kept, and the update to
+// pass to retain if the routes are used.
+func (g *backendGrace) apply(table *RouteTable, backends, grpcBackends map[string]http.Handler) (*RouteTable, *graceUpdate) {
+	if g == nil || g.period <= 0 {
+		return table, nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	update := &graceUpdate{now: g.now(), missing: make(map[string]time.Time)}
+	var kept []Backend
+	for _, id := range usedBackends(table.Routes) {
+		if _, ok := backends[id]; ok {
+			if _, ok := g.missing[id]; ok {
+				update.back = append(update.back, id)
+			}
+			continue
+		}
+		previous, ok := g.previous[id]
+		if !ok {
+			// It's never been loaded, so there's nothing to keep using.
+			continue
+		}
+		since, ok := g.missing[id]
+		if !ok {
+			since = update.now
+		}
+		update.missing[id] = since
+		if update.now.Sub(since) >= g.period {
+			update.expired = append(update.expired, id)
+			continue
+		}
+		backends[id] = previous.handler
+		grpcBackends[id] = previous.grpcProxy
+		kept = append(kept, previous.backend)
+		update.kept = append(update.kept, id)
+	}
+
+	if len(kept) == 0 {
+		return table, update
+	}
+	withKept := *table
+	withKept.Backends = append(append([]Backend(nil), table.Backends...), kept...)
+	return &withKept, update
+}
+
+// retain records the backends which the routes have just been built with,
+// for use if they go missing from a later reload, and applies the update
+// apply returned for them: alerting about backends which have gone missing
+// and scheduling a reload for when the first grace period ends.
+func (g *backendGrace) retain(table *RouteTable, backends, grpcBackends map[string]http.Handler, update *graceUpdate) {
+	if g == nil || g.period <= 0 || update == nil {
+		return
+	}
+
+	previous := make(map[string]graceBackend, len(table.Backends))
+	for _, backend := range table.Backends {
+		if handler, ok := backends[backend.BackendID]; ok {
+			previous[backend.BackendID] = graceBackend{backend, handler, grpcBackends[backend.BackendID]}
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, id := range update.back {
+		logInfo(fmt.Sprintf("router: backend %s is back after %v", id, update.now.Sub(g.missing[id]).Round(time.Second)))
+	}
+	var expiry time.Time
+	for _, id := range update.kept {
+		since := update.missing[id]
+		if _, ok := g.missing[id]; !ok {
+			err := fmt.Errorf("backend %s was removed but routes still use it, keeping it for %v", id, g.period)
+			logWarn("router:", err)
+			logger.NotifySentry(logger.ReportableError{Error: err})
+		}
+		if end := since.Add(g.period); expiry.IsZero() || end.Before(expiry) {
+			expiry = end
+		}
+		backendGraceMetric.WithLabelValues(id).Set(1)
+	}
+	for _, id := range update.expired {
+		logWarn(fmt.Sprintf("router: backend %s has been missing for longer than %v, skipping its routes", id, g.period))
+		backendGraceMetric.WithLabelValues(id).Set(0)
+	}
+	for id := range g.missing {
+		if _, ok := update.missing[id]; !ok {
+			// It's back, or nothing uses it any more so it was removed on
+			// purpose.
+			backendGraceMetric.WithLabelValues(id).Set(0)
+		}
+	}
+	g.missing = update.missing
+	g.previous = previous
+	g.schedule(expiry, update.now)
+}
+
+// schedule arranges for expire to be called at expiry, replacing any call
+// scheduled before, or cancels it if expiry is zero.
+func (g *backendGrace) schedule(expiry, now time.Time) {
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	g.expiry = expiry
+	if expiry.IsZero() || g.expire == nil {
+		return
+	}
+	g.timer = time.AfterFunc(expiry.Sub(now), g.expire)
+}
+
+// usedBackends returns the IDs of the backends which routes proxy to, in
+// order.
+func usedBackends(routes []Route) []string {
+	seen := make(map[string]bool)
+	for i := range routes {
+		if routes[i].Handler == "backend" && routes[i].BackendID != "" {
+			seen[routes[i].BackendID] = true
+		}
+	}
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	prommodel "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Backend grace period", func() {
+	var (
+		rt       *Router
+		source   *fakeRouteSource
+		frontend *httptest.Server
+		now      time.Time
+	)
+
+	BeforeEach(func() {
+		frontend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("frontend"))
+		}))
+		source = &fakeRouteSource{table: &RouteTable{
+			Checksum: "1",
+			Backends: []Backend{{BackendID: "frontend", BackendURL: frontend.URL}},
+			Routes: []Route{
+				{IncomingPath: "/government", RouteType: "prefix", Handler: "backend", BackendID: "frontend"},
+				{IncomingPath: "/old", RouteType: "exact", Handler: "gone"},
+			},
+		}}
+		now = time.Date(2024, time.May, 1, 9, 0, 0, 0, time.UTC)
+
+		rt = newTestRouter()
+		rt.source = source
+		rt.backendGrace = newBackendGrace(10 * time.Minute)
+		rt.backendGrace.now = func() time.Time { return now }
+		rt.reloadRoutes()
+	})
+
+	AfterEach(func() {
+		frontend.Close()
+	})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+
+	inGrace := func() float64 {
+		metric := new(prommodel.Metric)
+		Expect(backendGraceMetric.WithLabelValues("frontend").Write(metric)).To(Succeed())
+		return metric.Gauge.GetValue()
+	}
+
+	removeBackend := func(checksum string) {
+		source.table = &RouteTable{Checksum: checksum, Routes: source.table.Routes}
+		rt.reloadRoutes()
+	}
+
+	It("should keep using a removed backend during the grace period", func() {
+		removeBackend("2")
+		Expect(serve("/government").Body.String()).To(Equal("frontend"))
+		Expect(inGrace()).To(Equal(1.0))
+
+		now = now.Add(9 * time.Minute)
+		removeBackend("3")
+		Expect(serve("/government").Body.String()).To(Equal("frontend"))
+	})
+
+	It("should skip the routes after the grace period", func() {
+		removeBackend("2")
+		now = now.Add(10 * time.Minute)
+		removeBackend("3")
+		Expect(serve("/government").Code).To(Equal(http.StatusNotFound))
+		Expect(inGrace()).To(Equal(0.0))
+	})
+
+	It("should reload the routes when the grace period ends", func() {
+		removeBackend("2")
+		Expect(rt.backendGrace.expiry).To(Equal(now.Add(10 * time.Minute)))
+
+		now = now.Add(10 * time.Minute)
+		rt.reloadExpiredBackends()
+		Expect(serve("/government").Code).To(Equal(http.StatusNotFound))
+		Expect(rt.backendGrace.expiry.IsZero()).To(BeTrue())
+	})
+
+	It("shouldn't start the grace period until the routes are used", func() {
+		backendGraceMetric.WithLabelValues("frontend").Set(0)
+		_, update := rt.backendGrace.apply(&RouteTable{Routes: source.table.Routes}, map[string]http.Handler{}, map[string]http.Handler{})
+		Expect(update.kept).To(Equal([]string{"frontend"}))
+		Expect(rt.backendGrace.missing).To(BeEmpty())
+		Expect(inGrace()).To(Equal(0.0))
+	})
+
+	It("should start the grace period again if the backend comes back", func() {
+		routes := source.table.Routes
+		removeBackend("2")
+		now = now.Add(9 * time.Minute)
+		source.table = &RouteTable{
+			Checksum: "3",
+			Backends: []Backend{{BackendID: "frontend", BackendURL: frontend.URL}},
+			Routes:   routes,
+		}
+		rt.reloadRoutes()
+		Expect(inGrace()).To(Equal(0.0))
+
+		now = now.Add(9 * time.Minute)
+		removeBackend("4")
+		Expect(serve("/government").Body.String()).To(Equal("frontend"))
+	})
+
+	It("shouldn't keep backends without a grace period", func() {
+		rt.backendGrace = newBackendGrace(0)
+		removeBackend("2")
+		Expect(serve("/government").Code).To(Equal(http.StatusNotFound))
+	})
+})
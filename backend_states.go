@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/alphagov/router/handlers"
+)
+
+// backendStates keeps each backend's retry budget and circuit breaker, by
+// backend ID, across reloads of the routes, so that rebuilding a backend's
+// handler doesn't reset them.
+type backendStates struct {
+	mu     sync.Mutex
+	states map[string]*handlers.BackendState
+}
+
+func newBackendStates() *backendStates {
+	return &backendStates{states: make(map[string]*handlers.BackendState)}
+}
+
+// get returns the state of a backend, starting it if the backend's new.
+// Without any states, each backend starts afresh.
+func (s *backendStates) get(backendID string) *handlers.BackendState {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[backendID]
+	if !ok {
+		state = handlers.NewBackendState(backendID)
+		s.states[backendID] = state
+	}
+	return state
+}
+
+// retain forgets the states of backends which are no longer in use.
+func (s *backendStates) retain(backends map[string]http.Handler) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for backendID := range s.states {
+		if _, ok := backends[backendID]; !ok {
+			delete(s.states, backendID)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Backend state", func() {
+	var (
+		rt       *Router
+		source   *fakeRouteSource
+		frontend *httptest.Server
+		fallback *httptest.Server
+		requests int32
+	)
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&requests, 0)
+		frontend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		fallback = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("fallback"))
+		}))
+		source = &fakeRouteSource{table: &RouteTable{
+			Checksum: "1",
+			Backends: []Backend{{BackendID: "frontend", BackendURL: frontend.URL, FallbackURL: fallback.URL}},
+			Routes:   []Route{{IncomingPath: "/", RouteType: "prefix", Handler: "backend", BackendID: "frontend"}},
+		}}
+
+		rt = newTestRouter()
+		rt.source = source
+		rt.circuitBreaker = handlers.CircuitBreaker{Failures: 1, Cooldown: time.Hour}
+		rt.reloadRoutes()
+	})
+
+	AfterEach(func() {
+		frontend.Close()
+		fallback.Close()
+	})
+
+	serve := func() string {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+		return rw.Body.String()
+	}
+
+	It("should keep a backend's circuit breaker open across reloads", func() {
+		serve()
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(1))
+
+		source.table.Checksum = "2"
+		rt.reloadRoutes()
+		Expect(serve()).To(Equal("fallback"))
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(1), "the open circuit breaker should have been kept")
+	})
+
+	It("should forget the state of removed backends", func() {
+		state := rt.backendStates.get("frontend")
+		source.table = &RouteTable{Checksum: "2"}
+		rt.reloadRoutes()
+		Expect(rt.backendStates.get("frontend")).NotTo(BeIdenticalTo(state))
+	})
+})
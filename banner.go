@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// bannerCheckInterval is how often the banner file is checked for changes.
+const bannerCheckInterval = 5 * time.Second
+
+// bannerFile holds the HTML fragment inserted by the "banner" middleware.
+// The file is checked for changes at most every bannerCheckInterval, so that
+// a banner can be put up or taken down without restarting the router; an
+// empty or missing file means there's no banner.
+type bannerFile struct {
+	fileName string
+
+	mu        sync.Mutex
+	banner    []byte
+	modTime   time.Time
+	lastCheck time.Time
+	now       func() time.Time
+}
+
+func newBannerFile(fileName string) *bannerFile {
+	f := &bannerFile{fileName: fileName, now: time.Now}
+	f.check()
+	return f
+}
+
+// current returns the banner, reading the file again if it's time to check
+// for changes.
+func (f *bannerFile) current() []byte {
+	f.mu.Lock()
+	due := f.now().Sub(f.lastCheck) >= bannerCheckInterval
+	f.mu.Unlock()
+
+	if due {
+		f.check()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.banner
+}
+
+func (f *bannerFile) check() {
+	f.mu.Lock()
+	f.lastCheck = f.now()
+	modTime := f.modTime
+	f.mu.Unlock()
+
+	info, err := os.Stat(f.fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logWarn("router: couldn't read banner file, keeping the current banner:", err)
+			return
+		}
+		f.set(nil, time.Time{})
+		return
+	}
+	if info.ModTime().Equal(modTime) {
+		return
+	}
+
+	banner, err := ioutil.ReadFile(f.fileName)
+	if err != nil {
+		logWarn("router: couldn't read banner file, keeping the current banner:", err)
+		return
+	}
+	f.set(banner, info.ModTime())
+}
+
+func (f *bannerFile) set(banner []byte, modTime time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(banner) > 0 && len(f.banner) == 0 {
+		logWarn("router: adding the banner in", f.fileName, "to HTML pages")
+	} else if len(banner) == 0 && len(f.banner) > 0 {
+		logInfo("router: removed the banner from HTML pages")
+	}
+	f.banner, f.modTime = banner, modTime
+}
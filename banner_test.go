@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Banner file", func() {
+	var (
+		dir, fileName string
+		now           time.Time
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "banner")
+		Expect(err).NotTo(HaveOccurred())
+		fileName = filepath.Join(dir, "banner.html")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	newFile := func() *bannerFile {
+		f := newBannerFile(fileName)
+		now = f.lastCheck
+		f.now = func() time.Time { return now }
+		return f
+	}
+
+	It("should have no banner if the file doesn't exist", func() {
+		Expect(newFile().current()).To(BeEmpty())
+	})
+
+	It("should pick up changes after the check interval", func() {
+		Expect(ioutil.WriteFile(fileName, []byte("<p>Notice</p>"), 0644)).To(Succeed())
+		f := newFile()
+		Expect(string(f.current())).To(Equal("<p>Notice</p>"))
+
+		Expect(os.Remove(fileName)).To(Succeed())
+		Expect(string(f.current())).To(Equal("<p>Notice</p>"))
+
+		now = now.Add(bannerCheckInterval)
+		Expect(f.current()).To(BeEmpty())
+	})
+
+	It("should be needed by the banner middleware", func() {
+		_, err := newMiddlewareSet(Options{Middleware: []string{"banner"}})
+		Expect(err).To(MatchError(ContainSubstring("a banner file is needed")))
+
+		_, err = newMiddlewareSet(Options{Middleware: []string{"banner"}, BannerFileName: fileName})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
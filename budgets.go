@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/alphagov/router/handlers"
+	"github.com/alphagov/router/logger"
+)
+
+const (
+	// budgetMinRequests is how many requests a backend must have had in a
+	// window for its budgets to be checked, so that a couple of slow
+	// requests at a quiet time don't raise an alert.
+	budgetMinRequests = 10
+
+	// budgetLatencyQuantile is the fraction of requests which must be within
+	// a backend's latency budget.
+	budgetLatencyQuantile = 0.95
+
+	// alertWebhookTimeout is how long sending an alert to the webhook may
+	// take.
+	alertWebhookTimeout = 10 * time.Second
+)
+
+// BackendAlert is emitted when a backend goes over one of its budgets
+// during a window, and again when it's back within it.
+type BackendAlert struct {
+	Time      time.Time `json:"time"`
+	BackendID string    `json:"backend_id"`
+	// Budget is "latency" or "errors".
+	Budget   string `json:"budget"`
+	Breached bool   `json:"breached"`
+	Window   string `json:"window"`
+	Requests int64  `json:"requests"`
+	// Fraction is the fraction of the window's requests which were slower
+	// than LatencyBudget, or which failed, and Limit is the most allowed.
+	Fraction      float64 `json:"fraction"`
+	Limit         float64 `json:"limit"`
+	LatencyBudget string  `json:"latency_budget,omitempty"`
+}
+
+// backendBudget is the budget for a backend, and how its requests have
+// done against it in the current window.
+type backendBudget struct {
+	latency   time.Duration
+	errorRate float64
+
+	requests, slow, failed          int64
+	latencyBreached, errorsBreached bool
+}
+
+// budgetMonitor checks each backend's requests against its latency and
+// error budgets, which are set by its latency_budget and error_budget, over
+// each window. It emits a BackendAlert when a backend goes over a budget or
+// comes back within it, as a warning in the error log, a metric and, if
+// there's a webhook URL, a POST of the alert as JSON.
+type budgetMonitor struct {
+	window     time.Duration
+	webhookURL string
+	client     *http.Client
+	logger     logger.Logger
+	now        func() time.Time
+
+	mu       sync.Mutex
+	backends map[string]*backendBudget
+}
+
+func newBudgetMonitor(window time.Duration, webhookURL string, l logger.Logger) *budgetMonitor {
+	return &budgetMonitor{
+		window:     window,
+		webhookURL: webhookURL,
+		client:     &http.Client{Timeout: alertWebhookTimeout},
+		logger:     l,
+		now:        time.Now,
+		backends:   make(map[string]*backendBudget),
+	}
+}
+
+// monitor returns handler wrapped to measure the backend's responses, or
+// just handler if the backend has no budgets. The budgets themselves are
+// only set by retain, once the routes using handler are in use, so that
+// building routes which are then thrown away doesn't change them.
+func (m *budgetMonitor) monitor(backend *Backend, handler http.Handler) http.Handler {
+	if backend.LatencyBudget == "" && backend.ErrorBudget <= 0 {
+		return handler
+	}
+	backendID := backend.BackendID
+	return handlers.NewResponseObserverMiddleware(func(status int, elapsed time.Duration) {
+		m.record(backendID, status, elapsed)
+	})(handler)
+}
+
+// retain sets the budgets of the backends now in use, forgetting those of
+// backends which are no longer in use or no longer have budgets. Backends
+// whose budgets are kept carry on with the current window's counts.
+func (m *budgetMonitor) retain(backends []Backend) {
+	budgets := make(map[string]*backendBudget, len(backends))
+	for i := range backends {
+		backend := &backends[i]
+		latency := latencyBudget(backend)
+		if latency <= 0 && backend.ErrorBudget <= 0 {
+			continue
+		}
+		budgets[backend.BackendID] = &backendBudget{latency: latency, errorRate: backend.ErrorBudget}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for backendID, budget := range budgets {
+		if existing, ok := m.backends[backendID]; ok {
+			existing.latency, existing.errorRate = budget.latency, budget.errorRate
+			budgets[backendID] = existing
+		}
+	}
+	m.backends = budgets
+}
+
+// latencyBudget parses a backend's latency budget, logging and ignoring it
+// if it's invalid.
+func latencyBudget(backend *Backend) time.Duration {
+	if backend.LatencyBudget == "" {
+		return 0
+	}
+	latency, err := time.ParseDuration(backend.LatencyBudget)
+	if err != nil {
+		logWarn(fmt.Sprintf("router: couldn't parse latency budget %s for backend %s "+
+			"(error: %v), not checking its latency", backend.LatencyBudget, backend.BackendID, err))
+		return 0
+	}
+	return latency
+}
+
+func (m *budgetMonitor) record(backendID string, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	budget, ok := m.backends[backendID]
+	if !ok {
+		return
+	}
+	budget.requests++
+	if budget.latency > 0 && elapsed > budget.latency {
+		budget.slow++
+	}
+	if status >= 500 {
+		budget.failed++
+	}
+}
+
+// check ends the current window, returning an alert for each budget a
+// backend went over or came back within.
+func (m *budgetMonitor) check() []BackendAlert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	var alerts []BackendAlert
+	for backendID, budget := range m.backends {
+		requests := budget.requests
+		slow, failed := budget.slow, budget.failed
+		budget.requests, budget.slow, budget.failed = 0, 0, 0
+		if requests < budgetMinRequests {
+			continue
+		}
+
+		alert := BackendAlert{
+			Time:      now,
+			BackendID: backendID,
+			Window:    m.window.String(),
+			Requests:  requests,
+		}
+		if budget.latency > 0 {
+			fraction := float64(slow) / float64(requests)
+			breached := fraction > 1-budgetLatencyQuantile
+			if breached != budget.latencyBreached {
+				budget.latencyBreached = breached
+				a := alert
+				a.Budget, a.Breached = "latency", breached
+				a.Fraction, a.Limit = fraction, 1-budgetLatencyQuantile
+				a.LatencyBudget = budget.latency.String()
+				alerts = append(alerts, a)
+			}
+		}
+		if budget.errorRate > 0 {
+			fraction := float64(failed) / float64(requests)
+			breached := fraction > budget.errorRate
+			if breached != budget.errorsBreached {
+				budget.errorsBreached = breached
+				a := alert
+				a.Budget, a.Breached = "errors", breached
+				a.Fraction, a.Limit = fraction, budget.errorRate
+				alerts = append(alerts, a)
+			}
+		}
+	}
+	return alerts
+}
+
+// run checks the budgets at the end of every window. It doesn't return.
+func (m *budgetMonitor) run() {
+	for range time.Tick(m.window) {
+		for _, alert := range m.check() {
+			m.emit(alert)
+		}
+	}
+}
+
+func (m *budgetMonitor) emit(alert BackendAlert) {
+	value := 0.0
+	if alert.Breached {
+		value = 1
+		logWarn(fmt.Sprintf("router: backend %s is over its %s budget (%.1f%% of %d requests in %s, limit %.1f%%)",
+			alert.BackendID, alert.Budget, 100*alert.Fraction, alert.Requests, alert.Window, 100*alert.Limit))
+	} else {
+		logInfo(fmt.Sprintf("router: backend %s is back within its %s budget", alert.BackendID, alert.Budget))
+	}
+	backendBudgetBreachedMetric.With(prometheus.Labels{
+		"backend_id": alert.BackendID,
+		"budget":     alert.Budget,
+	}).Set(value)
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		logWarn("router: couldn't encode alert:", err)
+		return
+	}
+	if m.logger != nil {
+		m.logger.Log(map[string]interface{}{"alert": json.RawMessage(data)})
+	}
+	if m.webhookURL != "" {
+		go m.sendWebhook(data)
+	}
+}
+
+func (m *budgetMonitor) sendWebhook(data []byte) {
+	resp, err := m.client.Post(m.webhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		logWarn("router: couldn't send alert to webhook:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logWarn("router: alert webhook responded with status", resp.StatusCode)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backend budgets", func() {
+	var monitor *budgetMonitor
+
+	BeforeEach(func() {
+		monitor = newBudgetMonitor(time.Minute, "", nil)
+	})
+
+	record := func(backendID string, n, status int, elapsed time.Duration) {
+		for i := 0; i < n; i++ {
+			monitor.record(backendID, status, elapsed)
+		}
+	}
+
+	It("should alert when a backend goes over its latency budget and recovers", func() {
+		monitor.retain([]Backend{{BackendID: "frontend", LatencyBudget: "1s"}})
+
+		record("frontend", 94, http.StatusOK, 100*time.Millisecond)
+		record("frontend", 6, http.StatusOK, 2*time.Second)
+		alerts := monitor.check()
+		Expect(alerts).To(HaveLen(1))
+		Expect(alerts[0].BackendID).To(Equal("frontend"))
+		Expect(alerts[0].Budget).To(Equal("latency"))
+		Expect(alerts[0].Breached).To(BeTrue())
+		Expect(alerts[0].Requests).To(BeEquivalentTo(100))
+		Expect(alerts[0].Fraction).To(BeNumerically("~", 0.06))
+		Expect(alerts[0].LatencyBudget).To(Equal("1s"))
+
+		record("frontend", 100, http.StatusOK, 2*time.Second)
+		Expect(monitor.check()).To(BeEmpty(), "it should only alert when the state changes")
+
+		record("frontend", 100, http.StatusOK, 100*time.Millisecond)
+		alerts = monitor.check()
+		Expect(alerts).To(HaveLen(1))
+		Expect(alerts[0].Breached).To(BeFalse())
+	})
+
+	It("should alert when too many requests fail", func() {
+		monitor.retain([]Backend{{BackendID: "frontend", ErrorBudget: 0.1}})
+
+		record("frontend", 8, http.StatusOK, 0)
+		record("frontend", 2, http.StatusBadGateway, 0)
+		alerts := monitor.check()
+		Expect(alerts).To(HaveLen(1))
+		Expect(alerts[0].Budget).To(Equal("errors"))
+		Expect(alerts[0].Fraction).To(BeNumerically("~", 0.2))
+	})
+
+	It("should ignore quiet windows", func() {
+		monitor.retain([]Backend{{BackendID: "frontend", ErrorBudget: 0.1}})
+		record("frontend", budgetMinRequests-1, http.StatusBadGateway, 0)
+		Expect(monitor.check()).To(BeEmpty())
+	})
+
+	It("should measure the backend's responses", func() {
+		backend := Backend{BackendID: "frontend", ErrorBudget: 0.1}
+		handler := monitor.monitor(&backend, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		monitor.retain([]Backend{backend})
+		for i := 0; i < budgetMinRequests; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		Expect(monitor.check()).To(HaveLen(1))
+	})
+
+	It("should leave backends without budgets alone", func() {
+		handler := http.NewServeMux()
+		Expect(monitor.monitor(&Backend{BackendID: "frontend"}, handler)).To(BeIdenticalTo(handler))
+		monitor.retain([]Backend{{BackendID: "frontend", LatencyBudget: "1s"}})
+		monitor.retain([]Backend{{BackendID: "frontend"}})
+		Expect(monitor.backends).To(BeEmpty())
+	})
+
+	It("should only change budgets once the routes are in use", func() {
+		monitor.retain([]Backend{{BackendID: "frontend", ErrorBudget: 0.1}})
+		record("frontend", 5, http.StatusBadGateway, 0)
+
+		monitor.monitor(&Backend{BackendID: "frontend", ErrorBudget: 0.5}, http.NotFoundHandler())
+		monitor.monitor(&Backend{BackendID: "search", ErrorBudget: 0.1}, http.NotFoundHandler())
+		Expect(monitor.backends).To(HaveLen(1))
+		Expect(monitor.backends["frontend"].errorRate).To(Equal(0.1))
+
+		monitor.retain([]Backend{{BackendID: "frontend", ErrorBudget: 0.5}})
+		Expect(monitor.backends["frontend"].errorRate).To(Equal(0.5))
+		Expect(monitor.backends["frontend"].failed).To(BeEquivalentTo(5), "it should keep the window's counts")
+	})
+
+	It("should post alerts to the webhook", func() {
+		received := make(chan BackendAlert, 1)
+		webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var alert BackendAlert
+			body, _ := ioutil.ReadAll(r.Body)
+			Expect(json.Unmarshal(body, &alert)).To(Succeed())
+			received <- alert
+		}))
+		defer webhook.Close()
+
+		monitor.webhookURL = webhook.URL
+		monitor.emit(BackendAlert{BackendID: "frontend", Budget: "errors", Breached: true})
+		var alert BackendAlert
+		Eventually(received).Should(Receive(&alert))
+		Expect(alert.BackendID).To(Equal("frontend"))
+		Expect(alert.Breached).To(BeTrue())
+	})
+})
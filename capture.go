@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alphagov/router/handlers"
+)
+
+// Number of captured requests kept. Once full, the oldest are overwritten.
+const captureBufferSize = 100
+
+// Headers whose values are never captured.
+var redactedCaptureHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Set-Cookie",
+	previewTokenHeader,
+	handlers.SignatureHeader,
+}
+
+// CapturedRequest is a record of a single request and the router's response
+// to it, kept for debugging.
+type CapturedRequest struct {
+	Time       time.Time   `json:"time"`
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	URI        string      `json:"uri"`
+	Proto      string      `json:"proto"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"request_headers"`
+
+	// The route the request matched, if any
+	RoutePath   string `json:"route_path,omitempty"`
+	RoutePrefix bool   `json:"route_prefix,omitempty"`
+
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"response_headers"`
+	ResponseBytes  int64       `json:"response_bytes"`
+
+	// Time taken to send the response headers, and the whole response
+	HeaderSeconds   float64 `json:"header_seconds"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// CaptureStatus describes the state of request capture, for the API.
+type CaptureStatus struct {
+	Active     bool              `json:"active"`
+	Remaining  int               `json:"remaining"`
+	PathPrefix string            `json:"path_prefix"`
+	Requests   []CapturedRequest `json:"requests"`
+}
+
+// requestCapture records the next few requests whose paths match a filter,
+// so that hard-to-reproduce routing problems can be debugged in production.
+// It's switched on through the API.
+type requestCapture struct {
+	mu         sync.Mutex
+	remaining  int
+	pathPrefix string
+	buffer     []CapturedRequest
+	next       int
+}
+
+func newRequestCapture() *requestCapture {
+	return &requestCapture{buffer: make([]CapturedRequest, 0, captureBufferSize)}
+}
+
+// start captures the next count requests with paths starting with
+// pathPrefix, discarding any requests captured previously.
+func (c *requestCapture) start(count int, pathPrefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remaining = count
+	c.pathPrefix = pathPrefix
+	c.buffer = c.buffer[:0]
+	c.next = 0
+}
+
+// stop stops capturing requests, keeping those already captured.
+func (c *requestCapture) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remaining = 0
+}
+
+func (c *requestCapture) status() CaptureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Oldest first
+	requests := make([]CapturedRequest, 0, len(c.buffer))
+	if len(c.buffer) == captureBufferSize {
+		requests = append(requests, c.buffer[c.next:]...)
+		requests = append(requests, c.buffer[:c.next]...)
+	} else {
+		requests = append(requests, c.buffer...)
+	}
+
+	return CaptureStatus{
+		Active:     c.remaining > 0,
+		Remaining:  c.remaining,
+		PathPrefix: c.pathPrefix,
+		Requests:   requests,
+	}
+}
+
+// claim reports whether a request for path should be captured, and if so
+// counts it against the number remaining.
+func (c *requestCapture) claim(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.remaining == 0 || !strings.HasPrefix(path, c.pathPrefix) {
+		return false
+	}
+	c.remaining--
+	return true
+}
+
+func (c *requestCapture) record(req CapturedRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.buffer) < captureBufferSize {
+		c.buffer = append(c.buffer, req)
+	} else {
+		c.buffer[c.next] = req
+	}
+	c.next = (c.next + 1) % captureBufferSize
+}
+
+// serve passes the request to handler, recording it and the response.
+func (c *requestCapture) serve(handler http.Handler, w http.ResponseWriter, req *http.Request, captured CapturedRequest) {
+	rw := &captureResponseWriter{ResponseWrapper: handlers.ResponseWrapper{ResponseWriter: w}, start: time.Now()}
+	defer func() {
+		captured.Status = rw.Status()
+		captured.ResponseHeader = redactHeaders(rw.header)
+		captured.ResponseBytes = rw.bytes
+		captured.HeaderSeconds = rw.headerDuration.Seconds()
+		captured.DurationSeconds = time.Since(rw.start).Seconds()
+		c.record(captured)
+	}()
+
+	captured.Time = rw.start
+	captured.Method = req.Method
+	captured.Host = req.Host
+	captured.URI = req.RequestURI
+	captured.Proto = req.Proto
+	captured.RemoteAddr = req.RemoteAddr
+	captured.Header = redactHeaders(req.Header)
+
+	handler.ServeHTTP(rw, req)
+}
+
+func redactHeaders(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range redactedCaptureHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if _, ok := header[name]; ok {
+			header[name] = []string{"[redacted]"}
+		}
+	}
+	return header
+}
+
+type captureResponseWriter struct {
+	handlers.ResponseWrapper
+
+	start          time.Time
+	header         http.Header
+	headerDuration time.Duration
+	bytes          int64
+}
+
+func (rw *captureResponseWriter) WriteHeader(status int) {
+	rw.captureHeader()
+	rw.ResponseWrapper.WriteHeader(status)
+}
+
+func (rw *captureResponseWriter) Write(b []byte) (int, error) {
+	if rw.Status() == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWrapper.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+func (rw *captureResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rw.captureHeader()
+	return rw.ResponseWrapper.Hijack()
+}
+
+// captureHeader records the response header the first time it's written.
+func (rw *captureResponseWriter) captureHeader() {
+	if rw.Status() == 0 {
+		rw.header = rw.Header().Clone()
+		rw.headerDuration = time.Since(rw.start)
+	}
+}
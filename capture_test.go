@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request capture", func() {
+	var rt *Router
+
+	BeforeEach(func() {
+		rt = newTestRouter()
+		rt.mux.Handle("/foo", true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Set-Cookie", "session=secret")
+			w.WriteHeader(http.StatusTeapot)
+			w.Write([]byte("short and stout"))
+		}))
+	})
+
+	serve := func(path string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("Accept", "text/plain")
+		req.Header.Set("GOVUK-Preview-Token", "secret")
+		req.Header.Set("X-Router-Signature", "secret")
+		rt.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	It("should capture nothing until started", func() {
+		serve("/foo")
+		Expect(rt.capture.status().Requests).To(BeEmpty())
+	})
+
+	It("should capture the next requests matching the path prefix", func() {
+		rt.capture.start(2, "/foo")
+
+		serve("/bar")
+		serve("/foo/1")
+		serve("/foo/2")
+		serve("/foo/3")
+
+		status := rt.capture.status()
+		Expect(status.Active).To(BeFalse())
+		Expect(status.Requests).To(HaveLen(2))
+
+		captured := status.Requests[0]
+		Expect(captured.URI).To(Equal("/foo/1"))
+		Expect(captured.RoutePath).To(Equal("/foo"))
+		Expect(captured.RoutePrefix).To(BeTrue())
+		Expect(captured.Status).To(Equal(http.StatusTeapot))
+		Expect(captured.ResponseBytes).To(Equal(int64(15)))
+		Expect(captured.Header.Get("Accept")).To(Equal("text/plain"))
+		Expect(captured.Header.Get("Cookie")).To(Equal("[redacted]"))
+		Expect(captured.Header.Get("GOVUK-Preview-Token")).To(Equal("[redacted]"))
+		Expect(captured.Header.Get("X-Router-Signature")).To(Equal("[redacted]"))
+		Expect(captured.ResponseHeader.Get("Set-Cookie")).To(Equal("[redacted]"))
+		Expect(status.Requests[1].URI).To(Equal("/foo/2"))
+	})
+
+	It("should record requests which don't match a route", func() {
+		rt.capture.start(1, "")
+		serve("/bar")
+
+		captured := rt.capture.status().Requests[0]
+		Expect(captured.RoutePath).To(BeEmpty())
+		Expect(captured.Status).To(Equal(http.StatusNotFound))
+	})
+
+	It("should capture protocol upgrades", func() {
+		upgrades := newUpgradeServer()
+		defer upgrades.Close()
+		rt.mux, _ = rt.buildMux(&RouteTable{
+			Backends: []Backend{{BackendID: "sockets", BackendURL: upgrades.URL}},
+			Routes:   []Route{{IncomingPath: "/socket", RouteType: "exact", Handler: "backend", BackendID: "sockets"}},
+		})
+		server := httptest.NewServer(rt)
+		defer server.Close()
+
+		rt.capture.start(1, "")
+		status, echoed := upgrade(server.URL, "/socket", nil)
+		Expect(status).To(Equal(http.StatusSwitchingProtocols))
+		Expect(echoed).To(Equal("ping\n"))
+		Eventually(func() int {
+			if requests := rt.capture.status().Requests; len(requests) > 0 {
+				return requests[0].Status
+			}
+			return 0
+		}).Should(Equal(http.StatusSwitchingProtocols))
+	})
+
+	It("should keep only the most recent requests once the buffer is full", func() {
+		rt.capture.start(captureBufferSize+5, "/foo")
+		for i := 0; i < captureBufferSize+5; i++ {
+			serve("/foo/" + strings.Repeat("x", i))
+		}
+
+		requests := rt.capture.status().Requests
+		Expect(requests).To(HaveLen(captureBufferSize))
+		Expect(requests[0].URI).To(Equal("/foo/xxxxx"))
+		Expect(requests[captureBufferSize-1].URI).To(Equal("/foo/" + strings.Repeat("x", captureBufferSize+4)))
+	})
+
+	Context("API", func() {
+		var api http.Handler
+
+		BeforeEach(func() {
+			apiAuthToken = "token"
+			var err error
+			api, err = newAPIHandler(rt)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			apiAuthToken = ""
+		})
+
+		request := func(method, body, token string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "/capture", strings.NewReader(body))
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			rw := httptest.NewRecorder()
+			api.ServeHTTP(rw, req)
+			return rw
+		}
+
+		It("should require the API token", func() {
+			Expect(request("GET", "", "").Code).To(Equal(http.StatusUnauthorized))
+			Expect(request("GET", "", "wrong").Code).To(Equal(http.StatusUnauthorized))
+			Expect(request("GET", "", "token").Code).To(Equal(http.StatusOK))
+		})
+
+		It("should be disabled if there's no API token", func() {
+			apiAuthToken = ""
+			Expect(request("GET", "", "").Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should start and stop capturing", func() {
+			rw := request("POST", `{"count": 5, "path_prefix": "/foo"}`, "token")
+			Expect(rw.Code).To(Equal(http.StatusOK))
+
+			var status CaptureStatus
+			Expect(json.Unmarshal(rw.Body.Bytes(), &status)).To(Succeed())
+			Expect(status.Active).To(BeTrue())
+			Expect(status.Remaining).To(Equal(5))
+			Expect(status.PathPrefix).To(Equal("/foo"))
+
+			serve("/foo")
+			Expect(request("DELETE", "", "token").Code).To(Equal(http.StatusOK))
+			serve("/foo")
+
+			status = rt.capture.status()
+			Expect(status.Active).To(BeFalse())
+			Expect(status.Requests).To(HaveLen(1))
+		})
+
+		It("should reject a capture without a count", func() {
+			Expect(request("POST", `{"path_prefix": "/foo"}`, "token").Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cdnPurgeTimeout is how long a purge request to the CDN may take.
+const cdnPurgeTimeout = 10 * time.Second
+
+// cdnPurgeQueueSize is how many purges can be waiting to be sent to the CDN
+// before further ones are dropped.
+const cdnPurgeQueueSize = 10000
+
+// CDNConfig configures purging of the CDN cache, using the Fastly API.
+type CDNConfig struct {
+	// APIURL is the base URL of the API, e.g. "https://api.fastly.com".
+	APIURL string
+	APIKey string
+	// ServiceID is the service whose cache is purged by surrogate key.
+	ServiceID string
+	// Host is the public host name of the site, used to purge paths.
+	Host string
+}
+
+// cdnPurger purges responses from the CDN cache, either for a single path
+// or for everything tagged with a surrogate key.
+type cdnPurger struct {
+	apiURL    string
+	apiKey    string
+	serviceID string
+	host      string
+	client    *http.Client
+}
+
+func newCDNPurger(c CDNConfig) *cdnPurger {
+	return &cdnPurger{
+		apiURL:    strings.TrimSuffix(c.APIURL, "/"),
+		apiKey:    c.APIKey,
+		serviceID: c.ServiceID,
+		host:      c.Host,
+		client:    &http.Client{Timeout: cdnPurgeTimeout},
+	}
+}
+
+// purgePath purges the cached response for path. A soft purge marks it as
+// stale rather than removing it, so it can still be served if the router
+// can't be reached.
+func (p *cdnPurger) purgePath(path string, soft bool) error {
+	if p.host == "" {
+		return fmt.Errorf("router: can't purge paths without a CDN host name")
+	}
+	return p.purge("path", p.apiURL+"/purge/"+p.host+path, soft)
+}
+
+// purgeKey purges every cached response tagged with key.
+func (p *cdnPurger) purgeKey(key string, soft bool) error {
+	if p.serviceID == "" {
+		return fmt.Errorf("router: can't purge surrogate keys without a CDN service ID")
+	}
+	return p.purge("key", p.apiURL+"/service/"+url.PathEscape(p.serviceID)+"/purge/"+url.PathEscape(key), soft)
+}
+
+func (p *cdnPurger) purge(purgeType, purgeURL string, soft bool) (err error) {
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		cdnPurgeCountMetric.With(prometheus.Labels{"type": purgeType, "result": result}).Inc()
+	}()
+
+	req, err := http.NewRequest("POST", purgeURL, nil)
+	if err != nil {
+		return fmt.Errorf("router: invalid CDN purge URL: %v", err)
+	}
+	req.Header.Set("Fastly-Key", p.apiKey)
+	req.Header.Set("Accept", "application/json")
+	if soft {
+		req.Header.Set("Fastly-Soft-Purge", "1")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("router: CDN purge failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("router: CDN purge failed with status %d: %s",
+			resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// cdnPurgeQueue sends purges to the CDN one at a time in the background, so
+// that reloading routes doesn't wait for them.
+type cdnPurgeQueue struct {
+	purger *cdnPurger
+	// byKey purges the surrogate key for each route, which covers every
+	// path under a prefix route, rather than just the route's path.
+	byKey bool
+	queue chan string
+}
+
+func newCDNPurgeQueue(purger *cdnPurger, byKey bool) *cdnPurgeQueue {
+	return &cdnPurgeQueue{
+		purger: purger,
+		byKey:  byKey,
+		queue:  make(chan string, cdnPurgeQueueSize),
+	}
+}
+
+// enqueue queues a purge for each of paths, dropping any which don't fit in
+// the queue.
+func (q *cdnPurgeQueue) enqueue(paths []string) {
+	for i, path := range paths {
+		select {
+		case q.queue <- path:
+		default:
+			logWarn(fmt.Sprintf("router: CDN purge queue is full, dropping %d purges", len(paths)-i))
+			return
+		}
+	}
+}
+
+// run sends the queued purges to the CDN. It doesn't return.
+func (q *cdnPurgeQueue) run() {
+	for path := range q.queue {
+		var err error
+		if q.byKey {
+			err = q.purger.purgeKey(routeSurrogateKey(path), false)
+		} else {
+			err = q.purger.purgePath(path, false)
+		}
+		if err != nil {
+			logWarn(fmt.Sprintf("router: couldn't purge changed route %s: %v", path, err))
+			continue
+		}
+		logDebug("router: purged changed route from the CDN:", path)
+	}
+}
+
+// changedRoutePaths returns the incoming paths of the routes in previous
+// which have been removed or changed in current, in order.
+func changedRoutePaths(previous, current []Route) []string {
+	type routeKey struct{ path, routeType string }
+	currentRoutes := make(map[routeKey]*Route, len(current))
+	for i := range current {
+		route := &current[i]
+		currentRoutes[routeKey{route.IncomingPath, route.RouteType}] = route
+	}
+
+	seen := make(map[string]bool)
+	var paths []string
+	for i := range previous {
+		route := &previous[i]
+		newRoute, ok := currentRoutes[routeKey{route.IncomingPath, route.RouteType}]
+		if ok && reflect.DeepEqual(route, newRoute) {
+			continue
+		}
+		if !seen[route.IncomingPath] {
+			seen[route.IncomingPath] = true
+			paths = append(paths, route.IncomingPath)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
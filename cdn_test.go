@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CDN caching", func() {
+	It("should tag responses with surrogate keys for their route and backend", func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Surrogate-Key", "content-id-123")
+		}))
+		defer backend.Close()
+
+		middleware, err := newMiddlewareSet(Options{SurrogateKeys: true})
+		Expect(err).NotTo(HaveOccurred())
+		rt := newTestRouter()
+		rt.setMiddleware(middleware)
+		rt.mux, _ = rt.buildMux(&RouteTable{
+			Backends: []Backend{{BackendID: "frontend", BackendURL: backend.URL}},
+			Routes: []Route{
+				{IncomingPath: "/browse", RouteType: "prefix", Handler: "backend", BackendID: "frontend"},
+				{IncomingPath: "/old", RouteType: "exact", Handler: "gone"},
+			},
+		})
+
+		serve := func(path string) *httptest.ResponseRecorder {
+			rw := httptest.NewRecorder()
+			rt.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+			return rw
+		}
+		Expect(serve("/browse/tax").Header().Get("Surrogate-Key")).To(Equal("content-id-123 route:/browse backend:frontend"))
+		Expect(serve("/old").Header().Get("Surrogate-Key")).To(Equal("route:/old"))
+		Expect(serve("/missing").Header()).NotTo(HaveKey("Surrogate-Key"))
+	})
+
+	Context("purging through the API", func() {
+		var (
+			rt        *Router
+			api       http.Handler
+			cdn       *httptest.Server
+			cdnStatus int
+			purges    []string
+		)
+
+		BeforeEach(func() {
+			cdnStatus = http.StatusOK
+			purges = nil
+			cdn = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				purge := r.Method + " " + r.URL.EscapedPath() + " " + r.Header.Get("Fastly-Key")
+				if r.Header.Get("Fastly-Soft-Purge") == "1" {
+					purge += " soft"
+				}
+				purges = append(purges, purge)
+				w.WriteHeader(cdnStatus)
+				w.Write([]byte(`{"status": "ok"}`))
+			}))
+
+			rt = newTestRouter()
+			rt.cdn = newCDNPurger(CDNConfig{APIURL: cdn.URL + "/", APIKey: "fastly", ServiceID: "svc", Host: "www.gov.uk"})
+
+			apiAuthToken = "token"
+			var err error
+			api, err = newAPIHandler(rt)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			apiAuthToken = ""
+			cdn.Close()
+		})
+
+		purge := func(body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/purge", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer token")
+			rw := httptest.NewRecorder()
+			api.ServeHTTP(rw, req)
+			return rw
+		}
+
+		It("should purge a path", func() {
+			rw := purge(`{"path": "/browse/tax"}`)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(MatchJSON(`{"path": "/browse/tax", "soft": false}`))
+			Expect(purges).To(Equal([]string{"POST /purge/www.gov.uk/browse/tax fastly"}))
+		})
+
+		It("should purge a surrogate key", func() {
+			rw := purge(`{"key": "route:/browse", "soft": true}`)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(purges).To(Equal([]string{"POST /service/svc/purge/route:%2Fbrowse fastly soft"}))
+		})
+
+		It("should need exactly one of a path or a key", func() {
+			Expect(purge(`{}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(purge(`{"path": "/foo", "key": "route:/foo"}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(purge(`{"path": "foo"}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(purges).To(BeEmpty())
+		})
+
+		It("should report failed purges", func() {
+			cdnStatus = http.StatusUnauthorized
+			rw := purge(`{"key": "backend:frontend"}`)
+			Expect(rw.Code).To(Equal(http.StatusBadGateway))
+			Expect(rw.Body.String()).To(ContainSubstring("status 401"))
+		})
+
+		It("should 404 if purging isn't configured", func() {
+			rt.cdn = nil
+			Expect(purge(`{"path": "/foo"}`).Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	It("should find the routes which were removed or changed", func() {
+		previous := []Route{
+			{IncomingPath: "/same", RouteType: "exact", Handler: "backend", BackendID: "frontend"},
+			{IncomingPath: "/removed", RouteType: "prefix", Handler: "backend", BackendID: "frontend"},
+			{IncomingPath: "/redirected", RouteType: "exact", Handler: "backend", BackendID: "frontend"},
+			{IncomingPath: "/both", RouteType: "exact", Handler: "gone"},
+			{IncomingPath: "/both", RouteType: "prefix", Handler: "gone"},
+		}
+		current := []Route{
+			{IncomingPath: "/redirected", RouteType: "exact", Handler: "redirect", RedirectTo: "/new"},
+			{IncomingPath: "/same", RouteType: "exact", Handler: "backend", BackendID: "frontend"},
+			{IncomingPath: "/added", RouteType: "exact", Handler: "gone"},
+		}
+		Expect(changedRoutePaths(previous, current)).To(Equal([]string{"/both", "/redirected", "/removed"}))
+		Expect(changedRoutePaths(current, current)).To(BeEmpty())
+	})
+
+	It("should queue purges for changed routes after a reload", func() {
+		source := &fakeRouteSource{table: &RouteTable{
+			Routes: []Route{
+				{IncomingPath: "/foo", RouteType: "prefix", Handler: "gone"},
+				{IncomingPath: "/bar", RouteType: "exact", Handler: "gone"},
+			},
+			Checksum: "1",
+		}}
+		rt := newTestRouter()
+		rt.source = source
+		rt.purgeQueue = newCDNPurgeQueue(newCDNPurger(CDNConfig{}), true)
+
+		rt.reloadRoutes()
+		Expect(rt.purgeQueue.queue).To(BeEmpty())
+
+		source.table = &RouteTable{
+			Routes:   []Route{{IncomingPath: "/bar", RouteType: "exact", Handler: "gone"}},
+			Checksum: "2",
+		}
+		rt.reloadRoutes()
+		Expect(rt.purgeQueue.queue).To(Receive(Equal("/foo")))
+		Expect(rt.purgeQueue.queue).To(BeEmpty())
+	})
+})
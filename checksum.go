@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	routeChecksumsMu sync.Mutex
+	routeChecksums   = map[string]func() hash.Hash{
+		"sha1":   sha1.New,
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+)
+
+// RegisterRouteChecksum makes a hash algorithm available under name for the
+// route checksum, for use with ROUTER_ROUTE_CHECKSUM. It's intended to be
+// called from init functions, and panics if name is already registered.
+func RegisterRouteChecksum(name string, newHash func() hash.Hash) {
+	routeChecksumsMu.Lock()
+	defer routeChecksumsMu.Unlock()
+
+	if _, ok := routeChecksums[name]; ok {
+		panic(fmt.Sprintf("router: route checksum %q registered twice", name))
+	}
+	routeChecksums[name] = newHash
+}
+
+// routeChecksumHash returns the hash algorithm registered under name.
+func routeChecksumHash(name string) (func() hash.Hash, error) {
+	routeChecksumsMu.Lock()
+	defer routeChecksumsMu.Unlock()
+
+	newHash, ok := routeChecksums[name]
+	if !ok {
+		names := make([]string, 0, len(routeChecksums))
+		for name := range routeChecksums {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("router: unknown route checksum %q (available: %s)",
+			name, strings.Join(names, ", "))
+	}
+	return newHash, nil
+}
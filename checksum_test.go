@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha256"
+	"hash/fnv"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Route checksums", func() {
+	It("should use the chosen hash algorithm for new muxes", func() {
+		newHash, err := routeChecksumHash("sha256")
+		Expect(err).NotTo(HaveOccurred())
+
+		rt := newTestRouter()
+		rt.checksumHash = newHash
+		mux := rt.newMux()
+		mux.Handle("/foo", false, http.NotFoundHandler())
+		expected := sha256.Sum256([]byte("/foo(false)"))
+		Expect(mux.RouteChecksum()).To(Equal(expected[:]))
+	})
+
+	It("should reject unknown algorithms", func() {
+		_, err := routeChecksumHash("crc32")
+		Expect(err).To(MatchError(ContainSubstring(`unknown route checksum "crc32" (available: `)))
+	})
+
+	It("should allow other algorithms to be registered, once", func() {
+		RegisterRouteChecksum("test-fnv", fnv.New128a)
+		_, err := routeChecksumHash("test-fnv")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(func() {
+			RegisterRouteChecksum("sha1", fnv.New128a)
+		}).To(Panic())
+	})
+})
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alphagov/router/handlers"
+)
+
+const (
+	// clientPolicyFetchTimeout is how long fetching the client policy may
+	// take.
+	clientPolicyFetchTimeout = 10 * time.Second
+
+	// clientPolicyMaxSize is the largest client policy which will be read.
+	clientPolicyMaxSize = 16 << 20
+)
+
+// clientPolicySource fetches the client policy (see handlers.ClientPolicy)
+// used by the "rate-limit" middleware from a central service. If the
+// service can't be reached, or sends a policy which isn't valid or properly
+// signed, the last good policy carries on applying until it expires.
+//
+// The newest policy seen is only remembered until the router restarts, so
+// after that an older one could be replayed. To limit that, policies issued
+// more than maxAge ago, if it's set, aren't accepted.
+type clientPolicySource struct {
+	url    string
+	key    ed25519.PublicKey
+	maxAge time.Duration
+	client *http.Client
+	now    func() time.Time
+
+	mu       sync.RWMutex
+	issuedAt time.Time
+	rules    *handlers.ClientRules
+}
+
+func newClientPolicySource(url string, key ed25519.PublicKey, maxAge time.Duration) *clientPolicySource {
+	return &clientPolicySource{
+		url:    url,
+		key:    key,
+		maxAge: maxAge,
+		client: &http.Client{Timeout: clientPolicyFetchTimeout},
+		now:    time.Now,
+	}
+}
+
+// startClientPolicySource fetches the policy at o.ClientPolicyURL and then
+// fetches it again every o.ClientPolicyPollInterval, if it's set.
+func startClientPolicySource(o Options) *clientPolicySource {
+	source := newClientPolicySource(o.ClientPolicyURL, o.ClientPolicyKey, o.ClientPolicyMaxAge)
+	if err := source.fetch(); err != nil {
+		// Carry on without a policy rather than not serving requests.
+		logWarn(err, "(will keep trying)")
+	}
+	if o.ClientPolicyPollInterval > 0 {
+		go source.watch(o.ClientPolicyPollInterval)
+	}
+	return source
+}
+
+// fetch fetches the policy, replacing the current one if the new one is
+// valid and newer.
+func (s *clientPolicySource) fetch() error {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return fmt.Errorf("router: couldn't fetch client policy: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("router: couldn't fetch client policy: status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, clientPolicyMaxSize))
+	if err != nil {
+		return fmt.Errorf("router: couldn't fetch client policy: %v", err)
+	}
+
+	policy, err := handlers.ParseSignedClientPolicy(data, s.key)
+	if err != nil {
+		return err
+	}
+	if s.maxAge > 0 && policy.IssuedAt.Before(s.now().Add(-s.maxAge)) {
+		return fmt.Errorf("router: client policy issued at %v is more than %v old", policy.IssuedAt, s.maxAge)
+	}
+	rules, err := handlers.NewClientRules(policy)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if policy.IssuedAt.Before(s.issuedAt) {
+		return fmt.Errorf("router: client policy issued at %v is older than the current one (issued at %v)",
+			policy.IssuedAt, s.issuedAt)
+	}
+	if s.rules == nil || !policy.IssuedAt.Equal(s.issuedAt) {
+		s.issuedAt, s.rules = policy.IssuedAt, rules
+		logInfo(fmt.Sprintf("router: applying client policy issued at %v (%d blocked, %d rate limit overrides)",
+			policy.IssuedAt, len(policy.Blocked), len(policy.RateLimits)))
+	}
+	clientPolicyUpdatedMetric.Set(float64(s.now().Unix()))
+	return nil
+}
+
+// watch fetches the policy every interval. It doesn't return.
+func (s *clientPolicySource) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.fetch(); err != nil {
+			logWarn(err, "(keeping the current client policy)")
+		}
+	}
+}
+
+// current returns the current policy's rules, or nil if there isn't a
+// policy or it's expired.
+func (s *clientPolicySource) current() *handlers.ClientRules {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.rules == nil || s.rules.Expired(s.now()) {
+		return nil
+	}
+	return s.rules
+}
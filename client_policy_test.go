@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Client policy source", func() {
+	var (
+		service    *httptest.Server
+		response   []byte
+		status     int
+		privateKey ed25519.PrivateKey
+		source     *clientPolicySource
+		now        time.Time
+	)
+
+	issuedAt := time.Date(2021, time.March, 15, 8, 0, 0, 0, time.UTC)
+
+	sign := func(p *handlers.ClientPolicy) []byte {
+		signed, err := handlers.SignClientPolicy(p, privateKey)
+		Expect(err).NotTo(HaveOccurred())
+		return signed
+	}
+
+	BeforeEach(func() {
+		publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		privateKey = key
+
+		status = http.StatusOK
+		response = sign(&handlers.ClientPolicy{
+			IssuedAt:  issuedAt,
+			ExpiresAt: issuedAt.Add(time.Hour),
+			Blocked:   []string{"192.0.2.1"},
+		})
+		service = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write(response)
+		}))
+
+		now = issuedAt
+		source = newClientPolicySource(service.URL, publicKey, 24*time.Hour)
+		source.now = func() time.Time { return now }
+	})
+
+	AfterEach(func() {
+		service.Close()
+	})
+
+	It("should apply the fetched policy until it expires", func() {
+		Expect(source.current()).To(BeNil())
+		Expect(source.fetch()).To(Succeed())
+		Expect(source.current().Blocked("192.0.2.1")).To(BeTrue())
+
+		now = issuedAt.Add(time.Hour)
+		Expect(source.current()).To(BeNil())
+	})
+
+	It("should keep the current policy if the service fails", func() {
+		Expect(source.fetch()).To(Succeed())
+
+		status = http.StatusServiceUnavailable
+		Expect(source.fetch()).To(MatchError(ContainSubstring("status 503")))
+		Expect(source.current().Blocked("192.0.2.1")).To(BeTrue())
+
+		status = http.StatusOK
+		response = []byte(`{"policy": "e30=", "signature": "AAAA"}`)
+		Expect(source.fetch()).To(MatchError(ContainSubstring("signature doesn't match")))
+		Expect(source.current().Blocked("192.0.2.1")).To(BeTrue())
+	})
+
+	It("should only replace the policy with a newer one", func() {
+		Expect(source.fetch()).To(Succeed())
+
+		response = sign(&handlers.ClientPolicy{IssuedAt: issuedAt.Add(-time.Minute)})
+		Expect(source.fetch()).To(MatchError(ContainSubstring("older than the current one")))
+		Expect(source.current().Blocked("192.0.2.1")).To(BeTrue())
+
+		response = sign(&handlers.ClientPolicy{IssuedAt: issuedAt.Add(time.Minute)})
+		Expect(source.fetch()).To(Succeed())
+		Expect(source.current().Blocked("192.0.2.1")).To(BeFalse())
+	})
+
+	It("should reject policies which are too old, even without a current one", func() {
+		now = issuedAt.Add(25 * time.Hour)
+		Expect(source.fetch()).To(MatchError(ContainSubstring("more than 24h0m0s old")))
+		Expect(source.current()).To(BeNil())
+
+		source.maxAge = 0
+		Expect(source.fetch()).To(Succeed())
+	})
+
+	It("should need a key for the rate limiting middleware", func() {
+		_, err := newMiddlewareSet(Options{
+			Middleware:      []string{"rate-limit"},
+			RateLimit:       handlers.RateLimit{Rate: 1, Burst: 1},
+			ClientPolicyURL: service.URL,
+		})
+		Expect(err).To(MatchError(ContainSubstring("Ed25519 public key")))
+	})
+})
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alphagov/router/handlers"
+	"github.com/alphagov/router/triemux"
+)
+
+// decisionStreamBufferSize is how many decisions are queued for each
+// subscriber to the stream. Decisions for a subscriber which falls further
+// behind are dropped.
+const decisionStreamBufferSize = 1000
+
+// RoutingDecision records how the router routed a single request.
+type RoutingDecision struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace,omitempty"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+
+	// The route the request matched, if any
+	RoutePath   string `json:"route_path,omitempty"`
+	RoutePrefix bool   `json:"route_prefix,omitempty"`
+
+	// Handler is the route's handler type (such as "backend" or
+	// "redirect"), or "mirror", "shard", "disabled", "rule" or "not_found"
+	// for requests which didn't reach a route.
+	Handler   string `json:"handler"`
+	BackendID string `json:"backend_id,omitempty"`
+
+	Status          int     `json:"status"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// decisionRoute is what a decision records about a route.
+type decisionRoute struct {
+	handler, backendID string
+}
+
+// decisionLogKey is the context key for the decision being recorded for a
+// request.
+type decisionLogKey struct{}
+
+// decisionLog streams routing decisions, for debugging routing in
+// production without raising the log level. Each decision is written to a
+// file as a line of JSON, if there is one, and sent to any subscribers to
+// the stream from the API. Nothing is recorded while there's nowhere to send
+// it.
+type decisionLog struct {
+	namespace string
+	file      *os.File
+
+	fileMu sync.Mutex
+
+	// active counts the subscribers, plus one if there's a file.
+	active      int32
+	mu          sync.RWMutex
+	subscribers map[chan RoutingDecision]string
+	routes      map[triemux.Match]decisionRoute
+}
+
+// newDecisionLog creates a decision log streaming to the API if sink is
+// "api", or additionally appending to the file named by sink otherwise.
+func newDecisionLog(namespace, sink string) (*decisionLog, error) {
+	d := &decisionLog{
+		namespace:   namespace,
+		subscribers: make(map[chan RoutingDecision]string),
+		routes:      make(map[triemux.Match]decisionRoute),
+	}
+	if sink != "api" {
+		f, err := os.OpenFile(sink, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		d.file = f
+		d.active = 1
+	}
+	return d, nil
+}
+
+// setRoutes records the routes which decisions are now made with.
+func (d *decisionLog) setRoutes(routes []Route) {
+	index := make(map[triemux.Match]decisionRoute, len(routes))
+	for i := range routes {
+		route := &routes[i]
+		incomingURL, err := url.Parse(route.IncomingPath)
+		if err != nil {
+			continue
+		}
+		match := triemux.Match{Path: incomingURL.Path, Prefix: route.RouteType == "prefix"}
+		if _, ok := index[match]; ok {
+			// Routes for particular extensions share a path.
+			continue
+		}
+		summary := decisionRoute{handler: route.Handler, backendID: route.BackendID}
+		if route.Disabled {
+			summary.handler = "disabled"
+		}
+		index[match] = summary
+	}
+
+	d.mu.Lock()
+	d.routes = index
+	d.mu.Unlock()
+}
+
+// subscribe returns a channel of the decisions for requests with paths
+// starting with pathPrefix, until unsubscribe is called with it.
+func (d *decisionLog) subscribe(pathPrefix string) chan RoutingDecision {
+	ch := make(chan RoutingDecision, decisionStreamBufferSize)
+	d.mu.Lock()
+	d.subscribers[ch] = pathPrefix
+	d.mu.Unlock()
+	atomic.AddInt32(&d.active, 1)
+	return ch
+}
+
+func (d *decisionLog) unsubscribe(ch chan RoutingDecision) {
+	d.mu.Lock()
+	delete(d.subscribers, ch)
+	d.mu.Unlock()
+	atomic.AddInt32(&d.active, -1)
+}
+
+// start begins recording the decision for a request, returning the request
+// and response writer to use in its place, or nil if nothing is being
+// recorded.
+func (d *decisionLog) start(w http.ResponseWriter, req *http.Request) (*decisionWriter, *http.Request) {
+	if d == nil || atomic.LoadInt32(&d.active) == 0 {
+		return nil, req
+	}
+	dw := &decisionWriter{ResponseWrapper: handlers.ResponseWrapper{ResponseWriter: w}, log: d, decision: RoutingDecision{
+		Time:      time.Now(),
+		Namespace: d.namespace,
+		Method:    req.Method,
+		Host:      req.Host,
+		Path:      req.URL.Path,
+		Handler:   "not_found",
+	}}
+	return dw, req.WithContext(context.WithValue(req.Context(), decisionLogKey{}, &dw.decision))
+}
+
+// decisionFor returns the decision being recorded for a request, or nil.
+func decisionFor(req *http.Request) *RoutingDecision {
+	decision, _ := req.Context().Value(decisionLogKey{}).(*RoutingDecision)
+	return decision
+}
+
+// matchedRequest records the route a request matched, if its decision is
+// being recorded.
+func (d *decisionLog) matchedRequest(req *http.Request, match triemux.Match) {
+	if decision := decisionFor(req); decision != nil {
+		d.matched(decision, match)
+	}
+}
+
+// matched records the route a request matched.
+func (d *decisionLog) matched(decision *RoutingDecision, match triemux.Match) {
+	d.mu.RLock()
+	route, ok := d.routes[match]
+	d.mu.RUnlock()
+
+	decision.RoutePath, decision.RoutePrefix = match.Path, match.Prefix
+	if ok {
+		decision.Handler, decision.BackendID = route.handler, route.backendID
+	}
+}
+
+func (d *decisionLog) publish(decision RoutingDecision) {
+	if d.file != nil {
+		line, err := json.Marshal(decision)
+		if err == nil {
+			d.fileMu.Lock()
+			_, err = d.file.Write(append(line, '\n'))
+			d.fileMu.Unlock()
+		}
+		if err != nil {
+			logWarn("router: couldn't write routing decision:", err)
+		}
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for ch, pathPrefix := range d.subscribers {
+		if !strings.HasPrefix(decision.Path, pathPrefix) {
+			continue
+		}
+		select {
+		case ch <- decision:
+		default:
+		}
+	}
+}
+
+// decisionWriter records the outcome of a request for its decision.
+type decisionWriter struct {
+	handlers.ResponseWrapper
+	log      *decisionLog
+	decision RoutingDecision
+}
+
+// finish publishes the decision once the response is complete.
+func (w *decisionWriter) finish() {
+	w.decision.Status = w.Status()
+	w.decision.DurationSeconds = time.Since(w.decision.Time).Seconds()
+	w.log.publish(w.decision)
+}
+
+// serveDecisionStream streams decisions to an API client as server-sent
+// events until it disconnects.
+func (d *decisionLog) serveDecisionStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := d.subscribe(r.URL.Query().Get("path_prefix"))
+	defer d.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case decision := <-ch:
+			data, err := json.Marshal(decision)
+			if err != nil {
+				continue
+			}
+			if _, err := w.Write(append(append([]byte("data: "), data...), '\n', '\n')); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
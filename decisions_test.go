@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Decision log", func() {
+	var (
+		rt      *Router
+		backend *httptest.Server
+		routes  []Route
+	)
+
+	BeforeEach(func() {
+		backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		routes = []Route{
+			{IncomingPath: "/government", RouteType: "prefix", Handler: "backend", BackendID: "frontend"},
+			{IncomingPath: "/old", RouteType: "exact", Handler: "redirect", RedirectTo: "/new"},
+		}
+		rt = newTestRouter()
+		var err error
+		rt.decisions, err = newDecisionLog("draft", "api")
+		Expect(err).NotTo(HaveOccurred())
+		rt.decisions.setRoutes(routes)
+		rt.mux, _ = rt.buildMux(&RouteTable{
+			Backends: []Backend{{BackendID: "frontend", BackendURL: backend.URL}},
+			Routes:   routes,
+		})
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	serve := func(path string) {
+		rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	It("should record which route and handler each request reached", func() {
+		ch := rt.decisions.subscribe("")
+		defer rt.decisions.unsubscribe(ch)
+
+		serve("/government/news")
+		decision := <-ch
+		Expect(decision.Namespace).To(Equal("draft"))
+		Expect(decision.Method).To(Equal("GET"))
+		Expect(decision.Path).To(Equal("/government/news"))
+		Expect(decision.RoutePath).To(Equal("/government"))
+		Expect(decision.RoutePrefix).To(BeTrue())
+		Expect(decision.Handler).To(Equal("backend"))
+		Expect(decision.BackendID).To(Equal("frontend"))
+		Expect(decision.Status).To(Equal(http.StatusOK))
+
+		serve("/old")
+		decision = <-ch
+		Expect(decision.Handler).To(Equal("redirect"))
+		Expect(decision.Status).To(Equal(http.StatusMovedPermanently))
+
+		serve("/missing")
+		decision = <-ch
+		Expect(decision.RoutePath).To(BeEmpty())
+		Expect(decision.Handler).To(Equal("not_found"))
+		Expect(decision.Status).To(Equal(http.StatusNotFound))
+
+		rt.disabledPaths.disable(DisabledPath{Path: "/government", Prefix: true})
+		serve("/government")
+		Expect((<-ch).Handler).To(Equal("disabled"))
+	})
+
+	It("should only send subscribers decisions for their path prefix", func() {
+		ch := rt.decisions.subscribe("/old")
+		defer rt.decisions.unsubscribe(ch)
+
+		serve("/government")
+		serve("/old")
+		Expect((<-ch).Path).To(Equal("/old"))
+		Expect(ch).To(BeEmpty())
+	})
+
+	It("should record nothing while there's nowhere to send it", func() {
+		dw, _ := rt.decisions.start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		Expect(dw).To(BeNil())
+	})
+
+	It("should append decisions to a file", func() {
+		dir, err := ioutil.TempDir("", "decisions")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		rt.decisions, err = newDecisionLog("", filepath.Join(dir, "decisions.log"))
+		Expect(err).NotTo(HaveOccurred())
+		rt.decisions.setRoutes(routes)
+		serve("/old")
+		serve("/missing")
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "decisions.log"))
+		Expect(err).NotTo(HaveOccurred())
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		Expect(lines).To(HaveLen(2))
+		var decision RoutingDecision
+		Expect(json.Unmarshal([]byte(lines[0]), &decision)).To(Succeed())
+		Expect(decision.Handler).To(Equal("redirect"))
+	})
+
+	It("should record protocol upgrades", func() {
+		upgrades := newUpgradeServer()
+		defer upgrades.Close()
+		rt.mux, _ = rt.buildMux(&RouteTable{
+			Backends: []Backend{{BackendID: "sockets", BackendURL: upgrades.URL}},
+			Routes:   []Route{{IncomingPath: "/socket", RouteType: "exact", Handler: "backend", BackendID: "sockets"}},
+		})
+		server := httptest.NewServer(rt)
+		defer server.Close()
+
+		ch := rt.decisions.subscribe("")
+		defer rt.decisions.unsubscribe(ch)
+
+		status, echoed := upgrade(server.URL, "/socket", nil)
+		Expect(status).To(Equal(http.StatusSwitchingProtocols))
+		Expect(echoed).To(Equal("ping\n"))
+		Expect((<-ch).Status).To(Equal(http.StatusSwitchingProtocols))
+	})
+
+	Context("API", func() {
+		var api *httptest.Server
+
+		BeforeEach(func() {
+			apiAuthToken = "token"
+			handler, err := newAPIHandler(rt)
+			Expect(err).NotTo(HaveOccurred())
+			api = httptest.NewServer(handler)
+		})
+
+		AfterEach(func() {
+			api.Close()
+			apiAuthToken = ""
+		})
+
+		get := func() *http.Response {
+			req, err := http.NewRequest("GET", api.URL+"/decisions?path_prefix=/old", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer token")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			return resp
+		}
+
+		It("should stream decisions as server-sent events", func() {
+			resp := get()
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+			serve("/old")
+			line, err := bufio.NewReader(resp.Body).ReadString('\n')
+			Expect(err).NotTo(HaveOccurred())
+			Expect(line).To(HavePrefix("data: "))
+			Expect(strings.TrimPrefix(line, "data: ")).To(ContainSubstring(`"handler":"redirect"`))
+		})
+
+		It("should 404 if the decision log isn't enabled", func() {
+			rt.decisions = nil
+			resp := get()
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		})
+	})
+})
+
+// newUpgradeServer returns a server which switches requests to upgrade to
+// the "echo" protocol, then echoes a line back.
+func newUpgradeServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		if line, err := buf.ReadString('\n'); err == nil {
+			buf.WriteString(line)
+			buf.Flush()
+		}
+	}))
+}
+
+// upgrade asks the server at serverURL to switch to the echo protocol for
+// path, returning the response's status and the line echoed back.
+func upgrade(serverURL, path string, header http.Header) (status int, echoed string) {
+	req, err := http.NewRequest("GET", serverURL+path, nil)
+	Expect(err).NotTo(HaveOccurred())
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+
+	conn, err := net.Dial("tcp", req.URL.Host)
+	Expect(err).NotTo(HaveOccurred())
+	defer conn.Close()
+	Expect(req.Write(conn)).To(Succeed())
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	Expect(err).NotTo(HaveOccurred())
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return resp.StatusCode, ""
+	}
+	_, err = conn.Write([]byte("ping\n"))
+	Expect(err).NotTo(HaveOccurred())
+	echoed, _ = r.ReadString('\n')
+	return resp.StatusCode, echoed
+}
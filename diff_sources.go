@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// diffSourceOptions returns the options for one side of "router
+// diff-sources", which is either the name of a namespace, "main" for the
+// router's own routes, or a JSON object of route source settings in the same
+// form as a namespace's, such as {"route_source": "mongo", "mongo_db":
+// "router_staging"}. Settings which aren't given are the router's own.
+func diffSourceOptions(spec string, base Options, namespaces map[string]namespaceConfig) (Options, error) {
+	if strings.HasPrefix(strings.TrimSpace(spec), "{") {
+		var ns namespaceConfig
+		if err := json.Unmarshal([]byte(spec), &ns); err != nil {
+			return Options{}, fmt.Errorf("couldn't parse route source settings %q: %v", spec, err)
+		}
+		return ns.options("", base), nil
+	}
+	if spec == "main" {
+		return base, nil
+	}
+	ns, ok := namespaces[spec]
+	if !ok {
+		return Options{}, fmt.Errorf("unknown namespace %q", spec)
+	}
+	return ns.options(spec, base), nil
+}
+
+// loadDiffSource loads the route table from the source configured by o.
+func loadDiffSource(o Options) (*RouteTable, error) {
+	name := o.RouteSource
+	if name == "" {
+		name = "mongo"
+	}
+	source, err := newRouteSource(name, o)
+	if err != nil {
+		return nil, err
+	}
+	return loadRouteTable(context.Background(), source)
+}
+
+// runDiffSources implements "router diff-sources": it loads the route tables
+// from the two sources given in args (see diffSourceOptions) and reports the
+// differences between them to out. Like diff, it returns the exit status 0
+// if they're the same, 1 if they differ and 2 if there was a problem.
+func runDiffSources(o Options, namespaces map[string]namespaceConfig, args []string, out io.Writer) int {
+	if len(args) != 2 {
+		fmt.Fprintln(out, "Usage: router diff-sources <from> <to>")
+		return 2
+	}
+
+	var tables [2]*RouteTable
+	for i, spec := range args {
+		opts, err := diffSourceOptions(spec, o, namespaces)
+		if err == nil {
+			tables[i], err = loadDiffSource(opts)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "router diff-sources: loading %s: %v\n", spec, err)
+			return 2
+		}
+	}
+
+	diffs := diffRouteTables(tables[0], tables[1])
+	for _, d := range diffs {
+		fmt.Fprintln(out, d)
+	}
+	fmt.Fprintf(out, "router diff-sources: %d backends and %d routes compared, %s\n",
+		len(tables[1].Backends), len(tables[1].Routes), summariseTableDiffs(diffs))
+	if len(diffs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// tableDiff is a backend or route which was added, removed or changed
+// between two route tables.
+type tableDiff struct {
+	// Change is "+" for added, "-" for removed or "~" for changed.
+	Change string
+	// Item describes the backend or route, such as "route /foo (exact)".
+	Item string
+	// Detail describes what was added or removed, or lists the fields which
+	// changed.
+	Detail string
+}
+
+func (d tableDiff) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Change, d.Item, d.Detail)
+}
+
+// diffRouteTables compares two route tables, returning the differences in
+// their backends, by ID, and then their routes, by path and type.
+func diffRouteTables(from, to *RouteTable) []tableDiff {
+	var diffs []tableDiff
+
+	fromBackends := make(map[string]interface{}, len(from.Backends))
+	for _, backend := range from.Backends {
+		fromBackends[backend.BackendID] = backend
+	}
+	toBackends := make(map[string]interface{}, len(to.Backends))
+	for _, backend := range to.Backends {
+		toBackends[backend.BackendID] = backend
+	}
+	diffs = append(diffs, diffItems(fromBackends, toBackends, func(key string, item interface{}) (string, string) {
+		backend := item.(Backend)
+		return "backend " + key, backend.BackendURL
+	})...)
+
+	fromRoutes := make(map[string]interface{}, len(from.Routes))
+	for _, route := range from.Routes {
+		fromRoutes[route.IncomingPath+" ("+route.RouteType+")"] = route
+	}
+	toRoutes := make(map[string]interface{}, len(to.Routes))
+	for _, route := range to.Routes {
+		toRoutes[route.IncomingPath+" ("+route.RouteType+")"] = route
+	}
+	diffs = append(diffs, diffItems(fromRoutes, toRoutes, func(key string, item interface{}) (string, string) {
+		route := item.(Route)
+		return "route " + key, describeRoute(&route)
+	})...)
+
+	return diffs
+}
+
+// diffItems compares two sets of backends or routes by key, in key order.
+// describe returns the name of an item and a summary of it.
+func diffItems(from, to map[string]interface{}, describe func(key string, item interface{}) (string, string)) []tableDiff {
+	keys := make([]string, 0, len(from)+len(to))
+	for key := range from {
+		keys = append(keys, key)
+	}
+	for key := range to {
+		if _, ok := from[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var diffs []tableDiff
+	for _, key := range keys {
+		before, inFrom := from[key]
+		after, inTo := to[key]
+		switch {
+		case !inTo:
+			name, summary := describe(key, before)
+			diffs = append(diffs, tableDiff{Change: "-", Item: name, Detail: summary})
+		case !inFrom:
+			name, summary := describe(key, after)
+			diffs = append(diffs, tableDiff{Change: "+", Item: name, Detail: summary})
+		default:
+			if changes := fieldChanges(before, after); len(changes) > 0 {
+				name, _ := describe(key, after)
+				diffs = append(diffs, tableDiff{Change: "~", Item: name, Detail: strings.Join(changes, ", ")})
+			}
+		}
+	}
+	return diffs
+}
+
+// fieldChanges lists the fields which differ between two backends or
+// routes, by their names in the route store, in the form "field: before ->
+// after".
+func fieldChanges(before, after interface{}) []string {
+	var changes []string
+	b, a := reflect.ValueOf(before), reflect.ValueOf(after)
+	for i := 0; i < b.NumField(); i++ {
+		if reflect.DeepEqual(b.Field(i).Interface(), a.Field(i).Interface()) {
+			continue
+		}
+		field := b.Type().Field(i)
+		name := field.Tag.Get("bson")
+		if name == "" {
+			name = field.Name
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, fieldValue(b.Field(i)), fieldValue(a.Field(i))))
+	}
+	return changes
+}
+
+func fieldValue(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "(unset)"
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.String {
+		return fmt.Sprintf("%q", v.String())
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+// describeRoute summarises where a route sends requests.
+func describeRoute(route *Route) string {
+	var description string
+	switch route.Handler {
+	case "backend":
+		description = "backend " + route.BackendID
+	case "redirect":
+		description = "redirect to " + route.RedirectTo
+	default:
+		description = route.Handler
+	}
+	if route.Disabled {
+		description += " (disabled)"
+	}
+	return description
+}
+
+func summariseTableDiffs(diffs []tableDiff) string {
+	if len(diffs) == 0 {
+		return "no differences"
+	}
+	counts := make(map[string]int)
+	for _, d := range diffs {
+		counts[d.Change]++
+	}
+	return fmt.Sprintf("%d added, %d removed, %d changed", counts["+"], counts["-"], counts["~"])
+}
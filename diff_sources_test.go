@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// diffTestTables are the tables served by the "test-diff" route source, by
+// Mongo database name.
+var diffTestTables = make(map[string]*RouteTable)
+
+func init() {
+	RegisterRouteSource("test-diff", func(o Options) (RouteSource, error) {
+		table, ok := diffTestTables[o.MongoDbName]
+		if !ok {
+			table = &RouteTable{}
+		}
+		return &fakeRouteSource{table: table}, nil
+	})
+}
+
+var _ = Describe("Diffing route sources", func() {
+	var from, to *RouteTable
+
+	BeforeEach(func() {
+		from = &RouteTable{
+			Backends: []Backend{
+				{BackendID: "frontend", BackendURL: "http://frontend.example"},
+				{BackendID: "old", BackendURL: "http://old.example"},
+			},
+			Routes: []Route{
+				{IncomingPath: "/government", RouteType: "prefix", Handler: "backend", BackendID: "frontend"},
+				{IncomingPath: "/old", RouteType: "exact", Handler: "backend", BackendID: "old"},
+				{IncomingPath: "/same", RouteType: "exact", Handler: "gone"},
+			},
+		}
+		to = &RouteTable{
+			Backends: []Backend{
+				{BackendID: "frontend", BackendURL: "http://new-frontend.example"},
+			},
+			Routes: []Route{
+				{IncomingPath: "/same", RouteType: "exact", Handler: "gone"},
+				{IncomingPath: "/government", RouteType: "prefix", Handler: "backend", BackendID: "frontend"},
+				{IncomingPath: "/old", RouteType: "exact", Handler: "redirect", RedirectTo: "/new", RedirectType: "permanent"},
+				{IncomingPath: "/new", RouteType: "exact", Handler: "backend", BackendID: "frontend", Disabled: true},
+			},
+		}
+		diffTestTables["from"], diffTestTables["to"] = from, to
+	})
+
+	It("should report added, removed and changed backends and routes", func() {
+		var lines []string
+		for _, d := range diffRouteTables(from, to) {
+			lines = append(lines, d.String())
+		}
+		Expect(lines).To(Equal([]string{
+			`~ backend frontend: backend_url: "http://frontend.example" -> "http://new-frontend.example"`,
+			`- backend old: http://old.example`,
+			`+ route /new (exact): backend frontend (disabled)`,
+			`~ route /old (exact): handler: "backend" -> "redirect", backend_id: "old" -> "", ` +
+				`redirect_to: "" -> "/new", redirect_type: "" -> "permanent"`,
+		}))
+	})
+
+	It("should report no differences between the same routes", func() {
+		Expect(diffRouteTables(from, from)).To(BeEmpty())
+	})
+
+	It("should load each side from a namespace or route source settings", func() {
+		base := Options{RouteSource: "test-diff", MongoDbName: "from"}
+		namespaces := map[string]namespaceConfig{"staging": {MongoDbName: "to"}}
+
+		var out bytes.Buffer
+		Expect(runDiffSources(base, namespaces, []string{"main", "staging"}, &out)).To(Equal(1))
+		Expect(out.String()).To(ContainSubstring("1 backends and 4 routes compared, 1 added, 1 removed, 2 changed"))
+
+		out.Reset()
+		Expect(runDiffSources(base, namespaces, []string{`{"mongo_db": "to"}`, "staging"}, &out)).To(Equal(0))
+		Expect(out.String()).To(ContainSubstring("no differences"))
+	})
+
+	It("should refuse routes with a schema version it doesn't support", func() {
+		to.Routes[0].SchemaVersion = routeSchemaVersion + 1
+
+		var out bytes.Buffer
+		Expect(runDiffSources(Options{RouteSource: "test-diff", MongoDbName: "from"}, nil, []string{"main", `{"mongo_db": "to"}`}, &out)).To(Equal(2))
+		Expect(out.String()).To(ContainSubstring("schema version this router doesn't support"))
+	})
+
+	It("should reject unknown namespaces", func() {
+		var out bytes.Buffer
+		Expect(runDiffSources(Options{RouteSource: "test-diff"}, nil, []string{"main", "staging"}, &out)).To(Equal(2))
+		Expect(out.String()).To(ContainSubstring(`unknown namespace "staging"`))
+	})
+})
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/alphagov/router/handlers"
+	"github.com/alphagov/router/triemux"
+)
+
+// DisabledPath is a path (or, for a prefix, a path and everything below it)
+// which has been disabled through the API, so that requests for it get a
+// 503 whatever its route in the database says.
+type DisabledPath struct {
+	Path   string `json:"path"`
+	Prefix bool   `json:"prefix"`
+}
+
+// disabledPaths holds the paths disabled at runtime. They're matched using a
+// mux of their own, which is rebuilt whenever one is added or removed; that
+// happens rarely, and keeps the check on each request cheap.
+type disabledPaths struct {
+	namespace string
+
+	mu    sync.RWMutex
+	paths map[DisabledPath]bool
+	mux   *triemux.Mux
+}
+
+var disabledPathHandler = handlers.NewErrorHandler(http.StatusServiceUnavailable)
+
+func newDisabledPaths(namespace string) *disabledPaths {
+	return &disabledPaths{namespace: namespace, paths: make(map[DisabledPath]bool)}
+}
+
+func (d *disabledPaths) disable(p DisabledPath) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.paths[p] = true
+	d.rebuild()
+}
+
+// enable removes a path disabled by disable. It reports whether the path
+// had been disabled.
+func (d *disabledPaths) enable(p DisabledPath) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.paths[p] {
+		return false
+	}
+	delete(d.paths, p)
+	d.rebuild()
+	return true
+}
+
+func (d *disabledPaths) rebuild() {
+	disabledPathsMetric.WithLabelValues(d.namespace).Set(float64(len(d.paths)))
+
+	if len(d.paths) == 0 {
+		d.mux = nil
+		return
+	}
+	d.mux = triemux.NewMux()
+	for p := range d.paths {
+		d.mux.Handle(p.Path, p.Prefix, disabledPathHandler)
+	}
+}
+
+func (d *disabledPaths) matches(path string) bool {
+	d.mu.RLock()
+	mux := d.mux
+	d.mu.RUnlock()
+
+	if mux == nil {
+		return false
+	}
+	_, ok := mux.Lookup(path)
+	return ok
+}
+
+func (d *disabledPaths) list() []DisabledPath {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	paths := make([]DisabledPath, 0, len(d.paths))
+	for p := range d.paths {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].Path != paths[j].Path {
+			return paths[i].Path < paths[j].Path
+		}
+		return !paths[i].Prefix && paths[j].Prefix
+	})
+	return paths
+}
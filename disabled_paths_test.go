@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Disabling paths at runtime", func() {
+	var (
+		rt  *Router
+		api http.Handler
+	)
+
+	BeforeEach(func() {
+		rt = newTestRouter()
+		rt.mux.Handle("/foo", true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("foo"))
+		}))
+
+		apiAuthToken = "token"
+		var err error
+		api, err = newAPIHandler(rt)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		apiAuthToken = ""
+	})
+
+	serve := func(path string) int {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw.Code
+	}
+
+	request := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/disabled-paths", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("should serve a 503 for an exact path until the override is cleared", func() {
+		rw := request("POST", `{"path": "/foo/broken"}`)
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(MatchJSON(`[{"path": "/foo/broken", "prefix": false}]`))
+
+		Expect(serve("/foo/broken")).To(Equal(http.StatusServiceUnavailable))
+		Expect(serve("/foo/broken/child")).To(Equal(http.StatusOK))
+		Expect(serve("/foo")).To(Equal(http.StatusOK))
+
+		rw = request("DELETE", `{"path": "/foo/broken"}`)
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(MatchJSON(`[]`))
+		Expect(serve("/foo/broken")).To(Equal(http.StatusOK))
+	})
+
+	It("should disable everything under a prefix", func() {
+		Expect(request("POST", `{"path": "/foo/broken", "prefix": true}`).Code).To(Equal(http.StatusOK))
+
+		Expect(serve("/foo/broken")).To(Equal(http.StatusServiceUnavailable))
+		Expect(serve("/foo/broken/child")).To(Equal(http.StatusServiceUnavailable))
+		Expect(serve("/foo/other")).To(Equal(http.StatusOK))
+	})
+
+	It("should 404 when clearing a path which isn't disabled", func() {
+		Expect(request("DELETE", `{"path": "/foo"}`).Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should reject invalid paths", func() {
+		Expect(request("POST", `{"path": "foo"}`).Code).To(Equal(http.StatusBadRequest))
+		Expect(request("POST", `not json`).Code).To(Equal(http.StatusBadRequest))
+	})
+})
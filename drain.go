@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/alphagov/router/handlers"
+)
+
+// drainable wraps a backend's handler so that while the backend is drained
+// (through the API), requests are served by its fallback if it has one, and
+// otherwise get a 503. Whether a backend is drained is kept across reloads.
+func (rt *Router) drainable(backendID string, handler, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rt.backendDrained(backendID) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if fallback != nil {
+			fallback.ServeHTTP(w, r)
+		} else {
+			handlers.WriteError(w, r, http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func (rt *Router) backendDrained(backendID string) bool {
+	rt.drainLock.RLock()
+	defer rt.drainLock.RUnlock()
+
+	return rt.drained[backendID]
+}
+
+// drainBackend stops requests being sent to a backend until restoreBackend
+// is called. It returns an error if there's no such backend.
+func (rt *Router) drainBackend(backendID string) error {
+	rt.drainLock.Lock()
+	defer rt.drainLock.Unlock()
+
+	if !rt.knownBackends[backendID] {
+		return fmt.Errorf("unknown backend %s", backendID)
+	}
+	rt.drained[backendID] = true
+	backendDrainedMetric.With(prometheus.Labels{"backend_id": backendID}).Set(1)
+
+	logWarn(fmt.Sprintf("router: draining backend %s", backendID))
+	return nil
+}
+
+func (rt *Router) restoreBackend(backendID string) {
+	rt.drainLock.Lock()
+	defer rt.drainLock.Unlock()
+
+	if rt.drained[backendID] {
+		delete(rt.drained, backendID)
+		backendDrainedMetric.With(prometheus.Labels{"backend_id": backendID}).Set(0)
+
+		logInfo(fmt.Sprintf("router: restored backend %s", backendID))
+	}
+}
+
+func (rt *Router) drainedBackends() []string {
+	rt.drainLock.RLock()
+	defer rt.drainLock.RUnlock()
+
+	ids := make([]string, 0, len(rt.drained))
+	for id := range rt.drained {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// setKnownBackends records which backends were loaded, so that only those
+// can be drained.
+func (rt *Router) setKnownBackends(backends map[string]http.Handler) {
+	rt.drainLock.Lock()
+	defer rt.drainLock.Unlock()
+
+	rt.knownBackends = make(map[string]bool, len(backends))
+	for id := range backends {
+		rt.knownBackends[id] = true
+	}
+}
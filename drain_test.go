@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Draining backends", func() {
+	var (
+		rt      *Router
+		backend http.Handler
+	)
+
+	okHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	})
+	fallbackHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("fallback"))
+	})
+
+	serve := func(handler http.Handler) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+		return rw
+	}
+
+	BeforeEach(func() {
+		rt = newTestRouter()
+		backend = rt.drainable("frontend", okHandler, nil)
+		rt.setKnownBackends(map[string]http.Handler{"frontend": backend})
+	})
+
+	It("should serve a 503 while the backend is drained", func() {
+		Expect(rt.drainBackend("frontend")).To(Succeed())
+		Expect(serve(backend).Code).To(Equal(http.StatusServiceUnavailable))
+
+		rt.restoreBackend("frontend")
+		rw := serve(backend)
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(Equal("backend"))
+	})
+
+	It("should fail over to the backend's fallback", func() {
+		withFallback := rt.drainable("frontend", okHandler, fallbackHandler)
+		Expect(rt.drainBackend("frontend")).To(Succeed())
+		Expect(serve(withFallback).Body.String()).To(Equal("fallback"))
+	})
+
+	It("should refuse to drain an unknown backend", func() {
+		Expect(rt.drainBackend("unknown")).NotTo(Succeed())
+		Expect(rt.drainedBackends()).To(BeEmpty())
+	})
+
+	It("should keep backends drained when they're reloaded", func() {
+		Expect(rt.drainBackend("frontend")).To(Succeed())
+
+		reloaded := rt.drainable("frontend", okHandler, nil)
+		rt.setKnownBackends(map[string]http.Handler{"frontend": reloaded})
+		Expect(serve(reloaded).Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	Context("API", func() {
+		var api http.Handler
+
+		BeforeEach(func() {
+			apiAuthToken = "token"
+			var err error
+			api, err = newAPIHandler(rt)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			apiAuthToken = ""
+		})
+
+		request := func(method, path string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("Authorization", "Bearer token")
+			rw := httptest.NewRecorder()
+			api.ServeHTTP(rw, req)
+			return rw
+		}
+
+		It("should drain and restore a backend", func() {
+			rw := request("POST", "/backends/frontend/drain")
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(MatchJSON(`{"backend_id": "frontend", "draining": true}`))
+
+			var drained []string
+			Expect(json.Unmarshal(request("GET", "/drained-backends").Body.Bytes(), &drained)).To(Succeed())
+			Expect(drained).To(Equal([]string{"frontend"}))
+
+			rw = request("DELETE", "/backends/frontend/drain")
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(MatchJSON(`{"backend_id": "frontend", "draining": false}`))
+		})
+
+		It("should 404 for unknown backends and paths", func() {
+			Expect(request("POST", "/backends/unknown/drain").Code).To(Equal(http.StatusNotFound))
+			Expect(request("GET", "/backends/frontend").Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should require the API token", func() {
+			req := httptest.NewRequest("POST", "/backends/frontend/drain", nil)
+			rw := httptest.NewRecorder()
+			api.ServeHTTP(rw, req)
+			Expect(rw.Code).To(Equal(http.StatusUnauthorized))
+			Expect(rt.backendDrained("frontend")).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// AnalyticsHeaderPrefix starts the names of the headers which carry a
+// route's analytics tags to its backend, such as GOVUK-Analytics-Campaign.
+const AnalyticsHeaderPrefix = "GOVUK-Analytics-"
+
+// AnalyticsHeader returns the name of the header which carries the
+// analytics tag name, with underscores replaced by hyphens.
+func AnalyticsHeader(name string) string {
+	return textproto.CanonicalMIMEHeaderKey(AnalyticsHeaderPrefix + strings.Replace(name, "_", "-", -1))
+}
+
+// canonicalAnalyticsHeaderPrefix starts the names of analytics headers as
+// net/http stores them.
+var canonicalAnalyticsHeaderPrefix = textproto.CanonicalMIMEHeaderKey(AnalyticsHeaderPrefix)
+
+type analyticsTagsKey struct{}
+
+// NewAnalyticsTagMiddleware tags requests with analytics dimensions, such
+// as the campaign or content format they're for. The tags are sent to the
+// backend as headers, replacing any analytics headers the client sent, and
+// logged by the access log middleware if it's inside this middleware.
+func NewAnalyticsTagMiddleware(tags map[string]string) Middleware {
+	return func(handler http.Handler) http.Handler {
+		if len(tags) == 0 {
+			return handler
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r2 := r.WithContext(context.WithValue(r.Context(), analyticsTagsKey{}, tags))
+			r2.Header = r.Header.Clone()
+			for name := range r2.Header {
+				if strings.HasPrefix(name, canonicalAnalyticsHeaderPrefix) {
+					r2.Header.Del(name)
+				}
+			}
+			for name, value := range tags {
+				r2.Header.Set(AnalyticsHeader(name), value)
+			}
+			handler.ServeHTTP(w, r2)
+		})
+	}
+}
+
+// analyticsTags returns the analytics tags NewAnalyticsTagMiddleware added
+// to r, if any.
+func analyticsTags(r *http.Request) map[string]string {
+	tags, _ := r.Context().Value(analyticsTagsKey{}).(map[string]string)
+	return tags
+}
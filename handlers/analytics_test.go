@@ -0,0 +1,65 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+	log "github.com/alphagov/router/logger"
+)
+
+var _ = Describe("Analytics tags", func() {
+	var received http.Header
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	})
+	tags := handlers.NewAnalyticsTagMiddleware(map[string]string{"campaign": "cost-of-living", "content_format": "guide"})
+
+	BeforeEach(func() {
+		received = nil
+	})
+
+	It("should send the tags to the backend as headers", func() {
+		req := httptest.NewRequest("GET", "/", nil)
+		tags(backend).ServeHTTP(httptest.NewRecorder(), req)
+		Expect(received.Get("GOVUK-Analytics-Campaign")).To(Equal("cost-of-living"))
+		Expect(received.Get("GOVUK-Analytics-Content-Format")).To(Equal("guide"))
+		Expect(req.Header).NotTo(HaveKey("Govuk-Analytics-Campaign"), "the original request shouldn't be modified")
+	})
+
+	It("should replace analytics headers which the client sent", func() {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("GOVUK-Analytics-Campaign", "spoofed")
+		req.Header.Set("GOVUK-Analytics-Audience", "spoofed")
+		tags(backend).ServeHTTP(httptest.NewRecorder(), req)
+		Expect(received.Get("GOVUK-Analytics-Campaign")).To(Equal("cost-of-living"))
+		Expect(received).NotTo(HaveKey("Govuk-Analytics-Audience"))
+	})
+
+	It("should leave the handler alone without tags", func() {
+		Expect(handlers.NewAnalyticsTagMiddleware(nil)(backend)).To(BeAssignableToTypeOf(backend))
+	})
+
+	It("should log the tags", func() {
+		var buf syncBuffer
+		l, err := log.New(&buf)
+		Expect(err).NotTo(HaveOccurred())
+
+		handlers.Chain(tags, handlers.NewAccessLogMiddleware(l))(backend).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+		Eventually(buf.Len).Should(BeNumerically(">", 0))
+		var entry struct {
+			Fields map[string]interface{} `json:"@fields"`
+		}
+		Expect(json.Unmarshal(buf.Bytes(), &entry)).To(Succeed())
+		Expect(entry.Fields).To(HaveKeyWithValue("analytics", map[string]interface{}{
+			"campaign":       "cost-of-living",
+			"content_format": "guide",
+		}))
+	})
+})
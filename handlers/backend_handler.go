@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
@@ -12,33 +13,126 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
 
 	"github.com/alphagov/router/logger"
 )
 
 var TLSSkipVerify bool
 
+// Options for the dialer used to connect to backends. These apply to all
+// backends and should be set before any backend handlers are created.
+var (
+	// BackendKeepAlive is the interval between TCP keepalive probes on backend
+	// connections. Lowering this makes the router notice dead backend hosts
+	// sooner, at the cost of more packets on idle connections. A negative
+	// value disables keepalives.
+	BackendKeepAlive = 30 * time.Second // same as DefaultTransport
+
+	// BackendLocalAddr is the local address to dial backends from. If nil, a
+	// local address is chosen automatically.
+	BackendLocalAddr net.Addr
+
+	// BackendFallbackDelay is how long to wait for a connection attempt to
+	// a backend address before also trying the next one, when a backend has
+	// several addresses (see backendDialer). If zero, a default of 300ms is
+	// used.
+	BackendFallbackDelay time.Duration
+)
+
+// BackendOptions holds settings which can vary between backends. The zero
+// value gives the default behaviour.
+type BackendOptions struct {
+	// HedgeDelay, if non-zero, is how long to wait for a response to an
+	// idempotent request before sending a second "hedge" request and using
+	// whichever response arrives first (see hedgingTransport). Somewhere
+	// around the backend's 95th percentile response time is a good choice.
+	HedgeDelay time.Duration
+
+	// RetryBudget limits the hedge requests sent to the backend.
+	RetryBudget RetryBudget
+
+	// Fallback, if set, produces the response when the backend is down: while
+	// the circuit breaker is open, and when a request without a body fails.
+	// See NewStaticFallback and NewFallbackBackend.
+	Fallback http.RoundTripper
+
+	// CircuitBreaker decides when the backend is down. It's only used if
+	// there's a fallback.
+	CircuitBreaker CircuitBreaker
+
+	// State, if set, holds the backend's retry budget and circuit breaker,
+	// so that they carry on from the backend's previous handler.
+	State *BackendState
+
+	// PreserveHost sends the client's Host header to the backend. Otherwise
+	// it's rewritten to the backend's hostname.
+	PreserveHost bool
+
+	// ForwardHost sends the client's Host header in X-Forwarded-Host when
+	// it's rewritten (see setForwardedHost).
+	ForwardHost bool
+}
+
 func NewBackendHandler(
 	backendID string,
 	backendURL *url.URL,
 	connectTimeout, headerTimeout time.Duration,
 	logger logger.Logger,
+	options BackendOptions,
 ) http.Handler {
 
-	proxy := httputil.NewSingleHostReverseProxy(backendURL)
+	proxy := newBackendProxy(backendURL, options.PreserveHost, options.ForwardHost)
 
 	proxy.Transport = newBackendTransport(
 		backendID,
 		connectTimeout, headerTimeout,
 		logger,
+		options,
 	)
 
-	defaultDirector := proxy.Director
+	return proxy
+}
+
+// NewGRPCBackendHandler returns a handler which proxies gRPC requests to the
+// backend over HTTP/2. Backends with an "http" URL are spoken to using
+// cleartext HTTP/2 (h2c) and those with an "https" URL using HTTP/2 over TLS.
+//
+// Responses are flushed to the client as soon as they are received from the
+// backend, so that streaming RPCs work, and trailers (which carry the gRPC
+// status) are passed through.
+func NewGRPCBackendHandler(
+	backendID string,
+	backendURL *url.URL,
+	connectTimeout time.Duration,
+	logger logger.Logger,
+) http.Handler {
+
+	proxy := newBackendProxy(backendURL, false, false)
+	proxy.FlushInterval = -1
+
+	proxy.Transport = &backendTransport{
+		backendID: backendID,
+		wrapped:   signRequests(newGRPCTransport(backendID, backendURL, connectTimeout)),
+		logger:    logger,
+	}
+
+	return proxy
+}
+
+func newBackendProxy(backendURL *url.URL, preserveHost, forwardHost bool) *httputil.ReverseProxy {
+	proxy := &httputil.ReverseProxy{}
+
 	proxy.Director = func(req *http.Request) {
-		defaultDirector(req)
+		addressToBackend(req.URL, backendURL)
 
-		// Set the Host header to match the backend hostname instead of the one from the incoming request.
-		req.Host = backendURL.Host
+		if !preserveHost {
+			// Set the Host header to match the backend hostname instead of the one from the incoming request.
+			if forwardHost {
+				setForwardedHost(req)
+			}
+			req.Host = backendURL.Host
+		}
 
 		// Setting a blank User-Agent causes the http lib not to output one, whereas if there
 		// is no header, it will output a default one.
@@ -53,6 +147,89 @@ func NewBackendHandler(
 	return proxy
 }
 
+// addressToBackend rewrites a request URL to point at a backend. If the
+// backend's URL has a path, such as "/app1" in "https://legacy.example/app1",
+// it's prepended to the request path, and any query string in the backend's
+// URL is added to the request's.
+func addressToBackend(u, backendURL *url.URL) {
+	u.Scheme = backendURL.Scheme
+	u.Host = backendURL.Host
+	u.Path, u.RawPath = joinBackendPath(backendURL, u)
+
+	switch {
+	case backendURL.RawQuery == "":
+	case u.RawQuery == "":
+		u.RawQuery = backendURL.RawQuery
+	default:
+		u.RawQuery = backendURL.RawQuery + "&" + u.RawQuery
+	}
+}
+
+// joinBackendPath returns the decoded and encoded forms of the request path
+// with the backend's base path prepended. The encoded form is only needed,
+// and only returned, if either path contains characters which were encoded
+// differently from the default, such as "%2F", so that they reach the
+// backend exactly as the client sent them.
+func joinBackendPath(backendURL, u *url.URL) (path, rawPath string) {
+	basePath := strings.TrimSuffix(backendURL.Path, "/")
+	if basePath == "" {
+		return u.Path, u.RawPath
+	}
+
+	path = basePath + withLeadingSlash(u.Path)
+	if backendURL.RawPath == "" && u.RawPath == "" {
+		return path, ""
+	}
+	rawPath = strings.TrimSuffix(backendURL.EscapedPath(), "/") + withLeadingSlash(u.EscapedPath())
+	return path, rawPath
+}
+
+// stripBackend undoes the path and query parts of addressToBackend.
+func stripBackend(u, backendURL *url.URL) {
+	switch {
+	case backendURL.RawQuery == "":
+	case u.RawQuery == backendURL.RawQuery:
+		u.RawQuery = ""
+	default:
+		u.RawQuery = strings.TrimPrefix(u.RawQuery, backendURL.RawQuery+"&")
+	}
+
+	basePath := strings.TrimSuffix(backendURL.Path, "/")
+	if basePath == "" {
+		return
+	}
+
+	u.Path = withLeadingSlash(strings.TrimPrefix(u.Path, basePath))
+	if u.RawPath != "" {
+		u.RawPath = withLeadingSlash(strings.TrimPrefix(u.RawPath, strings.TrimSuffix(backendURL.EscapedPath(), "/")))
+	}
+}
+
+func withLeadingSlash(path string) string {
+	if strings.HasPrefix(path, "/") {
+		return path
+	}
+	return "/" + path
+}
+
+// ForwardedHostHeader carries the client's Host header to backends when the
+// Host header is rewritten.
+const ForwardedHostHeader = "X-Forwarded-Host"
+
+// setForwardedHost records the request's Host header in X-Forwarded-Host,
+// before it's rewritten, replacing any value the client sent. A value set by
+// one of the TrustedProxies in front of the router is kept.
+func setForwardedHost(req *http.Request) {
+	if req.Header.Get(ForwardedHostHeader) != "" && fromTrustedProxy(req) {
+		return
+	}
+	if req.Host == "" {
+		req.Header.Del(ForwardedHostHeader)
+		return
+	}
+	req.Header.Set(ForwardedHostHeader, req.Host)
+}
+
 func populateViaHeader(header http.Header, httpVersion string) {
 	via := httpVersion + " router"
 	if prior, ok := header["Via"]; ok {
@@ -64,8 +241,12 @@ func populateViaHeader(header http.Header, httpVersion string) {
 type backendTransport struct {
 	backendID string
 
-	wrapped *http.Transport
+	wrapped http.RoundTripper
 	logger  logger.Logger
+
+	// Both nil unless the backend has a fallback
+	breaker  *circuitBreaker
+	fallback http.RoundTripper
 }
 
 // Construct a backendTransport that wraps an http.Transport and implements http.RoundTripper.
@@ -75,15 +256,42 @@ func newBackendTransport(
 	backendID string,
 	connectTimeout, headerTimeout time.Duration,
 	logger logger.Logger,
+	options BackendOptions,
 ) *backendTransport {
 
+	state := options.State
+	if state == nil {
+		state = NewBackendState(backendID)
+	}
+
+	var transport http.RoundTripper = newHTTPTransport(backendID, connectTimeout, headerTimeout)
+
+	if options.HedgeDelay > 0 {
+		hedge := newHTTPTransport(backendID, connectTimeout, headerTimeout)
+		// Each hedge gets a new connection, so that it can avoid the
+		// instance the slow request went to (see hedgingTransport).
+		hedge.DisableKeepAlives = true
+		transport = &hedgingTransport{
+			backendID: backendID,
+			delay:     options.HedgeDelay,
+			budget:    state.retryBudget(options.RetryBudget),
+			primary:   transport,
+			hedge:     hedge,
+		}
+	}
+
+	bt := &backendTransport{backendID: backendID, wrapped: signRequests(transport), logger: logger}
+	if options.Fallback != nil {
+		bt.breaker = state.circuitBreaker(options.CircuitBreaker)
+		bt.fallback = options.Fallback
+	}
+	return bt
+}
+
+func newHTTPTransport(backendID string, connectTimeout, headerTimeout time.Duration) *http.Transport {
 	transport := http.Transport{}
 
-	transport.DialContext = (&net.Dialer{
-		Timeout:   connectTimeout,   // Configured by caller
-		KeepAlive: 30 * time.Second, // same as DefaultTransport
-		DualStack: true,             // same as DefaultTransport
-	}).DialContext
+	transport.DialContext = newBackendDialer(backendID, connectTimeout).DialContext
 
 	// Remember, we have one transport per backend
 	//
@@ -118,7 +326,40 @@ func newBackendTransport(
 		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
-	return &backendTransport{backendID, &transport, logger}
+	return &transport
+}
+
+// Construct an HTTP/2-only transport for proxying gRPC requests. Unlike
+// http.Transport, this will not fall back to HTTP/1.1, which gRPC does not
+// support.
+//
+// There is no equivalent of ResponseHeaderTimeout here: streaming RPCs can
+// legitimately stay open for a long time, so we rely on HTTP/2 pings to notice
+// backends which have gone away.
+func newGRPCTransport(backendID string, backendURL *url.URL, connectTimeout time.Duration) *http2.Transport {
+	dialer := newBackendDialer(backendID, connectTimeout)
+
+	transport := &http2.Transport{
+		// Permit "http" URLs, which are dialled as cleartext HTTP/2 below
+		AllowHTTP: true,
+
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+	}
+
+	if TLSSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	if backendURL.Scheme == "http" {
+		transport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		}
+	} else {
+		transport.DialTLS = dialer.DialTLS
+	}
+
+	return transport
 }
 
 func closeBody(resp *http.Response) {
@@ -133,6 +374,10 @@ func (bt *backendTransport) RoundTrip(req *http.Request) (resp *http.Response, e
 		startTime    = time.Now()
 	)
 
+	if bt.breaker != nil && !bt.breaker.allow() {
+		return bt.serveFallback(req, "circuit_open"), nil
+	}
+
 	BackendHandlerRequestCountMetric.With(prometheus.Labels{
 		"backend_id":     bt.backendID,
 		"request_method": req.Method,
@@ -151,6 +396,14 @@ func (bt *backendTransport) RoundTrip(req *http.Request) (resp *http.Response, e
 	resp, err = bt.wrapped.RoundTrip(req)
 	if err == nil {
 		responseCode = resp.StatusCode
+		if bt.breaker != nil {
+			switch responseCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				bt.breaker.recordFailure()
+			default:
+				bt.breaker.recordSuccess()
+			}
+		}
 		populateViaHeader(resp.Header, fmt.Sprintf("%d.%d", resp.ProtoMajor, resp.ProtoMinor))
 	} else {
 		// Log the error (deferred to allow special case error handling to add/change details)
@@ -159,29 +412,67 @@ func (bt *backendTransport) RoundTrip(req *http.Request) (resp *http.Response, e
 		defer logger.NotifySentry(logger.ReportableError{Error: err, Request: req, Response: resp})
 		defer closeBody(resp)
 
+		// Requests abandoned by the client don't tell us anything about the backend
+		if bt.breaker != nil && req.Context().Err() == nil {
+			bt.breaker.recordFailure()
+		}
+
 		// Intercept some specific errors and generate an appropriate HTTP error response
 		if netErr, ok := err.(net.Error); ok {
 			if netErr.Timeout() {
 				responseCode = http.StatusGatewayTimeout
 				logDetails["status"] = responseCode
-				return newErrorResponse(responseCode), nil
+				return bt.errorResponse(responseCode, req), nil
 			}
 		}
 		if strings.Contains(err.Error(), "connection refused") {
 			responseCode = http.StatusBadGateway
 			logDetails["status"] = responseCode
-			return newErrorResponse(responseCode), nil
+			return bt.errorResponse(responseCode, req), nil
 		}
 
 		// 500 for all other errors
 		responseCode = http.StatusInternalServerError
-		return newErrorResponse(responseCode), nil
+		return bt.errorResponse(responseCode, req), nil
 	}
 	return
 }
 
-func newErrorResponse(status int) (resp *http.Response) {
-	resp = &http.Response{StatusCode: status}
-	resp.Body = ioutil.NopCloser(strings.NewReader(""))
+// errorResponse returns the response to send when a request to the backend
+// has failed. That's the backend's fallback, if it has one, and otherwise an
+// error. Requests with a body aren't sent to a fallback, since the body has
+// already been read.
+func (bt *backendTransport) errorResponse(status int, req *http.Request) *http.Response {
+	if bt.fallback != nil && (req.Body == nil || req.Body == http.NoBody) {
+		return bt.serveFallback(req, "backend_error")
+	}
+	return newErrorResponse(status, req)
+}
+
+func (bt *backendTransport) serveFallback(req *http.Request, reason string) *http.Response {
+	BackendHandlerFallbackResponseCountMetric.With(prometheus.Labels{
+		"backend_id": bt.backendID,
+		"reason":     reason,
+	}).Inc()
+
+	resp, err := bt.fallback.RoundTrip(req)
+	if err != nil {
+		bt.logger.LogFromBackendRequest(map[string]interface{}{
+			"error":  "fallback failed: " + err.Error(),
+			"status": http.StatusServiceUnavailable,
+		}, req)
+		return newErrorResponse(http.StatusServiceUnavailable, req)
+	}
+	return resp
+}
+
+func newErrorResponse(status int, req *http.Request) (resp *http.Response) {
+	contentType, body := errorBody(req, status)
+
+	resp = &http.Response{StatusCode: status, Header: make(http.Header)}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("X-Content-Type-Options", "nosniff")
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
 	return
 }
@@ -5,11 +5,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"time"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/prometheus/client_golang/prometheus"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
@@ -56,6 +60,7 @@ var _ = Describe("Backend handler", func() {
 				backendURL,
 				timeout, timeout,
 				logger,
+				handlers.BackendOptions{},
 			)
 
 			backend.AppendHandlers(func(rw http.ResponseWriter, r *http.Request) {
@@ -78,6 +83,241 @@ var _ = Describe("Backend handler", func() {
 		})
 	})
 
+	Context("when the backend refuses the connection", func() {
+		BeforeEach(func() {
+			router = handlers.NewBackendHandler(
+				"backend-refused",
+				backendURL,
+				timeout, timeout,
+				logger,
+				handlers.BackendOptions{},
+			)
+			backend.Close()
+
+			req := httptest.NewRequest("GET", backendURL.String(), nil)
+			req.Header.Set("Accept", "application/json")
+			router.ServeHTTP(rw, req)
+		})
+
+		It("should return HTTP 502", func() {
+			Expect(rw.Result().StatusCode).To(Equal(http.StatusBadGateway))
+		})
+
+		It("should return a problem document to JSON clients", func() {
+			Expect(rw.Result().Header.Get("Content-Type")).To(Equal("application/problem+json"))
+			body, err := ioutil.ReadAll(rw.Result().Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(ContainSubstring(`"title":"Bad Gateway"`))
+		})
+	})
+
+	Context("when the backend has a fallback page", func() {
+		BeforeEach(func() {
+			page, err := ioutil.TempFile("", "fallback-*.html")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(page.Name())
+			_, err = page.WriteString("<p>Back soon</p>")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Close()).To(Succeed())
+
+			fallback, err := handlers.NewStaticFallback(page.Name())
+			Expect(err).NotTo(HaveOccurred())
+
+			router = handlers.NewBackendHandler(
+				"backend-fallback",
+				backendURL,
+				timeout, timeout,
+				logger,
+				handlers.BackendOptions{
+					Fallback:       fallback,
+					CircuitBreaker: handlers.CircuitBreaker{Failures: 2, Cooldown: time.Minute},
+				},
+			)
+		})
+
+		serve := func() *http.Response {
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, httptest.NewRequest("GET", backendURL.String(), nil))
+			return rw.Result()
+		}
+
+		It("should serve the fallback page when the backend is down", func() {
+			backend.Close()
+
+			resp := serve()
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("text/html; charset=utf-8"))
+			Expect(resp.Header.Get("Cache-Control")).To(Equal("no-store"))
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("<p>Back soon</p>"))
+		})
+
+		It("should stop sending requests to the backend once the circuit breaker opens", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(http.StatusBadGateway, "down"),
+				ghttp.RespondWith(http.StatusBadGateway, "down"),
+				ghttp.RespondWith(http.StatusOK, "up"),
+			)
+
+			Expect(serve().StatusCode).To(Equal(http.StatusBadGateway))
+			Expect(serve().StatusCode).To(Equal(http.StatusBadGateway))
+			Expect(serve().StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(backend.ReceivedRequests()).To(HaveLen(2))
+		})
+	})
+
+	Context("when the backend URL has a base path", func() {
+		proxyTo := func(base, requestURI string) string {
+			baseURL, err := url.Parse(backend.URL() + base)
+			Expect(err).NotTo(HaveOccurred())
+			backend.AppendHandlers(ghttp.RespondWith(http.StatusOK, "OK"))
+
+			router = handlers.NewBackendHandler(
+				"backend-base-path",
+				baseURL,
+				timeout, timeout,
+				logger,
+				handlers.BackendOptions{},
+			)
+			router.ServeHTTP(rw, httptest.NewRequest("GET", requestURI, nil))
+			Expect(rw.Result().StatusCode).To(Equal(http.StatusOK))
+
+			Expect(backend.ReceivedRequests()).To(HaveLen(1))
+			return backend.ReceivedRequests()[0].RequestURI
+		}
+
+		DescribeTable("prepending the base path to the request path",
+			func(base, requestURI, expected string) {
+				Expect(proxyTo(base, requestURI)).To(Equal(expected))
+			},
+			Entry("a simple path", "/app1", "/foo/bar", "/app1/foo/bar"),
+			Entry("the root path", "/app1", "/", "/app1/"),
+			Entry("a base path with a trailing slash", "/app1/", "/foo", "/app1/foo"),
+			Entry("a nested base path", "/apps/app1", "/foo", "/apps/app1/foo"),
+			Entry("a query string", "/app1", "/foo?bar=baz&qux", "/app1/foo?bar=baz&qux"),
+			Entry("a query string in the backend URL", "/app1?key=1", "/foo?bar=baz", "/app1/foo?key=1&bar=baz"),
+			Entry("encoded segments", "/app1", "/foo%2Fbar/caf%C3%A9%20au%20lait", "/app1/foo%2Fbar/caf%C3%A9%20au%20lait"),
+			Entry("encoded segments in the base path", "/app%2F1", "/foo", "/app%2F1/foo"),
+			Entry("encoded segments in both", "/app%2F1", "/foo%2Fbar", "/app%2F1/foo%2Fbar"),
+			Entry("no base path", "", "/foo%2Fbar?baz", "/foo%2Fbar?baz"),
+		)
+
+		It("should swap the base path for the fallback's when using the fallback", func() {
+			fallbackBackend := ghttp.NewServer()
+			defer fallbackBackend.Close()
+			fallbackBackend.AppendHandlers(ghttp.RespondWith(http.StatusOK, "mirror"))
+
+			baseURL, err := url.Parse("http://127.0.0.1:1/app1")
+			Expect(err).NotTo(HaveOccurred())
+			fallbackURL, err := url.Parse(fallbackBackend.URL() + "/mirror/app1")
+			Expect(err).NotTo(HaveOccurred())
+
+			router = handlers.NewBackendHandler(
+				"backend-base-path-fallback",
+				baseURL,
+				timeout, timeout,
+				logger,
+				handlers.BackendOptions{
+					Fallback: handlers.NewFallbackBackend(
+						"backend-base-path-fallback", baseURL, fallbackURL, timeout, timeout,
+					),
+					CircuitBreaker: handlers.CircuitBreaker{Failures: 5, Cooldown: time.Minute},
+				},
+			)
+			router.ServeHTTP(rw, httptest.NewRequest("GET", "/foo%2Fbar?baz=qux", nil))
+			Expect(rw.Result().StatusCode).To(Equal(http.StatusOK))
+
+			Expect(fallbackBackend.ReceivedRequests()).To(HaveLen(1))
+			Expect(fallbackBackend.ReceivedRequests()[0].RequestURI).To(Equal("/mirror/app1/foo%2Fbar?baz=qux"))
+		})
+
+		It("should swap the query for the fallback's when using the fallback", func() {
+			fallbackBackend := ghttp.NewServer()
+			defer fallbackBackend.Close()
+			fallbackBackend.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, "mirror"),
+				ghttp.RespondWith(http.StatusOK, "mirror"),
+			)
+
+			baseURL, err := url.Parse("http://127.0.0.1:1/app1?site=main")
+			Expect(err).NotTo(HaveOccurred())
+			fallbackURL, err := url.Parse(fallbackBackend.URL() + "/mirror?site=mirror")
+			Expect(err).NotTo(HaveOccurred())
+
+			router = handlers.NewBackendHandler(
+				"backend-query-fallback",
+				baseURL,
+				timeout, timeout,
+				logger,
+				handlers.BackendOptions{
+					Fallback: handlers.NewFallbackBackend(
+						"backend-query-fallback", baseURL, fallbackURL, timeout, timeout,
+					),
+					CircuitBreaker: handlers.CircuitBreaker{Failures: 5, Cooldown: time.Minute},
+				},
+			)
+			router.ServeHTTP(rw, httptest.NewRequest("GET", "/foo?baz=qux", nil))
+			Expect(rw.Result().StatusCode).To(Equal(http.StatusOK))
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+
+			Expect(fallbackBackend.ReceivedRequests()).To(HaveLen(2))
+			Expect(fallbackBackend.ReceivedRequests()[0].RequestURI).To(Equal("/mirror/foo?site=mirror&baz=qux"))
+			Expect(fallbackBackend.ReceivedRequests()[1].RequestURI).To(Equal("/mirror/foo?site=mirror"))
+		})
+	})
+
+	Context("Host header handling", func() {
+		serve := func(options handlers.BackendOptions, header http.Header) *http.Request {
+			backend.AppendHandlers(ghttp.RespondWith(http.StatusOK, "OK"))
+			router = handlers.NewBackendHandler("backend-host", backendURL, timeout, timeout, logger, options)
+
+			req := httptest.NewRequest("GET", "http://www.example.com/foo", nil)
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			router.ServeHTTP(rw, req)
+			Expect(rw.Result().StatusCode).To(Equal(http.StatusOK))
+
+			Expect(backend.ReceivedRequests()).To(HaveLen(1))
+			return backend.ReceivedRequests()[0]
+		}
+
+		It("should rewrite the Host header by default", func() {
+			beReq := serve(handlers.BackendOptions{}, nil)
+			Expect(beReq.Host).To(Equal(backendURL.Host))
+			Expect(beReq.Header.Get("X-Forwarded-Host")).To(BeEmpty())
+		})
+
+		It("should forward the original Host header if asked to", func() {
+			beReq := serve(handlers.BackendOptions{ForwardHost: true}, nil)
+			Expect(beReq.Host).To(Equal(backendURL.Host))
+			Expect(beReq.Header.Get("X-Forwarded-Host")).To(Equal("www.example.com"))
+		})
+
+		It("should replace an X-Forwarded-Host header sent by the client", func() {
+			beReq := serve(handlers.BackendOptions{ForwardHost: true}, http.Header{"X-Forwarded-Host": {"evil.example.com"}})
+			Expect(beReq.Header.Get("X-Forwarded-Host")).To(Equal("www.example.com"))
+		})
+
+		It("should keep an X-Forwarded-Host header set by a trusted proxy in front of the router", func() {
+			var err error
+			handlers.TrustedProxies, err = handlers.ParseNetworks([]string{"192.0.2.0/24"})
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { handlers.TrustedProxies = nil }()
+
+			beReq := serve(handlers.BackendOptions{ForwardHost: true}, http.Header{"X-Forwarded-Host": {"www.gov.uk"}})
+			Expect(beReq.Host).To(Equal(backendURL.Host))
+			Expect(beReq.Header.Get("X-Forwarded-Host")).To(Equal("www.gov.uk"))
+		})
+
+		It("should preserve the Host header if asked to", func() {
+			beReq := serve(handlers.BackendOptions{PreserveHost: true}, nil)
+			Expect(beReq.Host).To(Equal("www.example.com"))
+			Expect(beReq.Header.Get("X-Forwarded-Host")).To(BeEmpty())
+		})
+	})
+
 	Context("when the backend handles the connection", func() {
 		BeforeEach(func() {
 			router = handlers.NewBackendHandler(
@@ -85,6 +325,7 @@ var _ = Describe("Backend handler", func() {
 				backendURL,
 				timeout, timeout,
 				logger,
+				handlers.BackendOptions{},
 			)
 		})
 
@@ -139,6 +380,57 @@ var _ = Describe("Backend handler", func() {
 		})
 	})
 
+	Context("when proxying gRPC to a cleartext HTTP/2 backend", func() {
+		var grpcBackend *httptest.Server
+
+		BeforeEach(func() {
+			grpcBackend = httptest.NewServer(h2c.NewHandler(
+				http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+					rw.Header().Set("Content-Type", "application/grpc")
+					rw.Header().Set("Trailer", "Grpc-Status")
+					rw.Header().Set("X-Backend-Proto", r.Proto)
+					rw.WriteHeader(http.StatusOK)
+					rw.Write([]byte("grpc-message"))
+					rw.Header().Set("Grpc-Status", "0")
+				}),
+				&http2.Server{},
+			))
+
+			grpcBackendURL, err := url.Parse(grpcBackend.URL)
+			Expect(err).NotTo(HaveOccurred(), "Could not parse gRPC backend URL")
+
+			router = handlers.NewGRPCBackendHandler(
+				"backend-grpc",
+				grpcBackendURL,
+				timeout,
+				logger,
+			)
+
+			req := httptest.NewRequest("POST", grpcBackendURL.String(), nil)
+			req.Header.Set("Content-Type", "application/grpc")
+			router.ServeHTTP(rw, req)
+		})
+
+		AfterEach(func() {
+			grpcBackend.Close()
+		})
+
+		It("should speak HTTP/2 to the backend", func() {
+			Expect(rw.Result().StatusCode).To(Equal(http.StatusOK))
+			Expect(rw.Result().Header.Get("X-Backend-Proto")).To(Equal("HTTP/2.0"))
+		})
+
+		It("should return the body", func() {
+			body, err := ioutil.ReadAll(rw.Result().Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("grpc-message"))
+		})
+
+		It("should propagate trailers", func() {
+			Expect(rw.Result().Trailer.Get("Grpc-Status")).To(Equal("0"))
+		})
+	})
+
 	Context("metrics", func() {
 		var (
 			beforeRequestCountMetric float64
@@ -202,6 +494,7 @@ var _ = Describe("Backend handler", func() {
 				backendURL,
 				timeout, timeout,
 				logger,
+				handlers.BackendOptions{},
 			)
 
 			beforeRequestCountMetric = measureRequestCount()
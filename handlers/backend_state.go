@@ -0,0 +1,44 @@
+package handlers
+
+import "sync"
+
+// BackendState is what's learnt about a backend from the requests sent to
+// it: its retry budget and circuit breaker. Passing the same state in
+// BackendOptions each time a backend's handler is created, such as when the
+// routes are reloaded, carries it over to the new handler; otherwise each
+// handler starts afresh.
+type BackendState struct {
+	backendID string
+
+	mu      sync.Mutex
+	budget  *retryBudget
+	breaker *circuitBreaker
+}
+
+func NewBackendState(backendID string) *BackendState {
+	return &BackendState{backendID: backendID}
+}
+
+// retryBudget returns the backend's retry budget, which starts again if its
+// configuration has changed.
+func (s *BackendState) retryBudget(config RetryBudget) *retryBudget {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.budget == nil || s.budget.config != config {
+		s.budget = newRetryBudget(s.backendID, config)
+	}
+	return s.budget
+}
+
+// circuitBreaker returns the backend's circuit breaker, which starts again
+// if its configuration has changed.
+func (s *BackendState) circuitBreaker(config CircuitBreaker) *circuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.breaker == nil || s.breaker.config != config {
+		s.breaker = newCircuitBreaker(s.backendID, config)
+	}
+	return s.breaker
+}
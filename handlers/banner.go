@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+)
+
+// bannerSearchLimit is how much of a response is searched for the <body>
+// tag before giving up and passing it on unchanged.
+const bannerSearchLimit = 64 * 1024
+
+// NewBannerMiddleware inserts an HTML fragment, such as a notice of a
+// national emergency, just after the <body> tag of HTML pages. banner is
+// called for each request, and nothing is inserted while it returns nothing.
+//
+// Responses are streamed: only the start of each page is held back while
+// looking for the <body> tag. Compressed and partial responses are passed on
+// unchanged, so while there's a banner requests are sent to the backend
+// without an Accept-Encoding header. Pages which may get the banner are
+// marked as not to be stored, so that caches don't keep it.
+func NewBannerMiddleware(banner func() []byte) Middleware {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fragment := banner()
+			if len(fragment) == 0 || r.Method == "HEAD" || r.Header.Get("Range") != "" {
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			if r.Header.Get("Accept-Encoding") != "" {
+				r2 := new(http.Request)
+				*r2 = *r
+				r2.Header = r.Header.Clone()
+				r2.Header.Del("Accept-Encoding")
+				r = r2
+			}
+
+			bw := &bannerWriter{ResponseWrapper: ResponseWrapper{ResponseWriter: w}, fragment: fragment}
+			defer bw.finish()
+			handler.ServeHTTP(bw, r)
+		})
+	}
+}
+
+// bannerWriter inserts a fragment after the <body> tag of an HTML response.
+type bannerWriter struct {
+	ResponseWrapper
+	fragment []byte
+
+	// searching is true until the <body> tag is found or the search given
+	// up, while what's been written so far is held in buf.
+	searching bool
+	buf       []byte
+	searched  int
+}
+
+func (w *bannerWriter) WriteHeader(status int) {
+	if w.Status() != 0 {
+		return
+	}
+
+	h := w.Header()
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if status == http.StatusOK && mediaType == "text/html" &&
+		(h.Get("Content-Encoding") == "" || h.Get("Content-Encoding") == "identity") {
+		w.searching = true
+		// The page will be longer, and no longer the one the validators
+		// describe. Caches mustn't keep it either, or they'd go on showing
+		// the banner after it's been taken down.
+		h.Del("Content-Length")
+		h.Del("ETag")
+		h.Del("Last-Modified")
+		h.Set("Cache-Control", "no-store")
+	}
+	w.ResponseWrapper.WriteHeader(status)
+}
+
+func (w *bannerWriter) Write(b []byte) (int, error) {
+	if w.Status() == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.searching {
+		return w.ResponseWrapper.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	i, next := bodyTagEnd(w.buf, w.searched)
+	w.searched = next
+	if i >= 0 {
+		w.searching = false
+		out := make([]byte, 0, len(w.buf)+len(w.fragment))
+		out = append(out, w.buf[:i]...)
+		out = append(out, w.fragment...)
+		out = append(out, w.buf[i:]...)
+		w.buf = nil
+		if _, err := w.ResponseWrapper.Write(out); err != nil {
+			return 0, err
+		}
+	} else if len(w.buf) > bannerSearchLimit {
+		if err := w.giveUp(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush passes on what's been written so far, which means giving up on
+// inserting the banner if the <body> tag hasn't been found yet.
+func (w *bannerWriter) Flush() {
+	if w.searching {
+		w.giveUp()
+	}
+	w.ResponseWrapper.Flush()
+}
+
+func (w *bannerWriter) giveUp() error {
+	w.searching = false
+	buf := w.buf
+	w.buf = nil
+	_, err := w.ResponseWrapper.Write(buf)
+	return err
+}
+
+// finish writes anything still held back once the response is complete.
+func (w *bannerWriter) finish() {
+	if w.searching {
+		w.giveUp()
+	}
+}
+
+// bodyTagEnd returns the index just after the <body> tag in page, or -1 if
+// it doesn't contain a complete one. The search starts at from, and if it
+// fails next is where to start the search again once more has been written,
+// so that each part of the page is only searched once.
+func bodyTagEnd(page []byte, from int) (end, next int) {
+	for offset := from; ; {
+		i := bytes.IndexByte(page[offset:], '<')
+		if i < 0 {
+			return -1, len(page)
+		}
+		tag := offset + i
+		start := tag + len("<body")
+		if start >= len(page) {
+			// There might be a tag here once the rest of it's written.
+			return -1, tag
+		}
+		if !bytes.EqualFold(page[tag+1:start], []byte("body")) {
+			offset = tag + 1
+			continue
+		}
+		switch page[start] {
+		case '>', ' ', '\t', '\n', '\r', '\f', '/':
+			end := bytes.IndexByte(page[start:], '>')
+			if end < 0 {
+				return -1, tag
+			}
+			return start + end + 1, 0
+		}
+		// Something like <bodyguard>, so keep looking.
+		offset = start
+	}
+}
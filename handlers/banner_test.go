@@ -0,0 +1,155 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Banner middleware", func() {
+	const banner = `<div class="emergency">Notice</div>`
+
+	var acceptEncoding string
+
+	page := func(contentType string, chunks ...string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acceptEncoding = r.Header.Get("Accept-Encoding")
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Length", "1000")
+			w.Header().Set("ETag", `"abc"`)
+			w.Header().Set("Cache-Control", "max-age=300, public")
+			for _, chunk := range chunks {
+				w.Write([]byte(chunk))
+			}
+		})
+	}
+
+	serve := func(fragment string, handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		middleware := handlers.NewBannerMiddleware(func() []byte { return []byte(fragment) })
+		middleware(handler).ServeHTTP(rw, req)
+		return rw
+	}
+
+	get := func() *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		return req
+	}
+
+	table.DescribeTable("inserting the banner",
+		func(chunks []string, expected string) {
+			rw := serve(banner, page("text/html; charset=utf-8", chunks...), get())
+			Expect(rw.Body.String()).To(Equal(expected))
+			Expect(rw.Header()).NotTo(HaveKey("Content-Length"))
+			Expect(rw.Header()).NotTo(HaveKey("Etag"))
+			Expect(rw.Header().Get("Cache-Control")).To(Equal("no-store"))
+		},
+		table.Entry("simple page",
+			[]string{"<html><body><p>Hi</p></body></html>"},
+			"<html><body>"+banner+"<p>Hi</p></body></html>"),
+		table.Entry("body with attributes, in upper case",
+			[]string{`<HTML><BODY class="js-enabled"><p>Hi</p>`},
+			`<HTML><BODY class="js-enabled">`+banner+"<p>Hi</p>"),
+		table.Entry("tag split between writes",
+			[]string{"<html><bo", "dy cl", `ass="x">`, "<p>Hi</p>"},
+			`<html><body class="x">`+banner+"<p>Hi</p>"),
+		table.Entry("tag after several writes",
+			[]string{"<html>", "<head><title>Hi</title>", "</head>", "<", "BoDy>", "<p>Hi</p>"},
+			"<html><head><title>Hi</title></head><BoDy>"+banner+"<p>Hi</p>"),
+		table.Entry("similar tags",
+			[]string{"<html><bodyguard></bodyguard><body><p>Hi</p>"},
+			"<html><bodyguard></bodyguard><body>"+banner+"<p>Hi</p>"),
+		table.Entry("no body tag",
+			[]string{"<p>Just a fragment</p>"},
+			"<p>Just a fragment</p>"),
+	)
+
+	It("should ask the backend for an uncompressed response", func() {
+		serve(banner, page("text/html", "<body>"), get())
+		Expect(acceptEncoding).To(BeEmpty())
+	})
+
+	It("should leave responses alone without a banner", func() {
+		rw := serve("", page("text/html", "<body><p>Hi</p>"), get())
+		Expect(rw.Body.String()).To(Equal("<body><p>Hi</p>"))
+		Expect(rw.Header().Get("Content-Length")).To(Equal("1000"))
+		Expect(rw.Header().Get("Cache-Control")).To(Equal("max-age=300, public"))
+		Expect(acceptEncoding).To(Equal("gzip"))
+	})
+
+	It("should leave other content types alone", func() {
+		rw := serve(banner, page("application/json", `{"body": "<body>"}`), get())
+		Expect(rw.Body.String()).To(Equal(`{"body": "<body>"}`))
+		Expect(rw.Header().Get("Content-Length")).To(Equal("1000"))
+	})
+
+	It("should leave compressed responses alone", func() {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte("<body>compressed"))
+		})
+		Expect(serve(banner, handler, get()).Body.String()).To(Equal("<body>compressed"))
+	})
+
+	It("should leave error pages and partial responses alone", func() {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<body>not found"))
+		})
+		Expect(serve(banner, handler, get()).Body.String()).To(Equal("<body>not found"))
+
+		req := get()
+		req.Header.Set("Range", "bytes=0-10")
+		Expect(serve(banner, page("text/html", "<body>"), req).Body.String()).To(Equal("<body>"))
+	})
+
+	It("should give up on pages with no body tag near the start", func() {
+		long := strings.Repeat("<!-- padding -->", 5000)
+		rw := serve(banner, page("text/html", long, "<body>"), get())
+		Expect(rw.Body.String()).To(Equal(long + "<body>"))
+	})
+
+	It("should pass on what's been written when the response is flushed", func() {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><head>"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("</head><body>"))
+		})
+		rw := serve(banner, handler, get())
+		Expect(rw.Flushed).To(BeTrue())
+		Expect(rw.Body.String()).To(Equal("<html><head></head><body>"))
+	})
+
+	It("should let the handler hijack the connection", func() {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 14\r\n\r\n<body>hijacked")
+			buf.Flush()
+		})
+		server := httptest.NewServer(handlers.NewBannerMiddleware(func() []byte { return []byte(banner) })(handler))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("<body>hijacked"))
+	})
+})
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CircuitBreaker configures when the router stops sending requests to a
+// backend which appears to be down, and serves its fallback instead.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failed requests after which the
+	// circuit breaker opens. A request fails if the backend can't be reached,
+	// times out, or returns a 502, 503 or 504.
+	Failures int
+
+	// Cooldown is how long the circuit breaker stays open before a single
+	// request is let through to see whether the backend has recovered.
+	Cooldown time.Duration
+}
+
+// circuitBreaker tracks the health of a backend as seen by the requests sent
+// to it. It starts closed, letting every request through. After enough
+// consecutive failures it opens, rejecting requests until the cooldown has
+// passed, and then lets through one "probe" request at a time until one of
+// them succeeds and the circuit breaker closes again.
+type circuitBreaker struct {
+	backendID string
+	config    CircuitBreaker
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	probeAt  time.Time
+}
+
+func newCircuitBreaker(backendID string, config CircuitBreaker) *circuitBreaker {
+	return &circuitBreaker{
+		backendID: backendID,
+		config:    config,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a request should be sent to the backend.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+
+	now := b.now()
+	if now.Sub(b.openedAt) < b.config.Cooldown {
+		return false
+	}
+	// Only one probe at a time, but don't wait forever for a probe which
+	// never reports back (for example because the client went away).
+	if !b.probeAt.IsZero() && now.Sub(b.probeAt) < b.config.Cooldown {
+		return false
+	}
+	b.probeAt = now
+	return true
+}
+
+func (b *circuitBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.open {
+		b.open = false
+		b.probeAt = time.Time{}
+		b.updateMetric()
+	}
+}
+
+func (b *circuitBreaker) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.open || b.failures >= b.config.Failures {
+		b.open = true
+		b.openedAt = b.now()
+		b.probeAt = time.Time{}
+		b.updateMetric()
+	}
+}
+
+func (b *circuitBreaker) updateMetric() {
+	open := 0.0
+	if b.open {
+		open = 1
+	}
+	BackendHandlerCircuitBreakerOpenMetric.With(prometheus.Labels{
+		"backend_id": b.backendID,
+	}).Set(open)
+}
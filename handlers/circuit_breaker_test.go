@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Circuit breaker", func() {
+	var (
+		breaker *circuitBreaker
+		now     time.Time
+	)
+
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			breaker.recordFailure()
+		}
+	}
+
+	measureOpen := func() float64 {
+		return promtest.ToFloat64(BackendHandlerCircuitBreakerOpenMetric.With(prometheus.Labels{
+			"backend_id": "backend-breaker",
+		}))
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2021, time.March, 15, 8, 0, 0, 0, time.UTC)
+		breaker = newCircuitBreaker("backend-breaker", CircuitBreaker{Failures: 3, Cooldown: 10 * time.Second})
+		breaker.now = func() time.Time { return now }
+	})
+
+	It("should stay closed until there are enough consecutive failures", func() {
+		fail(2)
+		breaker.recordSuccess()
+		fail(2)
+		Expect(breaker.allow()).To(BeTrue())
+
+		fail(1)
+		Expect(breaker.allow()).To(BeFalse())
+		Expect(measureOpen()).To(Equal(float64(1)))
+	})
+
+	It("should let a single probe through after the cooldown", func() {
+		fail(3)
+
+		now = now.Add(10 * time.Second)
+		Expect(breaker.allow()).To(BeTrue())
+		Expect(breaker.allow()).To(BeFalse())
+	})
+
+	It("should close when a probe succeeds", func() {
+		fail(3)
+		now = now.Add(10 * time.Second)
+		Expect(breaker.allow()).To(BeTrue())
+
+		breaker.recordSuccess()
+		Expect(breaker.allow()).To(BeTrue())
+		Expect(breaker.allow()).To(BeTrue())
+		Expect(measureOpen()).To(Equal(float64(0)))
+	})
+
+	It("should reopen when a probe fails", func() {
+		fail(3)
+		now = now.Add(10 * time.Second)
+		Expect(breaker.allow()).To(BeTrue())
+
+		fail(1)
+		now = now.Add(5 * time.Second)
+		Expect(breaker.allow()).To(BeFalse())
+		now = now.Add(5 * time.Second)
+		Expect(breaker.allow()).To(BeTrue())
+	})
+
+	It("should allow another probe if one never reports back", func() {
+		fail(3)
+		now = now.Add(10 * time.Second)
+		Expect(breaker.allow()).To(BeTrue())
+
+		now = now.Add(10 * time.Second)
+		Expect(breaker.allow()).To(BeTrue())
+	})
+})
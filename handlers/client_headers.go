@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RemoveClientHeaders removes the headers which only the router sets from a
+// request as the client sent it, so that backends can believe them whatever
+// middleware the request's route uses.
+func RemoveClientHeaders(req *http.Request) {
+	req.Header.Del(AuthenticatedUserHeader)
+	req.Header.Del(ForwardedPrefixHeader)
+	for name := range req.Header {
+		if strings.HasPrefix(name, canonicalAnalyticsHeaderPrefix) {
+			req.Header.Del(name)
+		}
+	}
+}
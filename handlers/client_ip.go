@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Where ClientIP takes the client's address from.
+const (
+	// ClientIPForwardedFor uses the rightmost address in X-Forwarded-For
+	// which isn't one of the TrustedProxies.
+	ClientIPForwardedFor = "forwarded-for"
+	// ClientIPHeader uses the header named by ClientIPHeaderName, such as
+	// the True-Client-IP header set by a CDN.
+	ClientIPHeader = "header"
+	// ClientIPSocket uses the address of the connection.
+	ClientIPSocket = "socket"
+)
+
+var (
+	// ClientIPSource is where ClientIP takes the client's address from.
+	ClientIPSource = ClientIPForwardedFor
+
+	// ClientIPHeaderName is the header read with ClientIPHeader.
+	ClientIPHeaderName = "True-Client-IP"
+
+	// TrustedProxies are the proxies in front of the router, which are
+	// passed over when reading X-Forwarded-For, and whose X-Forwarded-Host
+	// is believed.
+	TrustedProxies []*net.IPNet
+)
+
+// ClientIP returns the IP address of the client which made a request, as
+// used by the access log, rate limiting and the client policy. The router
+// runs behind other proxies, so by default it's the last address in the
+// X-Forwarded-For header which wasn't added by one of the TrustedProxies
+// (with none, simply the last address, which was added by the proxy in front
+// of the router). If ClientIPSource is ClientIPHeader it's the value of that
+// header instead. Either way, it falls back to the address of the
+// connection.
+func ClientIP(r *http.Request) string {
+	switch ClientIPSource {
+	case ClientIPForwardedFor:
+		if ip := forwardedForClientIP(r); ip != "" {
+			return ip
+		}
+	case ClientIPHeader:
+		if ip := strings.TrimSpace(r.Header.Get(ClientIPHeaderName)); ip != "" {
+			return ip
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// fromTrustedProxy reports whether the request's connection is from one of
+// the TrustedProxies, so that the headers it sets about the client's
+// request, such as X-Forwarded-Host, can be believed.
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && containsIP(TrustedProxies, ip)
+}
+
+func forwardedForClientIP(r *http.Request) string {
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		client = hop
+		if ip := net.ParseIP(hop); ip == nil || !containsIP(TrustedProxies, ip) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ClientPolicy lists clients to block, and clients with different rate
+// limits from everyone else. It's distributed by a central service as a
+// SignedClientPolicy, so that it can be changed without restarting the
+// router.
+type ClientPolicy struct {
+	// IssuedAt orders policies, so that an older one can't replace a newer
+	// one. The policy stops applying at ExpiresAt, if it's set, so that a
+	// router which can't reach the service doesn't keep blocking people
+	// indefinitely.
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Blocked lists IP addresses or CIDR ranges of clients to reject.
+	Blocked []string `json:"blocked"`
+
+	// RateLimits overrides the rate limit for some clients. The first
+	// override matching a client applies to it.
+	RateLimits []RateLimitOverride `json:"rate_limits"`
+}
+
+// RateLimitOverride is a rate limit for a set of IP addresses or CIDR
+// ranges.
+type RateLimitOverride struct {
+	Clients []string `json:"clients"`
+	Rate    float64  `json:"rate"`
+	Burst   int      `json:"burst"`
+}
+
+// SignedClientPolicy is the format a ClientPolicy is distributed in: the
+// policy's JSON, base64-encoded, and an Ed25519 signature of the JSON, also
+// base64-encoded.
+type SignedClientPolicy struct {
+	Policy    string `json:"policy"`
+	Signature string `json:"signature"`
+}
+
+// ParseSignedClientPolicy checks the signature on a SignedClientPolicy with
+// key and returns the policy it contains.
+func ParseSignedClientPolicy(data []byte, key ed25519.PublicKey) (*ClientPolicy, error) {
+	var signed SignedClientPolicy
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("handlers: invalid signed client policy: %v", err)
+	}
+	policy, err := base64.StdEncoding.DecodeString(signed.Policy)
+	if err != nil {
+		return nil, fmt.Errorf("handlers: invalid client policy encoding: %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("handlers: invalid client policy signature encoding: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, policy, signature) {
+		return nil, errors.New("handlers: client policy signature doesn't match")
+	}
+
+	var p ClientPolicy
+	if err := json.Unmarshal(policy, &p); err != nil {
+		return nil, fmt.Errorf("handlers: invalid client policy: %v", err)
+	}
+	return &p, nil
+}
+
+// SignClientPolicy signs a policy with key, in the format read by
+// ParseSignedClientPolicy. It's intended for tests and tools.
+func SignClientPolicy(p *ClientPolicy, key ed25519.PrivateKey) ([]byte, error) {
+	policy, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(SignedClientPolicy{
+		Policy:    base64.StdEncoding.EncodeToString(policy),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, policy)),
+	})
+}
+
+// ClientRules is a ClientPolicy ready to be applied to requests.
+type ClientRules struct {
+	expiresAt time.Time
+	blocked   []*net.IPNet
+	overrides []clientOverride
+}
+
+type clientOverride struct {
+	clients []*net.IPNet
+	limit   RateLimit
+}
+
+// NewClientRules checks and prepares a policy to be applied to requests.
+func NewClientRules(p *ClientPolicy) (*ClientRules, error) {
+	blocked, err := ParseNetworks(p.Blocked)
+	if err != nil {
+		return nil, err
+	}
+	r := &ClientRules{expiresAt: p.ExpiresAt, blocked: blocked}
+	for i, override := range p.RateLimits {
+		if override.Rate < 0 || override.Burst < 0 {
+			return nil, fmt.Errorf("handlers: rate limit override %d can't be negative", i)
+		}
+		clients, err := ParseNetworks(override.Clients)
+		if err != nil {
+			return nil, err
+		}
+		r.overrides = append(r.overrides, clientOverride{
+			clients: clients,
+			limit:   RateLimit{Rate: override.Rate, Burst: override.Burst},
+		})
+	}
+	return r, nil
+}
+
+// Expired reports whether the policy has stopped applying.
+func (r *ClientRules) Expired(now time.Time) bool {
+	return !r.expiresAt.IsZero() && !now.Before(r.expiresAt)
+}
+
+// Blocked reports whether a client's IP address is blocked.
+func (r *ClientRules) Blocked(client string) bool {
+	ip := net.ParseIP(client)
+	return ip != nil && containsIP(r.blocked, ip)
+}
+
+// RateLimit returns the rate limit for a client's IP address, if it's
+// overridden.
+func (r *ClientRules) RateLimit(client string) (RateLimit, bool) {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return RateLimit{}, false
+	}
+	for _, override := range r.overrides {
+		if containsIP(override.clients, ip) {
+			return override.limit, true
+		}
+	}
+	return RateLimit{}, false
+}
+
+// ParseNetworks parses a list of IP addresses and CIDR ranges.
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("handlers: invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("handlers: invalid CIDR range %q", s)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package handlers_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Client policies", func() {
+	var (
+		publicKey  ed25519.PublicKey
+		privateKey ed25519.PrivateKey
+		policy     *handlers.ClientPolicy
+	)
+
+	BeforeEach(func() {
+		var err error
+		publicKey, privateKey, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		policy = &handlers.ClientPolicy{
+			IssuedAt: time.Date(2021, time.March, 15, 8, 0, 0, 0, time.UTC),
+			Blocked:  []string{"192.0.2.1", "198.51.100.0/24", "2001:db8::/32"},
+			RateLimits: []handlers.RateLimitOverride{
+				{Clients: []string{"203.0.113.0/24"}, Rate: 100, Burst: 200},
+				{Clients: []string{"203.0.113.10"}, Rate: 1, Burst: 1},
+			},
+		}
+	})
+
+	It("should check the policy's signature", func() {
+		signed, err := handlers.SignClientPolicy(policy, privateKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		parsed, err := handlers.ParseSignedClientPolicy(signed, publicKey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.IssuedAt).To(BeTemporally("==", policy.IssuedAt))
+		Expect(parsed.Blocked).To(Equal(policy.Blocked))
+
+		otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		_, err = handlers.ParseSignedClientPolicy(signed, otherKey)
+		Expect(err).To(MatchError(ContainSubstring("signature doesn't match")))
+
+		_, err = handlers.ParseSignedClientPolicy([]byte(`{"policy": "e30=", "signature": ""}`), publicKey)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should match clients by address or range", func() {
+		rules, err := handlers.NewClientRules(policy)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(rules.Blocked("192.0.2.1")).To(BeTrue())
+		Expect(rules.Blocked("192.0.2.2")).To(BeFalse())
+		Expect(rules.Blocked("198.51.100.77")).To(BeTrue())
+		Expect(rules.Blocked("2001:db8::1")).To(BeTrue())
+		Expect(rules.Blocked("not an address")).To(BeFalse())
+
+		limit, ok := rules.RateLimit("203.0.113.10")
+		Expect(ok).To(BeTrue())
+		Expect(limit.Rate).To(Equal(100.0), "the first matching override should apply")
+		_, ok = rules.RateLimit("192.0.2.2")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should reject invalid policies", func() {
+		policy.Blocked = []string{"192.0.2.300"}
+		_, err := handlers.NewClientRules(policy)
+		Expect(err).To(MatchError(ContainSubstring("invalid IP address")))
+
+		policy.Blocked = []string{"192.0.2.0/33"}
+		_, err = handlers.NewClientRules(policy)
+		Expect(err).To(MatchError(ContainSubstring("invalid CIDR range")))
+	})
+
+	It("should expire", func() {
+		policy.ExpiresAt = policy.IssuedAt.Add(time.Hour)
+		rules, err := handlers.NewClientRules(policy)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules.Expired(policy.IssuedAt)).To(BeFalse())
+		Expect(rules.Expired(policy.ExpiresAt)).To(BeTrue())
+	})
+
+	It("should be applied by the rate limiting middleware", func() {
+		rules, err := handlers.NewClientRules(policy)
+		Expect(err).NotTo(HaveOccurred())
+		middleware := handlers.NewRateLimitMiddleware(handlers.RateLimit{
+			Rate:  10,
+			Burst: 5,
+			Rules: func() *handlers.ClientRules { return rules },
+		})
+		handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		status := func(client string) int {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = client + ":1234"
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			return rw.Code
+		}
+
+		Expect(status("192.0.2.1")).To(Equal(http.StatusForbidden))
+		for i := 0; i < 10; i++ {
+			Expect(status("203.0.113.10")).To(Equal(http.StatusOK), "the override should allow bigger bursts")
+		}
+		for i := 0; i < 5; i++ {
+			Expect(status("192.0.2.2")).To(Equal(http.StatusOK))
+		}
+		Expect(status("192.0.2.2")).To(Equal(http.StatusTooManyRequests))
+	})
+})
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewCoalescingHandler wraps a backend handler so that identical GET and HEAD
+// requests which arrive while one is already in flight wait for its response
+// instead of each being sent to the backend. This protects slow backends when
+// many clients ask for the same uncached page at once.
+//
+// Only requests without credentials are coalesced, and a response is only
+// shared if it's publicly cacheable, doesn't vary on headers the requests
+// might differ in and its body is no more than maxBodySize bytes. Otherwise
+// the waiting requests are each sent to the backend, but no more than
+// unsharedWaiterConcurrency of them at a time.
+func NewCoalescingHandler(backendID string, handler http.Handler, maxBodySize int64) http.Handler {
+	return &coalescingHandler{
+		backendID:   backendID,
+		handler:     handler,
+		maxBodySize: maxBodySize,
+		calls:       make(map[string]*coalescedCall),
+	}
+}
+
+// unsharedWaiterConcurrency is how many of the requests which waited for a
+// response that couldn't be shared are sent to the backend at once, so that
+// they don't all arrive together.
+const unsharedWaiterConcurrency = 4
+
+type coalescingHandler struct {
+	backendID   string
+	handler     http.Handler
+	maxBodySize int64
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is an in-flight request whose response may be shared with
+// other identical requests. The fields other than done must not be read
+// until done is closed.
+type coalescedCall struct {
+	done chan struct{}
+
+	shared bool
+	status int
+	header http.Header
+	body   []byte
+	// unshared limits how many waiting requests are sent to the backend at
+	// once if the response isn't shared.
+	unshared chan struct{}
+}
+
+func (h *coalescingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !coalescable(r) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	key := coalescingKey(r)
+
+	h.mu.Lock()
+	if call, ok := h.calls[key]; ok {
+		h.mu.Unlock()
+		h.wait(call, w, r)
+		return
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	h.calls[key] = call
+	h.mu.Unlock()
+
+	rw := &coalescingResponseWriter{ResponseWriter: w, maxBodySize: h.maxBodySize}
+	completed := false
+	defer func() {
+		// If the handler panicked or the client went away, we may only have
+		// part of the response, so the waiting requests must fetch their own.
+		call.shared = completed && rw.shareable() && r.Context().Err() == nil
+		if call.shared {
+			call.status = rw.status
+			call.header = rw.header
+			call.body = rw.body.Bytes()
+		} else {
+			call.unshared = make(chan struct{}, unsharedWaiterConcurrency)
+		}
+
+		h.mu.Lock()
+		delete(h.calls, key)
+		h.mu.Unlock()
+		close(call.done)
+	}()
+
+	h.handler.ServeHTTP(rw, r)
+	completed = true
+}
+
+func (h *coalescingHandler) wait(call *coalescedCall, w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	if !call.shared {
+		select {
+		case call.unshared <- struct{}{}:
+		case <-r.Context().Done():
+			return
+		}
+		defer func() { <-call.unshared }()
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	BackendHandlerCoalescedRequestCountMetric.With(prometheus.Labels{
+		"backend_id": h.backendID,
+	}).Inc()
+
+	for k, v := range call.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(call.status)
+	if r.Method != http.MethodHead {
+		w.Write(call.body)
+	}
+}
+
+func coalescable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	for _, h := range []string{"Authorization", "Cookie", "Range", "Upgrade"} {
+		if r.Header.Get(h) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// coalescingKeyHeaders are the request headers that responses commonly vary
+// on, which are part of the coalescing key.
+var coalescingKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+// coalescingKey identifies requests which would get the same response: ones
+// for the same URL with the same coalescingKeyHeaders.
+func coalescingKey(r *http.Request) string {
+	parts := []string{r.Method, r.Host, r.URL.RequestURI()}
+	for _, h := range coalescingKeyHeaders {
+		parts = append(parts, r.Header.Get(h))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// variesOutsideKey reports whether a response with header varies on request
+// headers which aren't part of the coalescing key, so that requests with the
+// same key might still get different responses.
+func variesOutsideKey(header http.Header) bool {
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			inKey := false
+			for _, h := range coalescingKeyHeaders {
+				if name == h {
+					inKey = true
+					break
+				}
+			}
+			if !inKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// coalescingResponseWriter writes the response through to the client as
+// normal, keeping a copy of it to share with any requests waiting on it.
+type coalescingResponseWriter struct {
+	http.ResponseWriter
+	maxBodySize int64
+
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (rw *coalescingResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+		rw.header = rw.ResponseWriter.Header().Clone()
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *coalescingResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.truncated {
+		if int64(rw.body.Len()+len(b)) > rw.maxBodySize {
+			rw.truncated = true
+			rw.body = bytes.Buffer{}
+		} else {
+			rw.body.Write(b)
+		}
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *coalescingResponseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *coalescingResponseWriter) shareable() bool {
+	if rw.status == 0 || rw.truncated {
+		return false
+	}
+	if len(rw.header.Values("Set-Cookie")) > 0 || variesOutsideKey(rw.header) {
+		return false
+	}
+	cacheControl := strings.ToLower(strings.Join(rw.header.Values("Cache-Control"), ","))
+	return !strings.Contains(cacheControl, "private") && !strings.Contains(cacheControl, "no-store")
+}
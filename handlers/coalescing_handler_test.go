@@ -0,0 +1,152 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Coalescing handler", func() {
+	var (
+		backendCalls int32
+		backend      http.HandlerFunc
+		responses    []*http.Response
+	)
+
+	serveConcurrently := func(handler http.Handler, n int, headers map[string]string) {
+		responses = make([]*http.Response, n)
+		wg := sync.WaitGroup{}
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				req := httptest.NewRequest("GET", "/slow-page?q=1", nil)
+				for k, v := range headers {
+					req.Header.Set(k, v)
+				}
+				rw := httptest.NewRecorder()
+				handler.ServeHTTP(rw, req)
+				responses[i] = rw.Result()
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	slowBackend := func(header string, value string) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&backendCalls, 1)
+			time.Sleep(200 * time.Millisecond)
+			if header != "" {
+				rw.Header().Set(header, value)
+			}
+			rw.Header().Set("X-Path", r.URL.RequestURI())
+			rw.WriteHeader(http.StatusOK)
+			rw.Write([]byte("slow response"))
+		}
+	}
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&backendCalls, 0)
+		backend = slowBackend("", "")
+	})
+
+	It("should only send one of a set of identical requests to the backend", func() {
+		serveConcurrently(handlers.NewCoalescingHandler("coalescing", backend, 1024), 10, nil)
+
+		Expect(atomic.LoadInt32(&backendCalls)).To(Equal(int32(1)))
+		for _, resp := range responses {
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("X-Path")).To(Equal("/slow-page?q=1"))
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("slow response"))
+		}
+	})
+
+	It("should not coalesce requests with cookies", func() {
+		serveConcurrently(handlers.NewCoalescingHandler("coalescing", backend, 1024), 5, map[string]string{
+			"Cookie": "session=abc",
+		})
+
+		Expect(atomic.LoadInt32(&backendCalls)).To(Equal(int32(5)))
+	})
+
+	It("should not share responses which set cookies", func() {
+		backend = slowBackend("Set-Cookie", "session=abc")
+		serveConcurrently(handlers.NewCoalescingHandler("coalescing", backend, 1024), 5, nil)
+
+		Expect(atomic.LoadInt32(&backendCalls)).To(BeNumerically(">", 1))
+	})
+
+	It("should only send a few waiting requests at a time when the response isn't shared", func() {
+		var inFlight, maxInFlight int32
+		cookies := slowBackend("Set-Cookie", "session=abc")
+		backend = func(rw http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			cookies(rw, r)
+		}
+		serveConcurrently(handlers.NewCoalescingHandler("coalescing", backend, 1024), 10, nil)
+
+		Expect(atomic.LoadInt32(&backendCalls)).To(Equal(int32(10)))
+		Expect(atomic.LoadInt32(&maxInFlight)).To(BeNumerically("<=", 4))
+	})
+
+	It("should not share private responses", func() {
+		backend = slowBackend("Cache-Control", "max-age=0, private")
+		serveConcurrently(handlers.NewCoalescingHandler("coalescing", backend, 1024), 5, nil)
+
+		Expect(atomic.LoadInt32(&backendCalls)).To(BeNumerically(">", 1))
+	})
+
+	It("should not coalesce requests to upgrade the connection", func() {
+		serveConcurrently(handlers.NewCoalescingHandler("coalescing", backend, 1024), 5, map[string]string{
+			"Connection": "Upgrade",
+			"Upgrade":    "websocket",
+		})
+
+		Expect(atomic.LoadInt32(&backendCalls)).To(Equal(int32(5)))
+	})
+
+	It("should share responses which only vary on headers in the key", func() {
+		backend = slowBackend("Vary", "accept-encoding, Accept")
+		serveConcurrently(handlers.NewCoalescingHandler("coalescing", backend, 1024), 5, nil)
+
+		Expect(atomic.LoadInt32(&backendCalls)).To(Equal(int32(1)))
+	})
+
+	It("should not share responses which vary on other headers", func() {
+		for _, vary := range []string{"Accept-Encoding, User-Agent", "*"} {
+			atomic.StoreInt32(&backendCalls, 0)
+			backend = slowBackend("Vary", vary)
+			serveConcurrently(handlers.NewCoalescingHandler("coalescing", backend, 1024), 5, nil)
+
+			Expect(atomic.LoadInt32(&backendCalls)).To(BeNumerically(">", 1), vary)
+		}
+	})
+
+	It("should not share responses larger than the maximum body size", func() {
+		serveConcurrently(handlers.NewCoalescingHandler("coalescing", backend, 4), 5, nil)
+
+		Expect(atomic.LoadInt32(&backendCalls)).To(BeNumerically(">", 1))
+		for _, resp := range responses {
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("slow response"))
+		}
+	})
+})
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+type listenerKey struct{}
+
+// NewListenerMiddleware records name as the listener requests arrived on,
+// so that the access log and metrics can tell the router's listeners apart.
+func NewListenerMiddleware(name string) Middleware {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), listenerKey{}, name)
+			handler.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ConnectionInfo describes how a request reached the router: the listener
+// it arrived on, its protocol ("HTTP/1.1", "HTTP/2.0" and so on) and, if the
+// connection used TLS, the version and cipher suite negotiated.
+type ConnectionInfo struct {
+	Listener   string
+	Protocol   string
+	TLSVersion string
+	TLSCipher  string
+}
+
+// RequestConnectionInfo returns the ConnectionInfo for r. The listener is
+// empty unless r passed through NewListenerMiddleware.
+func RequestConnectionInfo(r *http.Request) ConnectionInfo {
+	info := ConnectionInfo{Protocol: r.Proto}
+	info.Listener, _ = r.Context().Value(listenerKey{}).(string)
+	if r.TLS != nil {
+		info.TLSVersion = tlsVersionName(r.TLS.Version)
+		info.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+	}
+	return info
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	addressFamilyIPv4 = "ipv4"
+	addressFamilyIPv6 = "ipv6"
+
+	// Used when BackendFallbackDelay is unset. This matches the default used
+	// by net.Dialer.
+	defaultFallbackDelay = 300 * time.Millisecond
+
+	// Same value as http.DefaultTransport
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// BackendAddressFamily is the address family ("ipv4" or "ipv6") to try first
+// when a backend's hostname resolves to both IPv4 and IPv6 addresses. If
+// empty, the order returned by the resolver is used.
+var BackendAddressFamily string
+
+// backendDialer connects to backends, implementing "Happy Eyeballs" as
+// described in RFC 8305. When a backend hostname resolves to several
+// addresses, they're ordered so that the address families alternate, and a
+// connection attempt is started every BackendFallbackDelay until one succeeds.
+// IPv4 and IPv6 backends are therefore both reachable without a broken path in
+// one family stalling every request.
+type backendDialer struct {
+	backendID string
+
+	// Used for each individual connection attempt
+	dialer   *net.Dialer
+	resolver *net.Resolver
+}
+
+func newBackendDialer(backendID string, connectTimeout time.Duration) *backendDialer {
+	return &backendDialer{
+		backendID: backendID,
+		dialer: &net.Dialer{
+			Timeout:   connectTimeout, // Configured by caller
+			KeepAlive: BackendKeepAlive,
+			LocalAddr: BackendLocalAddr,
+		},
+		resolver: net.DefaultResolver,
+	}
+}
+
+func (d *backendDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *backendDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		// Nothing to resolve, so let the standard dialer handle it
+		return d.dialAddress(ctx, network, addr)
+	}
+
+	if d.dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.dialer.Timeout)
+		defer cancel()
+	}
+
+	ips, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Source: d.dialer.LocalAddr, Err: err}
+	}
+
+	addrs := sortAddresses(ips, BackendAddressFamily, d.dialer.LocalAddr)
+	if len(addrs) == 0 {
+		return nil, &net.OpError{
+			Op: "dial", Net: network, Source: d.dialer.LocalAddr,
+			Err: &net.AddrError{Err: "no suitable address found", Addr: host},
+		}
+	}
+
+	if avoid, ok := ctx.Value(avoidAddressKey{}).(string); ok {
+		addrs = avoidAddress(addrs, avoid)
+	}
+
+	return d.dialParallel(ctx, network, port, addrs)
+}
+
+// avoidAddressKey is the context key for the address, with its port, of a
+// connection which a dial should try to avoid making another to, such as
+// the one a hedged request was sent over.
+type avoidAddressKey struct{}
+
+// avoidAddress moves the address in avoid to the end of addrs, so that it's
+// only used if the others can't be connected to.
+func avoidAddress(addrs []net.IPAddr, avoid string) []net.IPAddr {
+	host, _, err := net.SplitHostPort(avoid)
+	if err != nil {
+		return addrs
+	}
+	avoidIP := net.ParseIP(host)
+	var preferred, avoided []net.IPAddr
+	for _, addr := range addrs {
+		if addr.IP.Equal(avoidIP) {
+			avoided = append(avoided, addr)
+		} else {
+			preferred = append(preferred, addr)
+		}
+	}
+	return append(preferred, avoided...)
+}
+
+// DialTLS connects to addr and performs a TLS handshake using cfg.
+func (d *backendDialer) DialTLS(network, addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := d.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialParallel makes staggered connection attempts to each address in turn,
+// returning the first connection established. A new attempt is started when
+// the previous one fails or after the fallback delay, whichever is sooner.
+// If every attempt fails, the first error is returned.
+func (d *backendDialer) dialParallel(ctx context.Context, network, port string, addrs []net.IPAddr) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	delay := BackendFallbackDelay
+	if delay <= 0 {
+		delay = defaultFallbackDelay
+	}
+
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+	startAttempt := func() {
+		addr := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.dialAddress(ctx, network, addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var firstErr error
+	startAttempt()
+	for {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close any connections from attempts that were still in
+				// progress; we've no use for them.
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(addrs) {
+				startAttempt()
+				resetTimer(timer, delay)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				startAttempt()
+				timer.Reset(delay)
+			}
+		}
+	}
+}
+
+func (d *backendDialer) dialAddress(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+
+	family := addressFamilyOf(addr)
+	if err != nil {
+		if ctx.Err() != context.Canceled {
+			BackendHandlerConnectionErrorCountMetric.With(prometheus.Labels{
+				"backend_id":     d.backendID,
+				"address_family": family,
+			}).Inc()
+		}
+		return nil, err
+	}
+
+	BackendHandlerConnectionCountMetric.With(prometheus.Labels{
+		"backend_id":     d.backendID,
+		"address_family": family,
+	}).Inc()
+	return conn, nil
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// sortAddresses orders addresses for connection attempts as described in
+// section 4 of RFC 8305: starting with the preferred family (or that of the
+// first address, if there's no preference) and then alternating between
+// families. Addresses which can't be reached from localAddr are dropped.
+func sortAddresses(ips []net.IPAddr, preferredFamily string, localAddr net.Addr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	if tcpAddr, ok := localAddr.(*net.TCPAddr); ok && tcpAddr.IP != nil {
+		if tcpAddr.IP.To4() != nil {
+			v6 = nil
+		} else {
+			v4 = nil
+		}
+	}
+
+	primary, secondary := v4, v6
+	switch preferredFamily {
+	case addressFamilyIPv6:
+		primary, secondary = v6, v4
+	case addressFamilyIPv4:
+	default:
+		if len(ips) > 0 && ips[0].IP.To4() == nil {
+			primary, secondary = v6, v4
+		}
+	}
+
+	sorted := make([]net.IPAddr, 0, len(primary)+len(secondary))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			sorted = append(sorted, primary[i])
+		}
+		if i < len(secondary) {
+			sorted = append(sorted, secondary[i])
+		}
+	}
+	return sorted
+}
+
+func addressFamilyOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return addressFamilyIPv6
+	}
+	return addressFamilyIPv4
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Backend dialer", func() {
+	ipAddrs := func(ips ...string) []net.IPAddr {
+		addrs := make([]net.IPAddr, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+		}
+		return addrs
+	}
+
+	DescribeTable("ordering addresses",
+		func(ips []string, preferred string, localAddr net.Addr, expected []string) {
+			Expect(sortAddresses(ipAddrs(ips...), preferred, localAddr)).To(Equal(ipAddrs(expected...)))
+		},
+		Entry("alternates families, starting with that of the first address",
+			[]string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"}, "", nil,
+			[]string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}),
+		Entry("starts with IPv4 addresses when preferred",
+			[]string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}, "ipv4", nil,
+			[]string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}),
+		Entry("starts with IPv6 addresses when preferred",
+			[]string{"192.0.2.1", "2001:db8::1"}, "ipv6", nil,
+			[]string{"2001:db8::1", "192.0.2.1"}),
+		Entry("keeps the order of addresses from a single family",
+			[]string{"192.0.2.2", "192.0.2.1"}, "ipv6", nil,
+			[]string{"192.0.2.2", "192.0.2.1"}),
+		Entry("drops addresses which can't be reached from the local address",
+			[]string{"2001:db8::1", "192.0.2.1"}, "ipv6", &net.TCPAddr{IP: net.ParseIP("192.0.2.100")},
+			[]string{"192.0.2.1"}),
+	)
+
+	DescribeTable("avoiding an address",
+		func(ips []string, avoid string, expected []string) {
+			Expect(avoidAddress(ipAddrs(ips...), avoid)).To(Equal(ipAddrs(expected...)))
+		},
+		Entry("moves the address to the end",
+			[]string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, "192.0.2.1:8080",
+			[]string{"192.0.2.2", "192.0.2.3", "192.0.2.1"}),
+		Entry("matches IPv6 addresses",
+			[]string{"2001:db8::1", "192.0.2.1"}, "[2001:db8::1]:443",
+			[]string{"192.0.2.1", "2001:db8::1"}),
+		Entry("leaves other addresses alone",
+			[]string{"192.0.2.1", "192.0.2.2"}, "192.0.2.9:80",
+			[]string{"192.0.2.1", "192.0.2.2"}),
+	)
+
+	Context("connecting to a backend with several addresses", func() {
+		var (
+			backend *ghttp.Server
+			port    string
+			dialer  *backendDialer
+		)
+
+		measureConnectionCount := func() float64 {
+			return promtest.ToFloat64(BackendHandlerConnectionCountMetric.With(prometheus.Labels{
+				"backend_id":     "backend-dialer",
+				"address_family": "ipv4",
+			}))
+		}
+
+		BeforeEach(func() {
+			backend = ghttp.NewServer()
+			backendURL, err := url.Parse(backend.URL())
+			Expect(err).NotTo(HaveOccurred())
+			port = backendURL.Port()
+
+			dialer = newBackendDialer("backend-dialer", time.Second)
+		})
+
+		AfterEach(func() {
+			backend.Close()
+		})
+
+		It("should fall back to the next address when an attempt fails", func() {
+			// Nothing is listening on the IPv6 loopback, so this either fails
+			// immediately or IPv6 isn't available at all.
+			before := measureConnectionCount()
+
+			conn, err := dialer.dialParallel(context.Background(), "tcp", port, ipAddrs("::1", "127.0.0.1"))
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			Expect(conn.RemoteAddr().String()).To(Equal(net.JoinHostPort("127.0.0.1", port)))
+			Expect(measureConnectionCount() - before).To(Equal(float64(1)))
+		})
+
+		It("should return the first error if every attempt fails", func() {
+			backend.Close()
+
+			_, err := dialer.dialParallel(context.Background(), "tcp", port, ipAddrs("127.0.0.1"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("connection refused"))
+		})
+	})
+})
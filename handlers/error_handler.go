@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RequestIDHeader is the header carrying the ID assigned to each request by
+// the edge of the GOV.UK stack, which is included in error responses so that
+// they can be matched up with logs.
+const RequestIDHeader = "GOVUK-Request-Id"
+
+const (
+	errorFormatText = iota
+	errorFormatJSON
+	errorFormatHTML
+)
+
+var errorDetails = map[int]string{
+	http.StatusNotFound:            "The page you were looking for could not be found.",
+	http.StatusGone:                "The page you were looking for has been removed.",
+	http.StatusInternalServerError: "Something went wrong while handling your request.",
+	http.StatusBadGateway:          "The service handling this page could not be reached.",
+	http.StatusServiceUnavailable:  "This page is temporarily unavailable.",
+	http.StatusGatewayTimeout:      "The service handling this page took too long to respond.",
+}
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Detail}}</p>
+{{- if .RequestID}}
+<p>Request ID: <code>{{.RequestID}}</code></p>
+{{- end}}
+</body>
+</html>
+`))
+
+// problem is an RFC 7807 "problem details" object.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// NewErrorHandler returns a handler which responds to every request with
+// the given status, as described for WriteError.
+func NewErrorHandler(status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, r, status)
+	})
+}
+
+// WriteError writes an error response generated by the router itself, rather
+// than one from a backend. Clients which accept JSON get an
+// application/problem+json body and browsers get an HTML page, both
+// including the request ID. Other clients get a short plain text body.
+func WriteError(w http.ResponseWriter, r *http.Request, status int) {
+	contentType, body := errorBody(r, status)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func errorBody(r *http.Request, status int) (contentType string, body []byte) {
+	p := problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    errorDetails[status],
+		Instance:  r.URL.Path,
+		RequestID: r.Header.Get(RequestIDHeader),
+	}
+
+	switch negotiateErrorFormat(r.Header.Get("Accept")) {
+	case errorFormatJSON:
+		body, _ = json.Marshal(p)
+		return "application/problem+json", append(body, '\n')
+	case errorFormatHTML:
+		var buf bytes.Buffer
+		errorPageTemplate.Execute(&buf, p)
+		return "text/html; charset=utf-8", buf.Bytes()
+	}
+
+	if status == http.StatusNotFound {
+		// Matches the body written by http.NotFound, which we used to use.
+		return "text/plain; charset=utf-8", []byte("404 page not found\n")
+	}
+	return "text/plain; charset=utf-8", []byte(fmt.Sprintf("%d %s\n", status, p.Title))
+}
+
+// negotiateErrorFormat picks the error format best matching an Accept
+// header. Only JSON and HTML media types which are explicitly listed count;
+// a bare "*/*" (or no Accept header at all) gets plain text, so that tools
+// like curl see the same responses as before. Where JSON and HTML are equally
+// acceptable, HTML wins.
+func negotiateErrorFormat(accept string) int {
+	var jsonQ, htmlQ float64
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		switch {
+		case mediaType == "application/json", mediaType == "application/problem+json",
+			strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"):
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case mediaType == "text/html", mediaType == "application/xhtml+xml":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		}
+	}
+
+	switch {
+	case htmlQ > 0 && htmlQ >= jsonQ:
+		return errorFormatHTML
+	case jsonQ > 0:
+		return errorFormatJSON
+	}
+	return errorFormatText
+}
@@ -0,0 +1,84 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Error handler", func() {
+	serve := func(status int, accept string) *http.Response {
+		req := httptest.NewRequest("GET", "/foo?bar=baz", nil)
+		req.Header.Set(handlers.RequestIDHeader, "12345-<id>")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		rw := httptest.NewRecorder()
+		handlers.NewErrorHandler(status).ServeHTTP(rw, req)
+		return rw.Result()
+	}
+
+	readBody := func(resp *http.Response) string {
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return string(body)
+	}
+
+	DescribeTable("choosing a format from the Accept header",
+		func(accept, contentType string) {
+			resp := serve(http.StatusGone, accept)
+			Expect(resp.StatusCode).To(Equal(http.StatusGone))
+			Expect(resp.Header.Get("Content-Type")).To(Equal(contentType))
+		},
+		Entry("no Accept header", "", "text/plain; charset=utf-8"),
+		Entry("anything", "*/*", "text/plain; charset=utf-8"),
+		Entry("JSON", "application/json", "application/problem+json"),
+		Entry("problem JSON", "application/problem+json", "application/problem+json"),
+		Entry("a browser",
+			"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8"),
+		Entry("JSON preferred over HTML", "text/html;q=0.5, application/json", "application/problem+json"),
+		Entry("HTML preferred over JSON", "text/html, application/json;q=0.5", "text/html; charset=utf-8"),
+		Entry("JSON refused", "application/json;q=0", "text/plain; charset=utf-8"),
+	)
+
+	It("should keep the existing plain text bodies", func() {
+		Expect(readBody(serve(http.StatusGone, ""))).To(Equal("410 Gone\n"))
+		Expect(readBody(serve(http.StatusNotFound, ""))).To(Equal("404 page not found\n"))
+		Expect(readBody(serve(http.StatusServiceUnavailable, ""))).To(Equal("503 Service Unavailable\n"))
+	})
+
+	It("should return a problem document to JSON clients", func() {
+		resp := serve(http.StatusNotFound, "application/json")
+
+		var problem map[string]interface{}
+		Expect(json.Unmarshal([]byte(readBody(resp)), &problem)).To(Succeed())
+		Expect(problem).To(Equal(map[string]interface{}{
+			"type":       "about:blank",
+			"title":      "Not Found",
+			"status":     float64(404),
+			"detail":     "The page you were looking for could not be found.",
+			"instance":   "/foo",
+			"request_id": "12345-<id>",
+		}))
+	})
+
+	It("should return an HTML page to browsers, escaping the request ID", func() {
+		body := readBody(serve(http.StatusServiceUnavailable, "text/html"))
+		Expect(body).To(ContainSubstring("<title>Service Unavailable</title>"))
+		Expect(body).To(ContainSubstring("<code>12345-&lt;id&gt;</code>"))
+	})
+
+	It("should set the Content-Length and nosniff headers", func() {
+		resp := serve(http.StatusGone, "")
+		Expect(resp.Header.Get("Content-Length")).To(Equal("9"))
+		Expect(resp.Header.Get("X-Content-Type-Options")).To(Equal("nosniff"))
+	})
+})
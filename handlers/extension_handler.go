@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// NewExtensionHandler returns a handler which chooses between handlers
+// according to the extension of the request path, such as "json" for
+// "/foo/bar.json". Extensions are matched case-insensitively, and should be
+// given in lower case without the leading dot. Requests with any other
+// extension, or none, are passed to defaultHandler, or get a 404 if it's nil.
+func NewExtensionHandler(byExtension map[string]http.Handler, defaultHandler http.Handler) http.Handler {
+	if defaultHandler == nil {
+		defaultHandler = NewErrorHandler(http.StatusNotFound)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler, ok := byExtension[PathExtension(r.URL.Path)]; ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		defaultHandler.ServeHTTP(w, r)
+	})
+}
+
+// PathExtension returns the extension of the last segment of a path, in
+// lower case and without the leading dot, or "" if it doesn't have one.
+func PathExtension(p string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(p), "."))
+}
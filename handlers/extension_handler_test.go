@@ -0,0 +1,51 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Extension handler", func() {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+
+	serve := func(handler http.Handler, path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+
+	byExtension := map[string]http.Handler{
+		"json": named("api"),
+		"atom": named("feeds"),
+	}
+
+	DescribeTable("choosing a handler",
+		func(path, expected string) {
+			handler := handlers.NewExtensionHandler(byExtension, named("frontend"))
+			Expect(serve(handler, path).Body.String()).To(Equal(expected))
+		},
+		Entry("a matching extension", "/foo/bar.json", "api"),
+		Entry("another matching extension", "/foo/bar.atom", "feeds"),
+		Entry("an extension in a different case", "/foo/bar.JSON", "api"),
+		Entry("no extension", "/foo/bar", "frontend"),
+		Entry("another extension", "/foo/bar.xml", "frontend"),
+		Entry("an extension on an earlier segment", "/foo.json/bar", "frontend"),
+		Entry("a trailing slash", "/foo/bar.json/", "frontend"),
+	)
+
+	It("should return a 404 if there's no default handler", func() {
+		handler := handlers.NewExtensionHandler(byExtension, nil)
+		Expect(serve(handler, "/foo/bar.json").Body.String()).To(Equal("api"))
+		Expect(serve(handler, "/foo/bar").Code).To(Equal(http.StatusNotFound))
+	})
+})
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// NewStaticFallback returns a fallback which serves the file at path, read
+// once now, as a 503 response. It's intended for a holding page explaining
+// that the service is temporarily unavailable.
+func NewStaticFallback(path string) (http.RoundTripper, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+
+	return &staticFallback{body: body, contentType: contentType}, nil
+}
+
+type staticFallback struct {
+	body        []byte
+	contentType string
+}
+
+func (f *staticFallback) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode:    http.StatusServiceUnavailable,
+		Header:        make(http.Header),
+		ContentLength: int64(len(f.body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(f.body)),
+	}
+	resp.Header.Set("Content-Type", f.contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(f.body)))
+	// The backend should be back soon, so don't let caches hold on to this.
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp, nil
+}
+
+// NewFallbackBackend returns a fallback which proxies requests to a second,
+// "emergency" backend, such as a static mirror of the backend's pages.
+// backendURL is the URL of the main backend, which requests will already have
+// been addressed to.
+func NewFallbackBackend(
+	backendID string,
+	backendURL, fallbackURL *url.URL,
+	connectTimeout, headerTimeout time.Duration,
+) http.RoundTripper {
+	return &fallbackBackend{
+		backendURL: backendURL,
+		url:        fallbackURL,
+		transport:  signRequests(newHTTPTransport(backendID, connectTimeout, headerTimeout)),
+	}
+}
+
+type fallbackBackend struct {
+	backendURL *url.URL
+	url        *url.URL
+	transport  http.RoundTripper
+}
+
+func (f *fallbackBackend) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The request has already been addressed to the main backend by the
+	// proxy's director, so point it at the fallback instead, swapping the
+	// main backend's base path and query for the fallback's.
+	outreq := req.Clone(req.Context())
+	stripBackend(outreq.URL, f.backendURL)
+	addressToBackend(outreq.URL, f.url)
+	outreq.Host = f.url.Host
+
+	return f.transport.RoundTrip(outreq)
+}
+
+// NewFallbackHandler returns a handler which serves every request using a
+// backend's fallback, as if the backend were down.
+func NewFallbackHandler(backendURL *url.URL, fallback http.RoundTripper) http.Handler {
+	proxy := newBackendProxy(backendURL, false, false)
+	proxy.Transport = fallback
+	return proxy
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	hedgeOutcomeWon     = "won"
+	hedgeOutcomeLost    = "lost"
+	hedgeOutcomeSkipped = "skipped"
+)
+
+// hedgingTransport sends idempotent requests to the backend and, if there's
+// no response within the hedge delay, sends a second "hedge" request and uses
+// whichever response arrives first. This cuts tail latency when the slowness
+// is down to a single backend instance, at the cost of extra backend load,
+// which is bounded by the backend's retry budget.
+//
+// Hedge requests use a separate transport, which makes a new connection for
+// each of them, so that they aren't queued behind the slow request. Where a
+// backend hostname resolves to several addresses, the hedge connects to one
+// other than the slow request's, so that it's served by another instance;
+// backends behind a single address, such as a load balancer, are left to
+// it to spread the requests.
+type hedgingTransport struct {
+	backendID string
+	delay     time.Duration
+	budget    *retryBudget
+
+	primary http.RoundTripper
+	hedge   http.RoundTripper
+}
+
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	hedge  bool
+	cancel context.CancelFunc
+}
+
+func (t *hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hedgeable(req) {
+		return t.primary.RoundTrip(req)
+	}
+	t.budget.recordRequest()
+
+	results := make(chan hedgeResult, 2)
+	var primaryAddr atomic.Value
+	attempt := func(rt http.RoundTripper, hedge bool) {
+		ctx, cancel := context.WithCancel(req.Context())
+		if hedge {
+			if addr, ok := primaryAddr.Load().(string); ok {
+				ctx = context.WithValue(ctx, avoidAddressKey{}, addr)
+			}
+		} else {
+			ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) {
+					primaryAddr.Store(info.Conn.RemoteAddr().String())
+				},
+			})
+		}
+		go func() {
+			resp, err := rt.RoundTrip(req.Clone(ctx))
+			results <- hedgeResult{resp, err, hedge, cancel}
+		}()
+	}
+
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+
+	attempt(t.primary, false)
+	inFlight, hedged := 1, false
+	var firstErr error
+	for {
+		select {
+		case res := <-results:
+			inFlight--
+			if res.err == nil {
+				if hedged {
+					t.recordOutcome(res.hedge)
+				}
+				// Abandon the other attempt, if it's still going, and release
+				// this one's context once the response has been read.
+				go discardHedgeResults(results, inFlight)
+				res.resp.Body = &cancellingBody{res.resp.Body, res.cancel}
+				return res.resp, nil
+			}
+			res.cancel()
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if inFlight == 0 {
+				if hedged {
+					t.recordOutcome(false)
+				}
+				return nil, firstErr
+			}
+		case <-timer.C:
+			if t.budget.spend() {
+				attempt(t.hedge, true)
+				inFlight++
+				hedged = true
+			} else {
+				BackendHandlerHedgeCountMetric.With(prometheus.Labels{
+					"backend_id": t.backendID,
+					"outcome":    hedgeOutcomeSkipped,
+				}).Inc()
+			}
+		}
+	}
+}
+
+func (t *hedgingTransport) recordOutcome(hedgeWon bool) {
+	outcome := hedgeOutcomeLost
+	if hedgeWon {
+		outcome = hedgeOutcomeWon
+	}
+	BackendHandlerHedgeCountMetric.With(prometheus.Labels{
+		"backend_id": t.backendID,
+		"outcome":    outcome,
+	}).Inc()
+}
+
+func discardHedgeResults(results chan hedgeResult, n int) {
+	for ; n > 0; n-- {
+		res := <-results
+		res.cancel()
+		closeBody(res.resp)
+	}
+}
+
+// Only requests which can safely be sent twice are hedged. Requests with a
+// body are excluded because the body can only be read once.
+func hedgeable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+// cancellingBody cancels the context of the request which produced it once the
+// body has been closed.
+type cancellingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancellingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
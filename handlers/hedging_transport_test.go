@@ -0,0 +1,130 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/alphagov/router/handlers"
+	log "github.com/alphagov/router/logger"
+)
+
+var _ = Describe("Hedged requests", func() {
+	var (
+		logger     log.Logger
+		backend    *httptest.Server
+		backendURL *url.URL
+		requests   int32
+	)
+
+	measureHedgeCount := func(backendID, outcome string) float64 {
+		return promtest.ToFloat64(handlers.BackendHandlerHedgeCountMetric.With(prometheus.Labels{
+			"backend_id": backendID,
+			"outcome":    outcome,
+		}))
+	}
+
+	serve := func(handler http.Handler, method string) (*http.Response, time.Duration) {
+		rw := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(rw, httptest.NewRequest(method, backendURL.String(), nil))
+		return rw.Result(), time.Since(start)
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		logger, err = log.New(GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred(), "Could not create logger")
+
+		// The first request to the backend is slow; any others are quick
+		atomic.StoreInt32(&requests, 0)
+		backend = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) == 1 {
+				time.Sleep(time.Second)
+				rw.Write([]byte("slow"))
+				return
+			}
+			rw.Write([]byte("quick"))
+		}))
+
+		backendURL, err = url.Parse(backend.URL)
+		Expect(err).NotTo(HaveOccurred(), "Could not parse backend URL")
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	Context("when the hedge budget allows it", func() {
+		var router http.Handler
+
+		BeforeEach(func() {
+			router = handlers.NewBackendHandler(
+				"backend-hedge",
+				backendURL,
+				2*time.Second, 2*time.Second,
+				logger,
+				handlers.BackendOptions{
+					HedgeDelay:  100 * time.Millisecond,
+					RetryBudget: handlers.RetryBudget{Percent: 100, Window: time.Minute},
+				},
+			)
+		})
+
+		It("should use the response to the hedge request if it arrives first", func() {
+			before := measureHedgeCount("backend-hedge", "won")
+
+			resp, duration := serve(router, "GET")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("quick"))
+			Expect(duration).To(BeNumerically("<", 500*time.Millisecond))
+
+			Expect(measureHedgeCount("backend-hedge", "won") - before).To(Equal(float64(1)))
+		})
+
+		It("should not hedge requests which aren't idempotent", func() {
+			resp, duration := serve(router, "POST")
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("slow"))
+			Expect(duration).To(BeNumerically(">=", time.Second))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		})
+	})
+
+	Context("when the hedge budget is exhausted", func() {
+		It("should wait for the original request", func() {
+			router := handlers.NewBackendHandler(
+				"backend-hedge-budget",
+				backendURL,
+				2*time.Second, 2*time.Second,
+				logger,
+				handlers.BackendOptions{
+					HedgeDelay:  100 * time.Millisecond,
+					RetryBudget: handlers.RetryBudget{Percent: 0, Window: time.Minute},
+				},
+			)
+			before := measureHedgeCount("backend-hedge-budget", "skipped")
+
+			resp, _ := serve(router, "GET")
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("slow"))
+
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+			Expect(measureHedgeCount("backend-hedge-budget", "skipped") - before).To(Equal(float64(1)))
+		})
+	})
+})
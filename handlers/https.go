@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NewHTTPSMiddleware requires requests to have been made over HTTPS, either
+// to a TLS listener or to a trusted proxy which says so in
+// X-Forwarded-Proto. Plain HTTP GET and HEAD requests are redirected to the
+// same URL over HTTPS with a 301, and other requests, whose bodies a
+// redirect would lose, are forbidden. If there are any hostnames, requests
+// for other hosts are forbidden rather than redirected, so that the router
+// can't be used to redirect to any site. If hsts isn't empty, it's sent as
+// the Strict-Transport-Security header on responses to HTTPS requests.
+func NewHTTPSMiddleware(hsts string, hostnames []string) Middleware {
+	known := make(map[string]bool, len(hostnames))
+	for _, host := range hostnames {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		known[strings.ToLower(host)] = true
+	}
+
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isHTTPS(r) {
+				if hsts != "" {
+					w.Header().Set("Strict-Transport-Security", hsts)
+				}
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				// The port is for plain HTTP, so HTTPS uses its default.
+				host = h
+			}
+			if host == "" || (len(known) > 0 && !known[strings.ToLower(host)]) ||
+				(r.Method != "GET" && r.Method != "HEAD") {
+				InsecureRequestCountMetric.WithLabelValues("forbidden").Inc()
+				WriteError(w, r, http.StatusForbidden)
+				return
+			}
+			InsecureRequestCountMetric.WithLabelValues("redirected").Inc()
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		})
+	}
+}
+
+// isHTTPS reports whether r was made over HTTPS, believing X-Forwarded-Proto
+// only from a trusted proxy.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || (r.Header.Get("X-Forwarded-Proto") == "https" && fromTrustedProxy(r))
+}
@@ -0,0 +1,91 @@
+package handlers_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("HTTPS middleware", func() {
+	handler := handlers.NewHTTPSMiddleware("max-age=31536000", []string{"www.gov.uk"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("should serve requests to a TLS listener with HSTS", func() {
+		req := httptest.NewRequest("GET", "/tax", nil)
+		req.TLS = &tls.ConnectionState{}
+		rw := serve(req)
+		Expect(rw.Body.String()).To(Equal("secure"))
+		Expect(rw.Header().Get("Strict-Transport-Security")).To(Equal("max-age=31536000"))
+	})
+
+	It("should serve requests which a trusted proxy says were over HTTPS", func() {
+		var err error
+		handlers.TrustedProxies, err = handlers.ParseNetworks([]string{"192.0.2.1"})
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { handlers.TrustedProxies = nil }()
+
+		req := httptest.NewRequest("POST", "/tax", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		Expect(serve(req).Body.String()).To(Equal("secure"))
+	})
+
+	It("should ignore X-Forwarded-Proto from other clients", func() {
+		req := httptest.NewRequest("POST", "http://www.gov.uk/tax", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		Expect(serve(req).Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("should redirect plain HTTP GET requests to HTTPS", func() {
+		req := httptest.NewRequest("GET", "/tax?year=2024", nil)
+		req.Host = "WWW.gov.uk:8080"
+		rw := serve(req)
+		Expect(rw.Code).To(Equal(http.StatusMovedPermanently))
+		Expect(rw.Header().Get("Location")).To(Equal("https://WWW.gov.uk/tax?year=2024"))
+		Expect(rw.Header()).NotTo(HaveKey("Strict-Transport-Security"))
+	})
+
+	It("should forbid other plain HTTP requests", func() {
+		req := httptest.NewRequest("POST", "/tax", nil)
+		req.Header.Set("X-Forwarded-Proto", "http")
+		Expect(serve(req).Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("should forbid plain HTTP requests for other hosts", func() {
+		req := httptest.NewRequest("GET", "http://evil.example/tax", nil)
+		Expect(serve(req).Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("should redirect any host without hostnames", func() {
+		req := httptest.NewRequest("GET", "http://draft.example/tax", nil)
+		rw := httptest.NewRecorder()
+		handlers.NewHTTPSMiddleware("", nil)(http.NotFoundHandler()).ServeHTTP(rw, req)
+		Expect(rw.Code).To(Equal(http.StatusMovedPermanently))
+		Expect(rw.Header().Get("Location")).To(Equal("https://draft.example/tax"))
+	})
+
+	It("should forbid plain HTTP requests without a host", func() {
+		req := httptest.NewRequest("GET", "/tax", nil)
+		req.Host = ""
+		Expect(serve(req).Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("shouldn't send HSTS if it isn't configured", func() {
+		req := httptest.NewRequest("GET", "/tax", nil)
+		req.TLS = &tls.ConnectionState{}
+		rw := httptest.NewRecorder()
+		handlers.NewHTTPSMiddleware("", nil)(http.NotFoundHandler()).ServeHTTP(rw, req)
+		Expect(rw.Header()).NotTo(HaveKey("Strict-Transport-Security"))
+	})
+})
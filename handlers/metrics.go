@@ -28,6 +28,90 @@ var (
 		},
 	)
 
+	BackendHandlerConnectionCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_backend_handler_connection_total",
+			Help: "Number of connections established to backends by router backend handlers",
+		},
+		[]string{
+			"backend_id",
+			"address_family",
+		},
+	)
+
+	BackendHandlerConnectionErrorCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_backend_handler_connection_error_total",
+			Help: "Number of failed attempts to connect to backends by router backend handlers",
+		},
+		[]string{
+			"backend_id",
+			"address_family",
+		},
+	)
+
+	BackendHandlerCoalescedRequestCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_backend_handler_coalesced_request_total",
+			Help: "Number of requests served with a response shared from an identical in-flight request",
+		},
+		[]string{
+			"backend_id",
+		},
+	)
+
+	BackendHandlerHedgeCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_backend_handler_hedge_total",
+			Help: "Number of hedge requests considered by router backend handlers, by outcome",
+		},
+		[]string{
+			"backend_id",
+			"outcome",
+		},
+	)
+
+	BackendHandlerRetryBudgetUsedRatioMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_backend_handler_retry_budget_used_ratio",
+			Help: "Proportion of each backend's retry budget used in the current window",
+		},
+		[]string{
+			"backend_id",
+		},
+	)
+
+	BackendHandlerRetryBudgetExhaustedCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_backend_handler_retry_budget_exhausted_total",
+			Help: "Number of retries not made because the backend's retry budget was used up",
+		},
+		[]string{
+			"backend_id",
+		},
+	)
+
+	BackendHandlerCircuitBreakerOpenMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_backend_handler_circuit_breaker_open",
+			Help: "Whether each backend's circuit breaker is open (1) or closed (0)",
+		},
+		[]string{
+			"backend_id",
+		},
+	)
+
+	BackendHandlerFallbackResponseCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_backend_handler_fallback_responses_total",
+			Help: "Number of requests served by a backend's fallback instead of the backend",
+		},
+		[]string{
+			"backend_id",
+			"reason",
+		},
+	)
+
 	BackendHandlerResponseDurationSecondsMetric = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name: "router_backend_handler_response_duration_seconds",
@@ -39,11 +123,84 @@ var (
 			"response_code",
 		},
 	)
+
+	RequestDurationSecondsMetric = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "router_request_duration_seconds",
+			Help: "Histogram of durations of requests seen by the metrics middleware",
+		},
+		[]string{
+			"request_method",
+			"response_code",
+		},
+	)
+
+	RequestProtocolCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_request_protocol_total",
+			Help: "Number of requests seen by the metrics middleware by listener, protocol and TLS version and cipher",
+		},
+		[]string{
+			"listener",
+			"protocol",
+			"tls_version",
+			"tls_cipher",
+		},
+	)
+
+	RateLimitedRequestCountMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "router_rate_limited_requests_total",
+			Help: "Number of requests rejected by the rate limiting middleware",
+		},
+	)
+
+	BlockedRequestCountMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "router_blocked_requests_total",
+			Help: "Number of requests rejected because their client is on the block list",
+		},
+	)
+
+	InsecureRequestCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_insecure_requests_total",
+			Help: "Number of plain HTTP requests to routes which require HTTPS, by whether they were redirected or forbidden",
+		},
+		[]string{
+			"action",
+		},
+	)
+
+	RuleMatchCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_rule_match_total",
+			Help: "Number of requests matched by each transformation rule",
+		},
+		[]string{
+			"rule",
+		},
+	)
 )
 
 func initMetrics() {
 	prometheus.MustRegister(RedirectHandlerRedirectCountMetric)
 
 	prometheus.MustRegister(BackendHandlerRequestCountMetric)
+	prometheus.MustRegister(BackendHandlerConnectionCountMetric)
+	prometheus.MustRegister(BackendHandlerConnectionErrorCountMetric)
+	prometheus.MustRegister(BackendHandlerCoalescedRequestCountMetric)
+	prometheus.MustRegister(BackendHandlerHedgeCountMetric)
+	prometheus.MustRegister(BackendHandlerRetryBudgetUsedRatioMetric)
+	prometheus.MustRegister(BackendHandlerRetryBudgetExhaustedCountMetric)
+	prometheus.MustRegister(BackendHandlerCircuitBreakerOpenMetric)
+	prometheus.MustRegister(BackendHandlerFallbackResponseCountMetric)
 	prometheus.MustRegister(BackendHandlerResponseDurationSecondsMetric)
+
+	prometheus.MustRegister(RequestDurationSecondsMetric)
+	prometheus.MustRegister(RequestProtocolCountMetric)
+	prometheus.MustRegister(RateLimitedRequestCountMetric)
+	prometheus.MustRegister(BlockedRequestCountMetric)
+	prometheus.MustRegister(InsecureRequestCountMetric)
+	prometheus.MustRegister(RuleMatchCountMetric)
 }
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alphagov/router/logger"
+)
+
+// Middleware wraps a handler to add behaviour which applies to many
+// requests, such as logging or authentication.
+type Middleware func(http.Handler) http.Handler
+
+// Chain returns a middleware which applies each of middleware in turn, so
+// that the first is outermost: it sees each request first and each response
+// last.
+func Chain(middleware ...Middleware) Middleware {
+	return func(handler http.Handler) http.Handler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			handler = middleware[i](handler)
+		}
+		return handler
+	}
+}
+
+// NewAccessLogMiddleware logs each request, along with its response status,
+// size and duration, how it reached the router (see ConnectionInfo) and its
+// analytics tags (see NewAnalyticsTagMiddleware), to l.
+func NewAccessLogMiddleware(l logger.Logger) Middleware {
+	return NewSampledAccessLogMiddleware(l, 1)
+}
+
+// NewSampledAccessLogMiddleware is like NewAccessLogMiddleware, but only
+// logs a random sample of requests: rate is the fraction logged, unless
+// NewLogSampleRateMiddleware sets a different rate for a request.
+func NewSampledAccessLogMiddleware(l logger.Logger, rate float64) Middleware {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !sampled(logSampleRate(r, rate)) {
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			sw := newStatusWriter(w, nil)
+			start := time.Now()
+
+			handler.ServeHTTP(sw, r)
+
+			fields := map[string]interface{}{
+				"status":        sw.statusCode(),
+				"bytes_sent":    sw.bytes,
+				"request_time":  time.Since(start).Seconds(),
+				"host":          r.Host,
+				"remote_addr":   r.RemoteAddr,
+				"client_ip":     ClientIP(r),
+				"http_referrer": r.Referer(),
+				"user_agent":    r.UserAgent(),
+			}
+			info := RequestConnectionInfo(r)
+			fields["protocol"] = info.Protocol
+			if info.Listener != "" {
+				fields["listener"] = info.Listener
+			}
+			if info.TLSVersion != "" {
+				fields["tls_version"] = info.TLSVersion
+				fields["tls_cipher"] = info.TLSCipher
+			}
+			if tags := analyticsTags(r); tags != nil {
+				fields["analytics"] = tags
+			}
+			l.LogFromClientRequest(fields, r)
+		})
+	}
+}
+
+type logSampleRateKey struct{}
+
+// NewLogSampleRateMiddleware sets the fraction of requests logged by the
+// access log middleware, for requests which pass through it before the
+// access log middleware does. rate is called for each request, so that it
+// can be changed while the router is running.
+func NewLogSampleRateMiddleware(rate func() float64) Middleware {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), logSampleRateKey{}, rate())
+			handler.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func logSampleRate(r *http.Request, defaultRate float64) float64 {
+	if rate, ok := r.Context().Value(logSampleRateKey{}).(float64); ok {
+		return rate
+	}
+	return defaultRate
+}
+
+func sampled(rate float64) bool {
+	return rate >= 1 || (rate > 0 && rand.Float64() < rate)
+}
+
+// NewMetricsMiddleware counts requests and measures their durations by
+// method and response status, and counts them by listener, protocol and TLS
+// parameters to track clients' adoption of newer protocols.
+func NewMetricsMiddleware() Middleware {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := newStatusWriter(w, nil)
+			start := time.Now()
+
+			handler.ServeHTTP(sw, r)
+
+			RequestDurationSecondsMetric.WithLabelValues(
+				r.Method,
+				strconv.Itoa(sw.statusCode()),
+			).Observe(time.Since(start).Seconds())
+
+			info := RequestConnectionInfo(r)
+			RequestProtocolCountMetric.WithLabelValues(
+				info.Listener,
+				info.Protocol,
+				info.TLSVersion,
+				info.TLSCipher,
+			).Inc()
+		})
+	}
+}
+
+// NewResponseObserverMiddleware calls observe after each response with its
+// status and how long it took to start sending it (or to finish, if nothing
+// was written).
+func NewResponseObserverMiddleware(observe func(status int, latency time.Duration)) Middleware {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			var latency time.Duration
+			sw := newStatusWriter(w, func(http.Header) {
+				latency = time.Since(start)
+			})
+
+			handler.ServeHTTP(sw, r)
+
+			if sw.Status() == 0 {
+				latency = time.Since(start)
+			}
+			observe(sw.statusCode(), latency)
+		})
+	}
+}
+
+// NewBasicAuthMiddleware requires requests to have HTTP basic
+// authentication credentials matching username and password, responding to
+// others with a 401 asking for them.
+func NewBasicAuthMiddleware(username, password, realm string) Middleware {
+	challenge := fmt.Sprintf("Basic realm=%q", realm)
+
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, p, ok := r.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(u), []byte(username)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+				w.Header().Set("WWW-Authenticate", challenge)
+				WriteError(w, r, http.StatusUnauthorized)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NewHeaderMiddleware sets headers on requests before they're handled, and
+// on responses before they're sent. In each, a header with an empty value is
+// removed instead.
+func NewHeaderMiddleware(requestHeaders, responseHeaders map[string]string) Middleware {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(requestHeaders) > 0 {
+				r2 := new(http.Request)
+				*r2 = *r
+				r2.Header = r.Header.Clone()
+				setHeaders(r2.Header, requestHeaders)
+				r = r2
+			}
+			if len(responseHeaders) > 0 {
+				w = newStatusWriter(w, func(h http.Header) {
+					setHeaders(h, responseHeaders)
+				})
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+func setHeaders(header http.Header, values map[string]string) {
+	for name, value := range values {
+		if value == "" {
+			header.Del(name)
+		} else {
+			header.Set(name, value)
+		}
+	}
+}
+
+// statusWriter records the status and size of a response for middleware.
+type statusWriter struct {
+	ResponseWrapper
+
+	// beforeHeader, if set, is called just before the response header is
+	// written.
+	beforeHeader func(http.Header)
+
+	bytes int64
+}
+
+func newStatusWriter(w http.ResponseWriter, beforeHeader func(http.Header)) *statusWriter {
+	return &statusWriter{ResponseWrapper: ResponseWrapper{ResponseWriter: w}, beforeHeader: beforeHeader}
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.Status() == 0 && w.beforeHeader != nil {
+		w.beforeHeader(w.Header())
+	}
+	w.ResponseWrapper.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.Status() == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWrapper.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if w.Status() == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.ResponseWrapper.Flush()
+}
+
+// statusCode returns the response status, which is 200 if the handler
+// didn't write anything.
+func (w *statusWriter) statusCode() int {
+	if w.Status() == 0 {
+		return http.StatusOK
+	}
+	return w.Status()
+}
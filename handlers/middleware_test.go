@@ -0,0 +1,306 @@
+package handlers_test
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prommodel "github.com/prometheus/client_model/go"
+
+	"github.com/alphagov/router/handlers"
+	log "github.com/alphagov/router/logger"
+)
+
+var _ = Describe("Middleware", func() {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "yes")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})
+
+	serve := func(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	Describe("Chain", func() {
+		It("should apply middleware with the first outermost", func() {
+			var order []string
+			named := func(name string) handlers.Middleware {
+				return func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						order = append(order, name)
+						next.ServeHTTP(w, r)
+					})
+				}
+			}
+
+			handler := handlers.Chain(named("first"), named("second"))(ok)
+			serve(handler, httptest.NewRequest("GET", "/", nil))
+			Expect(order).To(Equal([]string{"first", "second"}))
+		})
+
+		It("should leave the handler alone if there's no middleware", func() {
+			rw := serve(handlers.Chain()(ok), httptest.NewRequest("GET", "/", nil))
+			Expect(rw.Code).To(Equal(http.StatusTeapot))
+		})
+	})
+
+	Describe("access logging", func() {
+		It("should log each request and its response", func() {
+			var buf syncBuffer
+			l, err := log.New(&buf)
+			Expect(err).NotTo(HaveOccurred())
+
+			req := httptest.NewRequest("GET", "/foo?bar", nil)
+			serve(handlers.NewAccessLogMiddleware(l)(ok), req)
+
+			Eventually(buf.Len).Should(BeNumerically(">", 0))
+			var entry struct {
+				Fields map[string]interface{} `json:"@fields"`
+			}
+			Expect(json.Unmarshal(buf.Bytes(), &entry)).To(Succeed())
+			Expect(entry.Fields).To(HaveKeyWithValue("status", BeNumerically("==", http.StatusTeapot)))
+			Expect(entry.Fields).To(HaveKeyWithValue("bytes_sent", BeNumerically("==", 15)))
+			Expect(entry.Fields).To(HaveKeyWithValue("request", "GET /foo?bar HTTP/1.1"))
+			Expect(entry.Fields).To(HaveKeyWithValue("protocol", "HTTP/1.1"))
+			Expect(entry.Fields).To(HaveKeyWithValue("client_ip", "192.0.2.1"))
+			Expect(entry.Fields).NotTo(HaveKey("tls_version"))
+		})
+
+		It("should log the listener and TLS parameters", func() {
+			var buf syncBuffer
+			l, err := log.New(&buf)
+			Expect(err).NotTo(HaveOccurred())
+
+			req := httptest.NewRequest("GET", "https://www.gov.uk/", nil)
+			req.TLS.Version = tls.VersionTLS13
+			req.TLS.CipherSuite = tls.TLS_AES_128_GCM_SHA256
+			serve(handlers.Chain(handlers.NewListenerMiddleware("proxy"), handlers.NewAccessLogMiddleware(l))(ok), req)
+
+			Eventually(buf.Len).Should(BeNumerically(">", 0))
+			var entry struct {
+				Fields map[string]interface{} `json:"@fields"`
+			}
+			Expect(json.Unmarshal(buf.Bytes(), &entry)).To(Succeed())
+			Expect(entry.Fields).To(HaveKeyWithValue("listener", "proxy"))
+			Expect(entry.Fields).To(HaveKeyWithValue("tls_version", "TLS 1.3"))
+			Expect(entry.Fields).To(HaveKeyWithValue("tls_cipher", "TLS_AES_128_GCM_SHA256"))
+		})
+
+		It("should only log the sampled requests", func() {
+			var buf syncBuffer
+			l, err := log.New(&buf)
+			Expect(err).NotTo(HaveOccurred())
+			logging := handlers.NewSampledAccessLogMiddleware(l, 0)
+
+			rw := serve(logging(ok), httptest.NewRequest("GET", "/unsampled", nil))
+			Expect(rw.Code).To(Equal(http.StatusTeapot))
+
+			sampleAll := handlers.NewLogSampleRateMiddleware(func() float64 { return 1 })
+			serve(handlers.Chain(sampleAll, logging)(ok), httptest.NewRequest("GET", "/sampled", nil))
+
+			Eventually(buf.String).Should(ContainSubstring("/sampled"))
+			Expect(buf.String()).NotTo(ContainSubstring("/unsampled"))
+		})
+	})
+
+	Describe("response observer", func() {
+		It("should observe each response's status", func() {
+			var statuses []int
+			observer := handlers.NewResponseObserverMiddleware(func(status int, latency time.Duration) {
+				statuses = append(statuses, status)
+				Expect(latency).To(BeNumerically(">=", 0))
+			})
+
+			serve(observer(ok), httptest.NewRequest("GET", "/", nil))
+			serve(observer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})), httptest.NewRequest("GET", "/", nil))
+			Expect(statuses).To(Equal([]int{http.StatusTeapot, http.StatusOK}))
+		})
+	})
+
+	Describe("basic authentication", func() {
+		handler := handlers.NewBasicAuthMiddleware("user", "secret", "GOV.UK")(ok)
+
+		It("should reject requests without credentials", func() {
+			rw := serve(handler, httptest.NewRequest("GET", "/", nil))
+			Expect(rw.Code).To(Equal(http.StatusUnauthorized))
+			Expect(rw.Header().Get("WWW-Authenticate")).To(Equal(`Basic realm="GOV.UK"`))
+		})
+
+		It("should reject requests with the wrong credentials", func() {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.SetBasicAuth("user", "wrong")
+			Expect(serve(handler, req).Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should pass on requests with the right credentials", func() {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.SetBasicAuth("user", "secret")
+			Expect(serve(handler, req).Code).To(Equal(http.StatusTeapot))
+		})
+	})
+
+	Describe("header manipulation", func() {
+		It("should set and remove request and response headers", func() {
+			var received http.Header
+			handler := handlers.NewHeaderMiddleware(
+				map[string]string{"X-Added": "1", "X-Removed": ""},
+				map[string]string{"X-Frame-Options": "DENY", "X-Backend": ""},
+			)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.Header
+				ok.ServeHTTP(w, r)
+			}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Removed", "1")
+			rw := serve(handler, req)
+
+			Expect(received.Get("X-Added")).To(Equal("1"))
+			Expect(received).NotTo(HaveKey("X-Removed"))
+			Expect(req.Header.Get("X-Removed")).To(Equal("1"), "the original request shouldn't be modified")
+			Expect(rw.Header().Get("X-Frame-Options")).To(Equal("DENY"))
+			Expect(rw.Header()).NotTo(HaveKey("X-Backend"))
+		})
+	})
+
+	Describe("rate limiting", func() {
+		It("should reject requests from clients over the limit", func() {
+			handler := handlers.NewRateLimitMiddleware(handlers.RateLimit{Rate: 1, Burst: 2})(ok)
+			request := func(client string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("X-Forwarded-For", client)
+				return serve(handler, req)
+			}
+
+			Expect(request("192.0.2.1").Code).To(Equal(http.StatusTeapot))
+			Expect(request("192.0.2.1").Code).To(Equal(http.StatusTeapot))
+
+			rw := request("192.0.2.1")
+			Expect(rw.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(rw.Header().Get("Retry-After")).To(Equal("1"))
+
+			Expect(request("192.0.2.2").Code).To(Equal(http.StatusTeapot))
+		})
+	})
+
+	Describe("ClientIP", func() {
+		It("should use the last address in X-Forwarded-For", func() {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Add("X-Forwarded-For", "203.0.113.1, 198.51.100.1")
+			req.Header.Add("X-Forwarded-For", "192.0.2.1, 192.0.2.2")
+			Expect(handlers.ClientIP(req)).To(Equal("192.0.2.2"))
+		})
+
+		It("should otherwise use the connection's address", func() {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "192.0.2.3:54321"
+			Expect(handlers.ClientIP(req)).To(Equal("192.0.2.3"))
+		})
+
+		Context("with trusted proxies", func() {
+			BeforeEach(func() {
+				var err error
+				handlers.TrustedProxies, err = handlers.ParseNetworks([]string{"10.0.0.0/8", "192.0.2.2"})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				handlers.TrustedProxies = nil
+			})
+
+			It("should use the rightmost address which isn't a trusted proxy", func() {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Add("X-Forwarded-For", "203.0.113.1, 198.51.100.1")
+				req.Header.Add("X-Forwarded-For", "10.1.2.3, 192.0.2.2")
+				Expect(handlers.ClientIP(req)).To(Equal("198.51.100.1"))
+			})
+
+			It("should use the leftmost address if they're all trusted", func() {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Add("X-Forwarded-For", "10.1.2.3, 192.0.2.2")
+				Expect(handlers.ClientIP(req)).To(Equal("10.1.2.3"))
+			})
+		})
+
+		Context("with other sources", func() {
+			AfterEach(func() {
+				handlers.ClientIPSource = handlers.ClientIPForwardedFor
+			})
+
+			It("should use the CDN's client IP header", func() {
+				handlers.ClientIPSource = handlers.ClientIPHeader
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("X-Forwarded-For", "192.0.2.2")
+				req.Header.Set("True-Client-IP", "203.0.113.9")
+				Expect(handlers.ClientIP(req)).To(Equal("203.0.113.9"))
+
+				req.Header.Del("True-Client-IP")
+				req.RemoteAddr = "192.0.2.3:54321"
+				Expect(handlers.ClientIP(req)).To(Equal("192.0.2.3"))
+			})
+
+			It("should use the connection's address", func() {
+				handlers.ClientIPSource = handlers.ClientIPSocket
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("X-Forwarded-For", "192.0.2.2")
+				req.RemoteAddr = "192.0.2.3:54321"
+				Expect(handlers.ClientIP(req)).To(Equal("192.0.2.3"))
+			})
+
+			It("should be used for rate limiting", func() {
+				handlers.ClientIPSource = handlers.ClientIPHeader
+				limited := handlers.NewRateLimitMiddleware(handlers.RateLimit{Rate: 0, Burst: 1})(ok)
+				request := func(client string) int {
+					req := httptest.NewRequest("GET", "/", nil)
+					req.Header.Set("True-Client-IP", client)
+					return serve(limited, req).Code
+				}
+				Expect(request("203.0.113.1")).To(Equal(http.StatusTeapot))
+				Expect(request("203.0.113.1")).To(Equal(http.StatusTooManyRequests))
+				Expect(request("203.0.113.2")).To(Equal(http.StatusTeapot))
+			})
+		})
+	})
+
+	It("should count requests and their durations", func() {
+		measureCount := func() uint64 {
+			metric := new(prommodel.Metric)
+			observer := handlers.RequestDurationSecondsMetric.WithLabelValues("DELETE", "200")
+			Expect(observer.(prometheus.Metric).Write(metric)).To(Succeed())
+			return metric.Histogram.GetSampleCount()
+		}
+		before := measureCount()
+
+		handler := handlers.NewMetricsMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		serve(handler, httptest.NewRequest("DELETE", "/", nil))
+
+		Expect(measureCount()).To(Equal(before + 1))
+	})
+
+	It("should count requests by listener and protocol", func() {
+		measureCount := func() float64 {
+			metric := new(prommodel.Metric)
+			counter := handlers.RequestProtocolCountMetric.WithLabelValues("proxy-1", "HTTP/2.0", "TLS 1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+			Expect(counter.Write(metric)).To(Succeed())
+			return metric.Counter.GetValue()
+		}
+		before := measureCount()
+
+		req := httptest.NewRequest("GET", "https://www.gov.uk/", nil)
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+		req.TLS.Version = tls.VersionTLS12
+		req.TLS.CipherSuite = tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+		handler := handlers.Chain(handlers.NewListenerMiddleware("proxy-1"), handlers.NewMetricsMiddleware())(ok)
+		serve(handler, req)
+
+		Expect(measureCount()).To(Equal(before + 1))
+	})
+})
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// OriginalURLHeader and ForwardedURIHeader both carry the path and query
+	// string of the request as the router received it, before any prefix was
+	// stripped. Different frameworks look for different names.
+	OriginalURLHeader  = "X-Original-URL"
+	ForwardedURIHeader = "X-Forwarded-Uri"
+
+	// ForwardedPortHeader carries the port the client connected to.
+	ForwardedPortHeader = "X-Forwarded-Port"
+)
+
+// SetOriginalURLHeaders records the request's original URL in headers which
+// are passed on to backends, so that a backend behind prefix stripping or
+// host rewriting can still reconstruct the public URL of a page.
+//
+// The URL headers are always overwritten, since the router is the first
+// thing which might change the path. X-Forwarded-Port is kept if a proxy in
+// front of the router has set it, in the same way as X-Forwarded-Host, and
+// is otherwise taken from the Host header or the port the router is
+// listening on.
+func SetOriginalURLHeaders(req *http.Request) {
+	uri := req.RequestURI
+	if !strings.HasPrefix(uri, "/") {
+		// Absolute-form ("GET http://host/path"), or a request which didn't
+		// come from a server.
+		uri = req.URL.RequestURI()
+	}
+	req.Header.Set(OriginalURLHeader, uri)
+	req.Header.Set(ForwardedURIHeader, uri)
+
+	if req.Header.Get(ForwardedPortHeader) == "" {
+		if port := requestPort(req); port != "" {
+			req.Header.Set(ForwardedPortHeader, port)
+		}
+	}
+}
+
+func requestPort(req *http.Request) string {
+	if _, port, err := net.SplitHostPort(req.Host); err == nil {
+		return port
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	return ""
+}
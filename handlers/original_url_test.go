@@ -0,0 +1,64 @@
+package handlers_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Original URL headers", func() {
+	It("should record the original path and query string", func() {
+		req := httptest.NewRequest("GET", "/foo/bar%2Fbaz?qux=quux", nil)
+		handlers.SetOriginalURLHeaders(req)
+
+		Expect(req.Header.Get(handlers.OriginalURLHeader)).To(Equal("/foo/bar%2Fbaz?qux=quux"))
+		Expect(req.Header.Get(handlers.ForwardedURIHeader)).To(Equal("/foo/bar%2Fbaz?qux=quux"))
+	})
+
+	It("should record only the path and query string of an absolute-form request", func() {
+		req := httptest.NewRequest("GET", "http://www.example.com/foo?bar", nil)
+		handlers.SetOriginalURLHeaders(req)
+
+		Expect(req.Header.Get(handlers.OriginalURLHeader)).To(Equal("/foo?bar"))
+	})
+
+	It("should overwrite URL headers sent by the client", func() {
+		req := httptest.NewRequest("GET", "/foo", nil)
+		req.Header.Set(handlers.OriginalURLHeader, "/admin")
+		handlers.SetOriginalURLHeaders(req)
+
+		Expect(req.Header.Get(handlers.OriginalURLHeader)).To(Equal("/foo"))
+	})
+
+	It("should take the port from the Host header", func() {
+		req := httptest.NewRequest("GET", "/foo", nil)
+		req.Host = "www.example.com:8443"
+		handlers.SetOriginalURLHeaders(req)
+
+		Expect(req.Header.Get(handlers.ForwardedPortHeader)).To(Equal("8443"))
+	})
+
+	It("should otherwise take the port the router is listening on", func() {
+		req := httptest.NewRequest("GET", "/foo", nil)
+		addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, addr))
+		handlers.SetOriginalURLHeaders(req)
+
+		Expect(req.Header.Get(handlers.ForwardedPortHeader)).To(Equal("8080"))
+	})
+
+	It("should keep an X-Forwarded-Port header set in front of the router", func() {
+		req := httptest.NewRequest("GET", "/foo", nil)
+		req.Host = "www.example.com:8443"
+		req.Header.Set(handlers.ForwardedPortHeader, "443")
+		handlers.SetOriginalURLHeaders(req)
+
+		Expect(req.Header.Get(handlers.ForwardedPortHeader)).To(Equal("443"))
+	})
+})
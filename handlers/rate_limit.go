@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit limits how many requests each client can make, using a token
+// bucket: each client can make Burst requests at once, and after that Rate
+// requests per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+
+	// Rules, if set, returns the current client rules (or nil if there
+	// aren't any), which block some clients and override the rate limit
+	// for others.
+	Rules func() *ClientRules
+}
+
+// NewRateLimitMiddleware rejects requests from clients which have gone over
+// the rate limit with a 429 response, and those which are blocked with a
+// 403. Clients are identified by ClientIP.
+func NewRateLimitMiddleware(config RateLimit) Middleware {
+	limiter := newRateLimiter(config)
+
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := ClientIP(r)
+			limit := config
+			if config.Rules != nil {
+				if rules := config.Rules(); rules != nil {
+					if rules.Blocked(client) {
+						BlockedRequestCountMetric.Inc()
+						WriteError(w, r, http.StatusForbidden)
+						return
+					}
+					if override, ok := rules.RateLimit(client); ok {
+						limit = override
+					}
+				}
+			}
+
+			if ok, retryAfter := limiter.allowWithin(client, limit); !ok {
+				RateLimitedRequestCountMetric.Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				WriteError(w, r, http.StatusTooManyRequests)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitSweepInterval is how often buckets which have refilled, and so
+// are no different from new ones, are forgotten.
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   RateLimit
+}
+
+type rateLimiter struct {
+	config RateLimit
+	now    func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(config RateLimit) *rateLimiter {
+	return &rateLimiter{
+		config:  config,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the client's bucket if there is one. Otherwise it
+// returns how long it'll be until there is.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	return l.allowWithin(client, l.config)
+}
+
+// allowWithin is like allow, but applies limit to the client instead of the
+// limiter's own limit.
+func (l *rateLimiter) allowWithin(client string, limit RateLimit) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now, limit: limit}
+		l.buckets[client] = bucket
+	}
+	l.refill(bucket, now)
+	if bucket.limit.Rate != limit.Rate || bucket.limit.Burst != limit.Burst {
+		// The client's limit has changed, so it gets a bucket of the new
+		// size, with no more tokens than it had.
+		bucket.limit = limit
+		bucket.tokens = math.Min(bucket.tokens, float64(limit.Burst))
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	if limit.Rate <= 0 {
+		return false, time.Hour
+	}
+	return false, time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+}
+
+func (l *rateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.tokens = math.Min(float64(bucket.limit.Burst), bucket.tokens+elapsed*bucket.limit.Rate)
+	bucket.updated = now
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for client, bucket := range l.buckets {
+		l.refill(bucket, now)
+		if bucket.tokens >= float64(bucket.limit.Burst) {
+			delete(l.buckets, client)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate limiter", func() {
+	var (
+		limiter *rateLimiter
+		now     time.Time
+	)
+
+	BeforeEach(func() {
+		now = time.Date(2021, time.March, 15, 8, 0, 0, 0, time.UTC)
+		limiter = newRateLimiter(RateLimit{Rate: 2, Burst: 3})
+		limiter.now = func() time.Time { return now }
+	})
+
+	allowed := func(client string, n int) int {
+		count := 0
+		for i := 0; i < n; i++ {
+			if ok, _ := limiter.allow(client); ok {
+				count++
+			}
+		}
+		return count
+	}
+
+	It("should allow a burst of requests and then limit them", func() {
+		Expect(allowed("a", 5)).To(Equal(3))
+
+		ok, retryAfter := limiter.allow("a")
+		Expect(ok).To(BeFalse())
+		Expect(retryAfter).To(Equal(500 * time.Millisecond))
+	})
+
+	It("should refill buckets over time", func() {
+		allowed("a", 3)
+		now = now.Add(time.Second)
+		Expect(allowed("a", 5)).To(Equal(2))
+
+		now = now.Add(time.Hour)
+		Expect(allowed("a", 5)).To(Equal(3), "buckets shouldn't fill beyond the burst")
+	})
+
+	It("should limit each client separately", func() {
+		allowed("a", 3)
+		Expect(allowed("b", 3)).To(Equal(3))
+	})
+
+	It("should forget clients whose buckets have refilled", func() {
+		allowed("a", 3)
+		now = now.Add(time.Second)
+		allowed("b", 1)
+		Expect(limiter.buckets).To(HaveLen(2))
+
+		now = now.Add(rateLimitSweepInterval)
+		allowed("c", 1)
+		Expect(limiter.buckets).To(HaveLen(1))
+		Expect(limiter.buckets).To(HaveKey("c"))
+	})
+
+	It("should resize a client's bucket when its limit changes", func() {
+		Expect(allowed("a", 2)).To(Equal(2))
+
+		ok, _ := limiter.allowWithin("a", RateLimit{Rate: 2, Burst: 10})
+		Expect(ok).To(BeTrue(), "the client should keep its remaining token")
+		ok, retryAfter := limiter.allowWithin("a", RateLimit{Rate: 4, Burst: 10})
+		Expect(ok).To(BeFalse())
+		Expect(retryAfter).To(Equal(250 * time.Millisecond))
+
+		now = now.Add(time.Hour)
+		Expect(allowed("a", 5)).To(Equal(3), "the original limit should apply again")
+	})
+})
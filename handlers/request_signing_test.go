@@ -0,0 +1,99 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+	log "github.com/alphagov/router/logger"
+)
+
+var _ = Describe("Request signing", func() {
+	var (
+		key = []byte("signing-key")
+		now = time.Date(2021, time.March, 12, 8, 0, 0, 0, time.UTC)
+	)
+
+	signed := func() *http.Request {
+		req := httptest.NewRequest("GET", "http://backend.example.com/foo?bar=baz", nil)
+		handlers.SignRequest(req, key, "key-1", now)
+		return req
+	}
+
+	It("should add a timestamp and signature", func() {
+		req := signed()
+		Expect(req.Header.Get(handlers.SignatureTimestampHeader)).To(Equal("1615536000"))
+		Expect(req.Header.Get(handlers.SignatureHeader)).To(HavePrefix("v1="))
+		Expect(req.Header.Get(handlers.SignatureKeyIDHeader)).To(Equal("key-1"))
+
+		Expect(handlers.VerifyRequestSignature(req, key, time.Minute, now.Add(30*time.Second))).To(Succeed())
+	})
+
+	It("should reject requests which have been changed", func() {
+		req := signed()
+		req.URL.RawQuery = "bar=qux"
+		Expect(handlers.VerifyRequestSignature(req, key, time.Minute, now)).To(MatchError("signature doesn't match"))
+
+		req = signed()
+		req.Method = "POST"
+		Expect(handlers.VerifyRequestSignature(req, key, time.Minute, now)).To(MatchError("signature doesn't match"))
+
+		req = signed()
+		req.Host = "other.example.com"
+		Expect(handlers.VerifyRequestSignature(req, key, time.Minute, now)).To(MatchError("signature doesn't match"))
+	})
+
+	It("should reject other keys and old or missing signatures", func() {
+		Expect(handlers.VerifyRequestSignature(signed(), []byte("other"), time.Minute, now)).To(HaveOccurred())
+		Expect(handlers.VerifyRequestSignature(signed(), key, time.Minute, now.Add(2*time.Minute))).
+			To(MatchError(ContainSubstring("timestamp")))
+
+		req := httptest.NewRequest("GET", "/foo", nil)
+		Expect(handlers.VerifyRequestSignature(req, key, time.Minute, now)).To(HaveOccurred())
+	})
+
+	Context("when proxying requests", func() {
+		var (
+			backend  *httptest.Server
+			received *http.Request
+		)
+
+		BeforeEach(func() {
+			handlers.RequestSigningKey = key
+			backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r
+				w.WriteHeader(http.StatusOK)
+			}))
+		})
+
+		AfterEach(func() {
+			handlers.RequestSigningKey = nil
+			backend.Close()
+		})
+
+		It("should sign each request, replacing any signature from the client", func() {
+			logger, err := log.New(GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			backendURL, err := url.Parse(backend.URL)
+			Expect(err).NotTo(HaveOccurred())
+
+			handler := handlers.NewBackendHandler("signed", backendURL, time.Second, time.Second, logger, handlers.BackendOptions{})
+
+			req := httptest.NewRequest("GET", "http://www.example.com/foo?bar=baz", nil)
+			req.Header.Set(handlers.SignatureHeader, "v1=forged")
+			req.Header.Set(handlers.SignatureKeyIDHeader, "forged")
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(received.Header).NotTo(HaveKey(handlers.SignatureKeyIDHeader))
+			Expect(handlers.VerifyRequestSignature(received, key, time.Minute, time.Now())).To(Succeed())
+			Expect(req.Header.Get(handlers.SignatureHeader)).To(Equal("v1=forged"))
+		})
+	})
+})
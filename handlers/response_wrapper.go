@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ResponseWrapper is embedded by response writers which wrap another to
+// watch or change a response. It records the response's status and passes
+// on flushes, so that streamed responses still work, and hijacking, so that
+// upgraded connections such as websockets do. Types embedding it which
+// override WriteHeader or Write should call its methods to write through.
+type ResponseWrapper struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *ResponseWrapper) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *ResponseWrapper) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *ResponseWrapper) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over to the handler, after which the
+// response's status is 101 Switching Protocols if nothing had been written.
+func (w *ResponseWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("handlers: %T doesn't support hijacking", w.ResponseWriter)
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// Status returns the response's status, or 0 if nothing has been written.
+func (w *ResponseWrapper) Status() int {
+	return w.status
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RetryBudget limits how many requests to a backend can be retried (or
+// hedged), so that when a backend is struggling the router doesn't make
+// things worse by multiplying the load on it.
+type RetryBudget struct {
+	// Percent is the most requests that can be retried, as a percentage of
+	// the requests made in the same window.
+	Percent float64
+
+	// Window is the period over which requests and retries are counted.
+	Window time.Duration
+
+	// MinRetries is the number of retries allowed in each window regardless
+	// of Percent, so that backends with little traffic can still be retried.
+	MinRetries int
+}
+
+// retryBudget tracks the requests and retries made to a backend in the
+// current window.
+type retryBudget struct {
+	backendID string
+	config    RetryBudget
+	now       func() time.Time
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func newRetryBudget(backendID string, config RetryBudget) *retryBudget {
+	return &retryBudget{
+		backendID: backendID,
+		config:    config,
+		now:       time.Now,
+	}
+}
+
+func (b *retryBudget) recordRequest() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rollWindow()
+	b.requests++
+	b.updateMetric()
+}
+
+// spend reports whether a retry is allowed and if so, counts it against the
+// budget.
+func (b *retryBudget) spend() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rollWindow()
+	if b.retries >= b.allowed() {
+		BackendHandlerRetryBudgetExhaustedCountMetric.With(prometheus.Labels{
+			"backend_id": b.backendID,
+		}).Inc()
+		return false
+	}
+	b.retries++
+	b.updateMetric()
+	return true
+}
+
+func (b *retryBudget) allowed() int {
+	allowed := int(float64(b.requests) * b.config.Percent / 100)
+	if allowed < b.config.MinRetries {
+		return b.config.MinRetries
+	}
+	return allowed
+}
+
+func (b *retryBudget) rollWindow() {
+	now := b.now()
+	if now.Sub(b.windowStart) >= b.config.Window {
+		b.windowStart = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+func (b *retryBudget) updateMetric() {
+	used := 1.0
+	if allowed := b.allowed(); allowed > 0 {
+		used = float64(b.retries) / float64(allowed)
+	}
+	BackendHandlerRetryBudgetUsedRatioMetric.With(prometheus.Labels{
+		"backend_id": b.backendID,
+	}).Set(used)
+}
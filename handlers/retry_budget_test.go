@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Retry budget", func() {
+	var (
+		budget *retryBudget
+		now    time.Time
+	)
+
+	makeRequests := func(n int) {
+		for i := 0; i < n; i++ {
+			budget.recordRequest()
+		}
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2021, time.March, 12, 8, 0, 0, 0, time.UTC)
+		budget = newRetryBudget("backend-budget", RetryBudget{Percent: 10, Window: 10 * time.Second, MinRetries: 1})
+		budget.now = func() time.Time { return now }
+	})
+
+	It("should allow retries up to the percentage of requests in the window", func() {
+		makeRequests(30)
+
+		Expect(budget.spend()).To(BeTrue())
+		Expect(budget.spend()).To(BeTrue())
+		Expect(budget.spend()).To(BeTrue())
+		Expect(budget.spend()).To(BeFalse())
+	})
+
+	It("should allow the minimum number of retries when there are few requests", func() {
+		makeRequests(2)
+
+		Expect(budget.spend()).To(BeTrue())
+		Expect(budget.spend()).To(BeFalse())
+	})
+
+	It("should start a new budget in each window", func() {
+		makeRequests(10)
+		Expect(budget.spend()).To(BeTrue())
+		Expect(budget.spend()).To(BeFalse())
+
+		now = now.Add(10 * time.Second)
+		makeRequests(10)
+		Expect(budget.spend()).To(BeTrue())
+	})
+
+	It("should report how much of the budget has been used", func() {
+		makeRequests(40)
+		budget.spend()
+
+		Expect(promtest.ToFloat64(BackendHandlerRetryBudgetUsedRatioMetric.With(prometheus.Labels{
+			"backend_id": "backend-budget",
+		}))).To(Equal(0.25))
+	})
+})
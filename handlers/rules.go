@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Rule is a transformation applied to requests which match all of its
+// conditions. Conditions which are left empty match every request.
+type Rule struct {
+	Name    string      `json:"name"`
+	Match   RuleMatch   `json:"match"`
+	Actions RuleActions `json:"actions"`
+}
+
+// RuleMatch is the set of conditions a request must meet for a rule to
+// apply to it.
+type RuleMatch struct {
+	// Path matches the request path exactly, and PathPrefix matches it and
+	// any path below it. PathRegexp must match the whole path, and the
+	// groups it captures can be used in RuleActions.RewritePath and
+	// RuleActions.Redirect as $1, ${name} and so on.
+	Path       string `json:"path"`
+	PathPrefix string `json:"path_prefix"`
+	PathRegexp string `json:"path_regexp"`
+
+	Methods []string          `json:"methods"`
+	Host    string            `json:"host"`
+	Headers map[string]string `json:"headers"`
+	Query   map[string]string `json:"query"`
+}
+
+// RuleActions is what a rule does to the requests it matches. Headers are
+// set first and then the path is rewritten. A rule with a redirect or a
+// status then responds itself, and no later rules are applied.
+type RuleActions struct {
+	SetRequestHeaders  map[string]string `json:"set_request_headers"`
+	SetResponseHeaders map[string]string `json:"set_response_headers"`
+	RewritePath        string            `json:"rewrite_path"`
+	Redirect           string            `json:"redirect"`
+	RedirectType       string            `json:"redirect_type"`
+	Status             int               `json:"status"`
+}
+
+// RuleSet is a list of rules, applied in order.
+type RuleSet struct {
+	rules []*compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	pathRegexp     *regexp.Regexp
+	redirectStatus int
+}
+
+// ParseRules parses a JSON object with a "rules" list, as described for
+// Rule, checking that each rule is valid.
+func ParseRules(data []byte) (*RuleSet, error) {
+	var config struct {
+		Rules []Rule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return NewRuleSet(config.Rules)
+}
+
+// NewRuleSet checks rules and prepares them to be applied.
+func NewRuleSet(rules []Rule) (*RuleSet, error) {
+	rs := &RuleSet{rules: make([]*compiledRule, 0, len(rules))}
+	for i, rule := range rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			name := rule.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("rule %s: %v", name, err)
+		}
+		rs.rules = append(rs.rules, compiled)
+	}
+	return rs, nil
+}
+
+func compileRule(rule Rule) (*compiledRule, error) {
+	c := &compiledRule{Rule: rule}
+	m, a := rule.Match, rule.Actions
+
+	if m.PathRegexp != "" {
+		re, err := regexp.Compile("^(?:" + m.PathRegexp + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid path_regexp: %v", err)
+		}
+		c.pathRegexp = re
+	}
+
+	if a.RewritePath != "" && !strings.HasPrefix(a.RewritePath, "/") {
+		return nil, fmt.Errorf("rewrite_path must start with /")
+	}
+	if a.Redirect != "" && a.Status != 0 {
+		return nil, fmt.Errorf("can't both redirect and set a status")
+	}
+	switch a.RedirectType {
+	case "", "permanent":
+		c.redirectStatus = http.StatusMovedPermanently
+	case "temporary":
+		c.redirectStatus = http.StatusFound
+	default:
+		return nil, fmt.Errorf("redirect_type must be permanent or temporary")
+	}
+	if a.Status != 0 && (a.Status < 400 || a.Status > 599) {
+		return nil, fmt.Errorf("status must be between 400 and 599")
+	}
+	if len(a.SetRequestHeaders) == 0 && len(a.SetResponseHeaders) == 0 &&
+		a.RewritePath == "" && a.Redirect == "" && a.Status == 0 {
+		return nil, fmt.Errorf("no actions")
+	}
+
+	return c, nil
+}
+
+// Len returns the number of rules in the set.
+func (rs *RuleSet) Len() int {
+	return len(rs.rules)
+}
+
+// Middleware applies the rules to each request before passing it on to
+// handler, unless a rule responds to it. It can be used as a Middleware.
+func (rs *RuleSet) Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var responseHeaders []map[string]string
+
+		for _, rule := range rs.rules {
+			captures, ok := rule.matches(r)
+			if !ok {
+				continue
+			}
+			RuleMatchCountMetric.WithLabelValues(rule.Name).Inc()
+
+			a, path := rule.Actions, r.URL.Path
+			if len(a.SetRequestHeaders) > 0 || a.RewritePath != "" {
+				r = cloneRequest(r)
+				setHeaders(r.Header, a.SetRequestHeaders)
+				if a.RewritePath != "" {
+					r.URL.Path = rule.expand(a.RewritePath, path, captures)
+					r.URL.RawPath = ""
+				}
+			}
+			if len(a.SetResponseHeaders) > 0 {
+				responseHeaders = append(responseHeaders, a.SetResponseHeaders)
+			}
+
+			if a.Redirect != "" || a.Status != 0 {
+				for _, headers := range responseHeaders {
+					setHeaders(w.Header(), headers)
+				}
+				if a.Redirect != "" {
+					addCacheHeaders(w)
+					http.Redirect(w, r, rule.expand(a.Redirect, path, captures), rule.redirectStatus)
+				} else {
+					WriteError(w, r, a.Status)
+				}
+				return
+			}
+		}
+
+		if len(responseHeaders) > 0 {
+			w = newStatusWriter(w, func(h http.Header) {
+				for _, headers := range responseHeaders {
+					setHeaders(h, headers)
+				}
+			})
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// matches reports whether the rule applies to r, returning the submatch
+// indexes of its path regexp, if it has one.
+func (rule *compiledRule) matches(r *http.Request) ([]int, bool) {
+	m := rule.Match
+	path := r.URL.Path
+
+	if m.Path != "" && path != m.Path {
+		return nil, false
+	}
+	if m.PathPrefix != "" && !pathHasPrefix(path, m.PathPrefix) {
+		return nil, false
+	}
+	if len(m.Methods) > 0 && !containsFold(m.Methods, r.Method) {
+		return nil, false
+	}
+	if m.Host != "" && !strings.EqualFold(stripPort(r.Host), m.Host) {
+		return nil, false
+	}
+	for name, value := range m.Headers {
+		if r.Header.Get(name) != value {
+			return nil, false
+		}
+	}
+	if len(m.Query) > 0 {
+		query := r.URL.Query()
+		for name, value := range m.Query {
+			if query.Get(name) != value {
+				return nil, false
+			}
+		}
+	}
+
+	var captures []int
+	if rule.pathRegexp != nil {
+		if captures = rule.pathRegexp.FindStringSubmatchIndex(path); captures == nil {
+			return nil, false
+		}
+	}
+	return captures, true
+}
+
+// expand substitutes the groups captured by the rule's path regexp into
+// template.
+func (rule *compiledRule) expand(template, path string, captures []int) string {
+	if rule.pathRegexp == nil {
+		return template
+	}
+	return string(rule.pathRegexp.ExpandString(nil, template, path, captures))
+}
+
+// pathHasPrefix reports whether path is prefix or below it, comparing whole
+// segments as prefix routes do.
+func pathHasPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
+
+func cloneRequest(r *http.Request) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	r2.URL = &u
+	r2.Header = r.Header.Clone()
+	return r2
+}
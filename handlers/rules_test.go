@@ -0,0 +1,156 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Rules", func() {
+	var (
+		seen  *http.Request
+		calls int
+	)
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+		calls++
+		w.Header().Set("X-Backend", "yes")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	BeforeEach(func() {
+		seen, calls = nil, 0
+	})
+
+	serve := func(config string, req *http.Request) *httptest.ResponseRecorder {
+		rules, err := handlers.ParseRules([]byte(config))
+		Expect(err).NotTo(HaveOccurred())
+
+		rw := httptest.NewRecorder()
+		rules.Middleware(backend).ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("should pass on requests which don't match any rules", func() {
+		rw := serve(`{"rules": [{"match": {"path": "/foo"}, "actions": {"status": 410}}]}`,
+			httptest.NewRequest("GET", "/bar", nil))
+
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(seen.URL.Path).To(Equal("/bar"))
+	})
+
+	table.DescribeTable("matching requests",
+		func(match string, method, target string, header http.Header, matches bool) {
+			req := httptest.NewRequest(method, target, nil)
+			for name, values := range header {
+				req.Header[name] = values
+			}
+			rw := serve(`{"rules": [{"match": `+match+`, "actions": {"status": 404}}]}`, req)
+
+			if matches {
+				Expect(rw.Code).To(Equal(http.StatusNotFound))
+			} else {
+				Expect(rw.Code).To(Equal(http.StatusOK))
+			}
+		},
+		table.Entry("exact path", `{"path": "/foo"}`, "GET", "/foo", nil, true),
+		table.Entry("exact path below", `{"path": "/foo"}`, "GET", "/foo/bar", nil, false),
+		table.Entry("prefix itself", `{"path_prefix": "/foo"}`, "GET", "/foo", nil, true),
+		table.Entry("prefix below", `{"path_prefix": "/foo"}`, "GET", "/foo/bar", nil, true),
+		table.Entry("prefix of a segment", `{"path_prefix": "/foo"}`, "GET", "/foobar", nil, false),
+		table.Entry("whole regexp", `{"path_regexp": "/foo/[0-9]+"}`, "GET", "/foo/123", nil, true),
+		table.Entry("partial regexp", `{"path_regexp": "/foo/[0-9]+"}`, "GET", "/foo/123/bar", nil, false),
+		table.Entry("method", `{"methods": ["post"]}`, "POST", "/", nil, true),
+		table.Entry("other method", `{"methods": ["POST"]}`, "GET", "/", nil, false),
+		table.Entry("host", `{"host": "example.com"}`, "GET", "http://Example.com:8080/", nil, true),
+		table.Entry("other host", `{"host": "example.com"}`, "GET", "http://www.example.com/", nil, false),
+		table.Entry("header", `{"headers": {"X-Foo": "bar"}}`, "GET", "/", http.Header{"X-Foo": {"bar"}}, true),
+		table.Entry("other header", `{"headers": {"X-Foo": "bar"}}`, "GET", "/", http.Header{"X-Foo": {"baz"}}, false),
+		table.Entry("query", `{"query": {"format": "rss"}}`, "GET", "/?format=rss", nil, true),
+		table.Entry("other query", `{"query": {"format": "rss"}}`, "GET", "/?format=atom", nil, false),
+		table.Entry("several conditions", `{"path_prefix": "/foo", "methods": ["GET"]}`, "POST", "/foo", nil, false),
+	)
+
+	It("should redirect, substituting captured groups", func() {
+		rw := serve(`{"rules": [{
+			"match": {"path_regexp": "/old/(?P<slug>[a-z-]+)"},
+			"actions": {"redirect": "https://example.com/new/${slug}", "redirect_type": "temporary"}
+		}]}`, httptest.NewRequest("GET", "/old/some-page", nil))
+
+		Expect(rw.Code).To(Equal(http.StatusFound))
+		Expect(rw.Header().Get("Location")).To(Equal("https://example.com/new/some-page"))
+		Expect(rw.Header().Get("Cache-Control")).To(ContainSubstring("max-age="))
+		Expect(calls).To(BeZero())
+	})
+
+	It("should redirect permanently by default", func() {
+		rw := serve(`{"rules": [{"match": {"path": "/a"}, "actions": {"redirect": "/b"}}]}`,
+			httptest.NewRequest("GET", "/a", nil))
+
+		Expect(rw.Code).To(Equal(http.StatusMovedPermanently))
+		Expect(rw.Header().Get("Location")).To(Equal("/b"))
+	})
+
+	It("should rewrite paths, keeping the query string", func() {
+		rw := serve(`{"rules": [{
+			"match": {"path_regexp": "/api/v1/(.*)"},
+			"actions": {"rewrite_path": "/api/v2/$1"}
+		}]}`, httptest.NewRequest("GET", "/api/v1/search?q=tax", nil))
+
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(seen.URL.Path).To(Equal("/api/v2/search"))
+		Expect(seen.URL.RawQuery).To(Equal("q=tax"))
+	})
+
+	It("should set request and response headers", func() {
+		req := httptest.NewRequest("GET", "/foo", nil)
+		req.Header.Set("X-Remove-Me", "yes")
+		rw := serve(`{"rules": [{
+			"match": {"path_prefix": "/foo"},
+			"actions": {
+				"set_request_headers": {"X-Rule": "applied", "X-Remove-Me": ""},
+				"set_response_headers": {"X-Frame-Options": "DENY", "X-Backend": ""}
+			}
+		}]}`, req)
+
+		Expect(seen.Header.Get("X-Rule")).To(Equal("applied"))
+		Expect(seen.Header).NotTo(HaveKey("X-Remove-Me"))
+		Expect(req.Header.Get("X-Remove-Me")).To(Equal("yes"))
+		Expect(rw.Header().Get("X-Frame-Options")).To(Equal("DENY"))
+		Expect(rw.Header()).NotTo(HaveKey("X-Backend"))
+	})
+
+	It("should apply each matching rule in turn until one responds", func() {
+		rw := serve(`{"rules": [
+			{"match": {"path": "/a"}, "actions": {"rewrite_path": "/b", "set_response_headers": {"X-First": "yes"}}},
+			{"match": {"path": "/b"}, "actions": {"status": 451}},
+			{"match": {"path": "/b"}, "actions": {"redirect": "/c"}}
+		]}`, httptest.NewRequest("GET", "/a", nil))
+
+		Expect(rw.Code).To(Equal(http.StatusUnavailableForLegalReasons))
+		Expect(rw.Header().Get("X-First")).To(Equal("yes"))
+		Expect(calls).To(BeZero())
+	})
+
+	table.DescribeTable("invalid rules",
+		func(config, message string) {
+			_, err := handlers.ParseRules([]byte(config))
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		table.Entry("bad JSON", `{"rules": [`, "unexpected end"),
+		table.Entry("bad regexp", `{"rules": [{"name": "r", "match": {"path_regexp": "("}, "actions": {"status": 404}}]}`,
+			"rule r: invalid path_regexp"),
+		table.Entry("no actions", `{"rules": [{"match": {"path": "/"}}]}`, "rule #1: no actions"),
+		table.Entry("relative rewrite", `{"rules": [{"actions": {"rewrite_path": "foo"}}]}`, "must start with /"),
+		table.Entry("redirect and status", `{"rules": [{"actions": {"redirect": "/a", "status": 410}}]}`, "can't both"),
+		table.Entry("bad redirect type", `{"rules": [{"actions": {"redirect": "/a", "redirect_type": "sometimes"}}]}`,
+			"redirect_type"),
+		table.Entry("non-error status", `{"rules": [{"actions": {"status": 200}}]}`, "between 400 and 599"),
+	)
+})
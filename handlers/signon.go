@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alphagov/router/logger"
+)
+
+// AuthenticatedUserHeader carries the signon user ID of requests checked
+// by the signon middleware to the backend. Any value sent by the client is
+// removed by RemoveClientHeaders, whether or not the route uses signon.
+const AuthenticatedUserHeader = "X-Govuk-Authenticated-User"
+
+const (
+	signonCheckTimeout = 5 * time.Second
+	signonCacheSize    = 10000
+)
+
+// SignonConfig configures how the signon middleware checks that requests
+// come from a signed-in user.
+type SignonConfig struct {
+	// CookieName is the session cookie set by signon. If CookieSecret is
+	// set, the cookie is checked as described for SignSignonSession.
+	CookieName   string
+	CookieSecret []byte
+
+	// AuthURL, if set, is asked about requests without a valid signed
+	// cookie: it's sent their Cookie and Authorization headers, and should
+	// respond with a 2xx status and the user ID in AuthenticatedUserHeader
+	// if they're signed in, or a 401 or 403 if not. A 2xx without a user ID
+	// is treated as a failed check. Successful checks are remembered for
+	// CacheTTL.
+	AuthURL  string
+	CacheTTL time.Duration
+
+	// LoginURL, if set, is where GET and HEAD requests which aren't signed
+	// in are redirected, with the URL they were for in a "return_to" query
+	// parameter. Other requests get a 401. The URL's host is only taken
+	// from X-Forwarded-Host if the request came from one of the
+	// TrustedProxies, so that it can't send users elsewhere after they
+	// sign in.
+	LoginURL string
+}
+
+type signonSession struct {
+	UserID  string `json:"uid"`
+	Expires int64  `json:"exp"`
+}
+
+// SignSignonSession returns a cookie value for the user which the signon
+// middleware accepts until expires. It's the base64url-encoded JSON object
+// {"uid": userID, "exp": expires as a Unix time}, a ".", and the
+// base64url-encoded HMAC-SHA256 of the first part keyed with secret.
+func SignSignonSession(userID string, expires time.Time, secret []byte) string {
+	payload, _ := json.Marshal(signonSession{UserID: userID, Expires: expires.Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signonMAC(encoded, secret))
+}
+
+func signonMAC(encoded string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// verifySignonSession returns the user ID from a signed cookie value, if
+// it's valid and hasn't expired.
+func verifySignonSession(value string, secret []byte, now time.Time) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !hmac.Equal(sig, signonMAC(value[:i], secret)) {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return "", false
+	}
+	var session signonSession
+	if err := json.Unmarshal(payload, &session); err != nil || session.UserID == "" {
+		return "", false
+	}
+	if now.Unix() >= session.Expires {
+		return "", false
+	}
+	return session.UserID, true
+}
+
+// NewSignonMiddleware only passes on requests from users signed in to
+// signon, as described for SignonConfig, so that draft content isn't
+// public.
+func NewSignonMiddleware(config SignonConfig) Middleware {
+	s := &signonChecker{
+		config: config,
+		client: &http.Client{Timeout: signonCheckTimeout},
+		cache:  make(map[string]signonCacheEntry),
+		now:    time.Now,
+	}
+
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := s.check(r)
+			if err != nil {
+				defer logger.NotifySentry(logger.ReportableError{Error: err, Request: r})
+				WriteError(w, r, http.StatusServiceUnavailable)
+				return
+			}
+			if userID == "" {
+				s.deny(w, r)
+				return
+			}
+
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.Header = r.Header.Clone()
+			r2.Header.Set(AuthenticatedUserHeader, userID)
+			handler.ServeHTTP(w, r2)
+		})
+	}
+}
+
+type signonCacheEntry struct {
+	userID  string
+	expires time.Time
+}
+
+type signonChecker struct {
+	config SignonConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]signonCacheEntry
+	now   func() time.Time
+}
+
+// check returns the ID of the signed-in user making r, or "" if there isn't
+// one. It returns an error if it couldn't find out.
+func (s *signonChecker) check(r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(s.config.CookieName); err == nil && len(s.config.CookieSecret) > 0 {
+		if userID, ok := verifySignonSession(cookie.Value, s.config.CookieSecret, s.now()); ok {
+			return userID, nil
+		}
+	}
+	if s.config.AuthURL == "" {
+		return "", nil
+	}
+
+	cookies, authorization := r.Header.Get("Cookie"), r.Header.Get("Authorization")
+	if cookies == "" && authorization == "" {
+		return "", nil
+	}
+	key := s.cacheKey(cookies, authorization)
+	if userID, ok := s.cached(key); ok {
+		return userID, nil
+	}
+
+	req, err := http.NewRequest("GET", s.config.AuthURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(r.Context())
+	if cookies != "" {
+		req.Header.Set("Cookie", cookies)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	req.Header.Set(OriginalURLHeader, r.Header.Get(OriginalURLHeader))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("signon: couldn't check session: %v", err)
+	}
+	defer closeBody(resp)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		userID := resp.Header.Get(AuthenticatedUserHeader)
+		if userID == "" {
+			return "", fmt.Errorf("signon: session check returned %s without a user ID", resp.Status)
+		}
+		s.remember(key, userID)
+		return userID, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return "", nil
+	default:
+		return "", fmt.Errorf("signon: session check returned %s", resp.Status)
+	}
+}
+
+func (s *signonChecker) cacheKey(cookies, authorization string) string {
+	sum := sha256.Sum256([]byte(cookies + "\n" + authorization))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *signonChecker) cached(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.cache[key]
+	if !ok || !s.now().Before(entry.expires) {
+		return "", false
+	}
+	return entry.userID, true
+}
+
+func (s *signonChecker) remember(key, userID string) {
+	if s.config.CacheTTL <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Rather than tracking which entries are oldest, start again once the
+	// cache is full; it only saves repeated checks for active users.
+	if len(s.cache) >= signonCacheSize {
+		s.cache = make(map[string]signonCacheEntry)
+	}
+	s.cache[key] = signonCacheEntry{userID: userID, expires: s.now().Add(s.config.CacheTTL)}
+}
+
+func (s *signonChecker) deny(w http.ResponseWriter, r *http.Request) {
+	if s.config.LoginURL != "" && (r.Method == "GET" || r.Method == "HEAD") {
+		if login, err := url.Parse(s.config.LoginURL); err == nil {
+			query := login.Query()
+			query.Set("return_to", requestURL(r))
+			login.RawQuery = query.Encode()
+
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, login.String(), http.StatusFound)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	WriteError(w, r, http.StatusUnauthorized)
+}
+
+// requestURL returns the absolute URL a request was for. The host is the
+// request's Host, or the X-Forwarded-Host set by a trusted proxy.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	host := r.Host
+	if forwarded := r.Header.Get(ForwardedHostHeader); forwarded != "" && fromTrustedProxy(r) {
+		host = forwarded
+	}
+	return scheme + "://" + host + r.URL.RequestURI()
+}
@@ -0,0 +1,188 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Signon middleware", func() {
+	var (
+		secret = []byte("draft-secret")
+		user   string
+	)
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = r.Header.Get(handlers.AuthenticatedUserHeader)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	BeforeEach(func() {
+		user = ""
+	})
+
+	serve := func(config handlers.SignonConfig, req *http.Request) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handlers.NewSignonMiddleware(config)(backend).ServeHTTP(rw, req)
+		return rw
+	}
+
+	withCookie := func(value string) *http.Request {
+		req := httptest.NewRequest("GET", "http://draft.example.com/foo?bar=baz", nil)
+		req.AddCookie(&http.Cookie{Name: "signon_session", Value: value})
+		return req
+	}
+
+	Context("with signed cookies", func() {
+		config := handlers.SignonConfig{CookieName: "signon_session", CookieSecret: secret}
+
+		It("should pass on requests with a valid session, identifying the user", func() {
+			req := withCookie(handlers.SignSignonSession("user-1", time.Now().Add(time.Hour), secret))
+			req.Header.Set(handlers.AuthenticatedUserHeader, "spoofed")
+
+			rw := serve(config, req)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(user).To(Equal("user-1"))
+		})
+
+		It("should reject expired sessions", func() {
+			rw := serve(config, withCookie(handlers.SignSignonSession("user-1", time.Now().Add(-time.Second), secret)))
+			Expect(rw.Code).To(Equal(http.StatusUnauthorized))
+			Expect(rw.Header().Get("Cache-Control")).To(Equal("no-store"))
+		})
+
+		It("should reject sessions signed with another secret", func() {
+			rw := serve(config, withCookie(handlers.SignSignonSession("user-1", time.Now().Add(time.Hour), []byte("other"))))
+			Expect(rw.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should reject malformed cookies", func() {
+			Expect(serve(config, withCookie("not-a-session")).Code).To(Equal(http.StatusUnauthorized))
+			Expect(serve(config, withCookie("e30.e30")).Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should reject requests without a session", func() {
+			rw := serve(config, httptest.NewRequest("GET", "/foo", nil))
+			Expect(rw.Code).To(Equal(http.StatusUnauthorized))
+			Expect(user).To(BeEmpty())
+		})
+	})
+
+	Context("with a login URL", func() {
+		config := handlers.SignonConfig{
+			CookieName:   "signon_session",
+			CookieSecret: secret,
+			LoginURL:     "https://signon.example.com/login?app=draft",
+		}
+
+		It("should redirect GET requests to sign in", func() {
+			rw := serve(config, httptest.NewRequest("GET", "http://draft.example.com/foo?bar=baz", nil))
+			Expect(rw.Code).To(Equal(http.StatusFound))
+
+			location, err := url.Parse(rw.Header().Get("Location"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(location.Host).To(Equal("signon.example.com"))
+			Expect(location.Query().Get("app")).To(Equal("draft"))
+			Expect(location.Query().Get("return_to")).To(Equal("http://draft.example.com/foo?bar=baz"))
+		})
+
+		It("should only return to X-Forwarded-Host from a trusted proxy", func() {
+			returnTo := func() string {
+				req := httptest.NewRequest("GET", "http://draft.example.com/foo", nil)
+				req.Header.Set("X-Forwarded-Host", "evil.example.com")
+				location, err := url.Parse(serve(config, req).Header().Get("Location"))
+				Expect(err).NotTo(HaveOccurred())
+				return location.Query().Get("return_to")
+			}
+			Expect(returnTo()).To(Equal("http://draft.example.com/foo"))
+
+			var err error
+			handlers.TrustedProxies, err = handlers.ParseNetworks([]string{"192.0.2.1"})
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { handlers.TrustedProxies = nil }()
+			Expect(returnTo()).To(Equal("http://evil.example.com/foo"))
+		})
+
+		It("should reject other requests", func() {
+			rw := serve(config, httptest.NewRequest("POST", "http://draft.example.com/foo", nil))
+			Expect(rw.Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("with an auth URL", func() {
+		var (
+			auth      *httptest.Server
+			checks    int
+			status    int
+			anonymous bool
+		)
+
+		BeforeEach(func() {
+			checks, status, anonymous = 0, http.StatusOK, false
+			auth = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				checks++
+				if anonymous {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				if c, err := r.Cookie("signon_session"); err == nil && c.Value == "good" {
+					w.Header().Set(handlers.AuthenticatedUserHeader, "user-2")
+					w.WriteHeader(status)
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+			}))
+		})
+
+		AfterEach(func() {
+			auth.Close()
+		})
+
+		config := func(ttl time.Duration) handlers.SignonConfig {
+			return handlers.SignonConfig{CookieName: "signon_session", AuthURL: auth.URL, CacheTTL: ttl}
+		}
+
+		It("should pass on requests the auth URL accepts", func() {
+			rw := serve(config(0), withCookie("good"))
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(user).To(Equal("user-2"))
+		})
+
+		It("should reject requests the auth URL rejects", func() {
+			Expect(serve(config(0), withCookie("bad")).Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should not ask about requests without credentials", func() {
+			Expect(serve(config(0), httptest.NewRequest("GET", "/foo", nil)).Code).To(Equal(http.StatusUnauthorized))
+			Expect(checks).To(BeZero())
+		})
+
+		It("should remember successful checks", func() {
+			middleware := handlers.NewSignonMiddleware(config(time.Minute))(backend)
+			for i := 0; i < 3; i++ {
+				rw := httptest.NewRecorder()
+				middleware.ServeHTTP(rw, withCookie("good"))
+				Expect(rw.Code).To(Equal(http.StatusOK))
+			}
+			Expect(checks).To(Equal(1))
+		})
+
+		It("should fail closed if the auth URL doesn't say who the user is", func() {
+			anonymous = true
+			Expect(serve(config(0), withCookie("good")).Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(user).To(BeEmpty())
+		})
+
+		It("should fail closed if the check fails", func() {
+			status = http.StatusInternalServerError
+			Expect(serve(config(0), withCookie("good")).Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(user).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ForwardedPrefixHeader tells a backend which prefix was stripped from the
+// request path, so that it can still generate links to its public URLs.
+const ForwardedPrefixHeader = "X-Forwarded-Prefix"
+
+// NewStripPrefixHandler returns a handler which removes prefix from the start
+// of the request path before passing the request on to handler, so that
+// "/api/content/foo" with a prefix of "/api/content" is passed on as "/foo".
+//
+// The prefix is removed segment by segment, in the same way as the mux
+// matches prefix routes, so "/api/content" is stripped from "/api//content/foo"
+// but not from "/api/contents". A request for the prefix itself is passed on
+// as "/". Requests which don't start with the prefix are passed on unchanged.
+func NewStripPrefixHandler(prefix string, handler http.Handler) http.Handler {
+	prefixSegments := strings.FieldsFunc(prefix, isSlash)
+	forwardedPrefix := "/" + strings.Join(prefixSegments, "/")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := stripSegments(r.URL.Path, prefixSegments)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = path
+		r2.URL.RawPath = ""
+		if r.URL.RawPath != "" {
+			// Keep the client's encoding of the rest of the path if it
+			// still corresponds to the stripped path.
+			if rawPath, ok := stripSegmentCount(r.URL.RawPath, len(prefixSegments)); ok {
+				if unescaped, err := url.PathUnescape(rawPath); err == nil && unescaped == path {
+					r2.URL.RawPath = rawPath
+				}
+			}
+		}
+		r2.Header = r.Header.Clone()
+		r2.Header.Set(ForwardedPrefixHeader, forwardedPrefix)
+
+		handler.ServeHTTP(w, r2)
+	})
+}
+
+func isSlash(r rune) bool {
+	return r == '/'
+}
+
+// stripSegments removes the given leading segments from path, ignoring empty
+// segments, and returns the rest of the path. It returns false if path
+// doesn't start with those segments.
+func stripSegments(path string, segments []string) (string, bool) {
+	rest := path
+	for _, segment := range segments {
+		rest = strings.TrimLeft(rest, "/")
+		if !strings.HasPrefix(rest, segment) {
+			return path, false
+		}
+		rest = rest[len(segment):]
+		if rest != "" && rest[0] != '/' {
+			return path, false
+		}
+	}
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest, true
+}
+
+// stripSegmentCount removes the first n non-empty segments from path.
+func stripSegmentCount(path string, n int) (string, bool) {
+	rest := path
+	for i := 0; i < n; i++ {
+		rest = strings.TrimLeft(rest, "/")
+		if rest == "" {
+			return path, false
+		}
+		if end := strings.IndexByte(rest, '/'); end >= 0 {
+			rest = rest[end:]
+		} else {
+			rest = ""
+		}
+	}
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest, true
+}
@@ -0,0 +1,53 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Strip prefix handler", func() {
+	var received *http.Request
+
+	handler := handlers.NewStripPrefixHandler("/api/content", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+
+	BeforeEach(func() {
+		received = nil
+	})
+
+	DescribeTable("stripping the prefix",
+		func(requestURI, expectedURI, expectedPrefix string) {
+			req := httptest.NewRequest("GET", requestURI, nil)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			Expect(received).NotTo(BeNil())
+			Expect(received.URL.RequestURI()).To(Equal(expectedURI))
+			Expect(received.Header.Get(handlers.ForwardedPrefixHeader)).To(Equal(expectedPrefix))
+			Expect(req.URL.RequestURI()).To(Equal(requestURI), "the original request shouldn't be modified")
+		},
+		Entry("a path below the prefix", "/api/content/foo", "/foo", "/api/content"),
+		Entry("a deeper path", "/api/content/foo/bar", "/foo/bar", "/api/content"),
+		Entry("the prefix itself", "/api/content", "/", "/api/content"),
+		Entry("the prefix with a trailing slash", "/api/content/", "/", "/api/content"),
+		Entry("a query string", "/api/content/foo?bar=baz", "/foo?bar=baz", "/api/content"),
+		Entry("empty segments", "//api//content/foo", "/foo", "/api/content"),
+		Entry("encoded characters", "/api/content/foo%2Fbar%20baz", "/foo%2Fbar%20baz", "/api/content"),
+		Entry("a path which doesn't start with the prefix", "/api/contents/foo", "/api/contents/foo", ""),
+	)
+
+	It("should replace an X-Forwarded-Prefix header sent by the client", func() {
+		req := httptest.NewRequest("GET", "/api/content/foo", nil)
+		req.Header.Set(handlers.ForwardedPrefixHeader, "/spoofed")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		Expect(received).NotTo(BeNil())
+		Expect(received.Header.Values(handlers.ForwardedPrefixHeader)).To(Equal([]string{"/api/content"}))
+	})
+})
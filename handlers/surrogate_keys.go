@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// SurrogateKeyHeader lists the cache keys a response is tagged with, so that
+// the CDN can purge every response tagged with a key at once.
+const SurrogateKeyHeader = "Surrogate-Key"
+
+// NewSurrogateKeyMiddleware adds keys to the Surrogate-Key header of
+// responses, after any keys the handler sets itself.
+func NewSurrogateKeyMiddleware(keys ...string) Middleware {
+	value := strings.Join(keys, " ")
+
+	return func(handler http.Handler) http.Handler {
+		if value == "" {
+			return handler
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w = newStatusWriter(w, func(h http.Header) {
+				if existing := strings.TrimSpace(h.Get(SurrogateKeyHeader)); existing != "" {
+					h.Set(SurrogateKeyHeader, existing+" "+value)
+				} else {
+					h.Set(SurrogateKeyHeader, value)
+				}
+			})
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Surrogate key middleware", func() {
+	serve := func(handler http.Handler, keys ...string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handlers.NewSurrogateKeyMiddleware(keys...)(handler).ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+		return rw
+	}
+
+	It("should tag responses with the keys", func() {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		})
+		rw := serve(handler, "route:/foo", "backend:frontend")
+		Expect(rw.Header().Get("Surrogate-Key")).To(Equal("route:/foo backend:frontend"))
+		Expect(rw.Body.String()).To(Equal("OK"))
+	})
+
+	It("should keep the keys the handler sets", func() {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Surrogate-Key", "content-id-123")
+			w.WriteHeader(http.StatusNotFound)
+		})
+		rw := serve(handler, "route:/foo")
+		Expect(rw.Code).To(Equal(http.StatusNotFound))
+		Expect(rw.Header().Get("Surrogate-Key")).To(Equal("content-id-123 route:/foo"))
+	})
+})
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// What to do with requests for an unknown host, or with an absolute-form
+// URI such as "GET http://www.gov.uk/ HTTP/1.1", which proxies send.
+const (
+	hostPolicyAllow   = "allow"
+	hostPolicyReject  = "reject"
+	hostPolicyDefault = "default"
+)
+
+// Reasons for rejecting requests under the host policy, which label the
+// router_malformed_requests_total metric along with requestChecks' reasons.
+const (
+	malformedUnknownHost = "unknown_host"
+	malformedAbsoluteURI = "absolute_uri"
+)
+
+// hostPolicy decides what happens to requests whose Host isn't one of the
+// router's host names, and to requests with an absolute-form URI, whose
+// host net/http uses in place of the Host header. Without a policy both are
+// routed as usual, as if they were for a known host.
+type hostPolicy struct {
+	// hostnames are the lower-case host names, without ports, which the
+	// router serves. If there aren't any, every host is known.
+	hostnames map[string]bool
+	// defaultHost is the host unknown hosts are replaced with if
+	// unknownHosts is "default".
+	defaultHost  string
+	unknownHosts string
+	absoluteURIs string
+}
+
+func validHostPolicy(hostnames []string, unknownHosts, absoluteURIs string) error {
+	switch unknownHosts {
+	case "", hostPolicyAllow:
+	case hostPolicyReject, hostPolicyDefault:
+		// Without any hostnames every host is known, so the policy would
+		// never apply.
+		if len(hostnames) == 0 {
+			return fmt.Errorf("router: unknown host policy %q needs the router's hostnames", unknownHosts)
+		}
+	default:
+		return fmt.Errorf("router: unknown host policy %q is not one of %q, %q or %q",
+			unknownHosts, hostPolicyAllow, hostPolicyReject, hostPolicyDefault)
+	}
+	switch absoluteURIs {
+	case "", hostPolicyAllow, hostPolicyReject:
+	default:
+		return fmt.Errorf("router: absolute URI policy %q is not one of %q or %q",
+			absoluteURIs, hostPolicyAllow, hostPolicyReject)
+	}
+	return nil
+}
+
+// newHostPolicy creates a policy for the router's hostnames, the first of
+// which is the default host. It returns nil, for no policy, if requests for
+// any host and with absolute-form URIs are allowed.
+func newHostPolicy(hostnames []string, unknownHosts, absoluteURIs string) *hostPolicy {
+	if unknownHosts == "" {
+		unknownHosts = hostPolicyAllow
+	}
+	if absoluteURIs == "" {
+		absoluteURIs = hostPolicyAllow
+	}
+	if len(hostnames) == 0 && absoluteURIs == hostPolicyAllow {
+		return nil
+	}
+	p := &hostPolicy{unknownHosts: unknownHosts, absoluteURIs: absoluteURIs}
+	if len(hostnames) > 0 {
+		p.defaultHost = hostnames[0]
+		p.hostnames = make(map[string]bool, len(hostnames))
+		for _, host := range hostnames {
+			p.hostnames[strings.ToLower(stripHostPort(host))] = true
+		}
+	}
+	return p
+}
+
+// apply counts and handles req if it's for an unknown host or has an
+// absolute-form URI. It returns the reason if req should be rejected, and
+// otherwise replaces an unknown host with the default host if the policy
+// says to.
+func (p *hostPolicy) apply(req *http.Request, namespace string) string {
+	if p == nil {
+		return ""
+	}
+	if req.URL.IsAbs() {
+		hostPolicyCountMetric.WithLabelValues(namespace, malformedAbsoluteURI, p.absoluteURIs).Inc()
+		if p.absoluteURIs == hostPolicyReject {
+			return malformedAbsoluteURI
+		}
+	}
+	if p.hostnames == nil || p.hostnames[strings.ToLower(stripHostPort(req.Host))] {
+		return ""
+	}
+	hostPolicyCountMetric.WithLabelValues(namespace, malformedUnknownHost, p.unknownHosts).Inc()
+	switch p.unknownHosts {
+	case hostPolicyReject:
+		return malformedUnknownHost
+	case hostPolicyDefault:
+		logDebug("router: routing request for unknown host", req.Host, "as", p.defaultHost)
+		req.Host = p.defaultHost
+	}
+	return ""
+}
+
+func stripHostPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
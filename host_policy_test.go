@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	prommodel "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Host policy", func() {
+	var (
+		rt         *Router
+		routedHost string
+	)
+
+	BeforeEach(func() {
+		routedHost = ""
+		rt = newTestRouter()
+		rt.mux.Handle("/", true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			routedHost = r.Host
+			w.Write([]byte("routed"))
+		}))
+		rt.checks = newRequestChecks(0, nil, false)
+		rt.namespace = "hosts"
+	})
+
+	counted := func(request, action string) float64 {
+		metric := new(prommodel.Metric)
+		Expect(hostPolicyCountMetric.WithLabelValues("hosts", request, action).Write(metric)).To(Succeed())
+		return metric.Counter.GetValue()
+	}
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("should route every request without a policy", func() {
+		Expect(newHostPolicy(nil, "", "")).To(BeNil())
+		Expect(serve(httptest.NewRequest("GET", "http://evil.example/", nil)).Body.String()).To(Equal("routed"))
+		Expect(routedHost).To(Equal("evil.example"))
+	})
+
+	It("should route requests for known hosts, ignoring case and port", func() {
+		rt.checks.hosts = newHostPolicy([]string{"www.gov.uk", "assets.publishing.service.gov.uk"}, hostPolicyReject, "")
+		Expect(serve(withHost(httptest.NewRequest("GET", "/", nil), "WWW.gov.uk:8080")).Body.String()).To(Equal("routed"))
+		Expect(serve(withHost(httptest.NewRequest("GET", "/", nil), "assets.publishing.service.gov.uk")).Body.String()).To(Equal("routed"))
+	})
+
+	It("should reject requests for unknown hosts", func() {
+		rt.checks.hosts = newHostPolicy([]string{"www.gov.uk"}, hostPolicyReject, "")
+		before := counted(malformedUnknownHost, hostPolicyReject)
+		Expect(serve(withHost(httptest.NewRequest("GET", "/", nil), "evil.example")).Code).To(Equal(http.StatusMisdirectedRequest))
+		Expect(routedHost).To(BeEmpty())
+		Expect(counted(malformedUnknownHost, hostPolicyReject)).To(Equal(before + 1))
+	})
+
+	It("should route requests for unknown hosts as the default host", func() {
+		rt.checks.hosts = newHostPolicy([]string{"www.gov.uk"}, hostPolicyDefault, "")
+		before := counted(malformedUnknownHost, hostPolicyDefault)
+		Expect(serve(withHost(httptest.NewRequest("GET", "/", nil), "evil.example")).Body.String()).To(Equal("routed"))
+		Expect(routedHost).To(Equal("www.gov.uk"))
+		Expect(counted(malformedUnknownHost, hostPolicyDefault)).To(Equal(before + 1))
+	})
+
+	It("should count but route requests for unknown hosts if they're allowed", func() {
+		rt.checks.hosts = newHostPolicy([]string{"www.gov.uk"}, hostPolicyAllow, "")
+		before := counted(malformedUnknownHost, hostPolicyAllow)
+		Expect(serve(withHost(httptest.NewRequest("GET", "/", nil), "evil.example")).Body.String()).To(Equal("routed"))
+		Expect(routedHost).To(Equal("evil.example"))
+		Expect(counted(malformedUnknownHost, hostPolicyAllow)).To(Equal(before + 1))
+	})
+
+	It("should reject requests with an absolute-form URI", func() {
+		rt.checks.hosts = newHostPolicy(nil, "", hostPolicyReject)
+		before := counted(malformedAbsoluteURI, hostPolicyReject)
+		Expect(serve(httptest.NewRequest("GET", "http://www.gov.uk/", nil)).Code).To(Equal(http.StatusBadRequest))
+		Expect(counted(malformedAbsoluteURI, hostPolicyReject)).To(Equal(before + 1))
+		Expect(serve(withHost(httptest.NewRequest("GET", "/", nil), "www.gov.uk")).Body.String()).To(Equal("routed"))
+	})
+
+	It("should check the host of an absolute-form URI", func() {
+		rt.checks.hosts = newHostPolicy([]string{"www.gov.uk"}, hostPolicyReject, hostPolicyAllow)
+		Expect(serve(httptest.NewRequest("GET", "http://www.gov.uk/", nil)).Body.String()).To(Equal("routed"))
+		Expect(serve(httptest.NewRequest("GET", "http://evil.example/", nil)).Code).To(Equal(http.StatusMisdirectedRequest))
+	})
+
+	It("should refuse unknown policies", func() {
+		hostnames := []string{"www.gov.uk"}
+		Expect(validHostPolicy(hostnames, "redirect", "")).To(MatchError(ContainSubstring(`unknown host policy "redirect"`)))
+		Expect(validHostPolicy(hostnames, "", "default")).To(MatchError(ContainSubstring(`absolute URI policy "default"`)))
+		Expect(validHostPolicy(hostnames, hostPolicyDefault, hostPolicyReject)).To(Succeed())
+	})
+
+	It("should refuse to reject unknown hosts without any hostnames", func() {
+		Expect(validHostPolicy(nil, hostPolicyReject, "")).To(MatchError(ContainSubstring("needs the router's hostnames")))
+		Expect(validHostPolicy(nil, hostPolicyDefault, "")).To(MatchError(ContainSubstring("needs the router's hostnames")))
+		Expect(validHostPolicy(nil, hostPolicyAllow, hostPolicyReject)).To(Succeed())
+	})
+
+	It("should know a namespace's hosts", func() {
+		o := namespaceConfig{Hosts: []string{"draft.gov.uk"}}.options("draft", Options{Hostnames: []string{"www.gov.uk"}})
+		Expect(o.Hostnames).To(Equal([]string{"www.gov.uk", "draft.gov.uk"}))
+	})
+})
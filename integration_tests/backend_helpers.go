@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func startSimpleBackend(identifier string) *httptest.Server {
@@ -60,3 +62,7 @@ func startRecordingServer(tls bool) (server *ghttp.Server) {
 	server.UnhandledRequestStatusCode = http.StatusOK
 	return server
 }
+
+func startH2CBackend(handler http.Handler) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
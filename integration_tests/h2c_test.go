@@ -0,0 +1,96 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cleartext HTTP/2", func() {
+
+	BeforeEach(func() {
+		err := startRouter(3167, 3166, envMap{"ROUTER_ENABLE_H2C": "1"})
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		stopRouter(3167)
+	})
+
+	Describe("serving requests", func() {
+		var backend *httptest.Server
+
+		BeforeEach(func() {
+			backend = startSimpleBackend("backend")
+			addBackend("backend", backend.URL)
+			addRoute("/foo", NewBackendRoute("backend"))
+			reloadRoutes(3166)
+		})
+
+		AfterEach(func() {
+			backend.Close()
+		})
+
+		It("should accept HTTP/2 requests with prior knowledge", func() {
+			resp := doH2CRequest(newRequest("GET", routerURL("/foo", 3167)))
+			Expect(resp.ProtoMajor).To(Equal(2))
+			Expect(resp.StatusCode).To(Equal(200))
+			Expect(readBody(resp)).To(Equal("backend"))
+		})
+
+		It("should continue to accept HTTP/1.1 requests", func() {
+			resp := routerRequest("/foo", 3167)
+			Expect(resp.ProtoMajor).To(Equal(1))
+			Expect(readBody(resp)).To(Equal("backend"))
+		})
+	})
+
+	Describe("proxying gRPC routes", func() {
+		var backend *httptest.Server
+
+		BeforeEach(func() {
+			backend = startH2CBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+				w.Header().Set("X-Backend-Proto", r.Proto)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("response"))
+				w.Header().Set("Grpc-Status", "0")
+				w.Header().Set("Grpc-Message", "OK")
+			}))
+			addBackend("grpc-backend", backend.URL)
+			route := NewBackendRoute("grpc-backend", "prefix")
+			route.Protocol = "grpc"
+			addRoute("/my.Service", route)
+			reloadRoutes(3166)
+		})
+
+		AfterEach(func() {
+			backend.Close()
+		})
+
+		It("should proxy the request to the backend over HTTP/2", func() {
+			req := newRequestWithHeaders("POST", routerURL("/my.Service/Method", 3167), map[string]string{
+				"Content-Type": "application/grpc",
+				"TE":           "trailers",
+			})
+			resp := doH2CRequest(req)
+			Expect(resp.StatusCode).To(Equal(200))
+			Expect(resp.Header.Get("X-Backend-Proto")).To(Equal("HTTP/2.0"))
+			Expect(readBody(resp)).To(Equal("response"))
+		})
+
+		It("should propagate the trailers from the backend", func() {
+			req := newRequestWithHeaders("POST", routerURL("/my.Service/Method", 3167), map[string]string{
+				"Content-Type": "application/grpc",
+				"TE":           "trailers",
+			})
+			resp := doH2CRequest(req)
+			readBody(resp)
+			Expect(resp.Trailer.Get("Grpc-Status")).To(Equal("0"))
+			Expect(resp.Trailer.Get("Grpc-Message")).To(Equal("OK"))
+		})
+	})
+})
@@ -2,6 +2,7 @@ package integration
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 	"net/textproto"
 
 	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
 )
 
 func routerRequest(path string, optionalPort ...int) *http.Response {
@@ -46,6 +48,20 @@ func doRequest(req *http.Request) *http.Response {
 	return resp
 }
 
+// doH2CRequest makes a cleartext HTTP/2 request with prior knowledge, as a
+// TLS-terminating load balancer speaking h2c to the router would.
+func doH2CRequest(req *http.Request) *http.Response {
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	resp, err := transport.RoundTrip(req)
+	Expect(err).To(BeNil())
+	return resp
+}
+
 func doHTTP10Request(req *http.Request) *http.Response {
 	conn, err := net.Dial("tcp", req.URL.Host)
 	Expect(err).To(BeNil())
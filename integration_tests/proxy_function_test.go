@@ -10,6 +10,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/globalsign/mgo/bson"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
@@ -170,6 +172,39 @@ var _ = Describe("Functioning as a reverse proxy", func() {
 			Expect(beReq.Host).To(Equal(recorderURL.Host))
 		})
 
+		It("should send the Host header in X-Forwarded-Host if the backend asks for it", func() {
+			addBackendWithOptions("forwarding-backend", recorder.URL(), bson.M{"host_header": "forward"})
+			addRoute("/bar", NewBackendRoute("forwarding-backend", "prefix"))
+			reloadRoutes()
+
+			resp := routerRequestWithHeaders("/bar", map[string]string{
+				"Host":             "www.example.com",
+				"X-Forwarded-Host": "evil.example.com",
+			})
+			Expect(resp.StatusCode).To(Equal(200))
+
+			Expect(recorder.ReceivedRequests()).To(HaveLen(1))
+			beReq := recorder.ReceivedRequests()[0]
+			Expect(beReq.Host).To(Equal(recorderURL.Host))
+			Expect(beReq.Header.Get("X-Forwarded-Host")).To(Equal("www.example.com"))
+		})
+
+		It("should preserve the Host header if the backend asks for it", func() {
+			addBackendWithOptions("preserving-backend", recorder.URL(), bson.M{"host_header": "preserve"})
+			addRoute("/bar", NewBackendRoute("preserving-backend", "prefix"))
+			reloadRoutes()
+
+			resp := routerRequestWithHeaders("/bar", map[string]string{
+				"Host": "www.example.com",
+			})
+			Expect(resp.StatusCode).To(Equal(200))
+
+			Expect(recorder.ReceivedRequests()).To(HaveLen(1))
+			beReq := recorder.ReceivedRequests()[0]
+			Expect(beReq.Host).To(Equal("www.example.com"))
+			Expect(beReq.Header.Get("X-Forwarded-Host")).To(BeEmpty())
+		})
+
 		It("should not add a default User-Agent if there isn't one in the request", func() {
 			// Most http libraries add a default User-Agent header.
 			resp := routerRequest("/foo")
@@ -348,6 +383,64 @@ var _ = Describe("Functioning as a reverse proxy", func() {
 			beReq := recorder.ReceivedRequests()[0]
 			Expect(beReq.URL.RequestURI()).To(Equal("/something/foo/bar?baz=qux"))
 		})
+
+		It("should preserve encoded segments in the request path", func() {
+			resp := routerRequest("/foo/bar/baz%2Fqux%20quux")
+			Expect(resp.StatusCode).To(Equal(200))
+
+			Expect(recorder.ReceivedRequests()).To(HaveLen(1))
+			beReq := recorder.ReceivedRequests()[0]
+			Expect(beReq.URL.RequestURI()).To(Equal("/something/foo/bar/baz%2Fqux%20quux"))
+		})
+	})
+
+	Describe("stripping the route's prefix before proxying", func() {
+		var (
+			recorder *ghttp.Server
+		)
+
+		BeforeEach(func() {
+			recorder = startRecordingBackend()
+			addBackend("backend", recorder.URL()+"/something")
+			route := NewBackendRoute("backend", "prefix")
+			route.StripPrefix = true
+			addRoute("/api/content", route)
+			reloadRoutes()
+		})
+
+		AfterEach(func() {
+			recorder.Close()
+		})
+
+		It("should proxy the rest of the path", func() {
+			resp := routerRequest("/api/content/foo?bar=baz")
+			Expect(resp.StatusCode).To(Equal(200))
+
+			Expect(recorder.ReceivedRequests()).To(HaveLen(1))
+			beReq := recorder.ReceivedRequests()[0]
+			Expect(beReq.URL.RequestURI()).To(Equal("/something/foo?bar=baz"))
+			Expect(beReq.Header.Get("X-Forwarded-Prefix")).To(Equal("/api/content"))
+		})
+
+		It("should proxy a request for the prefix itself to the backend's root", func() {
+			resp := routerRequest("/api/content")
+			Expect(resp.StatusCode).To(Equal(200))
+
+			Expect(recorder.ReceivedRequests()).To(HaveLen(1))
+			beReq := recorder.ReceivedRequests()[0]
+			Expect(beReq.URL.RequestURI()).To(Equal("/something/"))
+		})
+
+		It("should send the original URL to the backend", func() {
+			resp := routerRequest("/api/content/foo%2Fbar?baz=qux")
+			Expect(resp.StatusCode).To(Equal(200))
+
+			Expect(recorder.ReceivedRequests()).To(HaveLen(1))
+			beReq := recorder.ReceivedRequests()[0]
+			Expect(beReq.Header.Get("X-Original-URL")).To(Equal("/api/content/foo%2Fbar?baz=qux"))
+			Expect(beReq.Header.Get("X-Forwarded-Uri")).To(Equal("/api/content/foo%2Fbar?baz=qux"))
+			Expect(beReq.Header.Get("X-Forwarded-Port")).To(Equal("3169"))
+		})
 	})
 
 	Describe("handling HTTP/1.0 requests", func() {
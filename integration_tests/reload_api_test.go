@@ -90,6 +90,15 @@ var _ = Describe("reload API endpoint", func() {
 				Expect(data["routes"]["count"]).To(BeEquivalentTo(3))
 			})
 
+			It("should return the number of routes with each handler type", func() {
+				Expect(data["routes"]["handlers"]).To(Equal(map[string]interface{}{"redirect": float64(3)}))
+			})
+
+			It("should return the size of the route tries", func() {
+				Expect(data["routes"]["tries"]).To(HaveKeyWithValue("prefix", HaveKeyWithValue("entries", BeEquivalentTo(2))))
+				Expect(data["routes"]["estimated_bytes"]).To(BeNumerically(">", 0))
+			})
+
 			It("should return a checksum calculated from the sorted paths and route_types", func() {
 				hash := sha1.New()
 				hash.Write([]byte("/baz(true)"))
@@ -21,14 +21,17 @@ var (
 )
 
 type Route struct {
-	IncomingPath string `bson:"incoming_path"`
-	RouteType    string `bson:"route_type"`
-	Handler      string `bson:"handler"`
-	BackendID    string `bson:"backend_id"`
-	RedirectTo   string `bson:"redirect_to"`
-	RedirectType string `bson:"redirect_type"`
-	SegmentsMode string `bson:"segments_mode"`
-	Disabled     bool   `bson:"disabled"`
+	IncomingPath string   `bson:"incoming_path"`
+	RouteType    string   `bson:"route_type"`
+	Handler      string   `bson:"handler"`
+	BackendID    string   `bson:"backend_id"`
+	RedirectTo   string   `bson:"redirect_to"`
+	RedirectType string   `bson:"redirect_type"`
+	SegmentsMode string   `bson:"segments_mode"`
+	Protocol     string   `bson:"protocol"`
+	Extensions   []string `bson:"extensions,omitempty"`
+	StripPrefix  bool     `bson:"strip_prefix"`
+	Disabled     bool     `bson:"disabled"`
 }
 
 func NewBackendRoute(backendID string, extraParams ...string) Route {
@@ -96,7 +99,17 @@ func initRouteHelper() error {
 }
 
 func addBackend(id, url string) {
-	err := routerDB.C("backends").Insert(bson.M{"backend_id": id, "backend_url": url})
+	addBackendWithOptions(id, url, nil)
+}
+
+// addBackendWithOptions adds a backend with extra fields, such as
+// "host_header".
+func addBackendWithOptions(id, url string, options bson.M) {
+	backend := bson.M{"backend_id": id, "backend_url": url}
+	for k, v := range options {
+		backend[k] = v
+	}
+	err := routerDB.C("backends").Insert(backend)
 	Expect(err).To(BeNil())
 }
 
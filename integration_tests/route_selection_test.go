@@ -375,4 +375,48 @@ var _ = Describe("Route selection", func() {
 			Expect(recorder.ReceivedRequests()[0].RequestURI).To(Equal("/foo%20bar"))
 		})
 	})
+
+	Describe("routes restricted to path extensions", func() {
+		var (
+			frontend *httptest.Server
+			api      *httptest.Server
+		)
+
+		BeforeEach(func() {
+			frontend = startSimpleBackend("frontend")
+			api = startSimpleBackend("api")
+			addBackend("frontend", frontend.URL)
+			addBackend("api", api.URL)
+
+			addRoute("/government", NewBackendRoute("frontend", "prefix"))
+			apiRoute := NewBackendRoute("api", "prefix")
+			apiRoute.Extensions = []string{"json", ".atom"}
+			addRoute("/government", apiRoute)
+
+			reloadRoutes()
+		})
+		AfterEach(func() {
+			frontend.Close()
+			api.Close()
+		})
+
+		It("should send requests with those extensions to the restricted route", func() {
+			resp := routerRequest("/government/news.json")
+			Expect(readBody(resp)).To(Equal("api"))
+
+			resp = routerRequest("/government/feed.ATOM")
+			Expect(readBody(resp)).To(Equal("api"))
+		})
+
+		It("should send other requests to the unrestricted route", func() {
+			resp := routerRequest("/government/news")
+			Expect(readBody(resp)).To(Equal("frontend"))
+
+			resp = routerRequest("/government/news.xml")
+			Expect(readBody(resp)).To(Equal("frontend"))
+
+			resp = routerRequest("/government/news.json/more")
+			Expect(readBody(resp)).To(Equal("frontend"))
+		})
+	})
 })
@@ -0,0 +1,51 @@
+package integration
+
+import (
+	"os"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("router verify", func() {
+	runVerify := func() (string, error) {
+		bin := os.Getenv("BINARY")
+		if bin == "" {
+			bin = "../router"
+		}
+		cmd := exec.Command(bin, "verify")
+
+		env := newEnvMap(os.Environ())
+		env["ROUTER_MONGO_DB"] = "router_test"
+		env["ROUTER_ERROR_LOG"] = tempLogfile.Name()
+		cmd.Env = env.ToEnv()
+
+		output, err := cmd.CombinedOutput()
+		return string(output), err
+	}
+
+	AfterEach(func() {
+		clearRoutes()
+	})
+
+	It("should pass a consistent set of routes", func() {
+		addBackend("backend-1", "http://localhost:3160")
+		addRoute("/foo", NewBackendRoute("backend-1"))
+		addRoute("/foo", NewBackendRoute("backend-1", "prefix"))
+		addRoute("/bar", NewGoneRoute("prefix"))
+
+		output, err := runVerify()
+		Expect(err).NotTo(HaveOccurred(), output)
+		Expect(output).To(ContainSubstring("3 routes OK"))
+	})
+
+	It("should fail if the same route is registered twice", func() {
+		addRoute("/foo", NewGoneRoute())
+		addRoute("/foo/", NewGoneRoute())
+
+		output, err := runVerify()
+		Expect(err).To(HaveOccurred())
+		Expect(output).To(ContainSubstring("registered more than once"))
+	})
+})
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/alphagov/router/handlers"
+	"github.com/alphagov/router/triemux"
+)
+
+// Ways of handling a request under a locale prefix with no route, when the
+// path without the prefix has one.
+const (
+	// localeFallbackRedirect redirects to the path without the prefix.
+	localeFallbackRedirect = "redirect"
+	// localeFallbackProxy serves the request with the route for the path
+	// without the prefix, telling the backend the prefix in an
+	// X-Forwarded-Prefix header.
+	localeFallbackProxy = "proxy"
+)
+
+func validLocaleFallback(fallback string) error {
+	switch fallback {
+	case localeFallbackRedirect, localeFallbackProxy:
+		return nil
+	}
+	return fmt.Errorf("router: invalid locale fallback %q (should be %q or %q)",
+		fallback, localeFallbackRedirect, localeFallbackProxy)
+}
+
+// setLocaleFallback makes requests for paths under one of the router's
+// locale prefixes, such as /cy/some-page, which miss in mux, fall back to
+// the route for the path without the prefix, so that bilingual pages don't
+// need a route for each language. Requests which still miss are passed to
+// mux's existing not found handler, so it needs to be called after
+// setNotFoundHandler.
+func (rt *Router) setLocaleFallback(mux *triemux.Mux) {
+	if len(rt.localePrefixes) == 0 {
+		return
+	}
+
+	notFound := mux.NotFoundHandler
+	if notFound == nil {
+		notFound = http.NotFoundHandler()
+	}
+	byLocale := make(map[string]http.Handler, len(rt.localePrefixes))
+	for _, locale := range rt.localePrefixes {
+		if rt.localeFallback == localeFallbackProxy {
+			byLocale[locale] = handlers.NewStripPrefixHandler("/"+locale, mux)
+		} else {
+			byLocale[locale] = rt.middleware.globalChain(http.HandlerFunc(redirectWithoutLocale))
+		}
+	}
+
+	mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale, rest, ok := splitLocale(r.URL.Path)
+		handler := byLocale[locale]
+		if !ok || handler == nil {
+			notFound.ServeHTTP(w, r)
+			return
+		}
+		if _, found := mux.Lookup(rest); !found {
+			notFound.ServeHTTP(w, r)
+			return
+		}
+		localeFallbackCountMetric.WithLabelValues(locale, rt.localeFallback).Inc()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// splitLocale splits path into its first segment and the rest of the path,
+// so that "/cy/some-page" gives "cy" and "/some-page". A path with only one
+// segment gives "/" for the rest. Repeated slashes at the start of the rest
+// are collapsed, so that it can't be mistaken for a URL on another host.
+func splitLocale(path string) (locale, rest string, ok bool) {
+	if !strings.HasPrefix(path, "/") {
+		return "", "", false
+	}
+	locale = path[1:]
+	rest = "/"
+	if i := strings.IndexByte(locale, '/'); i >= 0 {
+		locale, rest = locale[:i], "/"+strings.TrimLeft(locale[i:], "/")
+	}
+	return locale, rest, locale != ""
+}
+
+// redirectWithoutLocale redirects to the request's path without its first
+// segment. The redirect is temporary, since the page may be translated
+// later.
+func redirectWithoutLocale(w http.ResponseWriter, r *http.Request) {
+	_, target, _ := splitLocale(r.URL.Path)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
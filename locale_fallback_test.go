@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Locale prefix fallback", func() {
+	var (
+		rt       *Router
+		frontend *httptest.Server
+		received *http.Request
+	)
+
+	BeforeEach(func() {
+		frontend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			w.Write([]byte("page"))
+		}))
+		rt = newTestRouter()
+		rt.localePrefixes = []string{"cy"}
+		rt.localeFallback = localeFallbackRedirect
+	})
+
+	AfterEach(func() {
+		frontend.Close()
+	})
+
+	load := func() {
+		rt.mux, _ = rt.buildMux(&RouteTable{
+			Backends: []Backend{{BackendID: "frontend", BackendURL: frontend.URL}},
+			Routes: []Route{
+				{IncomingPath: "/some-page", RouteType: "exact", Handler: "backend", BackendID: "frontend"},
+				{IncomingPath: "/cy/translated-page", RouteType: "exact", Handler: "gone"},
+			},
+		})
+	}
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+
+	It("should redirect to the path without the locale prefix", func() {
+		load()
+
+		rw := serve("/cy/some-page?q=1")
+		Expect(rw.Code).To(Equal(http.StatusFound))
+		Expect(rw.Header().Get("Location")).To(Equal("/some-page?q=1"))
+	})
+
+	It("should proxy to the route for the path without the locale prefix", func() {
+		rt.localeFallback = localeFallbackProxy
+		load()
+
+		rw := serve("/cy/some-page")
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(Equal("page"))
+		Expect(received.URL.Path).To(Equal("/some-page"))
+		Expect(received.Header.Get("X-Forwarded-Prefix")).To(Equal("/cy"))
+	})
+
+	It("should use routes under the locale prefix", func() {
+		load()
+
+		Expect(serve("/cy/translated-page").Code).To(Equal(http.StatusGone))
+	})
+
+	It("should 404 if the path without the prefix has no route either", func() {
+		load()
+
+		Expect(serve("/cy/missing").Code).To(Equal(http.StatusNotFound))
+		Expect(serve("/en/some-page").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("shouldn't redirect to another host", func() {
+		load()
+
+		rw := serve("/cy//some-page")
+		Expect(rw.Code).To(Equal(http.StatusFound))
+		Expect(rw.Header().Get("Location")).To(Equal("/some-page"))
+	})
+})
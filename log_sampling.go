@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// LogSampling describes the access log sample rates, for the API.
+type LogSampling struct {
+	DefaultRate float64              `json:"default_rate"`
+	Routes      []RouteLogSampleRate `json:"routes"`
+	Backends    map[string]float64   `json:"backends"`
+}
+
+// RouteLogSampleRate is the sample rate set through the API for a route.
+type RouteLogSampleRate struct {
+	Route     string  `json:"route"`
+	RouteType string  `json:"route_type"`
+	Rate      float64 `json:"rate"`
+}
+
+// logSampling decides what fraction of each route's requests the "logging"
+// middleware logs. Rates set through the API for a route or a backend take
+// precedence over those in the route table, and a route's rate over its
+// backend's. Those set through the API last until the router restarts.
+type logSampling struct {
+	defaultRate float64
+
+	mu       sync.RWMutex
+	routes   map[sampledRoute]float64
+	backends map[string]float64
+}
+
+// sampledRoute identifies a route, as an exact route and a prefix route can
+// have the same incoming path.
+type sampledRoute struct {
+	path, routeType string
+}
+
+func newLogSampling(defaultRate float64) *logSampling {
+	return &logSampling{
+		defaultRate: defaultRate,
+		routes:      make(map[sampledRoute]float64),
+		backends:    make(map[string]float64),
+	}
+}
+
+// rateFunc returns a function giving the current sample rate for a route.
+func (s *logSampling) rateFunc(route *Route, backend *Backend) func() float64 {
+	key, backendID := sampledRoute{route.IncomingPath, route.RouteType}, ""
+	configured := s.defaultRate
+	if backend != nil {
+		backendID = backend.BackendID
+		if backend.LogSampleRate != nil {
+			configured = *backend.LogSampleRate
+		}
+	}
+	if route.LogSampleRate != nil {
+		configured = *route.LogSampleRate
+	}
+
+	return func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if rate, ok := s.routes[key]; ok {
+			return rate
+		}
+		if rate, ok := s.backends[backendID]; ok {
+			return rate
+		}
+		return configured
+	}
+}
+
+// set overrides the sample rate for the route with incoming path route and
+// type routeType, or for the backend with backendID. Only one of them may be
+// given.
+func (s *logSampling) set(route, routeType, backendID string, rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("rate must be between 0 and 1")
+	}
+	if err := checkOverride(route, routeType, backendID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if route != "" {
+		s.routes[sampledRoute{route, routeType}] = rate
+	} else {
+		s.backends[backendID] = rate
+	}
+	return nil
+}
+
+// reset removes an override set with set, reporting whether there was one.
+func (s *logSampling) reset(route, routeType, backendID string) (bool, error) {
+	if err := checkOverride(route, routeType, backendID); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ok bool
+	if route != "" {
+		key := sampledRoute{route, routeType}
+		_, ok = s.routes[key]
+		delete(s.routes, key)
+	} else {
+		_, ok = s.backends[backendID]
+		delete(s.backends, backendID)
+	}
+	return ok, nil
+}
+
+func checkOverride(route, routeType, backendID string) error {
+	switch {
+	case (route == "") == (backendID == ""):
+		return fmt.Errorf("either a route or a backend_id must be given")
+	case route != "" && routeType != "exact" && routeType != "prefix":
+		return fmt.Errorf("a route needs a route_type of exact or prefix")
+	case route == "" && routeType != "":
+		return fmt.Errorf("a route_type needs a route")
+	}
+	return nil
+}
+
+func (s *logSampling) status() LogSampling {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := LogSampling{
+		DefaultRate: s.defaultRate,
+		Routes:      make([]RouteLogSampleRate, 0, len(s.routes)),
+		Backends:    make(map[string]float64, len(s.backends)),
+	}
+	for route, rate := range s.routes {
+		status.Routes = append(status.Routes, RouteLogSampleRate{route.path, route.routeType, rate})
+	}
+	sort.Slice(status.Routes, func(i, j int) bool {
+		if status.Routes[i].Route != status.Routes[j].Route {
+			return status.Routes[i].Route < status.Routes[j].Route
+		}
+		return status.Routes[i].RouteType < status.Routes[j].RouteType
+	})
+	for backendID, rate := range s.backends {
+		status.Backends[backendID] = rate
+	}
+	return status
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Access log sampling", func() {
+	var sampling *logSampling
+
+	rate := func(r float64) *float64 { return &r }
+
+	BeforeEach(func() {
+		sampling = newLogSampling(0.01)
+	})
+
+	It("should use the rates from the route table", func() {
+		backend := &Backend{BackendID: "frontend", LogSampleRate: rate(0.5)}
+		route := &Route{IncomingPath: "/foo", Handler: "backend", BackendID: "frontend"}
+		Expect(sampling.rateFunc(route, backend)()).To(Equal(0.5))
+
+		route.LogSampleRate = rate(1)
+		Expect(sampling.rateFunc(route, backend)()).To(Equal(1.0))
+
+		Expect(sampling.rateFunc(&Route{IncomingPath: "/bar", Handler: "gone"}, nil)()).To(Equal(0.01))
+	})
+
+	It("should let rates be changed while the router is running", func() {
+		backend := &Backend{BackendID: "frontend", LogSampleRate: rate(0.5)}
+		fooRate := sampling.rateFunc(&Route{IncomingPath: "/foo", RouteType: "prefix", Handler: "backend", BackendID: "frontend"}, backend)
+		barRate := sampling.rateFunc(&Route{IncomingPath: "/bar", RouteType: "prefix", Handler: "backend", BackendID: "frontend"}, backend)
+
+		Expect(sampling.set("", "", "frontend", 1)).To(Succeed())
+		Expect(fooRate()).To(Equal(1.0))
+		Expect(sampling.set("/foo", "prefix", "", 0)).To(Succeed())
+		Expect(fooRate()).To(Equal(0.0), "a route's rate should take precedence")
+		Expect(barRate()).To(Equal(1.0))
+
+		Expect(sampling.reset("/foo", "prefix", "")).To(BeTrue())
+		Expect(sampling.reset("/foo", "prefix", "")).To(BeFalse())
+		Expect(fooRate()).To(Equal(1.0))
+	})
+
+	It("should keep the rates for exact and prefix routes with the same path apart", func() {
+		exactRate := sampling.rateFunc(&Route{IncomingPath: "/foo", RouteType: "exact", Handler: "gone"}, nil)
+		prefixRate := sampling.rateFunc(&Route{IncomingPath: "/foo", RouteType: "prefix", Handler: "gone"}, nil)
+
+		Expect(sampling.set("/foo", "exact", "", 1)).To(Succeed())
+		Expect(exactRate()).To(Equal(1.0))
+		Expect(prefixRate()).To(Equal(0.01))
+	})
+
+	It("should reject invalid rates", func() {
+		Expect(sampling.set("/foo", "exact", "", 1.5)).To(MatchError(ContainSubstring("between 0 and 1")))
+		Expect(sampling.set("/foo", "exact", "frontend", 1)).To(MatchError(ContainSubstring("either a route or a backend_id")))
+		Expect(sampling.set("", "", "", 1)).To(MatchError(ContainSubstring("either a route or a backend_id")))
+		Expect(sampling.set("/foo", "", "", 1)).To(MatchError(ContainSubstring("route_type")))
+		Expect(sampling.set("", "exact", "frontend", 1)).To(MatchError(ContainSubstring("route_type")))
+	})
+
+	Context("API", func() {
+		var api http.Handler
+
+		BeforeEach(func() {
+			rt := newTestRouter()
+			rt.middleware.sampling = sampling
+
+			apiAuthToken = "token"
+			var err error
+			api, err = newAPIHandler(rt)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			apiAuthToken = ""
+		})
+
+		request := func(method, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "/log-sampling", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer token")
+			rw := httptest.NewRecorder()
+			api.ServeHTTP(rw, req)
+			return rw
+		}
+
+		It("should set and remove sample rates", func() {
+			rw := request("POST", `{"backend_id": "frontend", "rate": 1}`)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(MatchJSON(`{"default_rate": 0.01, "routes": [], "backends": {"frontend": 1}}`))
+
+			rw = request("DELETE", `{"backend_id": "frontend"}`)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(MatchJSON(`{"default_rate": 0.01, "routes": [], "backends": {}}`))
+
+			rw = request("POST", `{"route": "/foo", "route_type": "prefix", "rate": 1}`)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(MatchJSON(`{
+				"default_rate": 0.01,
+				"routes": [{"route": "/foo", "route_type": "prefix", "rate": 1}],
+				"backends": {}
+			}`))
+
+			Expect(request("DELETE", `{"backend_id": "frontend"}`).Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should reject invalid rates", func() {
+			Expect(request("POST", `{"route": "/foo", "route_type": "exact"}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(request("POST", `{"route": "/foo", "route_type": "exact", "rate": -1}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(request("POST", `{"route": "/foo", "rate": 1}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(request("GET", "").Body.String()).To(MatchJSON(`{"default_rate": 0.01, "routes": [], "backends": {}}`))
+		})
+	})
+})
@@ -1,50 +1,272 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/alext/tablecloth"
 	"github.com/alphagov/router/handlers"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
 	pubAddr               = getenvDefault("ROUTER_PUBADDR", ":8080")
 	apiAddr               = getenvDefault("ROUTER_APIADDR", ":8081")
+	apiAuthToken          = os.Getenv("ROUTER_API_AUTH_TOKEN")
+	routeSource           = getenvDefault("ROUTER_ROUTE_SOURCE", "mongo")
+	routeChecksum         = getenvDefault("ROUTER_ROUTE_CHECKSUM", "sha1")
 	mongoURL              = getenvDefault("ROUTER_MONGO_URL", "127.0.0.1")
 	mongoDbName           = getenvDefault("ROUTER_MONGO_DB", "router")
 	mongoPollInterval     = getenvDefault("ROUTER_MONGO_POLL_INTERVAL", "2s")
+	mongoDocLimit         = getenvDefault("ROUTER_MONGO_DOC_LIMIT", "0")
+	loadWorkers           = getenvDefault("ROUTER_LOAD_WORKERS", "0")
+	reloadLogInterval     = getenvDefault("ROUTER_RELOAD_LOG_INTERVAL", "10s")
+	reloadTimeout         = getenvDefault("ROUTER_RELOAD_TIMEOUT", "5m")
+	backendGracePeriod    = getenvDefault("ROUTER_BACKEND_GRACE_PERIOD", "0")
+	standbyMaxRoutes      = getenvDefault("ROUTER_STANDBY_MAX_ROUTES", "0")
+	routeArchives         = os.Getenv("ROUTER_ROUTE_ARCHIVES") != ""
 	errorLogFile          = getenvDefault("ROUTER_ERROR_LOG", "STDERR")
 	tlsSkipVerify         = os.Getenv("ROUTER_TLS_SKIP_VERIFY") != ""
+	enableH2C             = os.Getenv("ROUTER_ENABLE_H2C") != ""
+	decisionLogSink       = os.Getenv("ROUTER_DECISION_LOG")
 	enableDebugOutput     = os.Getenv("DEBUG") != ""
+	watchdogInterval      = os.Getenv("ROUTER_WATCHDOG_INTERVAL")
+	watchdogGoroutines    = getenvDefault("ROUTER_WATCHDOG_MAX_GOROUTINES", "10000")
+	watchdogDumpDir       = getenvDefault("ROUTER_WATCHDOG_DUMP_DIR", os.TempDir())
+	watchdogSentry        = os.Getenv("ROUTER_WATCHDOG_SENTRY") != ""
+	verifyRoutes          = os.Getenv("ROUTER_VERIFY_ROUTES") != ""
 	backendConnectTimeout = getenvDefault("ROUTER_BACKEND_CONNECT_TIMEOUT", "1s")
 	backendHeaderTimeout  = getenvDefault("ROUTER_BACKEND_HEADER_TIMEOUT", "15s")
+	backendKeepAlive      = getenvDefault("ROUTER_BACKEND_KEEPALIVE", "30s")
+	backendFallbackDelay  = getenvDefault("ROUTER_BACKEND_FALLBACK_DELAY", "300ms")
+	backendLocalAddr      = os.Getenv("ROUTER_BACKEND_LOCAL_ADDR")
+	backendAddressFamily  = os.Getenv("ROUTER_BACKEND_ADDRESS_FAMILY")
+	coalesceRequests      = os.Getenv("ROUTER_COALESCE_REQUESTS") != ""
+	coalesceMaxBodySize   = getenvDefault("ROUTER_COALESCE_MAX_BODY_SIZE", "1048576")
+	retryBudgetPercent    = getenvDefault("ROUTER_RETRY_BUDGET_PERCENT", "5")
+	retryBudgetWindow     = getenvDefault("ROUTER_RETRY_BUDGET_WINDOW", "10s")
+	retryBudgetMin        = getenvDefault("ROUTER_RETRY_BUDGET_MIN", "3")
+	breakerFailures       = getenvDefault("ROUTER_CIRCUIT_BREAKER_FAILURES", "5")
+	breakerCooldown       = getenvDefault("ROUTER_CIRCUIT_BREAKER_COOLDOWN", "10s")
+	budgetWindow          = getenvDefault("ROUTER_BUDGET_WINDOW", "1m")
+	alertWebhookURL       = os.Getenv("ROUTER_ALERT_WEBHOOK_URL")
+	middlewareList        = os.Getenv("ROUTER_MIDDLEWARE")
+	accessLogFile         = getenvDefault("ROUTER_ACCESS_LOG", "STDOUT")
+	accessLogSampleRate   = getenvDefault("ROUTER_ACCESS_LOG_SAMPLE_RATE", "1")
+	basicAuth             = os.Getenv("ROUTER_BASIC_AUTH")
+	clientIPSource        = getenvDefault("ROUTER_CLIENT_IP", "forwarded-for")
+	clientIPHeader        = getenvDefault("ROUTER_CLIENT_IP_HEADER", "True-Client-IP")
+	trustedProxies        = os.Getenv("ROUTER_TRUSTED_PROXIES")
+	maxHeaderBytes        = getenvDefault("ROUTER_MAX_HEADER_BYTES", "0")
+	allowedMethods        = os.Getenv("ROUTER_ALLOWED_METHODS")
+	requireUTF8Paths      = os.Getenv("ROUTER_REQUIRE_UTF8_PATHS") != ""
+	hostnames             = os.Getenv("ROUTER_HOSTNAMES")
+	unknownHosts          = getenvDefault("ROUTER_UNKNOWN_HOSTS", "allow")
+	absoluteURIs          = getenvDefault("ROUTER_ABSOLUTE_URIS", "allow")
+	previewTokens         = os.Getenv("ROUTER_PREVIEW_TOKENS")
+	notFoundBackend       = os.Getenv("ROUTER_NOT_FOUND_BACKEND")
+	localePrefixes        = os.Getenv("ROUTER_LOCALE_PREFIXES")
+	localeFallback        = getenvDefault("ROUTER_LOCALE_FALLBACK", "redirect")
+	shadowSource          = os.Getenv("ROUTER_SHADOW_SOURCE")
+	shardPrefixes         = os.Getenv("ROUTER_SHARD_PREFIXES")
+	shardPeerURL          = os.Getenv("ROUTER_SHARD_PEER_URL")
+	shardMissStatus       = getenvDefault("ROUTER_SHARD_MISS_STATUS", "404")
+	rateLimit             = getenvDefault("ROUTER_RATE_LIMIT", "10")
+	rateLimitBurst        = getenvDefault("ROUTER_RATE_LIMIT_BURST", "20")
+	requestHeaders        = os.Getenv("ROUTER_REQUEST_HEADERS")
+	responseHeaders       = os.Getenv("ROUTER_RESPONSE_HEADERS")
+	rulesFileName         = os.Getenv("ROUTER_RULES_FILE")
+	rulesPollInterval     = getenvDefault("ROUTER_RULES_POLL_INTERVAL", "10s")
+	routeNamespaces       = os.Getenv("ROUTER_NAMESPACES")
+	signonCookieName      = getenvDefault("ROUTER_SIGNON_COOKIE", "signon_session")
+	signonSecret          = os.Getenv("ROUTER_SIGNON_SECRET")
+	signonAuthURL         = os.Getenv("ROUTER_SIGNON_AUTH_URL")
+	signonLoginURL        = os.Getenv("ROUTER_SIGNON_LOGIN_URL")
+	signonCacheTTL        = getenvDefault("ROUTER_SIGNON_CACHE_TTL", "1m")
+	requestSigningKey     = os.Getenv("ROUTER_SIGNING_KEY")
+	requestSigningKeyID   = os.Getenv("ROUTER_SIGNING_KEY_ID")
+	mirrorURL             = os.Getenv("ROUTER_MIRROR_URL")
+	mirrorPrefixes        = os.Getenv("ROUTER_MIRROR_PREFIXES")
+	bannerFileName        = os.Getenv("ROUTER_BANNER_FILE")
+	hsts                  = os.Getenv("ROUTER_HSTS")
+	clientPolicyURL       = os.Getenv("ROUTER_CLIENT_POLICY_URL")
+	clientPolicyKey       = os.Getenv("ROUTER_CLIENT_POLICY_KEY")
+	clientPolicyInterval  = getenvDefault("ROUTER_CLIENT_POLICY_POLL_INTERVAL", "1m")
+	clientPolicyMaxAge    = getenvDefault("ROUTER_CLIENT_POLICY_MAX_AGE", "24h")
+	surrogateKeys         = os.Getenv("ROUTER_SURROGATE_KEYS") != ""
+	cdnAPIURL             = getenvDefault("ROUTER_CDN_API_URL", "https://api.fastly.com")
+	cdnAPIKey             = os.Getenv("ROUTER_CDN_API_KEY")
+	cdnServiceID          = os.Getenv("ROUTER_CDN_SERVICE_ID")
+	cdnHost               = os.Getenv("ROUTER_CDN_HOST")
+	cdnPurgeRoutes        = os.Getenv("ROUTER_CDN_PURGE_CHANGED_ROUTES") != ""
 )
 
 func usage() {
 	helpstring := `
 GOV.UK Router %s
-Usage: %s [-version]
+Usage: %s [-version] [verify | smoke [-dry-run] FILE | diff-sources FROM TO]
+
+With no command, the router serves requests. "verify" instead loads the
+routes, checks them for consistency and exits non-zero if there are any
+problems. "smoke" loads the routes and makes each request listed in FILE
+(or stdin, if it's "-") through them, exiting non-zero if any don't get the
+expected response. Each line of FILE is a path or URL, the expected status
+and optionally the ID of the backend which should serve it. With -dry-run,
+requests aren't sent on to backends. "diff-sources" compares the backends
+and routes loaded from two route sources, exiting with status 1 if they
+differ. FROM and TO are each the name of a namespace, "main" for the
+router's own routes, or a JSON object of route source settings in the same
+form as a namespace's.
 
 The following environment variables and defaults are available:
 
-ROUTER_PUBADDR=:8080             Address on which to serve public requests
-ROUTER_APIADDR=:8081             Address on which to receive reload requests
+ROUTER_PUBADDR=:8080             Address(es) on which to serve public requests
+ROUTER_APIADDR=:8081             Address(es) on which to receive reload requests
+ROUTER_API_AUTH_TOKEN=           Bearer token for API endpoints which change routing or expose request data (disabled if unset)
+ROUTER_ROUTE_SOURCE=mongo        Where to load routes from (the "mongo" source uses the ROUTER_MONGO_* settings)
+ROUTER_ROUTE_CHECKSUM=sha1       Hash algorithm for the route checksum: sha1, sha256 or sha512
 ROUTER_MONGO_URL=127.0.0.1       Address of mongo cluster (e.g. 'mongo1,mongo2,mongo3')
 ROUTER_MONGO_DB=router           Name of mongo database to use
 ROUTER_MONGO_POLL_INTERVAL=2s    Interval to poll mongo for route changes
+ROUTER_MONGO_DOC_LIMIT=0         Largest route document (in bytes) to load - larger ones fail the reload (0 for no limit)
+ROUTER_LOAD_WORKERS=0            Number of goroutines used to decode and set up routes during a reload (0 for one per CPU)
+ROUTER_RELOAD_LOG_INTERVAL=10s   How often to log the progress of a reload while it's running (0 to only report it in the API)
+ROUTER_RELOAD_TIMEOUT=5m         How long a reload can take before it's abandoned, keeping the current routes (0 for no limit)
+ROUTER_BACKEND_GRACE_PERIOD=0    How long routes keep using a backend which a reload removed while they still use it (0 to skip them)
+ROUTER_STANDBY_MAX_ROUTES=0      Most routes to keep after a reload replaces them, to roll back to through the API (0 not to keep them)
+ROUTER_ROUTE_ARCHIVES=           Whether to export and import route archives through the API, keeping a copy of the routes - set to anything to enable
 ROUTER_ERROR_LOG=STDERR          File to log errors to (in JSON format)
+ROUTER_ENABLE_H2C=               Whether to accept cleartext HTTP/2 (h2c) publicly - set to anything to enable
+ROUTER_VERIFY_ROUTES=            Whether to check routes for consistency after each reload, keeping the old routes if they fail
+ROUTER_MIRROR_URL=               URL of a static mirror which all requests can be switched to through the API
+ROUTER_MIRROR_PREFIXES=          Comma-separated path prefixes to switch to the mirror by default (all paths if unset)
+ROUTER_NAMESPACES=               JSON object of extra route namespaces to serve, e.g. '{"draft": {"mongo_db": "draft_router", "pubaddr": ":8082"}}'
+ROUTER_PREVIEW_TOKENS=           Comma-separated tokens which show preview-only routes, in a GOVUK-Preview-Token header or govuk_preview_token cookie
+ROUTER_NOT_FOUND_BACKEND=        ID of a backend to pass requests with no route to, e.g. to render a branded 404 page (the router responds itself if unset)
+ROUTER_LOCALE_PREFIXES=          Comma-separated locale path prefixes, e.g. 'cy', under which paths with no route fall back to the path without the prefix
+ROUTER_LOCALE_FALLBACK=redirect  How to fall back to the path without a locale prefix: 'redirect' to it, or 'proxy' to its route
+ROUTER_SHADOW_SOURCE=            Routes to compare each request's route with, as for diff-sources, e.g. a namespace name (disabled if unset)
+ROUTER_SHARD_PREFIXES=           Comma-separated top-level path segments (or '/' for the root path) to only load routes under (all routes if unset)
+ROUTER_SHARD_PEER_URL=           URL of a router to proxy requests outside ROUTER_SHARD_PREFIXES to
+ROUTER_SHARD_MISS_STATUS=404     Status for requests outside ROUTER_SHARD_PREFIXES if there's no peer
+ROUTER_DECISION_LOG=             Where to record how each request is routed: 'api' to stream from /decisions, or a file to append JSON to (disabled if unset)
 DEBUG=                           Whether to enable debug output - set to anything to enable
 
+Malformed requests: (rejected before routing, and counted by reason)
+
+ROUTER_MAX_HEADER_BYTES=0      Largest total size (in bytes) of a request's headers (0 for net/http's limit of 1MB)
+ROUTER_ALLOWED_METHODS=        Comma-separated methods which can be routed, or '*' for any (any method if unset)
+ROUTER_REQUIRE_UTF8_PATHS=     Whether to reject requests whose paths aren't valid UTF-8 once decoded - set to anything to enable
+ROUTER_HOSTNAMES=              Comma-separated hosts the router serves, the first being the default host (any host if unset)
+ROUTER_UNKNOWN_HOSTS=allow     What to do with requests for other hosts: 'allow' them, 'reject' them or route them to the 'default' host
+ROUTER_ABSOLUTE_URIS=allow     What to do with proxy-style requests with an absolute URI, e.g. 'GET http://host/path': 'allow' or 'reject' them
+
+Watchdog: (checks the router process for goroutine, memory and file descriptor leaks)
+
+ROUTER_WATCHDOG_INTERVAL=             Interval between checks, e.g. '30s' (disabled if unset)
+ROUTER_WATCHDOG_MAX_GOROUTINES=10000  Number of goroutines which suggests a leak
+ROUTER_WATCHDOG_DUMP_DIR=$TMPDIR      Directory to write goroutine and heap profiles to when a problem is found
+ROUTER_WATCHDOG_SENTRY=               Whether to report problems to Sentry - set to anything to enable
+
+Request coalescing:
+
+ROUTER_COALESCE_REQUESTS=              Whether to coalesce identical in-flight GET requests to a backend - set to anything to enable
+ROUTER_COALESCE_MAX_BODY_SIZE=1048576  Largest response body (in bytes) to share between coalesced requests
+
+Retry budgets: (applied to hedge requests)
+
+ROUTER_RETRY_BUDGET_PERCENT=5    Most requests to a backend which may be retried, as a percentage of its requests
+ROUTER_RETRY_BUDGET_WINDOW=10s   Period over which requests and retries are counted
+ROUTER_RETRY_BUDGET_MIN=3        Number of retries allowed in each period regardless of the percentage
+
+Circuit breakers: (only used for backends with a fallback page or URL)
+
+ROUTER_CIRCUIT_BREAKER_FAILURES=5    Consecutive failed requests after which a backend's fallback is served
+ROUTER_CIRCUIT_BREAKER_COOLDOWN=10s  How long to serve the fallback before trying the backend again
+
+Backend budgets: (for backends with a latency_budget or error_budget)
+
+ROUTER_BUDGET_WINDOW=1m    Period over which backends' requests are checked against their budgets
+ROUTER_ALERT_WEBHOOK_URL=  URL to POST alerts to as JSON when a backend goes over or comes back within a budget
+
+Middleware: (applied to every request, in the order listed)
+
+ROUTER_MIDDLEWARE=          Comma-separated middleware to use: logging, metrics, auth, rate-limit, headers, signon, banner, https
+ROUTER_ACCESS_LOG=STDOUT    File to log requests to (in JSON format), for "logging"
+ROUTER_BASIC_AUTH=          Username and password ('user:password') required by "auth"
+ROUTER_RATE_LIMIT=10        Requests per second allowed from each client by "rate-limit"
+ROUTER_RATE_LIMIT_BURST=20  Requests each client may make at once before "rate-limit" applies
+ROUTER_REQUEST_HEADERS=     JSON object of headers for "headers" to set on requests (empty values remove them)
+ROUTER_RESPONSE_HEADERS=    JSON object of headers for "headers" to set on responses (empty values remove them)
+ROUTER_BANNER_FILE=         HTML fragment for "banner" to add to the top of pages (checked for changes every 5s)
+ROUTER_HSTS=                Strict-Transport-Security header for "https" to send over HTTPS, e.g. 'max-age=31536000' (not sent if unset)
+
+Access log sampling: (for "logging", and adjustable for each route or backend through the API)
+
+ROUTER_ACCESS_LOG_SAMPLE_RATE=1  Fraction of requests to log, unless a route or backend sets its own log_sample_rate
+
+Client IP addresses: (used by "logging", "rate-limit" and the client policy)
+
+ROUTER_CLIENT_IP=forwarded-for          Where to find the client's address: 'forwarded-for', 'header' or 'socket' (the connection's address)
+ROUTER_CLIENT_IP_HEADER=True-Client-IP  Header set by the CDN with the client's address, for 'header'
+ROUTER_TRUSTED_PROXIES=                 Comma-separated IP addresses and CIDR ranges of proxies to skip over in X-Forwarded-For, for 'forwarded-for', and whose X-Forwarded-Host and X-Forwarded-Proto are believed
+
+Client policy: (fetched from a central service by "rate-limit")
+
+ROUTER_CLIENT_POLICY_URL=              URL of a signed client policy of clients to block and rate limits to override (disabled if unset)
+ROUTER_CLIENT_POLICY_KEY=              Base64-encoded Ed25519 public key to check the policy's signature with
+ROUTER_CLIENT_POLICY_POLL_INTERVAL=1m  Interval to fetch the policy again (the last good one is kept until it expires)
+ROUTER_CLIENT_POLICY_MAX_AGE=24h       Oldest a fetched policy may be, by its issued_at time, to be accepted (0 for any age)
+
+Signon sessions: (checked by "signon", e.g. for draft content)
+
+ROUTER_SIGNON_COOKIE=signon_session  Name of the signon session cookie
+ROUTER_SIGNON_SECRET=                Secret for checking signed session cookies
+ROUTER_SIGNON_AUTH_URL=              URL to check other sessions with, passing on the request's cookies
+ROUTER_SIGNON_CACHE_TTL=1m           How long to remember sessions checked with ROUTER_SIGNON_AUTH_URL
+ROUTER_SIGNON_LOGIN_URL=             URL to send users who aren't signed in to (they get a 401 if unset)
+
+Transformation rules: (applied to every request before it's routed)
+
+ROUTER_RULES_FILE=               JSON file of rules matching requests to redirect, rewrite or respond to them (disabled if unset)
+ROUTER_RULES_POLL_INTERVAL=10s   Interval to check the rules file for changes
+
+CDN caching:
+
+ROUTER_SURROGATE_KEYS=                     Whether to tag responses with Surrogate-Key headers for their route and backend - set to anything to enable
+ROUTER_CDN_API_URL=https://api.fastly.com  Base URL of the Fastly API, used to purge the cache through the router's API
+ROUTER_CDN_API_KEY=                        Fastly API token for purging (purging is disabled if unset)
+ROUTER_CDN_SERVICE_ID=                     Fastly service to purge surrogate keys from
+ROUTER_CDN_HOST=                           Public host name to purge paths for, e.g. 'www.gov.uk'
+ROUTER_CDN_PURGE_CHANGED_ROUTES=           Whether to purge routes removed or changed by a reload (by surrogate key if enabled) - set to anything to enable
+
 Timeouts: (values must be parseable by http://golang.org/pkg/time/#ParseDuration)
 
 ROUTER_BACKEND_CONNECT_TIMEOUT=1s  Connect timeout when connecting to backends
 ROUTER_BACKEND_HEADER_TIMEOUT=15s  Timeout for backend response headers to be returned
+
+Backend connections: (durations as above)
+
+ROUTER_BACKEND_KEEPALIVE=30s         Interval between TCP keepalive probes on backend connections
+ROUTER_BACKEND_FALLBACK_DELAY=300ms  Delay before also trying the other address family for dual-stack backends
+ROUTER_BACKEND_LOCAL_ADDR=           Local IP address to dial backends from (chosen automatically if unset)
+ROUTER_BACKEND_ADDRESS_FAMILY=       Address family to try first for dual-stack backends ('ipv4' or 'ipv6')
+ROUTER_SIGNING_KEY=                  HMAC key to sign requests to backends with, so they can check they came through the router
+ROUTER_SIGNING_KEY_ID=               Identifier for the signing key, sent to backends with each signature
+
+Listen addresses may be given as a comma-separated list, e.g. '10.0.0.1:8080,[fd00::1]:8080'.
+A wildcard address such as ':8080' or '[::]:8080' accepts both IPv4 and IPv6 connections.
 `
 	fmt.Fprintf(os.Stderr, helpstring, versionInfo(), os.Args[0])
 	os.Exit(2)
@@ -73,6 +295,287 @@ func logDebug(msg ...interface{}) {
 	}
 }
 
+func configureClientIP() error {
+	switch clientIPSource {
+	case handlers.ClientIPForwardedFor, handlers.ClientIPSocket:
+	case handlers.ClientIPHeader:
+		handlers.ClientIPHeaderName = clientIPHeader
+	default:
+		return fmt.Errorf("router: invalid client IP source %q (must be 'forwarded-for', 'header' or 'socket')", clientIPSource)
+	}
+	handlers.ClientIPSource = clientIPSource
+
+	proxies, err := handlers.ParseNetworks(parseList(trustedProxies))
+	if err != nil {
+		return fmt.Errorf("router: invalid trusted proxies: %v", err)
+	}
+	handlers.TrustedProxies = proxies
+
+	if clientIPSource == handlers.ClientIPHeader {
+		logInfo("router: taking client IP addresses from the", clientIPHeader, "header")
+	} else {
+		logInfo("router: taking client IP addresses from", clientIPSource)
+	}
+	return nil
+}
+
+func configureBackendDialer() error {
+	keepAlive, err := time.ParseDuration(backendKeepAlive)
+	if err != nil {
+		return err
+	}
+	fallbackDelay, err := time.ParseDuration(backendFallbackDelay)
+	if err != nil {
+		return err
+	}
+	handlers.BackendKeepAlive = keepAlive
+	handlers.BackendFallbackDelay = fallbackDelay
+	logInfo("router: using backend TCP keepalive interval:", keepAlive)
+	logInfo("router: using backend dial fallback delay:", fallbackDelay)
+
+	if backendLocalAddr != "" {
+		ip := net.ParseIP(backendLocalAddr)
+		if ip == nil {
+			return fmt.Errorf("router: invalid backend local address %q", backendLocalAddr)
+		}
+		handlers.BackendLocalAddr = &net.TCPAddr{IP: ip}
+		logInfo("router: dialling backends from local address:", ip)
+	}
+
+	switch backendAddressFamily {
+	case "":
+	case "ipv4", "ipv6":
+		handlers.BackendAddressFamily = backendAddressFamily
+		logInfo("router: preferring backend address family:", backendAddressFamily)
+	default:
+		return fmt.Errorf("router: invalid backend address family %q (must be 'ipv4' or 'ipv6')", backendAddressFamily)
+	}
+
+	return nil
+}
+
+func routerOptions() (o Options, err error) {
+	o = Options{
+		RouteSource:      routeSource,
+		MongoURL:         mongoURL,
+		MongoDbName:      mongoDbName,
+		LogFileName:      errorLogFile,
+		CoalesceRequests: coalesceRequests,
+		VerifyRoutes:     verifyRoutes,
+		RouteArchives:    routeArchives,
+		Middleware:       parseList(middlewareList),
+		MirrorURL:        mirrorURL,
+		DecisionLog:      decisionLogSink,
+	}
+	o.AccessLogFileName = accessLogFile
+	o.RouteChecksum = routeChecksum
+	o.RulesFileName = rulesFileName
+	o.MirrorPrefixes = parseList(mirrorPrefixes)
+	o.PreviewTokens = parseList(previewTokens)
+	o.NotFoundBackend = notFoundBackend
+	o.LocalePrefixes = parseList(localePrefixes)
+	o.LocaleFallback = localeFallback
+	o.ShardPrefixes = parseList(shardPrefixes)
+	o.ShardPeerURL = shardPeerURL
+	o.Hostnames = parseList(hostnames)
+	o.UnknownHosts = unknownHosts
+	o.AbsoluteURIs = absoluteURIs
+	if allowedMethods != "*" {
+		o.AllowedMethods = parseList(allowedMethods)
+	}
+	o.RequireUTF8Paths = requireUTF8Paths
+	o.BannerFileName = bannerFileName
+	o.HSTS = hsts
+	o.SurrogateKeys = surrogateKeys
+	o.PurgeChangedRoutes = cdnPurgeRoutes
+	o.AlertWebhookURL = alertWebhookURL
+	o.CDN = CDNConfig{
+		APIURL:    cdnAPIURL,
+		APIKey:    cdnAPIKey,
+		ServiceID: cdnServiceID,
+		Host:      cdnHost,
+	}
+	o.Signon = handlers.SignonConfig{
+		CookieName:   signonCookieName,
+		CookieSecret: []byte(signonSecret),
+		AuthURL:      signonAuthURL,
+		LoginURL:     signonLoginURL,
+	}
+
+	if o.MongoPollInterval, err = time.ParseDuration(mongoPollInterval); err != nil {
+		return
+	}
+	if o.MongoMaxDocumentSize, err = strconv.Atoi(mongoDocLimit); err != nil {
+		return
+	}
+	if o.LoadWorkers, err = strconv.Atoi(loadWorkers); err != nil {
+		return
+	}
+	if o.ReloadProgressInterval, err = time.ParseDuration(reloadLogInterval); err != nil {
+		return
+	}
+	if o.ReloadTimeout, err = time.ParseDuration(reloadTimeout); err != nil {
+		return
+	}
+	if o.BackendGracePeriod, err = time.ParseDuration(backendGracePeriod); err != nil {
+		return
+	}
+	if o.StandbyMaxRoutes, err = strconv.Atoi(standbyMaxRoutes); err != nil {
+		return
+	}
+	if o.ShardMissStatus, err = strconv.Atoi(shardMissStatus); err != nil {
+		return
+	}
+	if o.MaxHeaderBytes, err = strconv.Atoi(maxHeaderBytes); err != nil {
+		return
+	}
+	if o.BackendConnectTimeout, err = time.ParseDuration(backendConnectTimeout); err != nil {
+		return
+	}
+	if o.BackendHeaderTimeout, err = time.ParseDuration(backendHeaderTimeout); err != nil {
+		return
+	}
+	if o.CoalesceMaxBodySize, err = strconv.ParseInt(coalesceMaxBodySize, 10, 64); err != nil {
+		return
+	}
+	if o.RetryBudget.Percent, err = strconv.ParseFloat(retryBudgetPercent, 64); err != nil {
+		return
+	}
+	if o.RetryBudget.Window, err = time.ParseDuration(retryBudgetWindow); err != nil {
+		return
+	}
+	if o.RetryBudget.MinRetries, err = strconv.Atoi(retryBudgetMin); err != nil {
+		return
+	}
+	if o.CircuitBreaker.Failures, err = strconv.Atoi(breakerFailures); err != nil {
+		return
+	}
+	if o.CircuitBreaker.Cooldown, err = time.ParseDuration(breakerCooldown); err != nil {
+		return
+	}
+	if o.BudgetWindow, err = time.ParseDuration(budgetWindow); err != nil {
+		return
+	}
+	if basicAuth != "" {
+		var ok bool
+		if o.BasicAuthUsername, o.BasicAuthPassword, ok = cutString(basicAuth, ":"); !ok {
+			err = fmt.Errorf("router: ROUTER_BASIC_AUTH must be of the form 'user:password'")
+			return
+		}
+	}
+	if o.RateLimit.Rate, err = strconv.ParseFloat(rateLimit, 64); err != nil {
+		return
+	}
+	if o.RateLimit.Burst, err = strconv.Atoi(rateLimitBurst); err != nil {
+		return
+	}
+	if o.RequestHeaders, err = parseHeaders(requestHeaders); err != nil {
+		return
+	}
+	if o.ResponseHeaders, err = parseHeaders(responseHeaders); err != nil {
+		return
+	}
+	if o.AccessLogSampleRate, err = strconv.ParseFloat(accessLogSampleRate, 64); err != nil {
+		return
+	}
+	if o.AccessLogSampleRate < 0 || o.AccessLogSampleRate > 1 {
+		err = fmt.Errorf("router: ROUTER_ACCESS_LOG_SAMPLE_RATE must be between 0 and 1")
+		return
+	}
+	if o.RulesPollInterval, err = time.ParseDuration(rulesPollInterval); err != nil {
+		return
+	}
+	if o.Signon.CacheTTL, err = time.ParseDuration(signonCacheTTL); err != nil {
+		return
+	}
+	if clientPolicyURL != "" {
+		o.ClientPolicyURL = clientPolicyURL
+		if o.ClientPolicyKey, err = base64.StdEncoding.DecodeString(clientPolicyKey); err != nil {
+			err = fmt.Errorf("router: ROUTER_CLIENT_POLICY_KEY must be base64-encoded: %v", err)
+			return
+		}
+		if o.ClientPolicyPollInterval, err = time.ParseDuration(clientPolicyInterval); err != nil {
+			return
+		}
+		if o.ClientPolicyMaxAge, err = time.ParseDuration(clientPolicyMaxAge); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// parseList parses a comma-separated list, ignoring empty items.
+func parseList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// cutString splits s around the first instance of sep.
+func cutString(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// startWatchdog starts the watchdog, if it's enabled.
+func startWatchdog() error {
+	if watchdogInterval == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(watchdogInterval)
+	if err != nil {
+		return err
+	}
+	maxGoroutines, err := strconv.Atoi(watchdogGoroutines)
+	if err != nil {
+		return err
+	}
+	go newWatchdog(interval, maxGoroutines, watchdogDumpDir, watchdogSentry).run()
+	logInfo("router: watchdog checking the router process every", interval)
+	return nil
+}
+
+// publicHandler wraps a handler for public requests on addr, accepting
+// cleartext HTTP/2 if it's enabled.
+func publicHandler(handler http.Handler, addr string) http.Handler {
+	if !enableH2C {
+		return handler
+	}
+	// Accepts both HTTP/2 with prior knowledge and HTTP/1.1 requests
+	// asking to upgrade, alongside plain HTTP/1.1.
+	logInfo("router: accepting cleartext HTTP/2 (h2c) requests on " + addr)
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// listenAndServeAll serves handler on each of a comma-separated list of
+// addresses. The first address uses ident as its tablecloth identifier, and
+// subsequent ones have a numeric suffix appended. Requests are tagged with
+// the identifier as their listener's name, for the access log and metrics,
+// and then passed through wrap for the address if it's given.
+func listenAndServeAll(addrs string, handler http.Handler, ident string,
+	wrap func(http.Handler, string) http.Handler, wg *sync.WaitGroup) {
+	for i, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		listenerIdent := ident
+		if i > 0 {
+			listenerIdent = fmt.Sprintf("%s-%d", ident, i)
+		}
+		listenerHandler := handlers.NewListenerMiddleware(listenerIdent)(handler)
+		if wrap != nil {
+			listenerHandler = wrap(listenerHandler, addr)
+		}
+		wg.Add(1)
+		go catchListenAndServe(addr, listenerHandler, listenerIdent, wg)
+	}
+}
+
 func catchListenAndServe(addr string, handler http.Handler, ident string, wg *sync.WaitGroup) {
 	defer wg.Done()
 	err := tablecloth.ListenAndServe(addr, handler, ident)
@@ -100,6 +603,19 @@ func main() {
 			"Do not use this option in a production environment.")
 	}
 
+	if err := configureBackendDialer(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureClientIP(); err != nil {
+		log.Fatal(err)
+	}
+
+	if requestSigningKey != "" {
+		handlers.RequestSigningKey = []byte(requestSigningKey)
+		handlers.RequestSigningKeyID = requestSigningKeyID
+		logInfo("router: signing requests to backends")
+	}
+
 	// Set working dir for tablecloth if available This is to allow restarts to
 	// pick up new versions.
 	// See http://godoc.org/github.com/alext/tablecloth#pkg-variables for details
@@ -107,22 +623,88 @@ func main() {
 		tablecloth.WorkingDir = wd
 	}
 
-	rout, err := NewRouter(mongoURL, mongoDbName, mongoPollInterval, backendConnectTimeout, backendHeaderTimeout, errorLogFile)
+	opts, err := routerOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	namespaces, err := parseNamespaces(routeNamespaces)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.shared = newNamespaceShared()
+
+	switch flag.Arg(0) {
+	case "":
+	case "verify":
+		status := runVerify(opts, os.Stdout)
+		for _, name := range namespaceNames(namespaces) {
+			fmt.Fprintln(os.Stdout, "router verify: checking namespace", name)
+			if nsStatus := runVerify(namespaces[name].options(name, opts), os.Stdout); nsStatus != 0 {
+				status = nsStatus
+			}
+		}
+		os.Exit(status)
+	case "smoke":
+		os.Exit(runSmoke(opts, flag.Args()[1:], os.Stdout))
+	case "diff-sources":
+		os.Exit(runDiffSources(opts, namespaces, flag.Args()[1:], os.Stdout))
+	default:
+		fmt.Fprintf(os.Stderr, "router: unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+	}
+
+	if err := startWatchdog(); err != nil {
+		log.Fatal(err)
+	}
+
+	if shadowSource != "" {
+		if opts.ShadowSource, err = newShadowSource(shadowSource, opts, namespaces); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	rout, err := NewRouterWithOptions(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 	go rout.SelfUpdateRoutes()
 
 	wg := &sync.WaitGroup{}
-	wg.Add(2)
-	go catchListenAndServe(pubAddr, rout, "proxy", wg)
+
+	pubSwitch := newHostSwitch(rout)
+	nsRouters := make(map[string]*Router)
+	for _, name := range namespaceNames(namespaces) {
+		ns := namespaces[name]
+		nsRouter, err := NewRouterWithOptions(ns.options(name, opts))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go nsRouter.SelfUpdateRoutes()
+		nsRouters[name] = nsRouter
+
+		for _, host := range ns.Hosts {
+			pubSwitch.add(host, nsRouter)
+			logInfo(fmt.Sprintf("router: serving namespace %s for requests to %s", name, host))
+		}
+		if ns.PubAddr != "" {
+			listenAndServeAll(ns.PubAddr, nsRouter, "proxy-"+name, publicHandler, wg)
+			logInfo(fmt.Sprintf("router: listening for requests to namespace %s on %s", name, ns.PubAddr))
+		}
+	}
+
+	var pub http.Handler = rout
+	if len(pubSwitch.byHost) > 0 {
+		pub = pubSwitch
+	}
+	listenAndServeAll(pubAddr, pub, "proxy", publicHandler, wg)
 	logInfo("router: listening for requests on " + pubAddr)
 
-	api, err := newAPIHandler(rout)
+	api, err := newNamespacedAPIHandler(rout, nsRouters)
 	if err != nil {
 		log.Fatal(err)
 	}
-	go catchListenAndServe(apiAddr, api, "api", wg)
+	listenAndServeAll(apiAddr, api, "api", nil, wg)
 	logInfo("router: listening for refresh on " + apiAddr)
 
 	wg.Wait()
@@ -27,19 +27,180 @@ var (
 		},
 	)
 
+	backendDrainedMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_backend_drained",
+			Help: "Whether each backend has been drained through the API (1) or not (0)",
+		},
+		[]string{"backend_id"},
+	)
+
+	backendGraceMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_backend_grace",
+			Help: "Whether routes are using a backend's previous handler because a reload removed it (1) or not (0)",
+		},
+		[]string{"backend_id"},
+	)
+
+	backendBudgetBreachedMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_backend_budget_breached",
+			Help: "Whether each backend went over its latency or error budget in the last window (1) or not (0)",
+		},
+		[]string{"backend_id", "budget"},
+	)
+
+	disabledPathsMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_disabled_paths",
+			Help: "Number of paths currently disabled through the API (namespace is empty for the main routes)",
+		},
+		[]string{"namespace"},
+	)
+
+	mirrorEnabledMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_mirror_enabled",
+			Help: "Whether requests are being served from the mirror through the API (1) or not (0) (namespace is empty for the main routes)",
+		},
+		[]string{"namespace"},
+	)
+
+	cdnPurgeCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_cdn_purge_total",
+			Help: "Number of CDN purge requests made, by what was purged (path or key) and whether they succeeded",
+		},
+		[]string{"type", "result"},
+	)
+
+	clientPolicyUpdatedMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "router_client_policy_last_update_timestamp_seconds",
+			Help: "When the client policy was last fetched successfully, in seconds since the Unix epoch",
+		},
+	)
+
+	watchdogProblemMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_watchdog_problem",
+			Help: "Whether the watchdog currently sees each problem with the router process (1) or not (0)",
+		},
+		[]string{"problem"},
+	)
+
 	routesCountMetric = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "router_routes_loaded",
 			Help: "Number of routes currently loaded",
 		},
 	)
+
+	namespaceRoutesCountMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_namespace_routes_loaded",
+			Help: "Number of routes currently loaded in each route namespace",
+		},
+		[]string{"namespace"},
+	)
+
+	oversizedRouteDocumentCountMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "router_oversized_route_documents_total",
+			Help: "Number of route documents which failed reloads because they were larger than ROUTER_MONGO_DOC_LIMIT",
+		},
+	)
+
+	hostPolicyCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_host_policy_requests_total",
+			Help: "Number of requests for an unknown host or with an absolute-form URI, by what was done with them (namespace is empty for the main routes)",
+		},
+		[]string{"namespace", "request", "action"},
+	)
+
+	malformedRequestCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_malformed_requests_total",
+			Help: "Number of malformed requests rejected before routing, by reason (namespace is empty for the main routes)",
+		},
+		[]string{"namespace", "reason"},
+	)
+
+	localeFallbackCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_locale_fallback_total",
+			Help: "Number of requests under a locale prefix served by the route for the path without it, by locale and whether they were redirected or proxied",
+		},
+		[]string{"locale", "fallback"},
+	)
+
+	shardMissCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_shard_misses_total",
+			Help: "Number of requests for paths outside the router's shard, by whether they were forwarded to the peer or rejected",
+		},
+		[]string{"result"},
+	)
+
+	shadowComparisonCountMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "router_shadow_comparisons_total",
+			Help: "Number of requests whose route was compared with the shadow routes, by whether they matched (dropped if the comparison queue was full)",
+		},
+		[]string{"result"},
+	)
+
+	unsupportedSchemaDocumentsMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_unsupported_schema_documents",
+			Help: "Number of backend and route documents in the last load with a schema version the router doesn't support, by type",
+		},
+		[]string{"type"},
+	)
+
+	routesByBackendMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_routes_by_backend",
+			Help: "Number of routes currently loaded for each backend, by handler type (namespace is empty for the main routes)",
+		},
+		[]string{"namespace", "backend_id", "handler"},
+	)
+
+	routesByDocumentTypeMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "router_routes_by_document_type",
+			Help: "Number of routes currently loaded for each document type, by handler type (namespace is empty for the main routes)",
+		},
+		[]string{"namespace", "document_type", "handler"},
+	)
 )
 
 func initMetrics() {
 	prometheus.MustRegister(internalServerErrorCountMetric)
+	prometheus.MustRegister(malformedRequestCountMetric)
+	prometheus.MustRegister(hostPolicyCountMetric)
+	prometheus.MustRegister(localeFallbackCountMetric)
+	prometheus.MustRegister(shadowComparisonCountMetric)
+	prometheus.MustRegister(shardMissCountMetric)
 
 	prometheus.MustRegister(routeReloadCountMetric)
 	prometheus.MustRegister(routeReloadErrorCountMetric)
 
 	prometheus.MustRegister(routesCountMetric)
+	prometheus.MustRegister(namespaceRoutesCountMetric)
+	prometheus.MustRegister(routesByBackendMetric)
+	prometheus.MustRegister(oversizedRouteDocumentCountMetric)
+	prometheus.MustRegister(unsupportedSchemaDocumentsMetric)
+	prometheus.MustRegister(routesByDocumentTypeMetric)
+
+	prometheus.MustRegister(backendDrainedMetric)
+	prometheus.MustRegister(backendGraceMetric)
+	prometheus.MustRegister(backendBudgetBreachedMetric)
+	prometheus.MustRegister(disabledPathsMetric)
+	prometheus.MustRegister(mirrorEnabledMetric)
+	prometheus.MustRegister(cdnPurgeCountMetric)
+	prometheus.MustRegister(clientPolicyUpdatedMetric)
+	prometheus.MustRegister(watchdogProblemMetric)
 }
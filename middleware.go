@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alphagov/router/handlers"
+)
+
+// MiddlewareFactory creates a middleware configured by o.
+type MiddlewareFactory func(o Options) (handlers.Middleware, error)
+
+var (
+	middlewareMu        sync.Mutex
+	middlewareFactories = make(map[string]MiddlewareFactory)
+)
+
+func init() {
+	RegisterMiddleware("logging", newAccessLogMiddleware)
+	RegisterMiddleware("metrics", func(o Options) (handlers.Middleware, error) {
+		return handlers.NewMetricsMiddleware(), nil
+	})
+	RegisterMiddleware("auth", newBasicAuthMiddleware)
+	RegisterMiddleware("rate-limit", newRateLimitMiddleware)
+	RegisterMiddleware("headers", func(o Options) (handlers.Middleware, error) {
+		return handlers.NewHeaderMiddleware(o.RequestHeaders, o.ResponseHeaders), nil
+	})
+	RegisterMiddleware("signon", newSignonMiddleware)
+	RegisterMiddleware("banner", newBannerMiddleware)
+	RegisterMiddleware("https", func(o Options) (handlers.Middleware, error) {
+		return handlers.NewHTTPSMiddleware(o.HSTS, o.Hostnames), nil
+	})
+}
+
+// RegisterMiddleware makes a middleware available under name, for use in
+// ROUTER_MIDDLEWARE. It's intended to be called from init functions, and
+// panics if name is already registered.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+
+	if _, ok := middlewareFactories[name]; ok {
+		panic(fmt.Sprintf("router: middleware %q registered twice", name))
+	}
+	middlewareFactories[name] = factory
+}
+
+// middlewareSet creates the middleware used by a router. Each middleware is
+// only created once, so that those with state, such as rate limiters, share
+// it between all the routes they're used for.
+type middlewareSet struct {
+	options  Options
+	global   []string
+	sampling *logSampling
+
+	// globalChain is the chain of global middleware, used for requests which
+	// don't match a route.
+	globalChain handlers.Middleware
+
+	mu    sync.Mutex
+	built map[string]handlers.Middleware
+}
+
+// newMiddlewareSet creates the middleware named in o.Middleware, which is
+// applied to every route unless the route opts out of it.
+func newMiddlewareSet(o Options) (*middlewareSet, error) {
+	s := &middlewareSet{
+		options:  o,
+		global:   o.Middleware,
+		sampling: newLogSampling(o.AccessLogSampleRate),
+		built:    make(map[string]handlers.Middleware),
+	}
+
+	globalChain, err := s.chain(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.globalChain = globalChain
+	return s, nil
+}
+
+// get returns the named middleware, creating it if necessary.
+func (s *middlewareSet) get(name string) (handlers.Middleware, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.built[name]; ok {
+		return m, nil
+	}
+
+	middlewareMu.Lock()
+	factory, ok := middlewareFactories[name]
+	middlewareMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("router: unknown middleware %q (available: %s)",
+			name, strings.Join(middlewareNames(), ", "))
+	}
+	m, err := factory(s.options)
+	if err != nil {
+		return nil, fmt.Errorf("router: couldn't create middleware %q: %v", name, err)
+	}
+	s.built[name] = m
+	return m, nil
+}
+
+// chain returns the global middleware apart from those in skip, followed by
+// those in extra, the first being outermost. Nothing is included twice.
+func (s *middlewareSet) chain(skip, extra []string) (handlers.Middleware, error) {
+	var names []string
+	included := make(map[string]bool)
+	for _, name := range s.global {
+		if !containsString(skip, name) && !included[name] {
+			names = append(names, name)
+			included[name] = true
+		}
+	}
+	for _, name := range extra {
+		if !included[name] {
+			names = append(names, name)
+			included[name] = true
+		}
+	}
+
+	chain := make([]handlers.Middleware, 0, len(names))
+	for _, name := range names {
+		m, err := s.get(name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, m)
+	}
+	return handlers.Chain(chain...), nil
+}
+
+// forRoute returns the middleware for a route, taking into account the
+// middleware the route and its backend (if any) opt into and out of.
+//
+// If surrogate keys are enabled, the route's keys are added to its responses
+// inside all the other middleware. If requests are logged, the route's log
+// sample rate is set outside it, as are its analytics tags, so that they're
+// logged too.
+func (s *middlewareSet) forRoute(route *Route, backend *Backend) (handlers.Middleware, error) {
+	skip, extra := route.SkipMiddleware, route.Middleware
+	if backend != nil {
+		skip = append(append([]string(nil), backend.SkipMiddleware...), skip...)
+		extra = append(append([]string(nil), backend.Middleware...), extra...)
+	}
+
+	chain := s.globalChain
+	if len(skip) > 0 || len(extra) > 0 {
+		var err error
+		if chain, err = s.chain(skip, extra); err != nil {
+			return nil, err
+		}
+	}
+	if s.options.SurrogateKeys {
+		chain = handlers.Chain(chain, handlers.NewSurrogateKeyMiddleware(route.surrogateKeys()...))
+	}
+	if containsString(s.global, "logging") || containsString(extra, "logging") {
+		chain = handlers.Chain(handlers.NewLogSampleRateMiddleware(s.sampling.rateFunc(route, backend)), chain)
+	}
+	if tags := route.analyticsTags(); len(tags) > 0 {
+		chain = handlers.Chain(handlers.NewAnalyticsTagMiddleware(tags), chain)
+	}
+	return chain, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func middlewareNames() []string {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+
+	names := make([]string, 0, len(middlewareFactories))
+	for name := range middlewareFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newAccessLogMiddleware(o Options) (handlers.Middleware, error) {
+	l, err := o.shared.logger(o.AccessLogFileName)
+	if err != nil {
+		return nil, err
+	}
+	logInfo("router: logging requests as JSON to", o.AccessLogFileName)
+	if o.AccessLogSampleRate < 1 {
+		logInfo(fmt.Sprintf("router: logging %v of requests by default", o.AccessLogSampleRate))
+	}
+	return handlers.NewSampledAccessLogMiddleware(l, o.AccessLogSampleRate), nil
+}
+
+func newBasicAuthMiddleware(o Options) (handlers.Middleware, error) {
+	if o.BasicAuthUsername == "" || o.BasicAuthPassword == "" {
+		return nil, fmt.Errorf("a username and password are needed")
+	}
+	return handlers.NewBasicAuthMiddleware(o.BasicAuthUsername, o.BasicAuthPassword, "GOV.UK"), nil
+}
+
+func newRateLimitMiddleware(o Options) (handlers.Middleware, error) {
+	if o.RateLimit.Rate <= 0 || o.RateLimit.Burst < 1 {
+		return nil, fmt.Errorf("the rate must be positive and the burst at least 1")
+	}
+	logInfo(fmt.Sprintf("router: limiting clients to %v requests per second (bursts of %d)",
+		o.RateLimit.Rate, o.RateLimit.Burst))
+
+	config := o.RateLimit
+	if o.ClientPolicyURL != "" {
+		if len(o.ClientPolicyKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("a client policy needs an Ed25519 public key to check it with")
+		}
+		source := o.shared.clientPolicySource(o)
+		logInfo("router: applying the client policy from", o.ClientPolicyURL)
+		config.Rules = source.current
+	}
+	return handlers.NewRateLimitMiddleware(config), nil
+}
+
+func newSignonMiddleware(o Options) (handlers.Middleware, error) {
+	if len(o.Signon.CookieSecret) == 0 && o.Signon.AuthURL == "" {
+		return nil, fmt.Errorf("a cookie secret or an auth URL is needed")
+	}
+	if o.Signon.AuthURL != "" {
+		logInfo("router: checking signon sessions with", o.Signon.AuthURL)
+	}
+	return handlers.NewSignonMiddleware(o.Signon), nil
+}
+
+func newBannerMiddleware(o Options) (handlers.Middleware, error) {
+	if o.BannerFileName == "" {
+		return nil, fmt.Errorf("a banner file is needed")
+	}
+	return handlers.NewBannerMiddleware(newBannerFile(o.BannerFileName).current), nil
+}
+
+// parseHeaders parses a JSON object of header names and values, as used by
+// the "headers" middleware.
+func parseHeaders(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(s), &headers); err != nil {
+		return nil, fmt.Errorf("router: couldn't parse headers %q: %v", s, err)
+	}
+	return headers, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/alphagov/router/handlers"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var counterCreations int
+
+func init() {
+	RegisterMiddleware("test-counter", func(o Options) (handlers.Middleware, error) {
+		counterCreations++
+		return func(next http.Handler) http.Handler { return next }, nil
+	})
+}
+
+var _ = Describe("Middleware configuration", func() {
+	var rt *Router
+
+	useMiddleware := func(o Options) {
+		o.BasicAuthUsername, o.BasicAuthPassword = "user", "secret"
+		o.ResponseHeaders = map[string]string{"X-Frame-Options": "DENY"}
+		middleware, err := newMiddlewareSet(o)
+		Expect(err).NotTo(HaveOccurred())
+
+		rt = newTestRouter()
+		rt.setMiddleware(middleware)
+	}
+
+	loadRoutes := func(backends []Backend, routes []Route) {
+		rt.mux, _ = rt.buildMux(&RouteTable{Backends: backends, Routes: routes})
+	}
+
+	serve := func(path string, authenticated bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if authenticated {
+			req.SetBasicAuth("user", "secret")
+		}
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("should apply the global middleware to every request", func() {
+		useMiddleware(Options{Middleware: []string{"headers", "auth"}})
+		loadRoutes(nil, []Route{{IncomingPath: "/foo", RouteType: "prefix", Handler: "gone"}})
+
+		rw := serve("/foo", false)
+		Expect(rw.Code).To(Equal(http.StatusUnauthorized))
+		Expect(rw.Header().Get("X-Frame-Options")).To(Equal("DENY"))
+
+		rw = serve("/foo", true)
+		Expect(rw.Code).To(Equal(http.StatusGone))
+		Expect(rw.Header().Get("X-Frame-Options")).To(Equal("DENY"))
+
+		Expect(serve("/bar", false).Code).To(Equal(http.StatusUnauthorized))
+		Expect(serve("/bar", true).Code).To(Equal(http.StatusNotFound))
+
+		rt.disabledPaths.disable(DisabledPath{Path: "/foo/disabled"})
+		Expect(serve("/foo/disabled", false).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should let routes and backends opt out of global middleware", func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer backend.Close()
+
+		useMiddleware(Options{Middleware: []string{"headers", "auth"}})
+		loadRoutes(
+			[]Backend{{BackendID: "healthcheck", BackendURL: backend.URL, SkipMiddleware: []string{"auth"}}},
+			[]Route{
+				{IncomingPath: "/public", RouteType: "prefix", Handler: "gone", SkipMiddleware: []string{"auth"}},
+				{IncomingPath: "/healthcheck", RouteType: "exact", Handler: "backend", BackendID: "healthcheck"},
+				{IncomingPath: "/private", RouteType: "prefix", Handler: "gone"},
+			},
+		)
+
+		rw := serve("/public", false)
+		Expect(rw.Code).To(Equal(http.StatusGone))
+		Expect(rw.Header().Get("X-Frame-Options")).To(Equal("DENY"))
+		Expect(serve("/healthcheck", false).Code).To(Equal(http.StatusOK))
+		Expect(serve("/private", false).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should let routes opt into extra middleware", func() {
+		useMiddleware(Options{})
+		loadRoutes(nil, []Route{
+			{IncomingPath: "/admin", RouteType: "prefix", Handler: "gone", Middleware: []string{"auth"}},
+			{IncomingPath: "/public", RouteType: "prefix", Handler: "gone"},
+		})
+
+		Expect(serve("/admin/foo", false).Code).To(Equal(http.StatusUnauthorized))
+		Expect(serve("/admin/foo", true).Code).To(Equal(http.StatusGone))
+		Expect(serve("/public", false).Code).To(Equal(http.StatusGone))
+	})
+
+	It("should require HTTPS for routes which opt into it", func() {
+		useMiddleware(Options{HSTS: "max-age=300"})
+		loadRoutes(nil, []Route{
+			{IncomingPath: "/sign-in", RouteType: "prefix", Handler: "gone", Middleware: []string{"https"}},
+			{IncomingPath: "/public", RouteType: "prefix", Handler: "gone"},
+		})
+
+		rw := serve("/sign-in", false)
+		Expect(rw.Code).To(Equal(http.StatusMovedPermanently))
+		Expect(rw.Header().Get("Location")).To(Equal("https://example.com/sign-in"))
+		Expect(serve("/public", false).Code).To(Equal(http.StatusGone))
+
+		var err error
+		handlers.TrustedProxies, err = handlers.ParseNetworks([]string{"192.0.2.1"})
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { handlers.TrustedProxies = nil }()
+		req := httptest.NewRequest("GET", "/sign-in", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rw = httptest.NewRecorder()
+		rt.ServeHTTP(rw, req)
+		Expect(rw.Code).To(Equal(http.StatusGone))
+		Expect(rw.Header().Get("Strict-Transport-Security")).To(Equal("max-age=300"))
+	})
+
+	It("should send routes' analytics tags to their backends", func() {
+		var received http.Header
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header
+		}))
+		defer backend.Close()
+
+		useMiddleware(Options{})
+		loadRoutes(
+			[]Backend{{BackendID: "frontend", BackendURL: backend.URL}},
+			[]Route{{
+				IncomingPath: "/cost-of-living", RouteType: "prefix", Handler: "backend", BackendID: "frontend",
+				AnalyticsTags: map[string]string{
+					"campaign": "cost-of-living", "bad name": "skipped", "format": "bad\nvalue",
+					"content_format": "guide", "content-format": "answer",
+				},
+			}},
+		)
+
+		Expect(serve("/cost-of-living", false).Code).To(Equal(http.StatusOK))
+		Expect(received.Get("GOVUK-Analytics-Campaign")).To(Equal("cost-of-living"))
+		Expect(received).NotTo(HaveKey("Govuk-Analytics-Format"))
+		Expect(received).NotTo(HaveKey("Govuk-Analytics-Content-Format"))
+	})
+
+	It("should remove headers which only the router sets from every request", func() {
+		var received http.Header
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header
+		}))
+		defer backend.Close()
+
+		useMiddleware(Options{})
+		loadRoutes(
+			[]Backend{{BackendID: "frontend", BackendURL: backend.URL}},
+			[]Route{{IncomingPath: "/", RouteType: "prefix", Handler: "backend", BackendID: "frontend"}},
+		)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Govuk-Authenticated-User", "spoofed")
+		req.Header.Set("GOVUK-Analytics-Campaign", "spoofed")
+		req.Header.Set("X-Forwarded-Prefix", "/spoofed")
+		rt.ServeHTTP(httptest.NewRecorder(), req)
+		Expect(received).NotTo(BeNil())
+		Expect(received).NotTo(HaveKey("X-Govuk-Authenticated-User"))
+		Expect(received).NotTo(HaveKey("Govuk-Analytics-Campaign"))
+		Expect(received).NotTo(HaveKey("X-Forwarded-Prefix"))
+	})
+
+	It("should make routes with broken middleware unavailable", func() {
+		useMiddleware(Options{})
+		loadRoutes(nil, []Route{
+			{IncomingPath: "/admin", RouteType: "prefix", Handler: "gone", Middleware: []string{"unknown"}},
+		})
+
+		Expect(serve("/admin", true).Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("should only create each middleware once", func() {
+		counterCreations = 0
+		useMiddleware(Options{Middleware: []string{"test-counter"}})
+		loadRoutes(nil, []Route{
+			{IncomingPath: "/foo", RouteType: "prefix", Handler: "gone", Middleware: []string{"auth"}},
+			{IncomingPath: "/bar", RouteType: "prefix", Handler: "gone", Middleware: []string{"test-counter"}},
+		})
+		Expect(counterCreations).To(Equal(1))
+	})
+
+	It("should reject unknown global middleware", func() {
+		_, err := newMiddlewareSet(Options{Middleware: []string{"metrics", "unknown"}})
+		Expect(err).To(MatchError(ContainSubstring(`unknown middleware "unknown"`)))
+	})
+
+	It("should reject middleware which isn't configured properly", func() {
+		_, err := newMiddlewareSet(Options{Middleware: []string{"auth"}})
+		Expect(err).To(MatchError(ContainSubstring(`couldn't create middleware "auth"`)))
+
+		_, err = newMiddlewareSet(Options{Middleware: []string{"rate-limit"}})
+		Expect(err).To(HaveOccurred())
+
+		_, err = newMiddlewareSet(Options{Middleware: []string{"signon"}})
+		Expect(err).To(MatchError(ContainSubstring("a cookie secret or an auth URL is needed")))
+	})
+
+	It("should parse lists of middleware", func() {
+		Expect(parseList("")).To(BeEmpty())
+		Expect(parseList(" metrics, logging ,")).To(Equal([]string{"metrics", "logging"}))
+	})
+
+	It("should parse headers", func() {
+		headers, err := parseHeaders(`{"Cache-Control": "no-cache, private", "Server": ""}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(headers).To(Equal(map[string]string{"Cache-Control": "no-cache, private", "Server": ""}))
+
+		_, err = parseHeaders("X-Foo: bar")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/alphagov/router/triemux"
+)
+
+// MirrorStatus is the state of the mirror switch, as shown by the API.
+type MirrorStatus struct {
+	Enabled bool `json:"enabled"`
+
+	// Prefixes are the paths (and the paths below them) served from the
+	// mirror. If it's empty, every request is.
+	Prefixes []string `json:"prefixes"`
+}
+
+// mirrorSwitch sends requests to a static mirror of the site while it's
+// switched on through the API, bypassing the routes entirely. It's a last
+// resort for when the backends can't be relied on.
+type mirrorSwitch struct {
+	namespace       string
+	handler         http.Handler
+	defaultPrefixes []string
+
+	mu     sync.RWMutex
+	status MirrorStatus
+	// mux matches the prefixes, or is nil if everything is mirrored.
+	mux *triemux.Mux
+}
+
+func newMirrorSwitch(namespace string, handler http.Handler, defaultPrefixes []string) *mirrorSwitch {
+	return &mirrorSwitch{namespace: namespace, handler: handler, defaultPrefixes: defaultPrefixes}
+}
+
+// enable starts serving requests for prefixes from the mirror, or for the
+// default prefixes if there are none (which, if there are no defaults
+// either, means every request).
+func (m *mirrorSwitch) enable(prefixes []string) error {
+	if len(prefixes) == 0 {
+		prefixes = m.defaultPrefixes
+	}
+	for _, prefix := range prefixes {
+		if len(prefix) == 0 || prefix[0] != '/' {
+			return fmt.Errorf("prefix %q must start with /", prefix)
+		}
+	}
+
+	var mux *triemux.Mux
+	if len(prefixes) > 0 {
+		mux = triemux.NewMux()
+		for _, prefix := range prefixes {
+			mux.Handle(prefix, true, m.handler)
+		}
+	}
+
+	m.mu.Lock()
+	m.status = MirrorStatus{Enabled: true, Prefixes: append([]string{}, prefixes...)}
+	m.mux = mux
+	m.mu.Unlock()
+
+	mirrorEnabledMetric.WithLabelValues(m.namespace).Set(1)
+	if len(prefixes) == 0 {
+		logWarn("router: serving every request from the mirror")
+	} else {
+		logWarn("router: serving requests from the mirror for", prefixes)
+	}
+	return nil
+}
+
+func (m *mirrorSwitch) disable() {
+	m.mu.Lock()
+	wasEnabled := m.status.Enabled
+	m.status = MirrorStatus{}
+	m.mux = nil
+	m.mu.Unlock()
+
+	mirrorEnabledMetric.WithLabelValues(m.namespace).Set(0)
+	if wasEnabled {
+		logInfo("router: stopped serving requests from the mirror")
+	}
+}
+
+// matches reports whether a request for path should be served from the
+// mirror.
+func (m *mirrorSwitch) matches(path string) bool {
+	m.mu.RLock()
+	enabled, mux := m.status.Enabled, m.mux
+	m.mu.RUnlock()
+
+	if !enabled {
+		return false
+	}
+	if mux == nil {
+		return true
+	}
+	_, ok := mux.Lookup(path)
+	return ok
+}
+
+func (m *mirrorSwitch) currentStatus() MirrorStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := m.status
+	if status.Prefixes == nil {
+		status.Prefixes = []string{}
+	}
+	return status
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Serving from the mirror", func() {
+	var (
+		rt  *Router
+		api http.Handler
+	)
+
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+
+	BeforeEach(func() {
+		rt = newTestRouter()
+		rt.mux.Handle("/", true, named("backend"))
+		rt.mirror = newMirrorSwitch("", named("mirror"), []string{"/government"})
+
+		apiAuthToken = "token"
+		var err error
+		api, err = newAPIHandler(rt)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		apiAuthToken = ""
+	})
+
+	serve := func(path string) string {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw.Body.String()
+	}
+
+	request := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/mirror", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("should only use the mirror while it's switched on", func() {
+		Expect(serve("/government")).To(Equal("backend"))
+
+		Expect(rt.mirror.enable([]string{"/"})).To(Succeed())
+		Expect(serve("/government")).To(Equal("mirror"))
+		Expect(serve("/anything")).To(Equal("mirror"))
+
+		rt.mirror.disable()
+		Expect(serve("/government")).To(Equal("backend"))
+	})
+
+	It("should mirror just the given prefixes, or the default ones", func() {
+		Expect(rt.mirror.enable([]string{"/browse", "/search"})).To(Succeed())
+		Expect(serve("/browse/tax")).To(Equal("mirror"))
+		Expect(serve("/search")).To(Equal("mirror"))
+		Expect(serve("/browser")).To(Equal("backend"))
+
+		Expect(rt.mirror.enable(nil)).To(Succeed())
+		Expect(serve("/government/news")).To(Equal("mirror"))
+		Expect(serve("/browse")).To(Equal("backend"))
+	})
+
+	It("should mirror everything if there are no default prefixes", func() {
+		rt.mirror = newMirrorSwitch("", named("mirror"), nil)
+		Expect(rt.mirror.enable(nil)).To(Succeed())
+		Expect(serve("/anything")).To(Equal("mirror"))
+	})
+
+	It("should mirror disabled paths", func() {
+		rt.disabledPaths.disable(DisabledPath{Path: "/government", Prefix: true})
+		Expect(rt.mirror.enable(nil)).To(Succeed())
+		Expect(serve("/government")).To(Equal("mirror"))
+	})
+
+	Context("API", func() {
+		It("should switch the mirror on and off", func() {
+			rw := request("POST", "")
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(MatchJSON(`{"enabled": true, "prefixes": ["/government"]}`))
+			Expect(serve("/government")).To(Equal("mirror"))
+
+			rw = request("POST", `{"prefixes": ["/"]}`)
+			Expect(rw.Body.String()).To(MatchJSON(`{"enabled": true, "prefixes": ["/"]}`))
+
+			rw = request("DELETE", "")
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(MatchJSON(`{"enabled": false, "prefixes": []}`))
+
+			Expect(request("GET", "").Body.String()).To(MatchJSON(`{"enabled": false, "prefixes": []}`))
+		})
+
+		It("should reject invalid prefixes", func() {
+			Expect(request("POST", `{"prefixes": ["government"]}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(request("POST", `{"prefixes": `).Code).To(Equal(http.StatusBadRequest))
+			Expect(serve("/government")).To(Equal("backend"))
+		})
+
+		It("should 404 if there's no mirror", func() {
+			rt.mirror = nil
+			Expect(request("POST", "").Code).To(Equal(http.StatusNotFound))
+		})
+	})
+})
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alphagov/router/logger"
+)
+
+// namespaceConfig configures a route namespace: a separate route table
+// served by the same process, such as the draft stack's routes. It's served
+// on its own listen addresses and/or for requests with one of its hosts, and
+// uses the main router's settings apart from where its routes come from and,
+// optionally, its middleware.
+type namespaceConfig struct {
+	RouteSource string   `json:"route_source"`
+	MongoURL    string   `json:"mongo_url"`
+	MongoDbName string   `json:"mongo_db"`
+	Middleware  []string `json:"middleware"`
+	Hosts       []string `json:"hosts"`
+	PubAddr     string   `json:"pubaddr"`
+}
+
+// parseNamespaces parses a JSON object of namespace names and their
+// configuration.
+func parseNamespaces(s string) (map[string]namespaceConfig, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var namespaces map[string]namespaceConfig
+	if err := json.Unmarshal([]byte(s), &namespaces); err != nil {
+		return nil, fmt.Errorf("router: couldn't parse namespaces %q: %v", s, err)
+	}
+
+	hosts := make(map[string]string)
+	for _, name := range namespaceNames(namespaces) {
+		ns := namespaces[name]
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("router: invalid namespace name %q", name)
+		}
+		if len(ns.Hosts) == 0 && ns.PubAddr == "" {
+			return nil, fmt.Errorf("router: namespace %q needs hosts or a pubaddr to serve requests for", name)
+		}
+		for _, host := range ns.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := hosts[host]; ok {
+				return nil, fmt.Errorf("router: host %q is in both namespace %q and %q", host, other, name)
+			}
+			hosts[host] = name
+		}
+	}
+	return namespaces, nil
+}
+
+// options returns the options for a namespace's router, based on those of
+// the main router.
+func (ns namespaceConfig) options(name string, base Options) Options {
+	o := base
+	o.Namespace = name
+	// Only the main routes are compared with the shadow routes, or
+	// sharded.
+	o.ShadowSource = nil
+	o.ShardPrefixes = nil
+	if ns.RouteSource != "" {
+		o.RouteSource = ns.RouteSource
+	}
+	if ns.MongoURL != "" {
+		o.MongoURL = ns.MongoURL
+	}
+	if ns.MongoDbName != "" {
+		o.MongoDbName = ns.MongoDbName
+	}
+	if ns.Middleware != nil {
+		o.Middleware = ns.Middleware
+	}
+	// Requests for the namespace's hosts are sent to it, so they're known.
+	if len(o.Hostnames) > 0 {
+		o.Hostnames = append(append([]string{}, o.Hostnames...), ns.Hosts...)
+	}
+	return o
+}
+
+// namespaceShared holds what the routers for each namespace share rather
+// than creating their own: a logger for each log file, the client policy
+// fetcher and the rules file watcher. Each is created when a router first
+// needs it. A nil *namespaceShared creates them afresh every time.
+type namespaceShared struct {
+	mu              sync.Mutex
+	loggers         map[string]logger.Logger
+	clientPolicy    *clientPolicySource
+	clientPolicyURL string
+	rules           *rulesFile
+}
+
+func newNamespaceShared() *namespaceShared {
+	return &namespaceShared{loggers: make(map[string]logger.Logger)}
+}
+
+// logger returns the logger for fileName.
+func (s *namespaceShared) logger(fileName string) (logger.Logger, error) {
+	if s == nil {
+		return logger.New(fileName)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.loggers[fileName]; ok {
+		return l, nil
+	}
+	l, err := logger.New(fileName)
+	if err != nil {
+		return nil, err
+	}
+	s.loggers[fileName] = l
+	return l, nil
+}
+
+// clientPolicySource returns the source of the client policy at
+// o.ClientPolicyURL, fetching the policy and starting to watch it for
+// changes if it's new.
+func (s *namespaceShared) clientPolicySource(o Options) *clientPolicySource {
+	if s == nil {
+		return startClientPolicySource(o)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clientPolicy == nil || s.clientPolicyURL != o.ClientPolicyURL {
+		s.clientPolicy, s.clientPolicyURL = startClientPolicySource(o), o.ClientPolicyURL
+	}
+	return s.clientPolicy
+}
+
+// rulesFile returns the rules in o.RulesFileName, loading them and starting
+// to watch the file for changes if it's new.
+func (s *namespaceShared) rulesFile(o Options) (*rulesFile, error) {
+	if s == nil {
+		return startRulesFile(o)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rules != nil && s.rules.fileName == o.RulesFileName {
+		return s.rules, nil
+	}
+	rules, err := startRulesFile(o)
+	if err != nil {
+		return nil, err
+	}
+	s.rules = rules
+	return rules, nil
+}
+
+func namespaceNames(namespaces map[string]namespaceConfig) []string {
+	names := make([]string, 0, len(namespaces))
+	for name := range namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hostSwitch passes requests to the handler for their Host header, ignoring
+// case and any port, or to fallback if there isn't one.
+type hostSwitch struct {
+	byHost   map[string]http.Handler
+	fallback http.Handler
+}
+
+func newHostSwitch(fallback http.Handler) *hostSwitch {
+	return &hostSwitch{byHost: make(map[string]http.Handler), fallback: fallback}
+}
+
+func (s *hostSwitch) add(host string, handler http.Handler) {
+	s.byHost[strings.ToLower(host)] = handler
+}
+
+func (s *hostSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if handler, ok := s.byHost[strings.ToLower(host)]; ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	s.fallback.ServeHTTP(w, r)
+}
+
+// newNamespacedAPIHandler serves the API for rout, along with the API for
+// each namespace's router under /namespaces/<name>/, so that for example
+// /namespaces/draft/reload reloads the draft routes.
+func newNamespacedAPIHandler(rout *Router, namespaces map[string]*Router) (http.Handler, error) {
+	api, err := newAPIHandler(rout)
+	if err != nil || len(namespaces) == 0 {
+		return api, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", api)
+	for name, nsRouter := range namespaces {
+		nsAPI, err := newAPIHandler(nsRouter)
+		if err != nil {
+			return nil, err
+		}
+		prefix := "/namespaces/" + name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, nsAPI))
+	}
+	return mux, nil
+}
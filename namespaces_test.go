@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Route namespaces", func() {
+	Describe("parsing the configuration", func() {
+		It("should parse namespaces", func() {
+			namespaces, err := parseNamespaces(`{
+				"draft": {"mongo_db": "draft_router", "hosts": ["draft-origin.example.com"]},
+				"preview": {"route_source": "other", "pubaddr": ":8082"}
+			}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(namespaceNames(namespaces)).To(Equal([]string{"draft", "preview"}))
+			Expect(namespaces["draft"].Hosts).To(Equal([]string{"draft-origin.example.com"}))
+			Expect(namespaces["preview"].PubAddr).To(Equal(":8082"))
+		})
+
+		It("should allow there to be none", func() {
+			namespaces, err := parseNamespaces("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(namespaces).To(BeEmpty())
+		})
+
+		It("should reject namespaces which can't be reached", func() {
+			_, err := parseNamespaces(`{"draft": {"mongo_db": "draft_router"}}`)
+			Expect(err).To(MatchError(ContainSubstring(`namespace "draft" needs hosts or a pubaddr`)))
+		})
+
+		It("should reject hosts in more than one namespace", func() {
+			_, err := parseNamespaces(`{"a": {"hosts": ["example.com"]}, "b": {"hosts": ["Example.com"]}}`)
+			Expect(err).To(MatchError(ContainSubstring(`host "example.com" is in both namespace "a" and "b"`)))
+		})
+
+		It("should reject names which can't be used in API paths", func() {
+			_, err := parseNamespaces(`{"a/b": {"hosts": ["example.com"]}}`)
+			Expect(err).To(MatchError(ContainSubstring("invalid namespace name")))
+		})
+
+		It("should base a namespace's options on the main router's", func() {
+			base := Options{RouteSource: "mongo", MongoURL: "mongo1", MongoDbName: "router", VerifyRoutes: true}
+			o := namespaceConfig{MongoDbName: "draft_router"}.options("draft", base)
+
+			Expect(o.Namespace).To(Equal("draft"))
+			Expect(o.RouteSource).To(Equal("mongo"))
+			Expect(o.MongoURL).To(Equal("mongo1"))
+			Expect(o.MongoDbName).To(Equal("draft_router"))
+			Expect(o.VerifyRoutes).To(BeTrue())
+		})
+
+		It("should let a namespace use its own middleware", func() {
+			base := Options{Middleware: []string{"logging"}}
+			Expect(namespaceConfig{}.options("draft", base).Middleware).To(Equal([]string{"logging"}))
+
+			o := namespaceConfig{Middleware: []string{"logging", "signon"}}.options("draft", base)
+			Expect(o.Middleware).To(Equal([]string{"logging", "signon"}))
+		})
+	})
+
+	Describe("choosing a namespace by host", func() {
+		named := func(name string) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(name))
+			})
+		}
+
+		serve := func(handler http.Handler, host string) string {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = host
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			return rw.Body.String()
+		}
+
+		It("should use the namespace for the host, ignoring case and port", func() {
+			s := newHostSwitch(named("www"))
+			s.add("draft-origin.example.com", named("draft"))
+
+			Expect(serve(s, "draft-origin.example.com")).To(Equal("draft"))
+			Expect(serve(s, "Draft-Origin.example.com:8080")).To(Equal("draft"))
+			Expect(serve(s, "www-origin.example.com")).To(Equal("www"))
+			Expect(serve(s, "")).To(Equal("www"))
+		})
+	})
+
+	Describe("the API", func() {
+		It("should serve each namespace's API under its name", func() {
+			rt, draft := newTestRouter(), newTestRouter()
+			draft.ReloadChan = make(chan bool, 1)
+
+			api, err := newNamespacedAPIHandler(rt, map[string]*Router{"draft": draft})
+			Expect(err).NotTo(HaveOccurred())
+
+			rw := httptest.NewRecorder()
+			api.ServeHTTP(rw, httptest.NewRequest("POST", "/namespaces/draft/reload", nil))
+			Expect(rw.Code).To(Equal(http.StatusAccepted))
+			Expect(draft.ReloadChan).To(Receive())
+
+			rw = httptest.NewRecorder()
+			api.ServeHTTP(rw, httptest.NewRequest("GET", "/healthcheck", nil))
+			Expect(rw.Body.String()).To(Equal("OK"))
+		})
+	})
+
+	Describe("sharing between namespaces", func() {
+		It("should share loggers for the same file", func() {
+			shared := newNamespaceShared()
+			stdout, err := shared.logger("STDOUT")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shared.logger("STDOUT")).To(BeIdenticalTo(stdout))
+			Expect(shared.logger("STDERR")).NotTo(BeIdenticalTo(stdout))
+		})
+
+		It("should share the rules file", func() {
+			f, err := ioutil.TempFile("", "rules-*.json")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(f.Name())
+			f.WriteString(`{"rules": []}`)
+			f.Close()
+
+			shared := newNamespaceShared()
+			o := Options{RulesFileName: f.Name()}
+			rules, err := shared.rulesFile(o)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shared.rulesFile(o)).To(BeIdenticalTo(rules))
+
+			var unshared *namespaceShared
+			Expect(unshared.rulesFile(o)).NotTo(BeIdenticalTo(rules))
+		})
+
+		It("should share the client policy source", func() {
+			service := httptest.NewServer(http.NotFoundHandler())
+			defer service.Close()
+
+			shared := newNamespaceShared()
+			o := Options{ClientPolicyURL: service.URL}
+			source := shared.clientPolicySource(o)
+			Expect(shared.clientPolicySource(o)).To(BeIdenticalTo(source))
+		})
+	})
+})
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/alphagov/router/handlers"
+	"github.com/alphagov/router/triemux"
+)
+
+// notFoundHeader is set on requests passed to the not found backend. A
+// request which already has it gets the router's own 404, so that if the
+// backend sends a request back through the router for a path with no route,
+// it doesn't go round in a loop.
+const notFoundHeader = "GOVUK-Router-Not-Found"
+
+// newNotFoundFallback returns a handler which passes requests to backend,
+// unless they've already been through it, in which case they're passed to
+// notFound.
+func newNotFoundFallback(backend, notFound http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(notFoundHeader) != "" {
+			notFound.ServeHTTP(w, r)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Header = r.Header.Clone()
+		r2.Header.Set(notFoundHeader, "1")
+		backend.ServeHTTP(w, r2)
+	})
+}
+
+// setNotFoundHandler makes mux pass requests with no route to the not found
+// backend, if there is one. It needs to be called before routes are
+// registered, since routes with extensions use the mux's not found handler
+// for other extensions.
+func (rt *Router) setNotFoundHandler(mux *triemux.Mux, backends map[string]http.Handler) {
+	if rt.notFoundBackend == "" {
+		return
+	}
+	backend, ok := backends[rt.notFoundBackend]
+	if !ok {
+		logWarn("router: not found backend", rt.notFoundBackend, "doesn't exist, serving the router's own 404s")
+		return
+	}
+	notFound := handlers.NewErrorHandler(http.StatusNotFound)
+	mux.NotFoundHandler = rt.middleware.globalChain(newNotFoundFallback(backend, notFound))
+}
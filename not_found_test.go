@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Not found backend", func() {
+	var (
+		rt       *Router
+		frontend *httptest.Server
+		received http.Header
+	)
+
+	BeforeEach(func() {
+		frontend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("branded 404 for " + r.URL.Path))
+		}))
+		rt = newTestRouter()
+		rt.notFoundBackend = "frontend"
+	})
+
+	AfterEach(func() {
+		frontend.Close()
+	})
+
+	load := func() {
+		rt.mux, _ = rt.buildMux(&RouteTable{
+			Backends: []Backend{{BackendID: "frontend", BackendURL: frontend.URL}},
+			Routes: []Route{
+				{IncomingPath: "/government", RouteType: "prefix", Handler: "gone"},
+				{IncomingPath: "/data", RouteType: "prefix", Handler: "gone", Extensions: []string{"json"}},
+			},
+		})
+	}
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("should pass requests with no route to the backend", func() {
+		load()
+
+		rw := serve(httptest.NewRequest("GET", "/missing", nil))
+		Expect(rw.Code).To(Equal(http.StatusNotFound))
+		Expect(rw.Body.String()).To(Equal("branded 404 for /missing"))
+		Expect(received.Get("GOVUK-Router-Not-Found")).To(Equal("1"))
+
+		Expect(serve(httptest.NewRequest("GET", "/government/news", nil)).Code).To(Equal(http.StatusGone))
+	})
+
+	It("should pass requests for other extensions of a route to the backend", func() {
+		load()
+
+		Expect(serve(httptest.NewRequest("GET", "/data/2024.json", nil)).Code).To(Equal(http.StatusGone))
+		Expect(serve(httptest.NewRequest("GET", "/data/2024.csv", nil)).Body.String()).To(Equal("branded 404 for /data/2024.csv"))
+	})
+
+	It("should give requests which have already been to the backend the router's own 404", func() {
+		load()
+
+		req := httptest.NewRequest("GET", "/missing", nil)
+		req.Header.Set("GOVUK-Router-Not-Found", "1")
+		rw := serve(req)
+		Expect(rw.Code).To(Equal(http.StatusNotFound))
+		Expect(rw.Body.String()).NotTo(ContainSubstring("branded"))
+	})
+
+	It("should respond itself if the backend doesn't exist", func() {
+		rt.notFoundBackend = "missing"
+		load()
+
+		rw := serve(httptest.NewRequest("GET", "/missing", nil))
+		Expect(rw.Code).To(Equal(http.StatusNotFound))
+		Expect(rw.Body.String()).NotTo(ContainSubstring("branded"))
+	})
+})
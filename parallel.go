@@ -0,0 +1,47 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// loadWorkerCount is the number of goroutines to use for loading routes:
+// n, or one per CPU if n isn't positive.
+func loadWorkerCount(n int) int {
+	if n <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return n
+}
+
+// forEachParallel calls fn for each index from 0 to n-1, sharing contiguous
+// runs of them between up to workers goroutines, and returns once they're
+// all done. fn must be safe to call concurrently for different indexes.
+func forEachParallel(n, workers int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	chunk := (n + workers - 1) / workers
+	for start := 0; start < n; start += chunk {
+		end := start + chunk
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				fn(i)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/alphagov/router/handlers"
+)
+
+const (
+	// previewTokenHeader and previewTokenCookie carry the token which
+	// shows preview-only routes.
+	previewTokenHeader = "GOVUK-Preview-Token"
+	previewTokenCookie = "govuk_preview_token"
+)
+
+// previewGate only lets requests with a valid preview token through to
+// preview-only routes, which are kept in an overlay over the mux of the rest
+// of the routes. Other requests fall through to the rest of the routes, as if
+// the preview-only routes didn't exist: so they get a 404, or whatever a
+// shorter prefix route does with them.
+type previewGate struct {
+	tokens [][]byte
+}
+
+// splitPreviewRoutes splits routes into the preview-only ones and the rest.
+func splitPreviewRoutes(routes []Route) (public, preview []Route) {
+	for _, route := range routes {
+		if route.Preview {
+			preview = append(preview, route)
+		} else {
+			public = append(public, route)
+		}
+	}
+	return public, preview
+}
+
+// serve serves a request which matches a preview-only route, with preview if
+// it has a valid preview token and otherwise with public, the handler for the
+// route it would match without the preview-only routes.
+func (g *previewGate) serve(w http.ResponseWriter, r *http.Request, preview, public http.Handler) {
+	// Caches mustn't give a preview to other users, or give users with a
+	// token the public response.
+	w.Header().Add("Vary", previewTokenHeader)
+	w.Header().Add("Vary", "Cookie")
+	if !g.allows(r) {
+		public.ServeHTTP(w, r)
+		return
+	}
+	r.Header.Del(previewTokenHeader)
+	preview.ServeHTTP(&previewWriter{ResponseWrapper: handlers.ResponseWrapper{ResponseWriter: w}}, r)
+}
+
+func (g *previewGate) allows(r *http.Request) bool {
+	token := r.Header.Get(previewTokenHeader)
+	if token == "" {
+		if cookie, err := r.Cookie(previewTokenCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		return false
+	}
+	for _, valid := range g.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), valid) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// previewWriter stops responses to preview requests from being cached.
+type previewWriter struct {
+	handlers.ResponseWrapper
+}
+
+func (w *previewWriter) WriteHeader(status int) {
+	if w.Status() == 0 {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	w.ResponseWrapper.WriteHeader(status)
+}
+
+func (w *previewWriter) Write(b []byte) (int, error) {
+	if w.Status() == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWrapper.Write(b)
+}
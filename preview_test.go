@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Preview-only routes", func() {
+	var (
+		rt        *Router
+		backend   *httptest.Server
+		seenToken string
+	)
+
+	BeforeEach(func() {
+		seenToken = ""
+		backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seenToken = r.Header.Get("GOVUK-Preview-Token")
+			w.Header().Set("Cache-Control", "max-age=300, public")
+			w.Write([]byte("preview"))
+		}))
+		rt = newTestRouter()
+		rt.previewTokens = [][]byte{[]byte("secret")}
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	load := func(routes ...Route) {
+		rt.mux, _ = rt.buildMux(&RouteTable{
+			Backends: []Backend{{BackendID: "frontend", BackendURL: backend.URL}},
+			Routes:   routes,
+		})
+	}
+
+	serve := func(path string, token, cookie string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("GOVUK-Preview-Token", token)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "govuk_preview_token", Value: cookie})
+		}
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, req)
+		return rw
+	}
+
+	newPage := Route{IncomingPath: "/new-page", RouteType: "exact", Handler: "backend", BackendID: "frontend", Preview: true}
+
+	It("should serve the route with a preview token", func() {
+		load(newPage)
+
+		rw := serve("/new-page", "secret", "")
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(Equal("preview"))
+		Expect(rw.Header().Get("Cache-Control")).To(Equal("private, no-store"))
+
+		Expect(serve("/new-page", "", "secret").Body.String()).To(Equal("preview"))
+	})
+
+	It("shouldn't pass the token on to the backend", func() {
+		load(newPage)
+
+		Expect(serve("/new-page", "secret", "").Code).To(Equal(http.StatusOK))
+		Expect(seenToken).To(BeEmpty())
+	})
+
+	It("should vary responses for preview-only routes by token", func() {
+		public := Route{IncomingPath: "/new-page", RouteType: "prefix", Handler: "backend", BackendID: "frontend"}
+		load(newPage, public)
+
+		for _, token := range []string{"secret", ""} {
+			rw := serve("/new-page", token, "")
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Header().Values("Vary")).To(ConsistOf("GOVUK-Preview-Token", "Cookie"))
+		}
+		Expect(serve("/new-page", "", "").Header().Get("Cache-Control")).To(Equal("max-age=300, public"))
+		Expect(serve("/new-page/part", "", "").Header().Values("Vary")).To(BeEmpty())
+	})
+
+	It("should 404 without a valid token", func() {
+		load(newPage)
+
+		Expect(serve("/new-page", "", "").Code).To(Equal(http.StatusNotFound))
+		Expect(serve("/new-page", "wrong", "").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should fall through to the route which would otherwise match", func() {
+		load(newPage,
+			Route{IncomingPath: "/", RouteType: "prefix", Handler: "redirect", RedirectTo: "/home", RedirectType: "temporary"},
+			Route{IncomingPath: "/new-page", RouteType: "prefix", Handler: "gone"},
+		)
+
+		Expect(serve("/new-page", "", "").Code).To(Equal(http.StatusGone))
+		Expect(serve("/new-page/part", "", "").Code).To(Equal(http.StatusGone))
+		Expect(serve("/new-page", "secret", "").Code).To(Equal(http.StatusOK))
+		Expect(serve("/other", "", "").Code).To(Equal(http.StatusFound))
+	})
+
+	It("should pass on protocol upgrades with a preview token", func() {
+		upgrades := newUpgradeServer()
+		defer upgrades.Close()
+		rt.mux, _ = rt.buildMux(&RouteTable{
+			Backends: []Backend{{BackendID: "sockets", BackendURL: upgrades.URL}},
+			Routes:   []Route{{IncomingPath: "/socket", RouteType: "exact", Handler: "backend", BackendID: "sockets", Preview: true}},
+		})
+		server := httptest.NewServer(rt)
+		defer server.Close()
+
+		status, echoed := upgrade(server.URL, "/socket", http.Header{"Govuk-Preview-Token": {"secret"}})
+		Expect(status).To(Equal(http.StatusSwitchingProtocols))
+		Expect(echoed).To(Equal("ping\n"))
+	})
+
+	It("should hide the route if there aren't any tokens", func() {
+		rt.previewTokens = nil
+		load(newPage)
+
+		Expect(serve("/new-page", "secret", "").Code).To(Equal(http.StatusNotFound))
+	})
+})
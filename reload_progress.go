@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reload stages, as reported by the reload status.
+const (
+	reloadStageLoading   = "loading"
+	reloadStageBuilding  = "building"
+	reloadStageVerifying = "verifying"
+)
+
+// reloadProgress tracks how far through the current reload the router is,
+// so that a slow reload which is still making progress can be told apart
+// from one stuck waiting on the route source. While a reload is running its
+// progress is logged every interval.
+type reloadProgress struct {
+	interval time.Duration
+
+	// documents and routes are updated from the loading goroutines, and
+	// only counted while a reload is running.
+	documents int64
+	routes    int64
+	running   int32
+
+	mu      sync.Mutex
+	stage   string
+	started time.Time
+	done    chan struct{}
+	last    *reloadSummary
+	now     func() time.Time
+}
+
+// reloadSummary describes a finished reload.
+type reloadSummary struct {
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Documents       int64     `json:"documents"`
+	Routes          int64     `json:"routes"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// reloadStatus is what the /reload-status endpoint returns.
+type reloadStatus struct {
+	Reloading      bool           `json:"reloading"`
+	Stage          string         `json:"stage,omitempty"`
+	Started        *time.Time     `json:"started,omitempty"`
+	ElapsedSeconds float64        `json:"elapsed_seconds,omitempty"`
+	Documents      int64          `json:"documents"`
+	Routes         int64          `json:"routes"`
+	LastReload     *reloadSummary `json:"last_reload,omitempty"`
+}
+
+func newReloadProgress(interval time.Duration) *reloadProgress {
+	return &reloadProgress{interval: interval, now: time.Now}
+}
+
+// start resets the counts for a new reload, and starts logging its progress.
+func (p *reloadProgress) start() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	atomic.StoreInt64(&p.documents, 0)
+	atomic.StoreInt64(&p.routes, 0)
+	atomic.StoreInt32(&p.running, 1)
+	p.stage = reloadStageLoading
+	p.started = p.now()
+	p.done = make(chan struct{})
+	if p.interval > 0 {
+		go p.logEvery(p.interval, p.done)
+	}
+}
+
+// setStage records that the reload has moved on to stage.
+func (p *reloadProgress) setStage(stage string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stage = stage
+}
+
+// setDocuments records how many documents the route source has read. It's
+// passed to sources which implement ProgressReporter.
+func (p *reloadProgress) setDocuments(documents int) {
+	if p != nil && atomic.LoadInt32(&p.running) == 1 {
+		atomic.StoreInt64(&p.documents, int64(documents))
+	}
+}
+
+// routePrepared counts a route set up for the new mux.
+func (p *reloadProgress) routePrepared() {
+	if p != nil && atomic.LoadInt32(&p.running) == 1 {
+		atomic.AddInt64(&p.routes, 1)
+	}
+}
+
+// finish records the outcome of the reload, with err nil if it succeeded,
+// and stops logging its progress.
+func (p *reloadProgress) finish(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if atomic.SwapInt32(&p.running, 0) == 0 {
+		return
+	}
+	close(p.done)
+	p.last = &reloadSummary{
+		Started:         p.started,
+		DurationSeconds: p.now().Sub(p.started).Seconds(),
+		Documents:       atomic.LoadInt64(&p.documents),
+		Routes:          atomic.LoadInt64(&p.routes),
+	}
+	if err != nil {
+		p.last.Error = err.Error()
+	}
+	p.stage = ""
+}
+
+// status returns the progress of the current reload, if there is one, and
+// the outcome of the last one.
+func (p *reloadProgress) status() reloadStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := reloadStatus{LastReload: p.last}
+	if atomic.LoadInt32(&p.running) == 1 {
+		started := p.started
+		status.Reloading = true
+		status.Stage = p.stage
+		status.Started = &started
+		status.ElapsedSeconds = p.now().Sub(p.started).Seconds()
+		status.Documents = atomic.LoadInt64(&p.documents)
+		status.Routes = atomic.LoadInt64(&p.routes)
+	}
+	return status
+}
+
+func (p *reloadProgress) logEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			status := p.status()
+			if !status.Reloading {
+				return
+			}
+			logInfo(fmt.Sprintf("router: still reloading routes after %.0fs (%s: %d documents read, %d routes set up)",
+				status.ElapsedSeconds, status.Stage, status.Documents, status.Routes))
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reload progress", func() {
+	var (
+		progress *reloadProgress
+		now      time.Time
+	)
+
+	BeforeEach(func() {
+		now = time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+		progress = newReloadProgress(0)
+		progress.now = func() time.Time { return now }
+	})
+
+	It("should report the progress of a running reload", func() {
+		Expect(progress.status()).To(Equal(reloadStatus{}))
+
+		progress.start()
+		progress.setDocuments(1000)
+		progress.setStage(reloadStageBuilding)
+		progress.routePrepared()
+		progress.routePrepared()
+		now = now.Add(90 * time.Second)
+
+		status := progress.status()
+		Expect(status.Reloading).To(BeTrue())
+		Expect(status.Stage).To(Equal("building"))
+		Expect(status.ElapsedSeconds).To(Equal(90.0))
+		Expect(status.Documents).To(Equal(int64(1000)))
+		Expect(status.Routes).To(Equal(int64(2)))
+	})
+
+	It("should summarise the last reload once it's finished", func() {
+		progress.start()
+		progress.routePrepared()
+		now = now.Add(time.Second)
+		progress.finish(nil)
+
+		status := progress.status()
+		Expect(status.Reloading).To(BeFalse())
+		Expect(status.LastReload).To(Equal(&reloadSummary{
+			Started: now.Add(-time.Second), DurationSeconds: 1, Routes: 1,
+		}))
+
+		progress.start()
+		progress.finish(errors.New("source unavailable"))
+		Expect(progress.status().LastReload.Error).To(Equal("source unavailable"))
+		Expect(progress.status().LastReload.Routes).To(BeZero())
+	})
+
+	It("should only count while a reload is running", func() {
+		progress.setDocuments(10)
+		progress.routePrepared()
+		progress.start()
+		Expect(progress.status().Documents).To(BeZero())
+		Expect(progress.status().Routes).To(BeZero())
+	})
+
+	It("should be reported by the mongo source after each batch", func() {
+		var docs []interface{}
+		for i := 0; i < decodeRouteDocumentBatch+1; i++ {
+			docs = append(docs, bson.M{"incoming_path": "/", "route_type": "exact"})
+		}
+		var reported []int
+		_, err := decodeRouteDocuments(context.Background(), &mockMongoIter{docs: docs}, 0, 1, nil, func(documents int) {
+			reported = append(reported, documents)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reported).To(Equal([]int{decodeRouteDocumentBatch, decodeRouteDocumentBatch + 1}))
+	})
+
+	Context("reloading routes", func() {
+		var rt *Router
+
+		BeforeEach(func() {
+			rt = newTestRouter()
+			rt.source = &fakeRouteSource{table: &RouteTable{
+				Routes: []Route{
+					{IncomingPath: "/foo", RouteType: "prefix", Handler: "gone"},
+					{IncomingPath: "/bar", RouteType: "exact", Handler: "gone"},
+				},
+				Checksum: "1",
+			}}
+		})
+
+		It("should be shown by the API", func() {
+			rt.reloadRoutes()
+
+			api, err := newAPIHandler(rt)
+			Expect(err).NotTo(HaveOccurred())
+			rw := httptest.NewRecorder()
+			api.ServeHTTP(rw, httptest.NewRequest("GET", "/reload-status", nil))
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(ContainSubstring(`"reloading": false`))
+			Expect(rw.Body.String()).To(ContainSubstring(`"routes": 2`))
+		})
+
+		It("should record failed reloads", func() {
+			rt.source.(*fakeRouteSource).err = errors.New("source unavailable")
+			rt.reloadRoutes()
+
+			Expect(rt.progress.status().LastReload.Error).To(Equal("source unavailable"))
+		})
+	})
+})
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alphagov/router/handlers"
+)
+
+// Reasons for rejecting malformed requests, which label the
+// router_malformed_requests_total metric.
+const (
+	malformedBadHost           = "bad_host"
+	malformedInvalidUTF8       = "invalid_utf8"
+	malformedOversizedHeaders  = "oversized_headers"
+	malformedUnsupportedMethod = "unsupported_method"
+)
+
+// requestChecks rejects malformed requests before they're routed, counting
+// each by the reason it was rejected so that scanning campaigns and broken
+// clients show up in the metrics. Requests with a request line or headers
+// which net/http can't parse at all, including paths with invalid
+// percent-encoding, are rejected before they reach the router, and aren't
+// counted.
+type requestChecks struct {
+	// maxHeaderBytes is the largest total size of the request's headers,
+	// or 0 for no limit beyond net/http's.
+	maxHeaderBytes int
+	// allowedMethods are the methods which can be routed, or nil for any.
+	allowedMethods map[string]bool
+	allow          string
+	// requireUTF8Paths rejects requests whose decoded paths aren't valid
+	// UTF-8.
+	requireUTF8Paths bool
+	// hosts handles requests for unknown hosts and with absolute-form
+	// URIs, once they've passed the other checks.
+	hosts *hostPolicy
+}
+
+func newRequestChecks(maxHeaderBytes int, allowedMethods []string, requireUTF8Paths bool) *requestChecks {
+	c := &requestChecks{maxHeaderBytes: maxHeaderBytes, requireUTF8Paths: requireUTF8Paths}
+	if len(allowedMethods) > 0 {
+		c.allowedMethods = make(map[string]bool, len(allowedMethods))
+		for _, method := range allowedMethods {
+			c.allowedMethods[strings.ToUpper(method)] = true
+		}
+		methods := make([]string, 0, len(c.allowedMethods))
+		for method := range c.allowedMethods {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		c.allow = strings.Join(methods, ", ")
+	}
+	return c
+}
+
+// reject responds to req and returns the reason if it's malformed, or
+// returns "" without responding if it isn't.
+func (c *requestChecks) reject(w http.ResponseWriter, req *http.Request, namespace string) string {
+	if c == nil {
+		return ""
+	}
+
+	reason, status := c.check(req)
+	if reason == "" {
+		reason, status = c.checkHost(req, namespace)
+	}
+	if reason == "" {
+		return ""
+	}
+	malformedRequestCountMetric.WithLabelValues(namespace, reason).Inc()
+	logDebug("router: rejecting malformed request for", req.URL.Path, "("+reason+")")
+	if reason == malformedUnsupportedMethod {
+		w.Header().Set("Allow", c.allow)
+	}
+	handlers.WriteError(w, req, status)
+	return reason
+}
+
+func (c *requestChecks) check(req *http.Request) (reason string, status int) {
+	if c.allowedMethods != nil && !c.allowedMethods[req.Method] {
+		return malformedUnsupportedMethod, http.StatusMethodNotAllowed
+	}
+	if !validHost(req.Host) {
+		return malformedBadHost, http.StatusBadRequest
+	}
+	if c.requireUTF8Paths && !utf8.ValidString(req.URL.Path) {
+		return malformedInvalidUTF8, http.StatusBadRequest
+	}
+	if c.maxHeaderBytes > 0 && headerSize(req.Header) > c.maxHeaderBytes {
+		return malformedOversizedHeaders, http.StatusRequestHeaderFieldsTooLarge
+	}
+	return "", 0
+}
+
+// checkHost applies the host policy to a request which passed the other
+// checks.
+func (c *requestChecks) checkHost(req *http.Request, namespace string) (reason string, status int) {
+	switch reason = c.hosts.apply(req, namespace); reason {
+	case malformedUnknownHost:
+		return reason, http.StatusMisdirectedRequest
+	case malformedAbsoluteURI:
+		return reason, http.StatusBadRequest
+	}
+	return "", 0
+}
+
+// validHost reports whether host is a valid Host header: a host name or IP
+// address, optionally with a port. An empty host, which HTTP/1.0 allows, is
+// valid.
+func validHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	name := host
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if !allDigits(port) {
+			return false
+		}
+		name = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		name = host[1 : len(host)-1]
+	} else if strings.Contains(host, ":") {
+		// An IPv6 address without brackets, or something which isn't a port.
+		return false
+	}
+
+	if strings.Contains(name, ":") {
+		return net.ParseIP(name) != nil
+	}
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > 63 {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			b := label[i]
+			if !('a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || b == '-' || b == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// headerSize approximates the number of bytes header took up in the
+// request.
+func headerSize(header http.Header) int {
+	size := 0
+	for name, values := range header {
+		for _, value := range values {
+			size += len(name) + len(value) + len(": \r\n")
+		}
+	}
+	return size
+}
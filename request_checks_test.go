@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	prommodel "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Malformed requests", func() {
+	var rt *Router
+
+	BeforeEach(func() {
+		rt = newTestRouter()
+		rt.mux.Handle("/", true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("routed"))
+		}))
+		rt.checks = newRequestChecks(1024, []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}, true)
+		rt.namespace = "checks"
+	})
+
+	rejected := func(reason string) float64 {
+		metric := new(prommodel.Metric)
+		Expect(malformedRequestCountMetric.WithLabelValues("checks", reason).Write(metric)).To(Succeed())
+		return metric.Counter.GetValue()
+	}
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, req)
+		return rw
+	}
+
+	table.DescribeTable("rejecting requests",
+		func(req *http.Request, reason string, status int) {
+			before := rejected(reason)
+			rw := serve(req)
+			Expect(rw.Code).To(Equal(status))
+			Expect(rw.Body.String()).NotTo(Equal("routed"))
+			Expect(rejected(reason)).To(Equal(before + 1))
+		},
+		table.Entry("unsupported method", httptest.NewRequest("TRACE", "/", nil),
+			"unsupported_method", http.StatusMethodNotAllowed),
+		table.Entry("bad host", withHost(httptest.NewRequest("GET", "/", nil), "www.gov.uk:http"),
+			"bad_host", http.StatusBadRequest),
+		table.Entry("host with bad characters", withHost(httptest.NewRequest("GET", "/", nil), "www.gov.uk%2f"),
+			"bad_host", http.StatusBadRequest),
+		table.Entry("invalid UTF-8 in the path", httptest.NewRequest("GET", "/caf%e9", nil),
+			"invalid_utf8", http.StatusBadRequest),
+		table.Entry("oversized headers", withHeader(httptest.NewRequest("GET", "/", nil), "Cookie", strings.Repeat("a", 2000)),
+			"oversized_headers", http.StatusRequestHeaderFieldsTooLarge),
+	)
+
+	table.DescribeTable("routing valid requests",
+		func(host string) {
+			Expect(serve(withHost(httptest.NewRequest("GET", "/?q=tax", nil), host)).Body.String()).To(Equal("routed"))
+		},
+		table.Entry("host name", "www.gov.uk"),
+		table.Entry("host name and port", "www.gov.uk:8080"),
+		table.Entry("IPv4 address", "192.0.2.1"),
+		table.Entry("IPv6 address", "[2001:db8::1]"),
+		table.Entry("IPv6 address and port", "[2001:db8::1]:8080"),
+		table.Entry("no host", ""),
+	)
+
+	It("should say which methods are allowed", func() {
+		rw := serve(httptest.NewRequest("PROPFIND", "/", nil))
+		Expect(rw.Header().Get("Allow")).To(Equal("DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT"))
+	})
+
+	It("should allow any method if none are listed", func() {
+		rt.checks = newRequestChecks(0, nil, false)
+		Expect(serve(httptest.NewRequest("PROPFIND", "/", nil)).Body.String()).To(Equal("routed"))
+		Expect(serve(httptest.NewRequest("PURGE", "/", nil)).Body.String()).To(Equal("routed"))
+	})
+
+	It("should only check that paths are UTF-8 if asked to", func() {
+		rt.checks = newRequestChecks(0, nil, false)
+		Expect(serve(httptest.NewRequest("GET", "/caf%e9", nil)).Body.String()).To(Equal("routed"))
+	})
+
+	It("should pass query strings on as they are", func() {
+		for _, target := range []string{"/search?a=1;b=2", "/search?q=50%off", "/search?q=%zz"} {
+			Expect(serve(httptest.NewRequest("GET", target, nil)).Body.String()).To(Equal("routed"), target)
+		}
+	})
+})
+
+func withHost(req *http.Request, host string) *http.Request {
+	req.Host = host
+	return req
+}
+
+func withHeader(req *http.Request, name, value string) *http.Request {
+	req.Header.Set(name, value)
+	return req
+}
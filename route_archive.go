@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// routeArchiveFormat is the version of the route archive format. Archives
+// in other formats are refused rather than partly imported.
+const routeArchiveFormat = 1
+
+// maxRouteArchiveBytes is the largest archive which can be imported.
+const maxRouteArchiveBytes = 512 << 20
+
+// errNoRoutesLoaded is returned when exporting routes before any have been
+// loaded.
+var errNoRoutesLoaded = errors.New("no routes have been loaded yet")
+
+// RouteArchive is an export of the route table a router is serving, which
+// can be imported into a router without access to the route store, such as
+// one in an air-gapped environment or one being restored after a disaster.
+type RouteArchive struct {
+	Format        int       `json:"format"`
+	RouterVersion string    `json:"router_version"`
+	Namespace     string    `json:"namespace,omitempty"`
+	Exported      time.Time `json:"exported"`
+	Backends      []Backend `json:"backends"`
+	Routes        []Route   `json:"routes"`
+
+	// Checksum is a SHA-256 hash of the backends and routes (see
+	// routeArchiveChecksum), which is checked when the archive is read, and
+	// becomes the routes' checksum once they're imported. SourceChecksum is
+	// the checksum the routes had in the route source.
+	Checksum       string `json:"checksum"`
+	SourceChecksum string `json:"source_checksum"`
+}
+
+// RouteImport describes how importing an archive changes, or would change,
+// the router's routes.
+type RouteImport struct {
+	Imported bool     `json:"imported"`
+	Checksum string   `json:"checksum"`
+	Summary  string   `json:"summary"`
+	Changes  []string `json:"changes"`
+
+	// Problems are the reasons the archive can't be imported, if any.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// archiveRouteSource is a RouteSource which always has an archive's routes.
+type archiveRouteSource struct {
+	table *RouteTable
+}
+
+func (s *archiveRouteSource) Load() (*RouteTable, error) { return s.table, nil }
+func (s *archiveRouteSource) Checksum() (string, error)  { return s.table.Checksum, nil }
+func (s *archiveRouteSource) Watch(changed chan<- bool)  {}
+
+// exportRoutes archives the route table the router is serving.
+func (rt *Router) exportRoutes() (*RouteArchive, error) {
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	if rt.loadedTable == nil {
+		return nil, errNoRoutesLoaded
+	}
+	return &RouteArchive{
+		Format:         routeArchiveFormat,
+		RouterVersion:  version,
+		Namespace:      rt.namespace,
+		Exported:       time.Now().UTC(),
+		Backends:       rt.loadedTable.Backends,
+		Routes:         rt.loadedTable.Routes,
+		Checksum:       routeArchiveChecksum(rt.loadedTable.Backends, rt.loadedTable.Routes),
+		SourceChecksum: rt.loadedChecksum,
+	}, nil
+}
+
+// routeArchiveChecksum returns the SHA-256 hash of the JSON encoding of
+// backends and routes, in hex.
+func routeArchiveChecksum(backends []Backend, routes []Route) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	enc.Encode(backends)
+	enc.Encode(routes)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readRouteArchive reads an archive, checking that it hasn't been changed
+// since it was exported and that the router can import it.
+func readRouteArchive(r io.Reader) (*RouteTable, error) {
+	var archive RouteArchive
+	if err := json.NewDecoder(r).Decode(&archive); err != nil {
+		return nil, fmt.Errorf("couldn't read the route archive: %v", err)
+	}
+	if archive.Format != routeArchiveFormat {
+		return nil, fmt.Errorf("route archives in format %d aren't supported (expected %d)", archive.Format, routeArchiveFormat)
+	}
+	if archive.Checksum == "" {
+		return nil, errors.New("the route archive has no checksum")
+	}
+	if sum := routeArchiveChecksum(archive.Backends, archive.Routes); sum != archive.Checksum {
+		return nil, fmt.Errorf("the route archive's checksum is %s but its routes' checksum is %s", archive.Checksum, sum)
+	}
+	table := &RouteTable{Backends: archive.Backends, Routes: archive.Routes, Checksum: archive.Checksum}
+	if err := checkSchemaVersions(table); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// importRoutes switches to the routes in table, once they've been checked
+// for problems and consistency, or if dryRun is set just describes how they
+// differ from the current routes and any problems with them. The routes replaced are kept on standby, if the
+// router keeps any, and the route source's routes aren't reloaded until its
+// checksum changes.
+func (rt *Router) importRoutes(table *RouteTable, dryRun bool) (RouteImport, error) {
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	current := rt.loadedTable
+	if current == nil {
+		current = &RouteTable{}
+	}
+	diffs := diffRouteTables(current, table)
+	result := RouteImport{
+		Checksum: table.Checksum,
+		Summary:  summariseTableDiffs(diffs),
+		Changes:  make([]string, len(diffs)),
+	}
+	for i, d := range diffs {
+		result.Changes[i] = d.String()
+	}
+	for _, problem := range routeTableProblems(table) {
+		result.Problems = append(result.Problems, problem.Error())
+	}
+	if dryRun {
+		return result, nil
+	}
+	if len(result.Problems) > 0 {
+		return result, fmt.Errorf("the archive can't be imported: %s", strings.Join(result.Problems, "; "))
+	}
+
+	replaced := rt.replacedChecksum
+	if replaced == "" {
+		replaced = rt.loadedChecksum
+	}
+	logInfo(fmt.Sprintf("router: importing routes (checksum: %s, %s)", table.Checksum, result.Summary))
+	if err := rt.reloadRoutesFrom(&archiveRouteSource{table: table}, true); err != nil {
+		return result, err
+	}
+	rt.lock.Lock()
+	rt.replacedChecksum = replaced
+	rt.lock.Unlock()
+
+	result.Imported = true
+	return result, nil
+}
+
+// routeTableProblems checks each of table's backends and routes, returning
+// a description of each one which loading the table would skip, or which
+// would be set up differently from what it describes. Unlike the route
+// source's routes, which are loaded as well as they can be, an archive with
+// any problems is refused.
+func routeTableProblems(table *RouteTable) (problems []error) {
+	backends := make(map[string]bool, len(table.Backends))
+	for i := range table.Backends {
+		backend := &table.Backends[i]
+		switch {
+		case backend.BackendID == "":
+			problems = append(problems, fmt.Errorf("backend %d has no ID", i))
+			continue
+		case backends[backend.BackendID]:
+			problems = append(problems, fmt.Errorf("backend %s is defined more than once", backend.BackendID))
+		}
+		backends[backend.BackendID] = true
+		if u, err := backend.ParseURL(); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Errorf("backend %s has an invalid URL %q", backend.BackendID, backend.BackendURL))
+		}
+	}
+
+	routes := make(map[routeKey]bool, len(table.Routes))
+	for i := range table.Routes {
+		route := &table.Routes[i]
+		name := fmt.Sprintf("route %s (%s)", route.IncomingPath, route.RouteType)
+		if u, err := url.Parse(route.IncomingPath); err != nil || !strings.HasPrefix(u.Path, "/") {
+			problems = append(problems, fmt.Errorf("%s has an invalid incoming path", name))
+		}
+		if route.RouteType != "exact" && route.RouteType != "prefix" {
+			problems = append(problems, fmt.Errorf("%s has an unknown route type", name))
+		}
+		key := routeKey{route.IncomingPath, route.RouteType == "prefix"}
+		if routes[key] {
+			problems = append(problems, fmt.Errorf("%s is defined more than once", name))
+		}
+		routes[key] = true
+
+		if _, ok := routeHandlerFactory(route.Handler); !ok {
+			problems = append(problems, fmt.Errorf("%s has an unknown handler %q", name, route.Handler))
+		}
+		switch route.Handler {
+		case "backend":
+			if !backends[route.BackendID] {
+				problems = append(problems, fmt.Errorf("%s uses unknown backend %q", name, route.BackendID))
+			}
+			if !validProtocol(route.protocol()) {
+				problems = append(problems, fmt.Errorf("%s has an unknown protocol %q", name, route.Protocol))
+			}
+		case "redirect":
+			if route.RedirectTo == "" {
+				problems = append(problems, fmt.Errorf("%s has nowhere to redirect to", name))
+			}
+			if route.RedirectType != "" && route.RedirectType != "permanent" && route.RedirectType != "temporary" {
+				problems = append(problems, fmt.Errorf("%s has an unknown redirect type %q", name, route.RedirectType))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Route archives", func() {
+	var (
+		rt     *Router
+		source *fakeRouteSource
+	)
+
+	BeforeEach(func() {
+		source = &fakeRouteSource{table: &RouteTable{
+			Checksum: "1",
+			Backends: []Backend{{BackendID: "frontend", BackendURL: "http://frontend.example"}},
+			Routes: []Route{
+				{IncomingPath: "/", RouteType: "exact", Handler: "gone"},
+				{IncomingPath: "/government", RouteType: "prefix", Handler: "backend", BackendID: "frontend"},
+				{IncomingPath: "/old", RouteType: "exact", Handler: "redirect", RedirectTo: "/new", AnalyticsTags: map[string]string{"campaign": "move"}},
+			},
+		}}
+		rt = newTestRouter()
+		rt.routeArchives = true
+		rt.source = source
+		rt.reloadRoutes()
+	})
+
+	status := func(rt *Router, path string) int {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw.Code
+	}
+
+	roundTrip := func(archive *RouteArchive) *RouteTable {
+		var buf bytes.Buffer
+		Expect(json.NewEncoder(&buf).Encode(archive)).To(Succeed())
+		table, err := readRouteArchive(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		return table
+	}
+
+	It("should export the routes it's serving", func() {
+		archive, err := rt.exportRoutes()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(archive.Format).To(Equal(routeArchiveFormat))
+		Expect(archive.Checksum).To(Equal(routeArchiveChecksum(source.table.Backends, source.table.Routes)))
+		Expect(archive.SourceChecksum).To(Equal("1"))
+		Expect(archive.Backends).To(Equal(source.table.Backends))
+		Expect(archive.Routes).To(Equal(source.table.Routes))
+	})
+
+	It("shouldn't export anything before routes are loaded", func() {
+		_, err := newTestRouter().exportRoutes()
+		Expect(err).To(Equal(errNoRoutesLoaded))
+	})
+
+	It("should import an exported archive into another router", func() {
+		archive, err := rt.exportRoutes()
+		Expect(err).NotTo(HaveOccurred())
+
+		restored := newTestRouter()
+		restored.routeArchives = true
+		restored.source = &fakeRouteSource{table: &RouteTable{}}
+		result, err := restored.importRoutes(roundTrip(archive), false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Imported).To(BeTrue())
+		Expect(result.Summary).To(Equal("4 added, 0 removed, 0 changed"))
+		Expect(restored.loadedChecksum).To(Equal(archive.Checksum))
+		Expect(restored.loadedTable.Routes).To(Equal(source.table.Routes))
+		Expect(status(restored, "/old")).To(Equal(http.StatusMovedPermanently))
+	})
+
+	It("should describe the changes without making them in a dry run", func() {
+		table := &RouteTable{
+			Checksum: "archived",
+			Routes: []Route{
+				{IncomingPath: "/", RouteType: "exact", Handler: "gone"},
+				{IncomingPath: "/old", RouteType: "exact", Handler: "redirect", RedirectTo: "/elsewhere"},
+			},
+		}
+		result, err := rt.importRoutes(table, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Imported).To(BeFalse())
+		Expect(result.Summary).To(Equal("0 added, 2 removed, 1 changed"))
+		Expect(result.Changes).To(ContainElement(ContainSubstring(`~ route /old (exact): redirect_to: "/new" -> "/elsewhere"`)))
+		Expect(rt.loadedChecksum).To(Equal("1"))
+		Expect(status(rt, "/old")).To(Equal(http.StatusMovedPermanently))
+	})
+
+	It("shouldn't reload the route source's routes after an import until they change", func() {
+		_, err := rt.importRoutes(&RouteTable{
+			Checksum: "archived",
+			Routes:   []Route{{IncomingPath: "/", RouteType: "prefix", Handler: "gone"}},
+		}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.replacedChecksum).To(Equal("1"))
+
+		pollOnce(rt)
+		Expect(rt.loadedChecksum).To(Equal("archived"))
+
+		source.table = &RouteTable{Checksum: "2", Routes: []Route{{IncomingPath: "/", RouteType: "exact", Handler: "gone"}}}
+		pollOnce(rt)
+		Expect(rt.loadedChecksum).To(Equal("2"))
+	})
+
+	It("should refuse routes which wouldn't load, describing them in a dry run", func() {
+		table := &RouteTable{
+			Checksum: "archived",
+			Backends: []Backend{{BackendID: "frontend", BackendURL: "not a url"}},
+			Routes: []Route{
+				{IncomingPath: "/", RouteType: "exact", Handler: "gone"},
+				{IncomingPath: "/government", RouteType: "prefix", Handler: "backend", BackendID: "publisher"},
+				{IncomingPath: "/old", RouteType: "exact", Handler: "redirect"},
+				{IncomingPath: "/grpc", RouteType: "exact", Handler: "backend", BackendID: "frontend", Protocol: "grpcs"},
+				{IncomingPath: "/new", RouteType: "exact-ish", Handler: "unknown"},
+			},
+		}
+		result, err := rt.importRoutes(table, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Problems).To(ConsistOf(
+			`backend frontend has an invalid URL "not a url"`,
+			`route /government (prefix) uses unknown backend "publisher"`,
+			`route /old (exact) has nowhere to redirect to`,
+			`route /grpc (exact) has an unknown protocol "grpcs"`,
+			`route /new (exact-ish) has an unknown route type`,
+			`route /new (exact-ish) has an unknown handler "unknown"`,
+		))
+
+		result, err = rt.importRoutes(table, false)
+		Expect(err).To(MatchError(ContainSubstring("the archive can't be imported")))
+		Expect(result.Imported).To(BeFalse())
+		Expect(rt.loadedChecksum).To(Equal("1"))
+	})
+
+	It("should refuse archives which have been changed since they were exported", func() {
+		archive, err := rt.exportRoutes()
+		Expect(err).NotTo(HaveOccurred())
+		archive.Routes = append([]Route(nil), archive.Routes...)
+		archive.Routes[2].RedirectTo = "/elsewhere"
+
+		var buf bytes.Buffer
+		Expect(json.NewEncoder(&buf).Encode(archive)).To(Succeed())
+		_, err = readRouteArchive(&buf)
+		Expect(err).To(MatchError(ContainSubstring("the route archive's checksum is")))
+	})
+
+	It("should refuse archives it can't import", func() {
+		for _, archive := range []string{
+			`{"format": 2, "checksum": "1", "routes": []}`,
+			`{"format": 1, "routes": []}`,
+			`{"format": 1, "checksum": "` + routeArchiveChecksum(nil, []Route{{IncomingPath: "/", RouteType: "exact", SchemaVersion: 99}}) +
+				`", "routes": [{"incoming_path": "/", "route_type": "exact", "schema_version": 99}]}`,
+			`not json`,
+		} {
+			_, err := readRouteArchive(strings.NewReader(archive))
+			Expect(err).To(HaveOccurred(), archive)
+		}
+	})
+
+	It("should export and import through the API", func() {
+		apiAuthToken = "token"
+		defer func() { apiAuthToken = "" }()
+		api, err := newAPIHandler(rt)
+		Expect(err).NotTo(HaveOccurred())
+
+		call := func(method, path string, body []byte) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer token")
+			rw := httptest.NewRecorder()
+			api.ServeHTTP(rw, req)
+			return rw
+		}
+
+		rw := call("GET", "/routes/export", nil)
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		checksum := routeArchiveChecksum(source.table.Backends, source.table.Routes)
+		Expect(rw.Header().Get("Content-Disposition")).To(Equal(`attachment; filename="routes-` + checksum + `.json"`))
+		Expect(rw.Body.String()).To(ContainSubstring(`"incoming_path": "/government"`))
+		exported := rw.Body.Bytes()
+
+		source.table = &RouteTable{Checksum: "2", Routes: []Route{{IncomingPath: "/", RouteType: "exact", Handler: "gone"}}}
+		rt.reloadRoutes()
+
+		var result RouteImport
+		rw = call("POST", "/routes/import?dry_run=1", exported)
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(json.Unmarshal(rw.Body.Bytes(), &result)).To(Succeed())
+		Expect(result.Imported).To(BeFalse())
+		Expect(result.Summary).To(Equal("3 added, 0 removed, 0 changed"))
+
+		rw = call("POST", "/routes/import", exported)
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(status(rt, "/old")).To(Equal(http.StatusMovedPermanently))
+
+		Expect(call("POST", "/routes/import", []byte(`{"format": 2}`)).Code).To(Equal(http.StatusBadRequest))
+		Expect(call("GET", "/routes/import", nil).Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("shouldn't keep the route table or serve archives unless they're enabled", func() {
+		plain := newTestRouter()
+		plain.source = source
+		plain.reloadRoutes()
+		Expect(plain.loadedTable).To(BeNil())
+
+		apiAuthToken = "token"
+		defer func() { apiAuthToken = "" }()
+		api, err := newAPIHandler(plain)
+		Expect(err).NotTo(HaveOccurred())
+		req := httptest.NewRequest("GET", "/routes/export", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, req)
+		Expect(rw.Code).To(Equal(http.StatusNotFound))
+	})
+})
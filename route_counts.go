@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// routeCounts breaks down the loaded routes by handler type, counting
+// disabled routes as "disabled", in total and for each backend and document
+// type, so that it's clear, for example, how many routes still point at a
+// backend which is being decommissioned.
+type routeCounts struct {
+	Handlers      map[string]int            `json:"handlers"`
+	Backends      map[string]map[string]int `json:"backends"`
+	DocumentTypes map[string]map[string]int `json:"document_types"`
+}
+
+func countRoutes(routes []Route) routeCounts {
+	counts := routeCounts{
+		Handlers:      make(map[string]int),
+		Backends:      make(map[string]map[string]int),
+		DocumentTypes: make(map[string]map[string]int),
+	}
+	for i := range routes {
+		route := &routes[i]
+		handler := route.Handler
+		if route.Disabled {
+			handler = "disabled"
+		}
+
+		counts.Handlers[handler]++
+		if route.BackendID != "" {
+			addRouteCount(counts.Backends, route.BackendID, handler)
+		}
+		if route.DocumentType != "" {
+			addRouteCount(counts.DocumentTypes, route.DocumentType, handler)
+		}
+	}
+	return counts
+}
+
+func addRouteCount(counts map[string]map[string]int, key, handler string) {
+	if counts[key] == nil {
+		counts[key] = make(map[string]int)
+	}
+	counts[key][handler]++
+}
+
+// updateMetrics sets the route count metrics for a namespace's routes,
+// removing those for backends and document types which no longer have any
+// routes since previous.
+func (c routeCounts) updateMetrics(namespace string, previous routeCounts) {
+	updateRouteCountMetric(routesByBackendMetric, namespace, c.Backends, previous.Backends)
+	updateRouteCountMetric(routesByDocumentTypeMetric, namespace, c.DocumentTypes, previous.DocumentTypes)
+}
+
+func updateRouteCountMetric(metric *prometheus.GaugeVec, namespace string, counts, previous map[string]map[string]int) {
+	for key, handlers := range previous {
+		for handler := range handlers {
+			if counts[key][handler] == 0 {
+				metric.DeleteLabelValues(namespace, key, handler)
+			}
+		}
+	}
+	for key, handlers := range counts {
+		for handler, count := range handlers {
+			metric.WithLabelValues(namespace, key, handler).Set(float64(count))
+		}
+	}
+}
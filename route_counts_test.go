@@ -0,0 +1,43 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Route counts", func() {
+	routes := []Route{
+		{IncomingPath: "/government", RouteType: "prefix", Handler: "backend", BackendID: "whitehall", DocumentType: "organisation"},
+		{IncomingPath: "/government/news", RouteType: "exact", Handler: "backend", BackendID: "whitehall", DocumentType: "news_story"},
+		{IncomingPath: "/government/old", RouteType: "exact", Handler: "backend", BackendID: "whitehall", Disabled: true},
+		{IncomingPath: "/old-news", RouteType: "exact", Handler: "redirect", RedirectTo: "/government/news", DocumentType: "news_story"},
+		{IncomingPath: "/gone", RouteType: "exact", Handler: "gone"},
+	}
+
+	It("should break down routes by handler type, backend and document type", func() {
+		counts := countRoutes(routes)
+		Expect(counts.Handlers).To(Equal(map[string]int{"backend": 2, "disabled": 1, "redirect": 1, "gone": 1}))
+		Expect(counts.Backends).To(Equal(map[string]map[string]int{
+			"whitehall": {"backend": 2, "disabled": 1},
+		}))
+		Expect(counts.DocumentTypes).To(Equal(map[string]map[string]int{
+			"organisation": {"backend": 1},
+			"news_story":   {"backend": 1, "redirect": 1},
+		}))
+	})
+
+	It("should set metrics, removing those which no longer apply", func() {
+		counts := countRoutes(routes)
+		counts.updateMetrics("counts-test", routeCounts{})
+		Expect(promtest.ToFloat64(routesByBackendMetric.WithLabelValues("counts-test", "whitehall", "backend"))).To(Equal(2.0))
+		Expect(promtest.ToFloat64(routesByDocumentTypeMetric.WithLabelValues("counts-test", "news_story", "redirect"))).To(Equal(1.0))
+
+		updated := countRoutes(routes[:2])
+		updated.updateMetrics("counts-test", counts)
+		Expect(routesByBackendMetric.DeleteLabelValues("counts-test", "whitehall", "disabled")).To(BeFalse())
+		Expect(routesByDocumentTypeMetric.DeleteLabelValues("counts-test", "news_story", "redirect")).To(BeFalse())
+		Expect(promtest.ToFloat64(routesByDocumentTypeMetric.WithLabelValues("counts-test", "news_story", "backend"))).To(Equal(1.0))
+	})
+})
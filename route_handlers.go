@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/alphagov/router/handlers"
+)
+
+// RouteHandlerContext is what a RouteHandlerFactory can use to create the
+// handler for a route.
+type RouteHandlerContext struct {
+	// Path is the route's incoming path, unescaped, and Prefix is whether
+	// it's a prefix route.
+	Path   string
+	Prefix bool
+
+	// Backends and GRPCBackends are the handlers which proxy to each
+	// backend, by backend ID.
+	Backends, GRPCBackends map[string]http.Handler
+}
+
+// RouteHandlerFactory creates the handler for a route whose handler type it
+// was registered for. If it returns an error, the route is skipped. The
+// route's middleware is applied to the handler it returns.
+type RouteHandlerFactory func(route *Route, c RouteHandlerContext) (http.Handler, error)
+
+var (
+	routeHandlersMu sync.Mutex
+	routeHandlers   = make(map[string]RouteHandlerFactory)
+)
+
+func init() {
+	RegisterRouteHandler("backend", newBackendRouteHandler)
+	RegisterRouteHandler("redirect", newRedirectRouteHandler)
+	RegisterRouteHandler("gone", func(route *Route, c RouteHandlerContext) (http.Handler, error) {
+		logDebug(fmt.Sprintf("router: registered %s (prefix: %v) -> Gone", c.Path, c.Prefix))
+		return goneHandler, nil
+	})
+	// Special handler so that we can test failure behaviour.
+	RegisterRouteHandler("boom", func(route *Route, c RouteHandlerContext) (http.Handler, error) {
+		logDebug(fmt.Sprintf("router: registered %s (prefix: %v) -> Boom!!!", c.Path, c.Prefix))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("Boom!!!")
+		}), nil
+	})
+}
+
+// RegisterRouteHandler makes a handler type available under name, for use
+// in routes' handler field. It's intended to be called from init functions,
+// and panics if name is already registered.
+func RegisterRouteHandler(name string, factory RouteHandlerFactory) {
+	routeHandlersMu.Lock()
+	defer routeHandlersMu.Unlock()
+
+	if _, ok := routeHandlers[name]; ok {
+		panic(fmt.Sprintf("router: route handler %q registered twice", name))
+	}
+	routeHandlers[name] = factory
+}
+
+// routeHandlerFactory returns the factory registered for a handler type.
+func routeHandlerFactory(name string) (RouteHandlerFactory, bool) {
+	routeHandlersMu.Lock()
+	defer routeHandlersMu.Unlock()
+
+	factory, ok := routeHandlers[name]
+	return factory, ok
+}
+
+var goneHandler = handlers.NewErrorHandler(http.StatusGone)
+
+func newBackendRouteHandler(route *Route, c RouteHandlerContext) (http.Handler, error) {
+	backendHandlers := c.Backends
+	if route.Protocol == "grpc" {
+		backendHandlers = c.GRPCBackends
+	}
+	handler, ok := backendHandlers[route.BackendID]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %s", route.BackendID)
+	}
+	if route.StripPrefix {
+		handler = handlers.NewStripPrefixHandler(c.Path, handler)
+	}
+	logDebug(fmt.Sprintf("router: registered %s (prefix: %v) for %s (protocol: %s, strip prefix: %v)",
+		c.Path, c.Prefix, route.BackendID, route.protocol(), route.StripPrefix))
+	return handler, nil
+}
+
+func newRedirectRouteHandler(route *Route, c RouteHandlerContext) (http.Handler, error) {
+	redirectTemporarily := (route.RedirectType == "temporary")
+	logDebug(fmt.Sprintf("router: registered %s (prefix: %v) -> %s", c.Path, c.Prefix, route.RedirectTo))
+	return handlers.NewRedirectHandler(c.Path, route.RedirectTo, shouldPreserveSegments(route), redirectTemporarily), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func init() {
+	RegisterRouteHandler("test-placeholder", func(route *Route, c RouteHandlerContext) (http.Handler, error) {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("placeholder for " + c.Path))
+		}), nil
+	})
+	RegisterRouteHandler("test-broken", func(route *Route, c RouteHandlerContext) (http.Handler, error) {
+		return nil, errors.New("a broken handler")
+	})
+}
+
+var _ = Describe("Route handler registry", func() {
+	var rt *Router
+
+	BeforeEach(func() {
+		rt = newTestRouter()
+		rt.mux, _ = rt.buildMux(&RouteTable{Routes: []Route{
+			{IncomingPath: "/coming-soon", RouteType: "prefix", Handler: "test-placeholder"},
+			{IncomingPath: "/broken", RouteType: "exact", Handler: "test-broken"},
+			{IncomingPath: "/unknown", RouteType: "exact", Handler: "test-unknown"},
+			{IncomingPath: "/websocket", RouteType: "exact", Handler: "test-placeholder", Protocol: "websocket"},
+		}})
+	})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+
+	It("should serve routes with registered handler types", func() {
+		rw := serve("/coming-soon/page")
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(Equal("placeholder for /coming-soon"))
+	})
+
+	It("should skip routes whose handlers can't be set up", func() {
+		Expect(serve("/broken").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should skip routes with unknown handler types", func() {
+		Expect(serve("/unknown").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should skip routes with unknown protocols", func() {
+		Expect(serve("/websocket").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should only allow each handler type to be registered once", func() {
+		Expect(func() {
+			RegisterRouteHandler("gone", func(route *Route, c RouteHandlerContext) (http.Handler, error) {
+				return nil, nil
+			})
+		}).To(Panic())
+	})
+})
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RouteSource is somewhere the router loads its backends and routes from.
+// The router uses the "mongo" source unless configured otherwise; others can
+// be added with RegisterRouteSource.
+type RouteSource interface {
+	// Load returns the current backends and routes, along with the checksum
+	// of the version it loaded.
+	Load() (*RouteTable, error)
+
+	// Checksum returns an identifier for the version of the routes the
+	// source currently has, such as a database's last write time. The
+	// router reloads when it differs from the checksum of the routes it's
+	// serving, so it should be cheap to compute.
+	Checksum() (string, error)
+
+	// Watch sends on changed whenever the routes might have changed. It
+	// runs until the process exits. A source which can't be notified of
+	// changes can simply send periodically.
+	Watch(changed chan<- bool)
+}
+
+// ProgressReporter can be implemented by a RouteSource whose loads can take
+// a long time, to report how far through them it is.
+type ProgressReporter interface {
+	// SetProgress is called before the first Load, with a function for Load
+	// to call with the number of documents it's read so far.
+	SetProgress(progress func(documents int))
+}
+
+// RouteFilterer can be implemented by a RouteSource which can leave out
+// routes the router won't use while it loads them, such as those outside a
+// shard, rather than loading every route only for most to be dropped.
+type RouteFilterer interface {
+	// SetRouteFilter is called before the first Load, with a function
+	// reporting whether Load should keep a route.
+	SetRouteFilter(keep func(route *Route) bool)
+}
+
+// ContextLoader can be implemented by a RouteSource to stop loading when
+// ctx is done, such as when a reload has taken too long.
+type ContextLoader interface {
+	LoadContext(ctx context.Context) (*RouteTable, error)
+}
+
+// loadRouteTable loads the routes from source, giving up when ctx is done
+// even if the source doesn't implement ContextLoader (in which case its
+// Load carries on in the background, and what it returns is ignored). It
+// fails if any of the documents have a schema version the router doesn't
+// support.
+func loadRouteTable(ctx context.Context, source RouteSource) (*RouteTable, error) {
+	type result struct {
+		table *RouteTable
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		if loader, ok := source.(ContextLoader); ok {
+			r.table, r.err = loader.LoadContext(ctx)
+		} else {
+			r.table, r.err = source.Load()
+		}
+		done <- r
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		if err := checkSchemaVersions(r.table); err != nil {
+			return nil, err
+		}
+		return r.table, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// RouteTable is a version of the backends and routes from a RouteSource.
+type RouteTable struct {
+	Backends []Backend
+	Routes   []Route
+	Checksum string
+}
+
+// RouteSourceFactory creates a RouteSource configured by o.
+type RouteSourceFactory func(o Options) (RouteSource, error)
+
+var (
+	routeSourcesMu sync.Mutex
+	routeSources   = make(map[string]RouteSourceFactory)
+)
+
+// RegisterRouteSource makes a route source available under name, for use
+// with ROUTER_ROUTE_SOURCE. It's intended to be called from init functions,
+// and panics if name is already registered.
+func RegisterRouteSource(name string, factory RouteSourceFactory) {
+	routeSourcesMu.Lock()
+	defer routeSourcesMu.Unlock()
+
+	if _, ok := routeSources[name]; ok {
+		panic(fmt.Sprintf("router: route source %q registered twice", name))
+	}
+	routeSources[name] = factory
+}
+
+// newRouteSource creates the route source registered under name.
+func newRouteSource(name string, o Options) (RouteSource, error) {
+	routeSourcesMu.Lock()
+	factory, ok := routeSources[name]
+	routeSourcesMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("router: unknown route source %q (available: %s)",
+			name, strings.Join(routeSourceNames(), ", "))
+	}
+	return factory(o)
+}
+
+func routeSourceNames() []string {
+	routeSourcesMu.Lock()
+	defer routeSourcesMu.Unlock()
+
+	names := make([]string, 0, len(routeSources))
+	for name := range routeSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
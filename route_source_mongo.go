@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func init() {
+	RegisterRouteSource("mongo", newMongoRouteSource)
+}
+
+type MongoReplicaSet struct {
+	Members []MongoReplicaSetMember `bson:"members"`
+}
+
+type MongoReplicaSetMember struct {
+	Name    string              `bson:"name"`
+	Optime  bson.MongoTimestamp `bson:"optime"`
+	Current bool                `bson:"self"`
+}
+
+type mongoDatabase interface {
+	Run(command interface{}, result interface{}) error
+}
+
+// mongoIter is the part of *mgo.Iter that decodeRouteDocuments uses.
+type mongoIter interface {
+	Next(result interface{}) bool
+	Close() error
+}
+
+// mongoRouteSource loads routes from the "backends" and "routes" collections
+// of a MongoDB database. Its checksum is the optime (the time of the last
+// write) of the replica set member it's reading from.
+type mongoRouteSource struct {
+	mongoURL          string
+	mongoDbName       string
+	mongoPollInterval time.Duration
+	maxDocumentSize   int
+	loadWorkers       int
+	progress          func(documents int)
+	keep              func(route *Route) bool
+
+	mu                sync.Mutex
+	mongoReadToOptime bson.MongoTimestamp
+}
+
+func newMongoRouteSource(o Options) (RouteSource, error) {
+	logInfo("router: using mongo poll interval:", o.MongoPollInterval)
+
+	mongoReadToOptime, err := bson.NewMongoTimestamp(time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mongoRouteSource{
+		mongoURL:          o.MongoURL,
+		mongoDbName:       o.MongoDbName,
+		mongoPollInterval: o.MongoPollInterval,
+		maxDocumentSize:   o.MongoMaxDocumentSize,
+		loadWorkers:       loadWorkerCount(o.LoadWorkers),
+		mongoReadToOptime: mongoReadToOptime,
+	}, nil
+}
+
+func (s *mongoRouteSource) dial() (*mgo.Session, error) {
+	logDebug("mgo: connecting to", s.mongoURL)
+
+	sess, err := mgo.Dial(s.mongoURL)
+	if err != nil {
+		return nil, fmt.Errorf("mgo: error connecting to MongoDB, skipping update (error: %v)", err)
+	}
+	sess.SetMode(mgo.SecondaryPreferred, true)
+	return sess, nil
+}
+
+// Checksum returns the optime of the replica set member the router would
+// read from, unless it's behind the data the router has already loaded (as
+// a lagging secondary might be), in which case it returns the checksum of
+// that data so that the router doesn't go back to older routes.
+func (s *mongoRouteSource) Checksum() (string, error) {
+	sess, err := s.dial()
+	if err != nil {
+		return "", err
+	}
+	defer sess.Close()
+
+	currentMongoInstance, err := s.getCurrentMongoInstance(sess.DB("admin"))
+	if err != nil {
+		return "", err
+	}
+
+	logDebug("mgo: communicating with replica set member", currentMongoInstance.Name)
+
+	logDebug("router: polled mongo instance is ", currentMongoInstance.Name)
+	logDebug("router: polled mongo optime is ", currentMongoInstance.Optime)
+	logDebug("router: current read-to mongo optime is ", s.readToOptime())
+
+	if s.shouldReload(currentMongoInstance) {
+		return optimeChecksum(currentMongoInstance.Optime), nil
+	}
+	return optimeChecksum(s.readToOptime()), nil
+}
+
+// Load reads the backends and routes, along with the optime of the replica
+// set member they were read from.
+func (s *mongoRouteSource) Load() (*RouteTable, error) {
+	return s.LoadContext(context.Background())
+}
+
+// LoadContext implements ContextLoader. When ctx is done the session is
+// closed, so that a stalled query fails rather than blocking the reload.
+func (s *mongoRouteSource) LoadContext(ctx context.Context) (*RouteTable, error) {
+	sess, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sess.Close()
+		case <-stop:
+		}
+	}()
+
+	currentMongoInstance, err := s.getCurrentMongoInstance(sess.DB("admin"))
+	if err != nil {
+		return nil, err
+	}
+
+	db := sess.DB(s.mongoDbName)
+	table := &RouteTable{Checksum: optimeChecksum(currentMongoInstance.Optime)}
+	backends, err := decodeBackendDocuments(ctx, db.C("backends").Find(nil).Iter())
+	if err != nil {
+		return nil, err
+	}
+	table.Backends = backends
+	routes, err := decodeRouteDocuments(ctx, db.C("routes").Find(nil).Sort("incoming_path", "route_type").Iter(), s.maxDocumentSize, s.loadWorkers, s.keep, s.progress)
+	if err != nil {
+		return nil, err
+	}
+	table.Routes = routes
+
+	s.mu.Lock()
+	if currentMongoInstance.Optime > s.mongoReadToOptime {
+		s.mongoReadToOptime = currentMongoInstance.Optime
+	}
+	s.mu.Unlock()
+
+	return table, nil
+}
+
+// decodeBackendDocuments reads the backend documents from iter one at a
+// time, stopping early with ctx's error once it's done.
+func decodeBackendDocuments(ctx context.Context, iter mongoIter) ([]Backend, error) {
+	var backends []Backend
+	for {
+		var backend Backend
+		if !iter.Next(&backend) {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		backends = append(backends, backend)
+	}
+	if err := iter.Close(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return backends, nil
+}
+
+// decodeRouteDocumentBatch is how many route documents are read from Mongo
+// before they're decoded.
+const decodeRouteDocumentBatch = 1000
+
+// decodeRouteDocuments reads the route documents from iter one at a time,
+// failing if any is larger than maxSize bytes (unless it's 0): a route
+// can't be left out without its requests getting 404s, so it's better to
+// keep serving the current routes until the document is fixed. Oversized
+// documents are counted by a metric. The documents are
+// decoded in batches, shared between up to workers goroutines, keeping
+// their order, and only the routes which keep (if given) reports should be
+// kept are returned. progress, if given, is called with the number of documents
+// read after each batch. Reading stops early with ctx's error once it's
+// done.
+func decodeRouteDocuments(ctx context.Context, iter mongoIter, maxSize, workers int, keep func(route *Route) bool, progress func(documents int)) ([]Route, error) {
+	var routes []Route
+	read := 0
+	var batch []bson.Raw
+	decode := func() error {
+		decoded := make([]Route, len(batch))
+		errs := make([]error, len(batch))
+		forEachParallel(len(batch), workers, func(i int) {
+			errs[i] = batch[i].Unmarshal(&decoded[i])
+		})
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		for i := range decoded {
+			if keep == nil || keep(&decoded[i]) {
+				routes = append(routes, decoded[i])
+			}
+		}
+		batch = batch[:0]
+		if progress != nil {
+			progress(read)
+		}
+		return nil
+	}
+
+	var doc bson.Raw
+	for iter.Next(&doc) {
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		read++
+		if maxSize > 0 && len(doc.Data) > maxSize {
+			oversizedRouteDocumentCountMetric.Inc()
+			iter.Close()
+			var id struct {
+				IncomingPath string `bson:"incoming_path"`
+				RouteType    string `bson:"route_type"`
+			}
+			if err := doc.Unmarshal(&id); err != nil {
+				return nil, fmt.Errorf("route document %d is %d bytes (limit %d) and can't be decoded: %v",
+					read, len(doc.Data), maxSize, err)
+			}
+			return nil, fmt.Errorf("route %s (%s) is %d bytes (limit %d)",
+				id.IncomingPath, id.RouteType, len(doc.Data), maxSize)
+		}
+
+		// The iterator may reuse doc's buffer for the next document.
+		data := make([]byte, len(doc.Data))
+		copy(data, doc.Data)
+		batch = append(batch, bson.Raw{Kind: doc.Kind, Data: data})
+		if len(batch) == decodeRouteDocumentBatch {
+			if err := decode(); err != nil {
+				iter.Close()
+				return nil, err
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if err := decode(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// SetProgress implements ProgressReporter.
+func (s *mongoRouteSource) SetProgress(progress func(documents int)) {
+	s.progress = progress
+}
+
+// SetRouteFilter implements RouteFilterer.
+func (s *mongoRouteSource) SetRouteFilter(keep func(route *Route) bool) {
+	s.keep = keep
+}
+
+// Watch polls for changes every MongoPollInterval.
+func (s *mongoRouteSource) Watch(changed chan<- bool) {
+	logInfo(fmt.Sprintf("router: starting self-update process, polling for route changes every %v", s.mongoPollInterval))
+
+	tick := time.Tick(s.mongoPollInterval)
+	for range tick {
+		logInfo("router: polling MongoDB for changes")
+
+		changed <- true
+	}
+}
+
+func (s *mongoRouteSource) readToOptime() bson.MongoTimestamp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mongoReadToOptime
+}
+
+func (s *mongoRouteSource) getCurrentMongoInstance(db mongoDatabase) (MongoReplicaSetMember, error) {
+	replicaSetStatus := bson.M{}
+
+	if err := db.Run("replSetGetStatus", &replicaSetStatus); err != nil {
+		return MongoReplicaSetMember{}, errors.New(fmt.Sprintf("router: couldn't get replica set status from MongoDB, skipping update (error: %v)", err))
+	}
+
+	replicaSetStatusBytes, err := bson.Marshal(replicaSetStatus)
+	if err != nil {
+		return MongoReplicaSetMember{}, errors.New(fmt.Sprintf("router: couldn't marshal replica set status from MongoDB, skipping update (error: %v)", err))
+	}
+
+	replicaSet := MongoReplicaSet{}
+	err = bson.Unmarshal(replicaSetStatusBytes, &replicaSet)
+	if err != nil {
+		return MongoReplicaSetMember{}, errors.New(fmt.Sprintf("router: couldn't unmarshal replica set status from MongoDB, skipping update (error: %v)", err))
+	}
+
+	currentInstance := make([]MongoReplicaSetMember, 0)
+	for _, instance := range replicaSet.Members {
+		if instance.Current {
+			currentInstance = append(currentInstance, instance)
+		}
+	}
+
+	logDebug("router: MongoDB instances", currentInstance)
+
+	if len(currentInstance) != 1 {
+		return MongoReplicaSetMember{}, errors.New(fmt.Sprintf("router: did not find exactly one current MongoDB instance, skipping update (current instances found: %d)", len(currentInstance)))
+	}
+
+	return currentInstance[0], nil
+}
+
+func (s *mongoRouteSource) shouldReload(currentMongoInstance MongoReplicaSetMember) bool {
+	return currentMongoInstance.Optime > s.readToOptime()
+}
+
+func optimeChecksum(optime bson.MongoTimestamp) string {
+	return strconv.FormatInt(int64(optime), 10)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/triemux"
+)
+
+// fakeRouteSource serves a fixed route table, which tests can change.
+type fakeRouteSource struct {
+	table *RouteTable
+	err   error
+}
+
+func (s *fakeRouteSource) Load() (*RouteTable, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.table, nil
+}
+
+func (s *fakeRouteSource) Checksum() (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	return s.table.Checksum, nil
+}
+
+func (s *fakeRouteSource) Watch(changed chan<- bool) {}
+
+// stalledRouteSource doesn't finish loading until release is closed, or
+// its context is done if contextAware is set.
+type stalledRouteSource struct {
+	*fakeRouteSource
+	release      chan struct{}
+	contextAware bool
+	stopped      chan struct{}
+}
+
+func (s *stalledRouteSource) Load() (*RouteTable, error) {
+	<-s.release
+	return s.fakeRouteSource.Load()
+}
+
+func (s *stalledRouteSource) LoadContext(ctx context.Context) (*RouteTable, error) {
+	if !s.contextAware {
+		return s.Load()
+	}
+	<-ctx.Done()
+	close(s.stopped)
+	return nil, ctx.Err()
+}
+
+var _ = Describe("Route sources", func() {
+	var (
+		rt     *Router
+		source *fakeRouteSource
+	)
+
+	BeforeEach(func() {
+		source = &fakeRouteSource{table: &RouteTable{
+			Backends: []Backend{{BackendID: "backend", BackendURL: "http://backend.example"}},
+			Routes: []Route{
+				{IncomingPath: "/foo", RouteType: "prefix", Handler: "gone"},
+				{IncomingPath: "/bar", RouteType: "exact", Handler: "backend", BackendID: "backend"},
+			},
+			Checksum: "1",
+		}}
+		rt = newTestRouter()
+		rt.source = source
+	})
+
+	status := func(path string) int {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw.Code
+	}
+
+	It("should load routes from the source", func() {
+		rt.reloadRoutes()
+
+		Expect(rt.mux.RouteCount()).To(Equal(2))
+		Expect(rt.loadedChecksum).To(Equal("1"))
+		Expect(status("/foo/bar")).To(Equal(http.StatusGone))
+	})
+
+	It("should report the handler types and tries of the loaded routes", func() {
+		rt.reloadRoutes()
+
+		stats := rt.RouteStats()
+		Expect(stats["handlers"]).To(Equal(map[string]int{"gone": 1, "backend": 1}))
+		Expect(stats["backends"]).To(Equal(map[string]map[string]int{"backend": {"backend": 1}}))
+		tries := stats["tries"].(triemux.Stats)
+		Expect(tries.Exact.Entries).To(Equal(1))
+		Expect(tries.Prefix.Entries).To(Equal(1))
+		Expect(stats["estimated_bytes"]).To(BeNumerically(">", 0))
+	})
+
+	It("should keep the previous routes if the source fails", func() {
+		rt.reloadRoutes()
+		source.err = errors.New("source unavailable")
+		rt.reloadRoutes()
+
+		Expect(rt.mux.RouteCount()).To(Equal(2))
+		Expect(rt.loadedChecksum).To(Equal("1"))
+	})
+
+	It("should give the same checksum whatever order the routes are in", func() {
+		mux, _ := rt.buildMux(source.table)
+
+		reversed := *source.table
+		reversed.Routes = []Route{source.table.Routes[1], source.table.Routes[0]}
+		reversedMux, _ := rt.buildMux(&reversed)
+
+		Expect(reversedMux.RouteChecksum()).To(Equal(mux.RouteChecksum()))
+	})
+
+	It("should load the same routes in parallel as one at a time", func() {
+		table := &RouteTable{Backends: source.table.Backends}
+		for i := 0; i < 500; i++ {
+			table.Routes = append(table.Routes,
+				Route{IncomingPath: fmt.Sprintf("/gone/%d", i), RouteType: "exact", Handler: "gone"},
+				Route{IncomingPath: fmt.Sprintf("/redirect/%d", i), RouteType: "prefix", Handler: "redirect", RedirectTo: "/"},
+			)
+		}
+		table.Routes = append(table.Routes, Route{IncomingPath: "/gone/1", RouteType: "exact", Handler: "redirect", RedirectTo: "/"})
+
+		mux, _ := rt.buildMux(table)
+		rt.loadWorkers = 8
+		parallelMux, _ := rt.buildMux(table)
+
+		Expect(parallelMux.RouteCount()).To(Equal(mux.RouteCount()))
+		Expect(parallelMux.RouteChecksum()).To(Equal(mux.RouteChecksum()))
+
+		rw := httptest.NewRecorder()
+		parallelMux.ServeHTTP(rw, httptest.NewRequest("GET", "/gone/1", nil))
+		Expect(rw.Code).To(Equal(http.StatusMovedPermanently))
+	})
+
+	Context("with a reload timeout", func() {
+		var stalled *stalledRouteSource
+
+		BeforeEach(func() {
+			rt.reloadRoutes()
+			stalled = &stalledRouteSource{
+				fakeRouteSource: source,
+				release:         make(chan struct{}),
+				stopped:         make(chan struct{}),
+			}
+			rt.source = stalled
+			rt.reloadTimeout = 10 * time.Millisecond
+		})
+
+		AfterEach(func() {
+			close(stalled.release)
+		})
+
+		It("should give up on a stalled load and keep the previous routes", func() {
+			source.table = &RouteTable{Checksum: "2"}
+			rt.reloadRoutes()
+
+			Expect(rt.mux.RouteCount()).To(Equal(2))
+			Expect(rt.loadedChecksum).To(Equal("1"))
+			Expect(rt.progress.status().LastReload.Error).To(Equal("reload took longer than 10ms"))
+		})
+
+		It("should tell sources which implement ContextLoader to stop", func() {
+			stalled.contextAware = true
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := loadRouteTable(ctx, stalled)
+			Expect(err).To(Equal(context.DeadlineExceeded))
+			Eventually(stalled.stopped).Should(BeClosed())
+		})
+
+		It("should stop decoding route documents", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			docs := []interface{}{bson.M{"incoming_path": "/foo", "route_type": "exact"}}
+			_, err := decodeRouteDocuments(ctx, &mockMongoIter{docs: docs}, 0, 1, nil, nil)
+			Expect(err).To(Equal(context.Canceled))
+		})
+
+		It("should stop decoding backend documents", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			docs := []interface{}{bson.M{"backend_id": "frontend", "backend_url": "http://frontend"}}
+			_, err := decodeBackendDocuments(ctx, &mockMongoIter{docs: docs})
+			Expect(err).To(Equal(context.Canceled))
+		})
+	})
+
+	Describe("decoding backend documents", func() {
+		It("should decode each document separately", func() {
+			docs := []interface{}{
+				bson.M{"backend_id": "frontend", "backend_url": "http://frontend", "host_header": "www.gov.uk"},
+				bson.M{"backend_id": "search", "backend_url": "http://search"},
+			}
+			backends, err := decodeBackendDocuments(context.Background(), &mockMongoIter{docs: docs})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backends).To(HaveLen(2))
+			Expect(backends[0].BackendID).To(Equal("frontend"))
+			Expect(backends[0].HostHeader).To(Equal("www.gov.uk"))
+			Expect(backends[1].BackendID).To(Equal("search"))
+			Expect(backends[1].HostHeader).To(BeEmpty())
+		})
+
+		It("should fail if the query does", func() {
+			_, err := decodeBackendDocuments(context.Background(), &mockMongoIter{err: errors.New("cursor not found")})
+			Expect(err).To(MatchError("cursor not found"))
+		})
+	})
+
+	Describe("registration", func() {
+		It("should create registered sources by name", func() {
+			registered, err := newRouteSource("mongo", Options{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(registered).To(BeAssignableToTypeOf(&mongoRouteSource{}))
+		})
+
+		It("should reject unknown sources", func() {
+			_, err := newRouteSource("unknown", Options{})
+			Expect(err).To(MatchError(ContainSubstring(`unknown route source "unknown" (available: mongo`)))
+		})
+
+		It("should refuse to register a name twice", func() {
+			Expect(func() {
+				RegisterRouteSource("mongo", newMongoRouteSource)
+			}).To(Panic())
+		})
+	})
+})
@@ -1,67 +1,337 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"crypto/ed25519"
 	"fmt"
+	"hash"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http/httpguts"
 
 	"github.com/alphagov/router/handlers"
 	"github.com/alphagov/router/logger"
 	"github.com/alphagov/router/triemux"
-	"github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
 )
 
 // Router is a wrapper around an HTTP multiplexer (trie.Mux) which retrieves its
-// routes from a passed mongo database.
+// routes from a RouteSource.
 type Router struct {
 	mux                   *triemux.Mux
 	lock                  sync.RWMutex
-	mongoURL              string
-	mongoDbName           string
-	mongoPollInterval     time.Duration
+	middleware            *middlewareSet
+	disabledHandler       http.Handler
+	rules                 *rulesChain
+	mirror                *mirrorSwitch
+	cdn                   *cdnPurger
+	budgets               *budgetMonitor
+	backendStates         *backendStates
+	purgeQueue            *cdnPurgeQueue
+	loadedTable           *RouteTable
+	routeCounts           routeCounts
+	namespace             string
+	source                RouteSource
+	checksumHash          func() hash.Hash
+	loadWorkers           int
+	progress              *reloadProgress
+	reloadTimeout         time.Duration
+	loadedChecksum        string
 	backendConnectTimeout time.Duration
 	backendHeaderTimeout  time.Duration
-	mongoReadToOptime     bson.MongoTimestamp
+	coalesceRequests      bool
+	coalesceMaxBodySize   int64
+	retryBudget           handlers.RetryBudget
+	circuitBreaker        handlers.CircuitBreaker
+	capture               *requestCapture
+	decisions             *decisionLog
+	checks                *requestChecks
+	previewTokens         [][]byte
+	notFoundBackend       string
+	localePrefixes        []string
+	localeFallback        string
+	shadow                *shadowEvaluator
+	backendGrace          *backendGrace
+	shard                 *routeShard
+	reloadLock            sync.Mutex
+	standby               *standbyRoutes
+	standbyMaxRoutes      int
+	routeArchives         bool
+	replacedChecksum      string
+	drainLock             sync.RWMutex
+	drained               map[string]bool
+	knownBackends         map[string]bool
+	disabledPaths         *disabledPaths
+	verifyRoutes          bool
 	logger                logger.Logger
 	ReloadChan            chan bool
 }
 
 type Backend struct {
-	BackendID     string `bson:"backend_id"`
-	BackendURL    string `bson:"backend_url"`
-	SubdomainName string `bson:"subdomain_name"`
+	BackendID     string `bson:"backend_id" json:"backend_id"`
+	BackendURL    string `bson:"backend_url" json:"backend_url"`
+	SubdomainName string `bson:"subdomain_name" json:"subdomain_name"`
+	HedgeDelay    string `bson:"hedge_delay" json:"hedge_delay"`
+	FallbackPage  string `bson:"fallback_page" json:"fallback_page"`
+	FallbackURL   string `bson:"fallback_url" json:"fallback_url"`
+	HostHeader    string `bson:"host_header" json:"host_header"`
+
+	// Middleware and SkipMiddleware apply to each of the backend's routes,
+	// as well as any given for the routes themselves.
+	Middleware     []string `bson:"middleware" json:"middleware"`
+	SkipMiddleware []string `bson:"skip_middleware" json:"skip_middleware"`
+
+	// LogSampleRate, if set, is the fraction of requests to the backend's
+	// routes which the "logging" middleware logs.
+	LogSampleRate *float64 `bson:"log_sample_rate" json:"log_sample_rate"`
+
+	// LatencyBudget and ErrorBudget, if set, raise an alert when more than
+	// 5% of the backend's requests in a window take longer than
+	// LatencyBudget to respond, or more than ErrorBudget (a fraction) of
+	// them fail (see budgetMonitor).
+	LatencyBudget string  `bson:"latency_budget" json:"latency_budget"`
+	ErrorBudget   float64 `bson:"error_budget" json:"error_budget"`
+
+	// SchemaVersion is the version of the document's schema (see
+	// routeSchemaVersion), or 0 for version 1.
+	SchemaVersion int `bson:"schema_version" json:"schema_version"`
 }
 
-type MongoReplicaSet struct {
-	Members []MongoReplicaSetMember `bson:"members"`
-}
-
-type MongoReplicaSetMember struct {
-	Name    string              `bson:"name"`
-	Optime  bson.MongoTimestamp `bson:"optime"`
-	Current bool                `bson:"self"`
+type Route struct {
+	IncomingPath   string   `bson:"incoming_path" json:"incoming_path"`
+	RouteType      string   `bson:"route_type" json:"route_type"`
+	Handler        string   `bson:"handler" json:"handler"`
+	BackendID      string   `bson:"backend_id" json:"backend_id"`
+	RedirectTo     string   `bson:"redirect_to" json:"redirect_to"`
+	RedirectType   string   `bson:"redirect_type" json:"redirect_type"`
+	SegmentsMode   string   `bson:"segments_mode" json:"segments_mode"`
+	Protocol       string   `bson:"protocol" json:"protocol"`
+	Extensions     []string `bson:"extensions" json:"extensions"`
+	StripPrefix    bool     `bson:"strip_prefix" json:"strip_prefix"`
+	Middleware     []string `bson:"middleware" json:"middleware"`
+	SkipMiddleware []string `bson:"skip_middleware" json:"skip_middleware"`
+	Disabled       bool     `bson:"disabled" json:"disabled"`
+	LogSampleRate  *float64 `bson:"log_sample_rate" json:"log_sample_rate"`
+
+	// DocumentType is the type of the content the route is for, if the
+	// route store records it. It's only used to break down route counts.
+	DocumentType string `bson:"document_type" json:"document_type"`
+
+	// Preview marks a route as preview-only: it's only served to requests
+	// with one of the router's preview tokens, and others are routed as if
+	// it didn't exist.
+	Preview bool `bson:"preview" json:"preview"`
+
+	// SchemaVersion is the version of the document's schema (see
+	// routeSchemaVersion), or 0 for version 1.
+	SchemaVersion int `bson:"schema_version" json:"schema_version"`
+
+	// AnalyticsTags are dimensions for downstream analytics, such as the
+	// campaign or content format, which are sent to the backend as
+	// GOVUK-Analytics-* headers and included in the access log.
+	AnalyticsTags map[string]string `bson:"analytics_tags" json:"analytics_tags"`
 }
 
-type Route struct {
-	IncomingPath string `bson:"incoming_path"`
-	RouteType    string `bson:"route_type"`
-	Handler      string `bson:"handler"`
-	BackendID    string `bson:"backend_id"`
-	RedirectTo   string `bson:"redirect_to"`
-	RedirectType string `bson:"redirect_type"`
-	SegmentsMode string `bson:"segments_mode"`
-	Disabled     bool   `bson:"disabled"`
+// Options configures a Router.
+type Options struct {
+	// Namespace is the name of the route namespace the router serves, or
+	// empty for the main routes.
+	Namespace string
+	// shared is shared by the routers for each namespace, so that they
+	// don't each watch the same files or open the same logs.
+	shared *namespaceShared
+
+	// RouteSource is the name of the RouteSource to load routes from. The
+	// Mongo options are used by the "mongo" source.
+	RouteSource string
+
+	// RouteChecksum is the name of the hash algorithm for the route
+	// checksum (see RegisterRouteChecksum), or empty for SHA-1.
+	RouteChecksum string
+
+	MongoURL              string
+	MongoDbName           string
+	MongoPollInterval     time.Duration
+	BackendConnectTimeout time.Duration
+	BackendHeaderTimeout  time.Duration
+	LogFileName           string
+
+	// MongoMaxDocumentSize is the largest route document, in bytes, which
+	// the "mongo" source loads. Larger ones fail the reload. 0 means
+	// there's no limit.
+	MongoMaxDocumentSize int
+
+	// LoadWorkers is the number of goroutines used to decode and set up
+	// routes during a reload, or 0 for one per CPU.
+	LoadWorkers int
+
+	// ReloadProgressInterval is how often the progress of a reload is
+	// logged while it's running, or 0 to only report it in the API.
+	ReloadProgressInterval time.Duration
+
+	// ReloadTimeout is how long a reload can take before it's abandoned,
+	// keeping the current routes, or 0 for no limit.
+	ReloadTimeout time.Duration
+
+	// BackendGracePeriod is how long routes keep using a backend which a
+	// reload removed while they still use it, or 0 to skip them straight
+	// away.
+	BackendGracePeriod time.Duration
+
+	// MaxHeaderBytes, AllowedMethods and RequireUTF8Paths are used to
+	// reject malformed requests before they're routed. MaxHeaderBytes is
+	// the largest total size of a request's headers, or 0 for net/http's
+	// limit, AllowedMethods are the methods which can be routed, or empty
+	// for any, and RequireUTF8Paths rejects requests whose decoded paths
+	// aren't valid UTF-8.
+	MaxHeaderBytes   int
+	AllowedMethods   []string
+	RequireUTF8Paths bool
+
+	// Hostnames are the hosts the router serves, the first of which is the
+	// default host. Requests for other hosts are routed as usual if
+	// UnknownHosts is "allow" or empty, rejected with a 421 if it's
+	// "reject", or routed as if they were for the default host if it's
+	// "default". Requests with an absolute-form URI, whose host replaces
+	// the Host header, are rejected with a 400 if AbsoluteURIs is "reject".
+	Hostnames    []string
+	UnknownHosts string
+	AbsoluteURIs string
+
+	// PreviewTokens are the tokens which show preview-only routes, sent in
+	// a GOVUK-Preview-Token header or govuk_preview_token cookie. With none,
+	// preview-only routes aren't served to anyone.
+	PreviewTokens []string
+
+	// NotFoundBackend is the ID of a backend which serves requests with no
+	// route, such as the frontend app which renders the branded 404 page.
+	// If it's empty, or isn't a backend, the router responds itself.
+	NotFoundBackend string
+
+	// LocalePrefixes are path segments, such as "cy", which requests for
+	// translated pages start with. A request under one of them with no
+	// route is served by the route for the path without it, by redirecting
+	// to that path if LocaleFallback is "redirect" or proxying to the route
+	// if it's "proxy".
+	LocalePrefixes []string
+	LocaleFallback string
+
+	// ShadowSource is a second source of routes, such as a new route store
+	// being canaried, which each request's route is compared with in the
+	// background without affecting the response.
+	ShadowSource RouteSource
+
+	// ShardPrefixes are the top-level path segments, such as "government",
+	// or "/" for the root path, whose routes the router loads, so that a
+	// large route table can be split between instances. If it's empty, the
+	// router loads every route. Requests for paths under other prefixes are
+	// proxied to ShardPeerURL if it's set, or get ShardMissStatus.
+	ShardPrefixes   []string
+	ShardPeerURL    string
+	ShardMissStatus int
+
+	// StandbyMaxRoutes is the most routes the router keeps after a reload
+	// replaces them, so that it can roll back to them, or 0 not to keep
+	// them at all.
+	StandbyMaxRoutes int
+
+	// RouteArchives enables exporting and importing route archives through
+	// the API, for which the router keeps a copy of its route table.
+	RouteArchives bool
+
+	// CoalesceRequests enables coalescing of identical in-flight GET requests
+	// to each backend, with responses of up to CoalesceMaxBodySize bytes
+	// shared between the coalesced requests.
+	CoalesceRequests    bool
+	CoalesceMaxBodySize int64
+
+	// RetryBudget limits the requests to each backend which may be retried
+	// or hedged.
+	RetryBudget handlers.RetryBudget
+
+	// CircuitBreaker decides when a backend with a fallback is treated as
+	// down.
+	CircuitBreaker handlers.CircuitBreaker
+
+	// VerifyRoutes enables consistency checks on each newly loaded set of
+	// routes. If they fail, the router carries on using the previous routes.
+	VerifyRoutes bool
+
+	// Middleware names the middleware applied to every request, outermost
+	// first (see RegisterMiddleware), unless a route or its backend opts out
+	// of it. The remaining options configure the built-in middleware.
+	Middleware        []string
+	AccessLogFileName string
+	BasicAuthUsername string
+	BasicAuthPassword string
+	RateLimit         handlers.RateLimit
+	RequestHeaders    map[string]string
+	ResponseHeaders   map[string]string
+	Signon            handlers.SignonConfig
+	BannerFileName    string
+	HSTS              string
+
+	// AccessLogSampleRate is the fraction of requests logged by "logging",
+	// unless a route or its backend sets its own rate: 1 logs every
+	// request.
+	AccessLogSampleRate float64
+
+	// ClientPolicyURL is where the "rate-limit" middleware fetches the
+	// client policy from every ClientPolicyPollInterval, checking it's
+	// signed with ClientPolicyKey (see handlers.ClientPolicy) and, if
+	// ClientPolicyMaxAge is set, was issued no longer ago than that.
+	ClientPolicyURL          string
+	ClientPolicyKey          ed25519.PublicKey
+	ClientPolicyPollInterval time.Duration
+	ClientPolicyMaxAge       time.Duration
+
+	// SurrogateKeys tags each route's responses with Surrogate-Key headers
+	// for the route and its backend, which can be purged from the CDN
+	// (see CDNConfig).
+	SurrogateKeys bool
+	CDN           CDNConfig
+
+	// BudgetWindow is the period over which backends' requests are checked
+	// against their latency and error budgets. Alerts are also sent to
+	// AlertWebhookURL, if it's set.
+	BudgetWindow    time.Duration
+	AlertWebhookURL string
+
+	// PurgeChangedRoutes purges the paths of routes which are removed or
+	// changed by a reload from the CDN (or their surrogate keys, if
+	// SurrogateKeys is set), so that pages don't stay cached after their
+	// routes have gone.
+	PurgeChangedRoutes bool
+
+	// DecisionLog, if set, records how each request is routed: "api"
+	// streams the decisions from the API's /decisions endpoint, and
+	// anything else is also the name of a file to append them to as JSON.
+	DecisionLog string
+
+	// MirrorURL is a static mirror of the site, which requests can be sent
+	// to through the API if the backends can't be relied on. By default all
+	// requests are mirrored, or just those for MirrorPrefixes if it's set.
+	MirrorURL      string
+	MirrorPrefixes []string
+
+	// RulesFileName is a JSON file of transformation rules to apply to
+	// requests before they're routed (see handlers.Rule), which is checked
+	// for changes every RulesPollInterval.
+	RulesFileName     string
+	RulesPollInterval time.Duration
 }
 
 // NewRouter returns a new empty router instance. You will need to call
 // SelfUpdateRoutes() to initialise the self-update process for routes.
+//
+// It's kept for callers which only need the original settings; the rest
+// are set through NewRouterWithOptions.
 func NewRouter(mongoURL, mongoDbName, mongoPollInterval, backendConnectTimeout, backendHeaderTimeout, logFileName string) (rt *Router, err error) {
 	mgoPollInterval, err := time.ParseDuration(mongoPollInterval)
 	if err != nil {
@@ -75,34 +345,187 @@ func NewRouter(mongoURL, mongoDbName, mongoPollInterval, backendConnectTimeout,
 	if err != nil {
 		return nil, err
 	}
-	logInfo("router: using mongo poll interval:", mgoPollInterval)
-	logInfo("router: using backend connect timeout:", beConnTimeout)
-	logInfo("router: using backend header timeout:", beHeaderTimeout)
+	return NewRouterWithOptions(Options{
+		MongoURL:              mongoURL,
+		MongoDbName:           mongoDbName,
+		MongoPollInterval:     mgoPollInterval,
+		BackendConnectTimeout: beConnTimeout,
+		BackendHeaderTimeout:  beHeaderTimeout,
+		LogFileName:           logFileName,
+	})
+}
 
-	l, err := logger.New(logFileName)
+// NewRouterWithOptions is like NewRouter, but takes all of the router's
+// settings.
+func NewRouterWithOptions(o Options) (rt *Router, err error) {
+	if o.RouteSource == "" {
+		o.RouteSource = "mongo"
+	}
+	if o.Namespace != "" {
+		logInfo("router: setting up route namespace:", o.Namespace)
+	}
+	logInfo("router: loading routes from route source:", o.RouteSource)
+	source, err := newRouteSource(o.RouteSource, o)
 	if err != nil {
 		return nil, err
 	}
 
-	mongoReadToOptime, err := bson.NewMongoTimestamp(time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), 1)
+	var checksumHash func() hash.Hash
+	if o.RouteChecksum != "" {
+		if checksumHash, err = routeChecksumHash(o.RouteChecksum); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = validHostPolicy(o.Hostnames, o.UnknownHosts, o.AbsoluteURIs); err != nil {
+		return nil, err
+	}
+
+	if len(o.LocalePrefixes) > 0 {
+		if o.LocaleFallback == "" {
+			o.LocaleFallback = localeFallbackRedirect
+		}
+		if err = validLocaleFallback(o.LocaleFallback); err != nil {
+			return nil, err
+		}
+	}
+
+	logInfo("router: using backend connect timeout:", o.BackendConnectTimeout)
+	logInfo("router: using backend header timeout:", o.BackendHeaderTimeout)
+	if o.CoalesceRequests {
+		logInfo("router: coalescing identical GET requests, sharing responses up to", o.CoalesceMaxBodySize, "bytes")
+	}
+
+	l, err := o.shared.logger(o.LogFileName)
 	if err != nil {
 		return nil, err
 	}
 
-	logInfo("router: logging errors as JSON to", logFileName)
+	logInfo("router: logging errors as JSON to", o.LogFileName)
+
+	middleware, err := newMiddlewareSet(o)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.Middleware) > 0 {
+		logInfo("router: using middleware:", strings.Join(o.Middleware, ", "))
+	}
 
 	reloadChan := make(chan bool, 1)
 	rt = &Router{
-		mux:                   triemux.NewMux(),
-		mongoURL:              mongoURL,
-		mongoPollInterval:     mgoPollInterval,
-		mongoDbName:           mongoDbName,
-		backendConnectTimeout: beConnTimeout,
-		backendHeaderTimeout:  beHeaderTimeout,
-		mongoReadToOptime:     mongoReadToOptime,
+		source:                source,
+		checksumHash:          checksumHash,
+		loadWorkers:           loadWorkerCount(o.LoadWorkers),
+		progress:              newReloadProgress(o.ReloadProgressInterval),
+		reloadTimeout:         o.ReloadTimeout,
+		backendGrace:          newBackendGrace(o.BackendGracePeriod),
+		standbyMaxRoutes:      o.StandbyMaxRoutes,
+		routeArchives:         o.RouteArchives,
+		checks:                newRequestChecks(o.MaxHeaderBytes, o.AllowedMethods, o.RequireUTF8Paths),
+		notFoundBackend:       o.NotFoundBackend,
+		localeFallback:        o.LocaleFallback,
+		backendConnectTimeout: o.BackendConnectTimeout,
+		backendHeaderTimeout:  o.BackendHeaderTimeout,
+		coalesceRequests:      o.CoalesceRequests,
+		coalesceMaxBodySize:   o.CoalesceMaxBodySize,
+		retryBudget:           o.RetryBudget,
+		circuitBreaker:        o.CircuitBreaker,
+		capture:               newRequestCapture(),
+		budgets:               newBudgetMonitor(o.BudgetWindow, o.AlertWebhookURL, l),
+		backendStates:         newBackendStates(),
+		drained:               make(map[string]bool),
+		disabledPaths:         newDisabledPaths(o.Namespace),
+		namespace:             o.Namespace,
+		verifyRoutes:          o.VerifyRoutes,
 		logger:                l,
 		ReloadChan:            reloadChan,
 	}
+	rt.setMiddleware(middleware)
+	rt.mux = rt.newMux()
+	rt.backendGrace.expire = rt.reloadExpiredBackends
+	for _, locale := range o.LocalePrefixes {
+		if locale = strings.Trim(locale, "/"); locale != "" {
+			rt.localePrefixes = append(rt.localePrefixes, locale)
+		}
+	}
+	for _, token := range o.PreviewTokens {
+		rt.previewTokens = append(rt.previewTokens, []byte(token))
+	}
+
+	if o.RulesFileName != "" {
+		rules, err := o.shared.rulesFile(o)
+		if err != nil {
+			return nil, err
+		}
+		rt.rules = rules.apply(http.HandlerFunc(rt.routeRequest))
+	}
+
+	if reporter, ok := source.(ProgressReporter); ok {
+		reporter.SetProgress(rt.progress.setDocuments)
+	}
+
+	if o.MirrorURL != "" {
+		mirrorURL, err := url.Parse(o.MirrorURL)
+		if err != nil {
+			return nil, fmt.Errorf("router: invalid mirror URL %q: %v", o.MirrorURL, err)
+		}
+		mirror := handlers.NewBackendHandler("mirror", mirrorURL,
+			o.BackendConnectTimeout, o.BackendHeaderTimeout, l, handlers.BackendOptions{})
+		rt.mirror = newMirrorSwitch(o.Namespace, middleware.globalChain(mirror), o.MirrorPrefixes)
+		logInfo("router: requests can be switched to the mirror at", o.MirrorURL)
+	}
+
+	if len(o.ShardPrefixes) > 0 {
+		var peer http.Handler
+		if o.ShardPeerURL != "" {
+			peerURL, err := url.Parse(o.ShardPeerURL)
+			if err != nil {
+				return nil, fmt.Errorf("router: invalid shard peer URL %q: %v", o.ShardPeerURL, err)
+			}
+			peer = handlers.NewBackendHandler("shard-peer", peerURL,
+				o.BackendConnectTimeout, o.BackendHeaderTimeout, l, handlers.BackendOptions{})
+		}
+		if o.ShardMissStatus == 0 {
+			o.ShardMissStatus = http.StatusNotFound
+		}
+		rt.shard = newRouteShard(o.ShardPrefixes, peer, o.ShardMissStatus, middleware.globalChain)
+		if filterer, ok := source.(RouteFilterer); ok {
+			filterer.SetRouteFilter(rt.shard.ownsRoute)
+		}
+		logInfo("router: only loading routes under", strings.Join(o.ShardPrefixes, ", "))
+	}
+
+	rt.checks.hosts = newHostPolicy(o.Hostnames, o.UnknownHosts, o.AbsoluteURIs)
+
+	if o.DecisionLog != "" {
+		if rt.decisions, err = newDecisionLog(o.Namespace, o.DecisionLog); err != nil {
+			return nil, fmt.Errorf("router: couldn't open the decision log: %v", err)
+		}
+		logInfo("router: recording routing decisions to", o.DecisionLog)
+	}
+
+	if o.CDN.APIKey != "" {
+		rt.cdn = newCDNPurger(o.CDN)
+		logInfo("router: CDN cache can be purged through the API with", rt.cdn.apiURL)
+	}
+	if o.PurgeChangedRoutes {
+		if rt.cdn == nil {
+			return nil, fmt.Errorf("router: purging changed routes needs a CDN API key")
+		}
+		rt.purgeQueue = newCDNPurgeQueue(rt.cdn, o.SurrogateKeys)
+		go rt.purgeQueue.run()
+		logInfo("router: purging changed routes from the CDN")
+	}
+
+	if o.BudgetWindow > 0 {
+		go rt.budgets.run()
+	}
+
+	if o.ShadowSource != nil {
+		rt.shadow = newShadowEvaluator(o.ShadowSource)
+		rt.shadow.start()
+		logInfo("router: comparing routes with the shadow routes")
+	}
 
 	go rt.pollAndReload()
 
@@ -112,6 +535,11 @@ func NewRouter(mongoURL, mongoDbName, mongoPollInterval, backendConnectTimeout,
 // ServeHTTP delegates responsibility for serving requests to the proxy mux
 // instance for this router.
 func (rt *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if dw, dreq := rt.decisions.start(w, req); dw != nil {
+		defer dw.finish()
+		w, req = dw, dreq
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
 			logWarn("router: recovered from panic in ServeHTTP:", r)
@@ -125,33 +553,104 @@ func (rt *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				"status": http.StatusInternalServerError,
 			}, req)
 
-			w.WriteHeader(http.StatusInternalServerError)
+			handlers.WriteError(w, req, http.StatusInternalServerError)
 
 			internalServerErrorCountMetric.With(prometheus.Labels{"host": req.Host}).Inc()
 		}
 	}()
-	rt.lock.RLock()
-	mux := rt.mux
-	rt.lock.RUnlock()
 
-	mux.ServeHTTP(w, req)
+	if reason := rt.checks.reject(w, req, rt.namespace); reason != "" {
+		if decision := decisionFor(req); decision != nil {
+			decision.Handler = "rejected"
+		}
+		return
+	}
+	handlers.RemoveClientHeaders(req)
+	handlers.SetOriginalURLHeaders(req)
+
+	if rt.capture.claim(req.URL.Path) {
+		var captured CapturedRequest
+		if match, ok := rt.currentMux().Lookup(req.URL.Path); ok {
+			captured.RoutePath, captured.RoutePrefix = match.Path, match.Prefix
+		}
+		rt.capture.serve(http.HandlerFunc(rt.route), w, req, captured)
+		return
+	}
+
+	rt.route(w, req)
 }
 
-func (rt *Router) SelfUpdateRoutes() {
-	logInfo(fmt.Sprintf("router: starting self-update process, polling for route changes every %v", rt.mongoPollInterval))
+// setMiddleware sets the middleware which requests pass through. It's
+// applied to each route's handler as routes are loaded, and to the responses
+// for requests which don't reach a route.
+func (rt *Router) setMiddleware(middleware *middlewareSet) {
+	rt.middleware = middleware
+	rt.disabledHandler = middleware.globalChain(disabledPathHandler)
+}
 
-	tick := time.Tick(rt.mongoPollInterval)
-	for range tick {
-		logInfo("router: polling MongoDB for changes")
+// route sends the request to the mirror if it's switched on for it.
+// Otherwise it applies the transformation rules, if there are any, and then
+// passes the request to the handler for its route.
+func (rt *Router) route(w http.ResponseWriter, req *http.Request) {
+	decision := decisionFor(req)
+	if rt.mirror != nil && rt.mirror.matches(req.URL.Path) {
+		if decision != nil {
+			decision.Handler = "mirror"
+		}
+		rt.mirror.handler.ServeHTTP(w, req)
+		return
+	}
+	if rt.rules != nil {
+		if decision != nil {
+			// Unless the request reaches a route.
+			decision.Handler = "rule"
+		}
+		rt.rules.handler().ServeHTTP(w, req)
+		return
+	}
+	rt.routeRequest(w, req)
+}
 
-		rt.ReloadChan <- true
+func (rt *Router) routeRequest(w http.ResponseWriter, req *http.Request) {
+	decision := decisionFor(req)
+	if !rt.shard.owns(req.URL.Path) {
+		if decision != nil {
+			decision.Handler = "shard"
+		}
+		rt.shard.miss.ServeHTTP(w, req)
+		return
 	}
+	if rt.disabledPaths.matches(req.URL.Path) {
+		if decision != nil {
+			decision.Handler = "disabled"
+		}
+		rt.disabledHandler.ServeHTTP(w, req)
+		return
+	}
+	if decision != nil {
+		// Unless the mux finds a route for it.
+		decision.Handler = "not_found"
+	}
+	rt.shadow.observe(req.URL.Path)
+	rt.currentMux().ServeHTTP(w, req)
+}
+
+func (rt *Router) currentMux() *triemux.Mux {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+	return rt.mux
+}
+
+// SelfUpdateRoutes watches the route source for changes, reloading the
+// routes when they change. It doesn't return.
+func (rt *Router) SelfUpdateRoutes() {
+	rt.source.Watch(rt.ReloadChan)
 }
 
 // pollAndReload blocks until it receives a message on reloadChan,
 // and will immediately reload again if another message was received
 // during reload.
-func (rt *Router) pollAndReload()  {
+func (rt *Router) pollAndReload() {
 	for range rt.ReloadChan {
 		func() {
 			defer func() {
@@ -160,32 +659,19 @@ func (rt *Router) pollAndReload()  {
 				}
 			}()
 
-			logDebug("mgo: connecting to", rt.mongoURL)
-
-			sess, err := mgo.Dial(rt.mongoURL)
-			if err != nil {
-				logWarn(fmt.Sprintf("mgo: error connecting to MongoDB, skipping update (error: %v)", err))
-				return
-			}
-
-			defer sess.Close()
-			sess.SetMode(mgo.SecondaryPreferred, true)
-
-			currentMongoInstance, err := rt.getCurrentMongoInstance(sess.DB("admin"))
+			checksum, err := rt.source.Checksum()
 			if err != nil {
 				logWarn(err)
 				return
 			}
 
-			logDebug("mgo: communicating with replica set member", currentMongoInstance.Name)
-
-			logDebug("router: polled mongo instance is ", currentMongoInstance.Name)
-			logDebug("router: polled mongo optime is ", currentMongoInstance.Optime)
-			logDebug("router: current read-to mongo optime is ", rt.mongoReadToOptime)
-			
-			if rt.shouldReload(currentMongoInstance) {
+			rt.reloadLock.Lock()
+			defer rt.reloadLock.Unlock()
+			if checksum == rt.replacedChecksum {
+				logInfo("router: not reloading the routes which were replaced through the API")
+			} else if checksum != rt.loadedChecksum {
 				logInfo("router: updates found")
-				rt.reloadRoutes(sess.DB(rt.mongoDbName), currentMongoInstance.Optime)
+				rt.reloadRoutes()
 			} else {
 				logInfo("router: no updates found")
 			}
@@ -193,94 +679,155 @@ func (rt *Router) pollAndReload()  {
 	}
 }
 
-type mongoDatabase interface {
-	Run(command interface{}, result interface{}) error
+// reloadExpiredBackends reloads the routes when a missing backend's grace
+// period ends, so that its routes stop using it without waiting for the
+// routes to change. Routes replaced through the API are left alone, and
+// the period is applied when they're next replaced.
+func (rt *Router) reloadExpiredBackends() {
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	if rt.replacedChecksum != "" {
+		logInfo("router: a backend's grace period has ended, but not reloading the routes which were replaced through the API")
+		return
+	}
+	logInfo("router: reloading routes as a backend's grace period has ended")
+	rt.reloadRoutes()
 }
 
 // reloadRoutes reloads the routes for this Router instance on the fly. It will
 // create a new proxy mux, load applications (backends) and routes into it, and
 // then flip the "mux" pointer in the Router.
-func (rt *Router) reloadRoutes(db *mgo.Database, currentOptime bson.MongoTimestamp) {
+func (rt *Router) reloadRoutes() {
+	rt.reloadRoutesFrom(rt.source, rt.verifyRoutes)
+}
+
+// reloadRoutesFrom is reloadRoutes with the routes from source, which are
+// checked for consistency first if verify is set.
+func (rt *Router) reloadRoutesFrom(source RouteSource, verify bool) (err error) {
+	var table *RouteTable
+
+	ctx := context.Background()
+	if rt.reloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rt.reloadTimeout)
+		defer cancel()
+	}
+
+	rt.progress.start()
 	defer func() {
 		// increment this metric regardless of whether the route reload succeeded
 		routeReloadCountMetric.Inc()
 
 		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+			rt.progress.finish(err)
 			logWarn("router: recovered from panic in reloadRoutes:", r)
 			logInfo("router: original routes have not been modified")
 			errorMessage := fmt.Sprintf("panic: %v", r)
 			err := logger.RecoveredError{ErrorMessage: errorMessage}
 			logger.NotifySentry(logger.ReportableError{Error: err})
 
+			routeReloadErrorCountMetric.Inc()
+		} else if err != nil {
+			if err == context.DeadlineExceeded {
+				err = fmt.Errorf("reload took longer than %v", rt.reloadTimeout)
+			}
+			rt.progress.finish(err)
+			logWarn("router: couldn't reload routes:", err)
+			logInfo("router: original routes have not been modified")
+			logger.NotifySentry(logger.ReportableError{Error: err})
+
 			routeReloadErrorCountMetric.Inc()
 		} else {
-			rt.mongoReadToOptime = currentOptime
+			rt.progress.finish(nil)
+			rt.loadedChecksum = table.Checksum
 		}
 	}()
 
 	logInfo("router: reloading routes")
-	newmux := triemux.NewMux()
+	if table, err = loadRouteTable(ctx, source); err != nil {
+		return
+	}
+	rt.progress.setStage(reloadStageBuilding)
+	table = rt.shard.table(table)
+	backends, grpcBackends := rt.loadBackends(table.Backends)
+	table, grace := rt.backendGrace.apply(table, backends, grpcBackends)
+	newmux := rt.buildMuxWithBackends(table, backends, grpcBackends)
+
+	if verify {
+		rt.progress.setStage(reloadStageVerifying)
+		if problems := newmux.Verify(); len(problems) > 0 {
+			for _, problem := range problems {
+				logWarn("router: route verification failed:", problem)
+			}
+			err = fmt.Errorf("%d problems found verifying the new routes", len(problems))
+			return
+		}
+	}
 
-	backends := rt.loadBackends(db.C("backends"))
-	loadRoutes(db.C("routes"), newmux, backends)
+	// Don't switch to routes which took too long to build.
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	rt.setKnownBackends(backends)
+	rt.budgets.retain(table.Backends)
+	rt.backendStates.retain(backends)
+	rt.backendGrace.retain(table, backends, grpcBackends, grace)
+
+	counts := countRoutes(table.Routes)
 
 	rt.lock.Lock()
+	rt.keepStandby(rt.mux, rt.loadedTable, rt.routeCounts, rt.loadedChecksum)
 	rt.mux = newmux
+	previousCounts := rt.routeCounts
+	rt.routeCounts = counts
+	rt.replacedChecksum = ""
 	rt.lock.Unlock()
 
-	logInfo(fmt.Sprintf("router: reloaded %d routes (checksum: %x)", rt.mux.RouteCount(), rt.mux.RouteChecksum()))
-
-	routesCountMetric.Set(float64(rt.mux.RouteCount()))
-}
-
-func (rt *Router) getCurrentMongoInstance(db mongoDatabase) (MongoReplicaSetMember, error) {
-	replicaSetStatus := bson.M{}
-
-	if err := db.Run("replSetGetStatus", &replicaSetStatus); err != nil {
-		return MongoReplicaSetMember{}, errors.New(fmt.Sprintf("router: couldn't get replica set status from MongoDB, skipping update (error: %v)", err))
+	if rt.decisions != nil {
+		rt.decisions.setRoutes(table.Routes)
 	}
+	rt.shadow.setPrimary(newmux, table.Routes)
 
-	replicaSetStatusBytes, err := bson.Marshal(replicaSetStatus)
-	if err != nil {
-		return MongoReplicaSetMember{}, errors.New(fmt.Sprintf("router: couldn't marshal replica set status from MongoDB, skipping update (error: %v)", err))
-	}
-
-	replicaSet := MongoReplicaSet{}
-	err = bson.Unmarshal(replicaSetStatusBytes, &replicaSet)
-	if err != nil {
-		return MongoReplicaSetMember{}, errors.New(fmt.Sprintf("router: couldn't unmarshal replica set status from MongoDB, skipping update (error: %v)", err))
-	}
-
-	currentInstance := make([]MongoReplicaSetMember, 0)
-	for _, instance := range replicaSet.Members {
-		if instance.Current {
-			currentInstance = append(currentInstance, instance)
+	if rt.purgeQueue != nil {
+		// Nothing can be cached from before the first load.
+		if rt.loadedTable != nil {
+			rt.purgeQueue.enqueue(changedRoutePaths(rt.loadedTable.Routes, table.Routes))
 		}
 	}
-
-	logDebug("router: MongoDB instances", currentInstance)
-
-	if len(currentInstance) != 1 {
-		return MongoReplicaSetMember{}, errors.New(fmt.Sprintf("router: did not find exactly one current MongoDB instance, skipping update (current instances found: %d)", len(currentInstance)))
+	if rt.keepsRouteTables() {
+		rt.loadedTable = table
 	}
 
-	return currentInstance[0], nil
+	logInfo(fmt.Sprintf("router: reloaded %d routes (checksum: %x)", rt.mux.RouteCount(), rt.mux.RouteChecksum()))
+	rt.updateRouteCountMetrics(counts, previousCounts)
+	return nil
 }
 
-func (rt *Router) shouldReload(currentMongoInstance MongoReplicaSetMember) bool {
-	return currentMongoInstance.Optime > rt.mongoReadToOptime
+// updateRouteCountMetrics sets the route count metrics after the routes
+// change from previous to counts.
+func (rt *Router) updateRouteCountMetrics(counts, previous routeCounts) {
+	total := rt.currentMux().RouteCount()
+	if rt.namespace == "" {
+		routesCountMetric.Set(float64(total))
+	} else {
+		namespaceRoutesCountMetric.WithLabelValues(rt.namespace).Set(float64(total))
+	}
+	counts.updateMetrics(rt.namespace, previous)
 }
 
-// loadBackends is a helper function which loads backends from the
-// passed mongo collection, constructs a Handler for each one, and returns
-// them in map keyed on the backend_id
-func (rt *Router) loadBackends(c *mgo.Collection) (backends map[string]http.Handler) {
-	backend := &Backend{}
+// loadBackends is a helper function which constructs a Handler for each of
+// the passed backends, and returns them in map keyed on the backend_id. A
+// second map holds the handlers used for routes which proxy gRPC to the same
+// backends.
+func (rt *Router) loadBackends(backendList []Backend) (backends, grpcBackends map[string]http.Handler) {
 	backends = make(map[string]http.Handler)
+	grpcBackends = make(map[string]http.Handler)
 
-	iter := c.Find(nil).Iter()
-
-	for iter.Next(&backend) {
+	for i := range backendList {
+		backend := &backendList[i]
 		backendURL, err := backend.ParseURL()
 		if err != nil {
 			logWarn(fmt.Sprintf("router: couldn't parse URL %s for backend %s "+
@@ -288,36 +835,184 @@ func (rt *Router) loadBackends(c *mgo.Collection) (backends map[string]http.Hand
 			continue
 		}
 
-		backends[backend.BackendID] = handlers.NewBackendHandler(
+		opts := rt.backendOptions(backend, backendURL)
+		handler := handlers.NewBackendHandler(
 			backend.BackendID,
 			backendURL,
 			rt.backendConnectTimeout, rt.backendHeaderTimeout,
 			rt.logger,
+			opts,
 		)
+		if rt.coalesceRequests {
+			handler = handlers.NewCoalescingHandler(
+				backend.BackendID,
+				handler,
+				rt.coalesceMaxBodySize,
+			)
+		}
+		handler = rt.budgets.monitor(backend, handler)
+		var fallback http.Handler
+		if opts.Fallback != nil {
+			fallback = handlers.NewFallbackHandler(backendURL, opts.Fallback)
+		}
+		backends[backend.BackendID] = rt.drainable(backend.BackendID, handler, fallback)
+
+		grpcBackends[backend.BackendID] = rt.drainable(backend.BackendID, handlers.NewGRPCBackendHandler(
+			backend.BackendID,
+			backendURL,
+			rt.backendConnectTimeout,
+			rt.logger,
+		), nil)
 	}
 
-	if err := iter.Err(); err != nil {
-		panic(err)
+	return
+}
+
+// backendOptions returns the per-backend settings for the handler for the
+// passed backend. Invalid settings are logged and ignored, rather than the
+// backend being skipped.
+func (rt *Router) backendOptions(backend *Backend, backendURL *url.URL) (opts handlers.BackendOptions) {
+	if backend.HedgeDelay != "" {
+		hedgeDelay, err := time.ParseDuration(backend.HedgeDelay)
+		if err != nil {
+			logWarn(fmt.Sprintf("router: couldn't parse hedge delay %s for backend %s "+
+				"(error: %v), not hedging requests", backend.HedgeDelay, backend.BackendID, err))
+		} else {
+			opts.HedgeDelay = hedgeDelay
+		}
 	}
+	opts.RetryBudget = rt.retryBudget
 
+	switch {
+	case backend.FallbackPage != "":
+		fallback, err := handlers.NewStaticFallback(backend.FallbackPage)
+		if err != nil {
+			logWarn(fmt.Sprintf("router: couldn't load fallback page for backend %s "+
+				"(error: %v), not using a fallback", backend.BackendID, err))
+		} else {
+			opts.Fallback = fallback
+		}
+	case backend.FallbackURL != "":
+		fallbackURL, err := url.Parse(backend.FallbackURL)
+		if err != nil {
+			logWarn(fmt.Sprintf("router: couldn't parse fallback URL %s for backend %s "+
+				"(error: %v), not using a fallback", backend.FallbackURL, backend.BackendID, err))
+		} else {
+			opts.Fallback = handlers.NewFallbackBackend(
+				backend.BackendID,
+				backendURL, fallbackURL,
+				rt.backendConnectTimeout, rt.backendHeaderTimeout,
+			)
+		}
+	}
+	opts.CircuitBreaker = rt.circuitBreaker
+	opts.State = rt.backendStates.get(backend.BackendID)
+
+	switch backend.HostHeader {
+	case "", "rewrite":
+	case "forward":
+		opts.ForwardHost = true
+	case "preserve":
+		opts.PreserveHost = true
+	default:
+		logWarn(fmt.Sprintf("router: unknown host_header %q for backend %s, "+
+			"rewriting the Host header", backend.HostHeader, backend.BackendID))
+	}
 	return
 }
 
-// loadRoutes is a helper function which loads routes from the passed mongo
-// collection and registers them with the passed proxy mux.
-func loadRoutes(c *mgo.Collection, mux *triemux.Mux, backends map[string]http.Handler) {
-	route := &Route{}
+// newMux returns an empty mux which generates its own 404 and 503 responses
+// in the same format as the router's other errors.
+func newMux() *triemux.Mux {
+	return newMuxWithMiddleware(handlers.Chain())
+}
 
-	iter := c.Find(nil).Sort("incoming_path", "route_type").Iter()
+func newMuxWithMiddleware(middleware handlers.Middleware) *triemux.Mux {
+	mux := triemux.NewMux()
+	mux.NotFoundHandler = middleware(handlers.NewErrorHandler(http.StatusNotFound))
+	mux.UnavailableHandler = middleware(handlers.NewErrorHandler(http.StatusServiceUnavailable))
+	return mux
+}
 
-	goneHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "410 Gone", http.StatusGone)
-	})
-	unavailableHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+// newMux is like the newMux function, but the mux's 404 and 503 responses
+// pass through the router's global middleware.
+func (rt *Router) newMux() *triemux.Mux {
+	mux := newMuxWithMiddleware(rt.middleware.globalChain)
+	mux.ChecksumHash = rt.checksumHash
+	if rt.decisions != nil {
+		mux.Matched = rt.decisions.matchedRequest
+	}
+	return mux
+}
+
+// buildMux loads the backends and routes from a route table into a new mux,
+// returning it along with the backends' handlers.
+func (rt *Router) buildMux(table *RouteTable) (mux *triemux.Mux, backends map[string]http.Handler) {
+	backends, grpcBackends := rt.loadBackends(table.Backends)
+	return rt.buildMuxWithBackends(table, backends, grpcBackends), backends
+}
+
+// buildMuxWithBackends loads the routes from a route table into a new mux,
+// using the given handlers for the backends. Preview-only routes are loaded
+// into an overlay, which requests without a preview token fall through.
+func (rt *Router) buildMuxWithBackends(table *RouteTable, backends, grpcBackends map[string]http.Handler) *triemux.Mux {
+	mux := rt.newMux()
+	rt.setNotFoundHandler(mux, backends)
+	rt.setLocaleFallback(mux)
+
+	backendsByID := make(map[string]*Backend, len(table.Backends))
+	for i := range table.Backends {
+		backendsByID[table.Backends[i].BackendID] = &table.Backends[i]
+	}
+
+	public, preview := splitPreviewRoutes(table.Routes)
+	if len(preview) > 0 {
+		mux.Overlay = rt.newMux()
+		mux.ServeOverlay = (&previewGate{tokens: rt.previewTokens}).serve
+		loadRoutes(preview, mux.Overlay, backends, grpcBackends, backendsByID, rt.middleware, rt.loadWorkers, rt.progress)
+	}
+	loadRoutes(public, mux, backends, grpcBackends, backendsByID, rt.middleware, rt.loadWorkers, rt.progress)
+
+	return mux
+}
+
+// loadRoutes is a helper function which registers the passed routes with the
+// passed proxy mux. They're registered in order of path and then route type,
+// whatever order the route source gave them in, so that the same handler
+// wins when routes clash and extension routes are grouped consistently. Up
+// to workers goroutines set up the routes' handlers, counting them in
+// progress.
+func loadRoutes(
+	routes []Route,
+	mux *triemux.Mux,
+	backends, grpcBackends map[string]http.Handler,
+	backendsByID map[string]*Backend,
+	middlewareSet *middlewareSet,
+	workers int,
+	progress *reloadProgress,
+) {
+	registrations := newRouteRegistrations()
+
+	routes = append([]Route(nil), routes...)
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].IncomingPath != routes[j].IncomingPath {
+			return routes[i].IncomingPath < routes[j].IncomingPath
+		}
+		return routes[i].RouteType < routes[j].RouteType
 	})
 
-	for iter.Next(&route) {
+	unavailableHandler := handlers.NewErrorHandler(http.StatusServiceUnavailable)
+
+	// Setting up each route's handler is most of the work of loading lots
+	// of routes, so it's shared between workers. The handlers are then
+	// registered in order.
+	prepared := make([]preparedRoute, len(routes))
+	forEachParallel(len(routes), workers, func(i int) {
+		defer progress.routePrepared()
+		route := &routes[i]
+		add := func(path string, prefix bool, extensions []string, handler http.Handler) {
+			prepared[i] = preparedRoute{path, prefix, extensions, handler}
+		}
 		prefix := (route.RouteType == "prefix")
 
 		// the database contains paths with % encoded routes.
@@ -325,50 +1020,166 @@ func loadRoutes(c *mgo.Collection, mux *triemux.Mux, backends map[string]http.Ha
 		incomingURL, err := url.Parse(route.IncomingPath)
 		if err != nil {
 			logWarn(fmt.Sprintf("router: found route %+v with invalid incoming path '%s', skipping!", route, route.IncomingPath))
-			continue
+			return
+		}
+
+		extensions := route.extensions()
+		if len(extensions) > 0 {
+			logDebug(fmt.Sprintf("router: route %s (prefix: %v) applies to extensions %v",
+				incomingURL.Path, prefix, extensions))
+		}
+
+		var backend *Backend
+		if route.Handler == "backend" {
+			backend = backendsByID[route.BackendID]
+		}
+		middleware, err := middlewareSet.forRoute(route, backend)
+		if err != nil {
+			// Fail closed, since the middleware might have been protecting it.
+			logWarn(fmt.Sprintf("router: couldn't set up middleware for route %s (prefix: %v) "+
+				"(error: %v), it will be unavailable", incomingURL.Path, prefix, err))
+			add(incomingURL.Path, prefix, extensions, unavailableHandler)
+			return
+		}
+		if len(route.Middleware) > 0 || len(route.SkipMiddleware) > 0 {
+			logDebug(fmt.Sprintf("router: route %s (prefix: %v) adds middleware %v and skips %v",
+				incomingURL.Path, prefix, route.Middleware, route.SkipMiddleware))
 		}
 
 		if route.Disabled {
-			mux.Handle(incomingURL.Path, prefix, unavailableHandler)
+			add(incomingURL.Path, prefix, extensions, middleware(unavailableHandler))
 			logDebug(fmt.Sprintf("router: registered %s (prefix: %v)(disabled) -> Unavailable", incomingURL.Path, prefix))
-			continue
+			return
 		}
 
-		switch route.Handler {
-		case "backend":
-			handler, ok := backends[route.BackendID]
-			if !ok {
-				logWarn(fmt.Sprintf("router: found route %+v which references unknown backend "+
-					"%s, skipping!", route, route.BackendID))
-				continue
-			}
-			mux.Handle(incomingURL.Path, prefix, handler)
-			logDebug(fmt.Sprintf("router: registered %s (prefix: %v) for %s",
-				incomingURL.Path, prefix, route.BackendID))
-		case "redirect":
-			redirectTemporarily := (route.RedirectType == "temporary")
-			handler := handlers.NewRedirectHandler(incomingURL.Path, route.RedirectTo, shouldPreserveSegments(route), redirectTemporarily)
-			mux.Handle(incomingURL.Path, prefix, handler)
-			logDebug(fmt.Sprintf("router: registered %s (prefix: %v) -> %s",
-				incomingURL.Path, prefix, route.RedirectTo))
-		case "gone":
-			mux.Handle(incomingURL.Path, prefix, goneHandler)
-			logDebug(fmt.Sprintf("router: registered %s (prefix: %v) -> Gone", incomingURL.Path, prefix))
-		case "boom":
-			// Special handler so that we can test failure behaviour.
-			mux.Handle(incomingURL.Path, prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				panic("Boom!!!")
-			}))
-			logDebug(fmt.Sprintf("router: registered %s (prefix: %v) -> Boom!!!", incomingURL.Path, prefix))
-		default:
+		if !validProtocol(route.protocol()) {
+			logWarn(fmt.Sprintf("router: found route %+v with unknown protocol "+
+				"%s, skipping!", route, route.Protocol))
+			return
+		}
+		factory, ok := routeHandlerFactory(route.Handler)
+		if !ok {
 			logWarn(fmt.Sprintf("router: found route %+v with unknown handler type "+
 				"%s, skipping!", route, route.Handler))
-			continue
+			return
+		}
+		handler, err := factory(route, RouteHandlerContext{
+			Path:         incomingURL.Path,
+			Prefix:       prefix,
+			Backends:     backends,
+			GRPCBackends: grpcBackends,
+		})
+		if err != nil {
+			logWarn(fmt.Sprintf("router: found route %+v which couldn't be set up (%v), skipping!", route, err))
+			return
+		}
+		add(incomingURL.Path, prefix, extensions, middleware(handler))
+	})
+
+	for i := range prepared {
+		if p := &prepared[i]; p.handler != nil {
+			registrations.add(p.path, p.prefix, p.extensions, p.handler)
 		}
 	}
+	registrations.register(mux)
+}
+
+// preparedRoute is a route's handler, ready to be registered.
+type preparedRoute struct {
+	path       string
+	prefix     bool
+	extensions []string
+	handler    http.Handler
+}
 
-	if err := iter.Err(); err != nil {
-		panic(err)
+type routeKey struct {
+	path   string
+	prefix bool
+}
+
+// muxEntryPath returns the path of the mux entry which a route for path is
+// registered under. The mux ignores empty path segments, so routes for /foo
+// and /foo/ share an entry.
+func muxEntryPath(path string) string {
+	segments := strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+	return "/" + strings.Join(segments, "/")
+}
+
+type routeRegistration struct {
+	path        string
+	handler     http.Handler
+	byExtension map[string]http.Handler
+}
+
+// routeRegistrations collects the handlers for each route before they're
+// registered with a mux, so that routes which only apply to particular path
+// extensions can share a path with the route for everything else. Each mux
+// entry is only registered once: a route sharing an entry with an earlier
+// one, such as /foo/ after /foo, replaces it, and is logged.
+type routeRegistrations struct {
+	keys    []routeKey
+	entries map[routeKey]*routeRegistration
+}
+
+func newRouteRegistrations() *routeRegistrations {
+	return &routeRegistrations{entries: make(map[routeKey]*routeRegistration)}
+}
+
+// add records the handler for a route. If extensions are given, the handler
+// is only used for requests with one of those path extensions.
+func (r *routeRegistrations) add(path string, prefix bool, extensions []string, handler http.Handler) {
+	key := routeKey{muxEntryPath(path), prefix}
+	entry, ok := r.entries[key]
+	if !ok {
+		entry = &routeRegistration{}
+		r.entries[key] = entry
+		r.keys = append(r.keys, key)
+	} else if entry.replacedBy(extensions) {
+		logWarn(fmt.Sprintf("router: route %s (prefix: %v) shares a mux entry with %s, which it replaces",
+			path, prefix, entry.path))
+	}
+	entry.path = path
+
+	if len(extensions) == 0 {
+		entry.handler = handler
+		return
+	}
+	if entry.byExtension == nil {
+		entry.byExtension = make(map[string]http.Handler)
+	}
+	for _, ext := range extensions {
+		entry.byExtension[ext] = handler
+	}
+}
+
+// replacedBy reports whether a route for extensions would replace one of the
+// entry's handlers.
+func (entry *routeRegistration) replacedBy(extensions []string) bool {
+	if len(extensions) == 0 {
+		return entry.handler != nil
+	}
+	for _, ext := range extensions {
+		if _, ok := entry.byExtension[ext]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// register registers each route with the mux, in the order they were first
+// added.
+func (r *routeRegistrations) register(mux *triemux.Mux) {
+	for _, key := range r.keys {
+		entry := r.entries[key]
+		handler := entry.handler
+		if entry.byExtension != nil {
+			defaultHandler := entry.handler
+			if defaultHandler == nil {
+				defaultHandler = mux.NotFoundHandler
+			}
+			handler = handlers.NewExtensionHandler(entry.byExtension, defaultHandler)
+		}
+		mux.Handle(entry.path, key.prefix, handler)
 	}
 }
 
@@ -383,14 +1194,117 @@ func (be *Backend) ParseURL() (*url.URL, error) {
 func (rt *Router) RouteStats() (stats map[string]interface{}) {
 	rt.lock.RLock()
 	mux := rt.mux
+	counts := rt.routeCounts
 	rt.lock.RUnlock()
 
 	stats = make(map[string]interface{})
 	stats["count"] = mux.RouteCount()
 	stats["checksum"] = fmt.Sprintf("%x", mux.RouteChecksum())
+
+	trieStats := mux.Stats()
+	stats["tries"] = trieStats
+	stats["estimated_bytes"] = trieStats.Exact.EstimatedBytes + trieStats.Prefix.EstimatedBytes
+	if counts.Handlers == nil {
+		counts = countRoutes(nil)
+	}
+	stats["handlers"] = counts.Handlers
+	stats["backends"] = counts.Backends
+	stats["document_types"] = counts.DocumentTypes
 	return
 }
 
+func (route *Route) protocol() string {
+	if route.Protocol == "" {
+		return "http"
+	}
+	return route.Protocol
+}
+
+// validProtocol reports whether routes can be proxied with protocol.
+func validProtocol(protocol string) bool {
+	return protocol == "http" || protocol == "grpc"
+}
+
+// extensions returns the path extensions the route is restricted to, in lower
+// case and without leading dots, or nil if it applies to every request.
+func (route *Route) extensions() []string {
+	var extensions []string
+	for _, ext := range route.Extensions {
+		if ext = strings.ToLower(strings.TrimPrefix(ext, ".")); ext != "" {
+			extensions = append(extensions, ext)
+		}
+	}
+	return extensions
+}
+
+// surrogateKeys returns the keys the route's responses are tagged with for
+// the CDN: one for the route itself, and one for its backend if it has one.
+func (route *Route) surrogateKeys() []string {
+	keys := []string{routeSurrogateKey(route.IncomingPath)}
+	if route.Handler == "backend" && route.BackendID != "" {
+		keys = append(keys, backendSurrogateKey(route.BackendID))
+	}
+	return keys
+}
+
+// analyticsTags returns the route's analytics tags which can be sent as
+// headers, logging and skipping any others. Tags whose names would be sent
+// in the same header, such as content_format and content-format, are all
+// skipped, since there's no telling which was meant.
+func (route *Route) analyticsTags() map[string]string {
+	var tags map[string]string
+	names := make(map[string][]string, len(route.AnalyticsTags))
+	for name, value := range route.AnalyticsTags {
+		if !validAnalyticsTagName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			logWarn(fmt.Sprintf("router: route %s has analytics tag %q which can't be sent as a header, skipping it",
+				route.IncomingPath, name))
+			continue
+		}
+		header := handlers.AnalyticsHeader(name)
+		names[header] = append(names[header], name)
+		if tags == nil {
+			tags = make(map[string]string, len(route.AnalyticsTags))
+		}
+		tags[name] = value
+	}
+	for header, colliding := range names {
+		if len(colliding) < 2 {
+			continue
+		}
+		sort.Strings(colliding)
+		logWarn(fmt.Sprintf("router: route %s has analytics tags %s which would all be sent as %s, skipping them",
+			route.IncomingPath, strings.Join(colliding, ", "), header))
+		for _, name := range colliding {
+			delete(tags, name)
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+func validAnalyticsTagName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		if !('a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || b == '-' || b == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func routeSurrogateKey(path string) string {
+	return "route:" + path
+}
+
+func backendSurrogateKey(backendID string) string {
+	return "backend:" + backendID
+}
+
 func shouldPreserveSegments(route *Route) bool {
 	switch {
 	case route.RouteType == "exact" && route.SegmentsMode == "preserve":
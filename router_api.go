@@ -1,9 +1,12 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"runtime"
+	"strings"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -33,6 +36,22 @@ func newAPIHandler(rout *Router) (api http.Handler, err error) {
 		w.WriteHeader(http.StatusAccepted)
 		w.Write([]byte("Reload queued"))
 	})
+	mux.HandleFunc("/reload-status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		jsonData, err := json.MarshalIndent(rout.progress.status(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(jsonData)
+		w.Write([]byte("\n"))
+	})
 	mux.HandleFunc("/healthcheck", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			w.Header().Set("Allow", "GET")
@@ -79,7 +98,344 @@ func newAPIHandler(rout *Router) (api http.Handler, err error) {
 		w.Write(jsonData)
 		w.Write([]byte("\n"))
 	})
+	mux.HandleFunc("/capture", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var params struct {
+				Count      int    `json:"count"`
+				PathPrefix string `json:"path_prefix"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+				http.Error(w, "invalid capture parameters: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if params.Count <= 0 {
+				http.Error(w, "count must be greater than zero", http.StatusBadRequest)
+				return
+			}
+			rout.capture.start(params.Count, params.PathPrefix)
+			logInfo(fmt.Sprintf("router: capturing the next %d requests for paths starting %q",
+				params.Count, params.PathPrefix))
+		case "DELETE":
+			rout.capture.stop()
+			logInfo("router: stopped capturing requests")
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, rout.capture.status())
+	}))
+	mux.HandleFunc("/decisions", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if rout.decisions == nil {
+			http.Error(w, "the decision log isn't enabled (ROUTER_DECISION_LOG isn't set)", http.StatusNotFound)
+			return
+		}
+
+		rout.decisions.serveDecisionStream(w, r)
+	}))
+	mux.HandleFunc("/shadow-divergences", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if rout.shadow == nil {
+			http.Error(w, "shadow evaluation isn't enabled (ROUTER_SHADOW_SOURCE isn't set)", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, rout.shadow.divergences())
+	}))
+	mux.HandleFunc("/rollback", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, rout.standbyStatus())
+		case "POST":
+			status, err := rout.rollback()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			writeJSON(w, status)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/routes/export", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		if !rout.routeArchives {
+			http.Error(w, "route archives aren't enabled", http.StatusNotFound)
+			return
+		}
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		archive, err := rout.exportRoutes()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="routes-%s.json"`, archive.Checksum))
+		writeJSON(w, archive)
+	}))
+	mux.HandleFunc("/routes/import", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		if !rout.routeArchives {
+			http.Error(w, "route archives aren't enabled", http.StatusNotFound)
+			return
+		}
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		table, err := readRouteArchive(http.MaxBytesReader(w, r.Body, maxRouteArchiveBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := rout.importRoutes(table, r.URL.Query().Get("dry_run") != "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, result)
+	}))
+	mux.HandleFunc("/backends/", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		// The only resource under a backend is /backends/<backend_id>/drain
+		backendID := strings.TrimPrefix(r.URL.Path, "/backends/")
+		if !strings.HasSuffix(backendID, "/drain") {
+			http.NotFound(w, r)
+			return
+		}
+		backendID = strings.TrimSuffix(backendID, "/drain")
+
+		switch r.Method {
+		case "GET":
+		case "POST":
+			if err := rout.drainBackend(backendID); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		case "DELETE":
+			rout.restoreBackend(backendID)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"backend_id": backendID,
+			"draining":   rout.backendDrained(backendID),
+		})
+	}))
+	mux.HandleFunc("/drained-backends", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, rout.drainedBackends())
+	}))
+	mux.HandleFunc("/disabled-paths", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST", "DELETE":
+			var p DisabledPath
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				http.Error(w, "invalid path: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !strings.HasPrefix(p.Path, "/") {
+				http.Error(w, "path must start with /", http.StatusBadRequest)
+				return
+			}
+
+			if r.Method == "POST" {
+				rout.disabledPaths.disable(p)
+				logWarn(fmt.Sprintf("router: disabled %s (prefix: %v)", p.Path, p.Prefix))
+			} else if rout.disabledPaths.enable(p) {
+				logInfo(fmt.Sprintf("router: re-enabled %s (prefix: %v)", p.Path, p.Prefix))
+			} else {
+				http.Error(w, "path is not disabled", http.StatusNotFound)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, rout.disabledPaths.list())
+	}))
+	mux.HandleFunc("/mirror", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		if rout.mirror == nil {
+			http.Error(w, "no mirror is configured (ROUTER_MIRROR_URL isn't set)", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var params struct {
+				Prefixes []string `json:"prefixes"`
+			}
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+					http.Error(w, "invalid mirror parameters: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := rout.mirror.enable(params.Prefixes); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case "DELETE":
+			rout.mirror.disable()
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, rout.mirror.currentStatus())
+	}))
+	mux.HandleFunc("/log-sampling", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		sampling := rout.middleware.sampling
+
+		switch r.Method {
+		case "GET":
+		case "POST", "DELETE":
+			var params struct {
+				Route     string   `json:"route"`
+				RouteType string   `json:"route_type"`
+				BackendID string   `json:"backend_id"`
+				Rate      *float64 `json:"rate"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+				http.Error(w, "invalid sampling parameters: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if r.Method == "POST" {
+				if params.Rate == nil {
+					http.Error(w, "a rate must be given", http.StatusBadRequest)
+					return
+				}
+				if err := sampling.set(params.Route, params.RouteType, params.BackendID, *params.Rate); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				logInfo(fmt.Sprintf("router: logging %v of requests for route %q (%s) / backend %q",
+					*params.Rate, params.Route, params.RouteType, params.BackendID))
+			} else if ok, err := sampling.reset(params.Route, params.RouteType, params.BackendID); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if !ok {
+				http.Error(w, "no sample rate has been set for it", http.StatusNotFound)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, sampling.status())
+	}))
+	mux.HandleFunc("/purge", requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if rout.cdn == nil {
+			http.Error(w, "CDN purging isn't configured (ROUTER_CDN_API_KEY isn't set)", http.StatusNotFound)
+			return
+		}
+
+		var params struct {
+			Path string `json:"path,omitempty"`
+			Key  string `json:"key,omitempty"`
+			Soft bool   `json:"soft"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			http.Error(w, "invalid purge parameters: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		switch {
+		case (params.Path == "") == (params.Key == ""):
+			http.Error(w, "either a path or a key must be given", http.StatusBadRequest)
+			return
+		case params.Path != "":
+			if !strings.HasPrefix(params.Path, "/") {
+				http.Error(w, "path must start with /", http.StatusBadRequest)
+				return
+			}
+			err = rout.cdn.purgePath(params.Path, params.Soft)
+		default:
+			err = rout.cdn.purgeKey(params.Key, params.Soft)
+		}
+		if err != nil {
+			logWarn(err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		logInfo(fmt.Sprintf("router: purged %+v from the CDN", params))
+		writeJSON(w, params)
+	}))
 	mux.Handle("/metrics", promhttp.Handler())
 
 	return mux, nil
 }
+
+// requireAPIToken only passes requests on to handler if they have an
+// "Authorization: Bearer" header with the API token. It's used for endpoints
+// which change how requests are routed or expose request data, which are
+// disabled entirely unless ROUTER_API_AUTH_TOKEN is set.
+func requireAPIToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiAuthToken == "" {
+			http.Error(w, "This endpoint is disabled because ROUTER_API_AUTH_TOKEN is not set", http.StatusForbidden)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(apiAuthToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="router"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	jsonData, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+	w.Write([]byte("\n"))
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -34,6 +36,46 @@ func (m *mockMongoDB) Run(cmd interface{}, res interface{}) error {
 	return nil
 }
 
+// mockMongoIter returns each of docs in turn, and then err.
+type mockMongoIter struct {
+	docs []interface{}
+	err  error
+}
+
+func (m *mockMongoIter) Next(result interface{}) bool {
+	if len(m.docs) == 0 {
+		return false
+	}
+	bytes, err := bson.Marshal(m.docs[0])
+	if err != nil {
+		m.err = err
+		return false
+	}
+	m.docs = m.docs[1:]
+	return bson.Unmarshal(bytes, result) == nil
+}
+
+func (m *mockMongoIter) Close() error {
+	return m.err
+}
+
+// newTestRouter returns a router with no routes which doesn't need mongo.
+func newTestRouter() *Router {
+	rt := &Router{
+		mux:           newMux(),
+		capture:       newRequestCapture(),
+		drained:       make(map[string]bool),
+		disabledPaths: newDisabledPaths(""),
+		backendStates: newBackendStates(),
+		budgets:       newBudgetMonitor(0, "", nil),
+		progress:      newReloadProgress(0),
+	}
+	middleware, err := newMiddlewareSet(Options{})
+	Expect(err).NotTo(HaveOccurred())
+	rt.setMiddleware(middleware)
+	return rt
+}
+
 func TestRouter(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Router Suite")
@@ -43,15 +85,15 @@ var _ = Describe("Router", func() {
 	Context("When calling shouldReload", func() {
 		Context("with an up-to-date mongo instance", func() {
 			It("should return false", func() {
-				rt := Router{}
+				src := mongoRouteSource{}
 				initialOptime, _ := bson.NewMongoTimestamp(time.Date(2021, time.March, 12, 8, 0, 0, 0, time.UTC), 1)
-				rt.mongoReadToOptime = initialOptime
+				src.mongoReadToOptime = initialOptime
 
 				currentOptime, _ := bson.NewMongoTimestamp(time.Date(2021, time.March, 12, 8, 0, 0, 0, time.UTC), 1)
 				mongoInstance := MongoReplicaSetMember{}
 				mongoInstance.Optime = currentOptime
 
-				Expect(rt.shouldReload(mongoInstance)).To(
+				Expect(src.shouldReload(mongoInstance)).To(
 					Equal(false),
 					"Router should determine no reload is necessary when Mongo optime hasn't changed",
 				)
@@ -60,30 +102,30 @@ var _ = Describe("Router", func() {
 
 		Context("with a stale mongo instance", func() {
 			It("should return false when timestamp differs", func() {
-				rt := Router{}
+				src := mongoRouteSource{}
 				initialOptime, _ := bson.NewMongoTimestamp(time.Date(2021, time.March, 12, 8, 0, 0, 0, time.UTC), 1)
-				rt.mongoReadToOptime = initialOptime
+				src.mongoReadToOptime = initialOptime
 				
 				currentOptime, _ := bson.NewMongoTimestamp(time.Date(2021, time.March, 12, 8, 2, 30, 0, time.UTC), 1)
 				mongoInstance := MongoReplicaSetMember{}
 				mongoInstance.Optime = currentOptime
 
-				Expect(rt.shouldReload(mongoInstance)).To(
+				Expect(src.shouldReload(mongoInstance)).To(
 					Equal(true),
 					"Router should determine reload is necessary when Mongo optime has changed by timestamp",
 				)
 			})
 
 			It("should return false when operand differs", func() {
-				rt := Router{}
+				src := mongoRouteSource{}
 				initialOptime, _ := bson.NewMongoTimestamp(time.Date(2021, time.March, 12, 8, 0, 0, 0, time.UTC), 1)
-				rt.mongoReadToOptime = initialOptime
+				src.mongoReadToOptime = initialOptime
 				
 				currentOptime, _ := bson.NewMongoTimestamp(time.Date(2021, time.March, 12, 8, 0, 0, 0, time.UTC), 2)
 				mongoInstance := MongoReplicaSetMember{}
 				mongoInstance.Optime = currentOptime
 
-				Expect(rt.shouldReload(mongoInstance)).To(
+				Expect(src.shouldReload(mongoInstance)).To(
 					Equal(true),
 					"Router should determine reload is necessary when Mongo optime has changed by operand",
 				)
@@ -97,8 +139,8 @@ var _ = Describe("Router", func() {
 				err: errors.New("Error connecting to replica set"),
 			}
 
-			rt := Router{}
-			_, err := rt.getCurrentMongoInstance(mockMongoObj)
+			src := mongoRouteSource{}
+			_, err := src.getCurrentMongoInstance(mockMongoObj)
 
 			Expect(err).NotTo(
 				BeNil(), 
@@ -111,8 +153,8 @@ var _ = Describe("Router", func() {
 				result: replicaSetStatusBson,
 			}
 
-			rt := Router{}
-			_, err := rt.getCurrentMongoInstance(mockMongoObj)
+			src := mongoRouteSource{}
+			_, err := src.getCurrentMongoInstance(mockMongoObj)
 
 			Expect(err).NotTo(
 				BeNil(), 
@@ -125,8 +167,8 @@ var _ = Describe("Router", func() {
 				result: replicaSetStatusBson,
 			}
 
-			rt := Router{}
-			_, err := rt.getCurrentMongoInstance(mockMongoObj)
+			src := mongoRouteSource{}
+			_, err := src.getCurrentMongoInstance(mockMongoObj)
 
 			Expect(err).NotTo(
 				BeNil(), 
@@ -139,8 +181,8 @@ var _ = Describe("Router", func() {
 				result: replicaSetStatusBson,
 			}
 
-			rt := Router{}
-			_, err := rt.getCurrentMongoInstance(mockMongoObj)
+			src := mongoRouteSource{}
+			_, err := src.getCurrentMongoInstance(mockMongoObj)
 
 			Expect(err).NotTo(
 				BeNil(), 
@@ -159,8 +201,8 @@ var _ = Describe("Router", func() {
 				Current: true,
 			}
 
-			rt := Router{}
-			currentMongoInstance, _ := rt.getCurrentMongoInstance(mockMongoObj)
+			src := mongoRouteSource{}
+			currentMongoInstance, _ := src.getCurrentMongoInstance(mockMongoObj)
 
 			Expect(currentMongoInstance).To(
 				Equal(expectedMongoInstance),
@@ -168,4 +210,54 @@ var _ = Describe("Router", func() {
 			)
 		})
 	})		
+
+	Context("When decoding route documents", func() {
+		docs := func() []interface{} {
+			return []interface{}{
+				bson.M{"incoming_path": "/foo", "route_type": "exact", "handler": "gone"},
+				bson.M{"incoming_path": "/huge", "route_type": "prefix", "handler": "gone",
+					"extensions": make([]string, 1000)},
+				bson.M{"incoming_path": "/bar", "route_type": "exact", "handler": "gone"},
+			}
+		}
+
+		It("should fail if a document is over the size limit", func() {
+			_, err := decodeRouteDocuments(context.Background(), &mockMongoIter{docs: docs()}, 1024, 1, nil, nil)
+			Expect(err).To(MatchError(ContainSubstring("route /huge (prefix) is")))
+		})
+
+		It("should load every document without a limit", func() {
+			routes, err := decodeRouteDocuments(context.Background(), &mockMongoIter{docs: docs()}, 0, 4, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(3))
+			Expect(routes[1].Extensions).To(HaveLen(1000))
+		})
+
+		It("should keep the documents' order when decoding in parallel", func() {
+			var many []interface{}
+			for i := 0; i < 2*decodeRouteDocumentBatch+10; i++ {
+				many = append(many, bson.M{"incoming_path": fmt.Sprintf("/%d", i), "route_type": "exact"})
+			}
+			routes, err := decodeRouteDocuments(context.Background(), &mockMongoIter{docs: many}, 0, 8, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(len(many)))
+			for i, route := range routes {
+				Expect(route.IncomingPath).To(Equal(fmt.Sprintf("/%d", i)))
+			}
+		})
+
+		It("should only keep the routes it's asked to", func() {
+			keep := func(route *Route) bool { return route.IncomingPath != "/huge" }
+			routes, err := decodeRouteDocuments(context.Background(), &mockMongoIter{docs: docs()}, 0, 2, keep, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(2))
+			Expect(routes[0].IncomingPath).To(Equal("/foo"))
+			Expect(routes[1].IncomingPath).To(Equal("/bar"))
+		})
+
+		It("should fail if the query does", func() {
+			_, err := decodeRouteDocuments(context.Background(), &mockMongoIter{err: errors.New("cursor not found")}, 0, 1, nil, nil)
+			Expect(err).To(MatchError("cursor not found"))
+		})
+	})
 })
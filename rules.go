@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alphagov/router/handlers"
+)
+
+// rulesFile holds the transformation rules loaded from a JSON file, which
+// is read again whenever it changes. The rules can be applied in front of
+// several handlers, such as the routers for each namespace.
+type rulesFile struct {
+	fileName string
+
+	mu      sync.RWMutex
+	rules   *handlers.RuleSet
+	chains  []*rulesChain
+	modTime time.Time
+	size    int64
+}
+
+// rulesChain applies the current rules from a rulesFile before passing
+// requests to next.
+type rulesChain struct {
+	file  *rulesFile
+	next  http.Handler
+	chain http.Handler
+}
+
+// newRulesFile loads the rules in fileName, which must be valid.
+func newRulesFile(fileName string) (*rulesFile, error) {
+	f := &rulesFile{fileName: fileName}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// apply returns a chain applying the rules to requests before passing them
+// to next, which is kept up to date as the rules are reloaded.
+func (f *rulesFile) apply(next http.Handler) *rulesChain {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := &rulesChain{file: f, next: next, chain: f.rules.Middleware(next)}
+	f.chains = append(f.chains, c)
+	return c
+}
+
+// reload reads the rules again if the file has changed since it was last
+// read, reporting whether they were reloaded. If the new rules aren't valid,
+// the old ones are kept.
+func (f *rulesFile) reload() (bool, error) {
+	info, err := os.Stat(f.fileName)
+	if err != nil {
+		return false, fmt.Errorf("router: couldn't read rules file %s: %v", f.fileName, err)
+	}
+
+	f.mu.RLock()
+	unchanged := f.rules != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(f.fileName)
+	if err != nil {
+		return false, fmt.Errorf("router: couldn't read rules file %s: %v", f.fileName, err)
+	}
+	rules, err := handlers.ParseRules(data)
+	if err != nil {
+		return false, fmt.Errorf("router: invalid rules file %s, keeping the current rules (error: %v)", f.fileName, err)
+	}
+
+	f.mu.Lock()
+	f.rules, f.modTime, f.size = rules, info.ModTime(), info.Size()
+	for _, c := range f.chains {
+		c.chain = rules.Middleware(c.next)
+	}
+	f.mu.Unlock()
+
+	logInfo(fmt.Sprintf("router: loaded %d rules from %s", rules.Len(), f.fileName))
+	return true, nil
+}
+
+// startRulesFile loads the rules in o.RulesFileName and checks the file for
+// changes every o.RulesPollInterval, if it's set.
+func startRulesFile(o Options) (*rulesFile, error) {
+	f, err := newRulesFile(o.RulesFileName)
+	if err != nil {
+		return nil, err
+	}
+	if o.RulesPollInterval > 0 {
+		go f.watch(o.RulesPollInterval)
+	}
+	return f, nil
+}
+
+// watch checks the file for changes every interval. It doesn't return.
+func (f *rulesFile) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := f.reload(); err != nil {
+			logWarn(err)
+		}
+	}
+}
+
+func (f *rulesFile) current() *handlers.RuleSet {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.rules
+}
+
+// handler returns the current rules applied in front of the next handler.
+// It's only built when the rules are reloaded.
+func (c *rulesChain) handler() http.Handler {
+	c.file.mu.RLock()
+	defer c.file.mu.RUnlock()
+	return c.chain
+}
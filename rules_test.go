@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transformation rules", func() {
+	var (
+		rt       *Router
+		fileName string
+	)
+
+	writeRules := func(rules string) {
+		// Each version of the rules in these tests is a different size, so
+		// changes are noticed even within the resolution of the file's
+		// modification time.
+		Expect(ioutil.WriteFile(fileName, []byte(rules), 0644)).To(Succeed())
+	}
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "rules-*.json")
+		Expect(err).NotTo(HaveOccurred())
+		f.Close()
+		fileName = f.Name()
+
+		writeRules(`{"rules": [{"match": {"path": "/old"}, "actions": {"rewrite_path": "/new"}}]}`)
+		rt = newTestRouter()
+		file, err := newRulesFile(fileName)
+		Expect(err).NotTo(HaveOccurred())
+		rt.rules = file.apply(http.HandlerFunc(rt.routeRequest))
+		rt.mux.Handle("/new", false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("new"))
+		}))
+	})
+
+	AfterEach(func() {
+		os.Remove(fileName)
+	})
+
+	It("should apply the rules before routing requests", func() {
+		rw := serve("/old")
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(Equal("new"))
+	})
+
+	It("should reload the rules when the file changes", func() {
+		reloaded, err := rt.rules.file.reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reloaded).To(BeFalse())
+
+		writeRules(`{"rules": [{"match": {"path": "/old"}, "actions": {"status": 410}}]}`)
+		reloaded, err = rt.rules.file.reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reloaded).To(BeTrue())
+
+		Expect(serve("/old").Code).To(Equal(http.StatusGone))
+	})
+
+	It("should keep the current rules if the file becomes invalid", func() {
+		writeRules(`{"rules": [{"match": {"path": "/old"}}]}`)
+		_, err := rt.rules.file.reload()
+		Expect(err).To(MatchError(ContainSubstring("keeping the current rules")))
+
+		Expect(serve("/old").Body.String()).To(Equal("new"))
+	})
+
+	It("should apply the same rules in front of each handler", func() {
+		other := newTestRouter()
+		other.rules = rt.rules.file.apply(http.HandlerFunc(other.routeRequest))
+		other.mux.Handle("/new", false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("other"))
+		}))
+		serveOther := func(path string) *httptest.ResponseRecorder {
+			rw := httptest.NewRecorder()
+			other.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+			return rw
+		}
+		Expect(serveOther("/old").Body.String()).To(Equal("other"))
+
+		writeRules(`{"rules": [{"match": {"path": "/old"}, "actions": {"status": 410}}]}`)
+		_, err := rt.rules.file.reload()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(serve("/old").Code).To(Equal(http.StatusGone))
+		Expect(serveOther("/old").Code).To(Equal(http.StatusGone))
+	})
+
+	It("should refuse to start with invalid rules", func() {
+		writeRules(`{"rules": [`)
+		_, err := newRulesFile(fileName)
+		Expect(err).To(MatchError(ContainSubstring("invalid rules file")))
+	})
+})
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// routeSchemaVersion is the latest version of the backend and route
+// document schema which the router understands. Documents without a
+// schema_version are version 1. When the publishing pipeline starts writing
+// documents which older routers would misread, it should give them a new
+// version, and this should be raised once the router understands them.
+const routeSchemaVersion = 1
+
+// schemaVersion returns the version of a document's schema.
+func schemaVersion(version int) int {
+	if version == 0 {
+		return 1
+	}
+	return version
+}
+
+func supportedSchemaVersion(version int) bool {
+	v := schemaVersion(version)
+	return v >= 1 && v <= routeSchemaVersion
+}
+
+// checkSchemaVersions returns an error if any of table's backends or routes
+// have a schema version the router doesn't understand, so that a reload
+// fails loudly, keeping the current routes, rather than routing subtly
+// wrongly. The number of such documents is reported by a metric.
+func checkSchemaVersions(table *RouteTable) error {
+	var problems []string
+	backends, routes := 0, 0
+	for i := range table.Backends {
+		backend := &table.Backends[i]
+		if !supportedSchemaVersion(backend.SchemaVersion) {
+			if backends == 0 {
+				problems = append(problems, fmt.Sprintf("backend %s has version %d", backend.BackendID, backend.SchemaVersion))
+			}
+			backends++
+		}
+	}
+	for i := range table.Routes {
+		route := &table.Routes[i]
+		if !supportedSchemaVersion(route.SchemaVersion) {
+			if routes == 0 {
+				problems = append(problems, fmt.Sprintf("route %s (%s) has version %d", route.IncomingPath, route.RouteType, route.SchemaVersion))
+			}
+			routes++
+		}
+	}
+	unsupportedSchemaDocumentsMetric.WithLabelValues("backend").Set(float64(backends))
+	unsupportedSchemaDocumentsMetric.WithLabelValues("route").Set(float64(routes))
+
+	if backends == 0 && routes == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d backends and %d routes have a schema version this router doesn't support "+
+		"(it supports versions up to %d): %s", backends, routes, routeSchemaVersion, strings.Join(problems, ", "))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	prommodel "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Schema versions", func() {
+	unsupported := func(documentType string) float64 {
+		metric := new(prommodel.Metric)
+		Expect(unsupportedSchemaDocumentsMetric.WithLabelValues(documentType).Write(metric)).To(Succeed())
+		return metric.Gauge.GetValue()
+	}
+
+	It("should accept documents with a supported version or none", func() {
+		Expect(checkSchemaVersions(&RouteTable{
+			Backends: []Backend{{BackendID: "frontend"}, {BackendID: "search", SchemaVersion: 1}},
+			Routes:   []Route{{IncomingPath: "/", RouteType: "prefix", SchemaVersion: routeSchemaVersion}},
+		})).To(Succeed())
+		Expect(unsupported("backend")).To(BeZero())
+		Expect(unsupported("route")).To(BeZero())
+	})
+
+	It("should refuse documents with an unknown version", func() {
+		err := checkSchemaVersions(&RouteTable{
+			Backends: []Backend{{BackendID: "frontend", SchemaVersion: routeSchemaVersion + 1}},
+			Routes: []Route{
+				{IncomingPath: "/a", RouteType: "exact", SchemaVersion: routeSchemaVersion + 1},
+				{IncomingPath: "/b", RouteType: "exact", SchemaVersion: -1},
+				{IncomingPath: "/c", RouteType: "exact"},
+			},
+		})
+		Expect(err).To(MatchError(ContainSubstring("1 backends and 2 routes have a schema version this router doesn't support")))
+		Expect(err).To(MatchError(ContainSubstring("backend frontend has version 2, route /a (exact) has version 2")))
+		Expect(unsupported("backend")).To(Equal(1.0))
+		Expect(unsupported("route")).To(Equal(2.0))
+	})
+
+	It("should keep the current routes when a reload has unknown versions", func() {
+		source := &fakeRouteSource{table: &RouteTable{
+			Checksum: "1",
+			Routes:   []Route{{IncomingPath: "/old", RouteType: "exact", Handler: "gone"}},
+		}}
+		rt := newTestRouter()
+		rt.source = source
+		rt.reloadRoutes()
+
+		source.table = &RouteTable{
+			Checksum: "2",
+			Routes:   []Route{{IncomingPath: "/new", RouteType: "exact", Handler: "gone", SchemaVersion: routeSchemaVersion + 1}},
+		}
+		rt.reloadRoutes()
+		Expect(rt.loadedChecksum).To(Equal("1"))
+		Expect(rt.progress.status().LastReload.Error).To(ContainSubstring("schema version"))
+
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", "/old", nil))
+		Expect(rw.Code).To(Equal(http.StatusGone))
+	})
+})
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/alphagov/router/triemux"
+)
+
+const (
+	// shadowQueueSize is how many request paths can wait to be compared.
+	// Paths for requests which arrive while the queue is full aren't
+	// compared, so shadow evaluation can't slow requests down.
+	shadowQueueSize = 10000
+
+	// shadowRecentDivergences is how many of the latest divergences are
+	// kept for the API.
+	shadowRecentDivergences = 100
+)
+
+// Results of comparing a request's route with its shadow route, which label
+// the router_shadow_comparisons_total metric.
+const (
+	shadowSame             = "same"
+	shadowDifferentRoute   = "different_route"
+	shadowDifferentHandler = "different_handler"
+	shadowPrimaryOnly      = "primary_only"
+	shadowShadowOnly       = "shadow_only"
+	shadowDropped          = "dropped"
+)
+
+// ShadowMatch describes a route which a request matched.
+type ShadowMatch struct {
+	RoutePath   string `json:"route_path"`
+	RoutePrefix bool   `json:"route_prefix"`
+	Handler     string `json:"handler"`
+	BackendID   string `json:"backend_id,omitempty"`
+	RedirectTo  string `json:"redirect_to,omitempty"`
+}
+
+// ShadowDivergence records a request which the shadow routes would have
+// handled differently.
+type ShadowDivergence struct {
+	Time    time.Time    `json:"time"`
+	Path    string       `json:"path"`
+	Result  string       `json:"result"`
+	Primary *ShadowMatch `json:"primary,omitempty"`
+	Shadow  *ShadowMatch `json:"shadow,omitempty"`
+}
+
+// routeIndex looks up which route a path matches in a mux, and what the
+// route does.
+type routeIndex struct {
+	mux    *triemux.Mux
+	routes map[triemux.Match]ShadowMatch
+}
+
+func newRouteIndex(mux *triemux.Mux, routes []Route) *routeIndex {
+	ix := &routeIndex{mux: mux, routes: make(map[triemux.Match]ShadowMatch, len(routes))}
+	for i := range routes {
+		route := &routes[i]
+		incomingURL, err := url.Parse(route.IncomingPath)
+		if err != nil {
+			continue
+		}
+		match := triemux.Match{Path: incomingURL.Path, Prefix: route.RouteType == "prefix"}
+		if _, ok := ix.routes[match]; ok {
+			// Routes for particular extensions share a path.
+			continue
+		}
+		summary := ShadowMatch{
+			RoutePath:   match.Path,
+			RoutePrefix: match.Prefix,
+			Handler:     route.Handler,
+			BackendID:   route.BackendID,
+			RedirectTo:  route.RedirectTo,
+		}
+		if route.Disabled {
+			summary.Handler = "disabled"
+		}
+		ix.routes[match] = summary
+	}
+	return ix
+}
+
+// newShadowRouteIndex builds an index of routes from the shadow source. Its
+// mux is only used for lookups, so the routes don't need real handlers.
+func newShadowRouteIndex(routes []Route) *routeIndex {
+	mux := triemux.NewMux()
+	for i := range routes {
+		incomingURL, err := url.Parse(routes[i].IncomingPath)
+		if err != nil {
+			continue
+		}
+		mux.Handle(incomingURL.Path, routes[i].RouteType == "prefix", http.NotFoundHandler())
+	}
+	return newRouteIndex(mux, routes)
+}
+
+func (ix *routeIndex) lookup(path string) *ShadowMatch {
+	if ix == nil {
+		return nil
+	}
+	match, ok := ix.mux.Lookup(path)
+	if !ok {
+		return nil
+	}
+	summary, ok := ix.routes[match]
+	if !ok {
+		summary = ShadowMatch{RoutePath: match.Path, RoutePrefix: match.Prefix}
+	}
+	return &summary
+}
+
+// shadowEvaluator compares the route each request matches with the route it
+// would match in the routes from a second source, such as a new route store
+// being canaried, without affecting the response. Comparisons are made in
+// the background and counted by result, and the latest divergences are kept
+// for the API. Pointing it at the router's own routes gives an A/A test,
+// which should never diverge.
+type shadowEvaluator struct {
+	source RouteSource
+	queue  chan string
+
+	mu              sync.RWMutex
+	primary, shadow *routeIndex
+	checksum        string
+
+	recentMu sync.Mutex
+	recent   []ShadowDivergence
+	next     int
+}
+
+func newShadowEvaluator(source RouteSource) *shadowEvaluator {
+	return &shadowEvaluator{
+		source: source,
+		queue:  make(chan string, shadowQueueSize),
+		recent: make([]ShadowDivergence, 0, shadowRecentDivergences),
+	}
+}
+
+// start runs the comparisons, and reloads the shadow routes whenever the
+// shadow source changes. It's called once, before any requests.
+func (e *shadowEvaluator) start() {
+	go e.compareQueued()
+	changed := make(chan bool, 1)
+	go e.source.Watch(changed)
+	go func() {
+		for range changed {
+			e.reload(context.Background())
+		}
+	}()
+}
+
+// reload loads the shadow routes, unless they haven't changed.
+func (e *shadowEvaluator) reload(ctx context.Context) {
+	checksum, err := e.source.Checksum()
+	if err != nil {
+		logWarn("router: couldn't check the shadow routes:", err)
+		return
+	}
+	e.mu.RLock()
+	unchanged := e.shadow != nil && checksum == e.checksum
+	e.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	table, err := loadRouteTable(ctx, e.source)
+	if err != nil {
+		logWarn("router: couldn't load the shadow routes:", err)
+		return
+	}
+	shadow := newShadowRouteIndex(table.Routes)
+
+	e.mu.Lock()
+	e.shadow = shadow
+	e.checksum = table.Checksum
+	e.mu.Unlock()
+	logInfo("router: loaded", shadow.mux.RouteCount(), "shadow routes")
+}
+
+// setPrimary records the routes which requests are now served with.
+func (e *shadowEvaluator) setPrimary(mux *triemux.Mux, routes []Route) {
+	if e == nil {
+		return
+	}
+	primary := newRouteIndex(mux, routes)
+	e.mu.Lock()
+	e.primary = primary
+	e.mu.Unlock()
+}
+
+// observe queues a request's path to be compared, if there's room.
+func (e *shadowEvaluator) observe(path string) {
+	if e == nil {
+		return
+	}
+	select {
+	case e.queue <- path:
+	default:
+		shadowComparisonCountMetric.WithLabelValues(shadowDropped).Inc()
+	}
+}
+
+func (e *shadowEvaluator) compareQueued() {
+	for path := range e.queue {
+		e.compare(path)
+	}
+}
+
+// compare looks path up in both sets of routes and counts the result. It
+// returns the result, or "" if there aren't both sets of routes yet.
+func (e *shadowEvaluator) compare(path string) string {
+	e.mu.RLock()
+	primaryIndex, shadowIndex := e.primary, e.shadow
+	e.mu.RUnlock()
+	if primaryIndex == nil || shadowIndex == nil {
+		return ""
+	}
+
+	primary, shadow := primaryIndex.lookup(path), shadowIndex.lookup(path)
+	result := shadowSame
+	switch {
+	case primary == nil && shadow == nil:
+	case shadow == nil:
+		result = shadowPrimaryOnly
+	case primary == nil:
+		result = shadowShadowOnly
+	case primary.RoutePath != shadow.RoutePath || primary.RoutePrefix != shadow.RoutePrefix:
+		result = shadowDifferentRoute
+	case *primary != *shadow:
+		result = shadowDifferentHandler
+	}
+	shadowComparisonCountMetric.WithLabelValues(result).Inc()
+
+	if result != shadowSame {
+		logDebug("router: shadow routes diverge for", path, "("+result+")")
+		e.record(ShadowDivergence{Time: time.Now(), Path: path, Result: result, Primary: primary, Shadow: shadow})
+	}
+	return result
+}
+
+func (e *shadowEvaluator) record(d ShadowDivergence) {
+	e.recentMu.Lock()
+	defer e.recentMu.Unlock()
+	if len(e.recent) < shadowRecentDivergences {
+		e.recent = append(e.recent, d)
+		return
+	}
+	e.recent[e.next] = d
+	e.next = (e.next + 1) % shadowRecentDivergences
+}
+
+// divergences returns the latest divergences, oldest first.
+func (e *shadowEvaluator) divergences() []ShadowDivergence {
+	e.recentMu.Lock()
+	defer e.recentMu.Unlock()
+	divergences := make([]ShadowDivergence, 0, len(e.recent))
+	divergences = append(divergences, e.recent[e.next:]...)
+	return append(divergences, e.recent[:e.next]...)
+}
+
+// newShadowSource creates the route source described by spec, which is in
+// the same form as the arguments to "router diff-sources".
+func newShadowSource(spec string, o Options, namespaces map[string]namespaceConfig) (RouteSource, error) {
+	so, err := diffSourceOptions(spec, o, namespaces)
+	if err != nil {
+		return nil, err
+	}
+	name := so.RouteSource
+	if name == "" {
+		name = "mongo"
+	}
+	return newRouteSource(name, so)
+}
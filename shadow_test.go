@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	prommodel "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Shadow evaluation", func() {
+	var (
+		rt     *Router
+		source *fakeRouteSource
+	)
+
+	primaryRoutes := []Route{
+		{IncomingPath: "/government", RouteType: "prefix", Handler: "redirect", RedirectTo: "/old", RedirectType: "temporary"},
+		{IncomingPath: "/government/news", RouteType: "exact", Handler: "gone"},
+		{IncomingPath: "/help", RouteType: "exact", Handler: "gone"},
+	}
+
+	BeforeEach(func() {
+		rt = newTestRouter()
+		source = &fakeRouteSource{table: &RouteTable{Checksum: "shadow", Routes: []Route{
+			{IncomingPath: "/government", RouteType: "prefix", Handler: "redirect", RedirectTo: "/new", RedirectType: "temporary"},
+			{IncomingPath: "/government/news", RouteType: "exact", Handler: "gone"},
+			{IncomingPath: "/government/news", RouteType: "prefix", Handler: "gone"},
+			{IncomingPath: "/contact", RouteType: "exact", Handler: "gone"},
+		}}}
+		rt.shadow = newShadowEvaluator(source)
+		rt.shadow.reload(context.Background())
+		rt.mux, _ = rt.buildMux(&RouteTable{Routes: primaryRoutes})
+		rt.shadow.setPrimary(rt.mux, primaryRoutes)
+	})
+
+	compared := func(result string) float64 {
+		metric := new(prommodel.Metric)
+		Expect(shadowComparisonCountMetric.WithLabelValues(result).Write(metric)).To(Succeed())
+		return metric.Counter.GetValue()
+	}
+
+	It("should compare the route each request would match", func() {
+		Expect(rt.shadow.compare("/government/news")).To(Equal(shadowSame))
+		Expect(rt.shadow.compare("/missing")).To(Equal(shadowSame))
+		Expect(rt.shadow.compare("/government/news/2024")).To(Equal(shadowDifferentRoute))
+		Expect(rt.shadow.compare("/government/policy")).To(Equal(shadowDifferentHandler))
+		Expect(rt.shadow.compare("/help")).To(Equal(shadowPrimaryOnly))
+		Expect(rt.shadow.compare("/contact")).To(Equal(shadowShadowOnly))
+	})
+
+	It("should count the results", func() {
+		before := compared(shadowDifferentHandler)
+		rt.shadow.compare("/government/policy")
+		Expect(compared(shadowDifferentHandler)).To(Equal(before + 1))
+	})
+
+	It("should keep the latest divergences", func() {
+		rt.shadow.compare("/government/news")
+		rt.shadow.compare("/government/policy")
+		for i := 0; i < shadowRecentDivergences; i++ {
+			rt.shadow.compare("/help")
+		}
+
+		divergences := rt.shadow.divergences()
+		Expect(divergences).To(HaveLen(shadowRecentDivergences))
+		Expect(divergences[0].Path).To(Equal("/help"))
+		Expect(divergences[0].Result).To(Equal(shadowPrimaryOnly))
+		Expect(divergences[0].Primary.Handler).To(Equal("gone"))
+		Expect(divergences[0].Shadow).To(BeNil())
+	})
+
+	It("should queue requests for comparison without affecting them", func() {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", "/government/policy", nil))
+		Expect(rw.Code).To(Equal(http.StatusFound))
+		Expect(rw.Header().Get("Location")).To(Equal("/old/policy"))
+		Expect(rt.shadow.queue).To(Receive(Equal("/government/policy")))
+	})
+
+	It("should count requests which couldn't be queued", func() {
+		rt.shadow.queue = make(chan string)
+		before := compared(shadowDropped)
+		rt.shadow.observe("/help")
+		Expect(compared(shadowDropped)).To(Equal(before + 1))
+	})
+
+	It("should only reload the shadow routes when they change", func() {
+		routes := source.table.Routes
+		source.table = &RouteTable{Checksum: "shadow", Routes: routes[:1]}
+		rt.shadow.reload(context.Background())
+		Expect(rt.shadow.compare("/contact")).To(Equal(shadowShadowOnly))
+
+		source.table.Checksum = "changed"
+		rt.shadow.reload(context.Background())
+		Expect(rt.shadow.compare("/contact")).To(Equal(shadowSame))
+	})
+
+	It("should list the divergences in the API", func() {
+		apiAuthToken = "token"
+		defer func() { apiAuthToken = "" }()
+		api, err := newAPIHandler(rt)
+		Expect(err).NotTo(HaveOccurred())
+		rt.shadow.compare("/contact")
+
+		req := httptest.NewRequest("GET", "/shadow-divergences", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, req)
+		Expect(rw.Code).To(Equal(http.StatusOK))
+
+		var divergences []ShadowDivergence
+		Expect(json.Unmarshal(rw.Body.Bytes(), &divergences)).To(Succeed())
+		Expect(divergences).To(HaveLen(1))
+		Expect(divergences[0].Shadow.RoutePath).To(Equal("/contact"))
+	})
+})
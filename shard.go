@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alphagov/router/handlers"
+)
+
+// shardForwardedHeader is set on requests forwarded to the shard peer. A
+// request which already has it isn't forwarded again, so that shards whose
+// prefixes are misconfigured can't forward requests round in a loop.
+const shardForwardedHeader = "GOVUK-Router-Shard-Forwarded"
+
+// shardRoot stands for routes and requests at the root path "/", which has
+// no first segment, in a shard's list of prefixes.
+const shardRoot = "/"
+
+// routeShard restricts a router to the routes under a set of top-level
+// prefixes, so that a very large route table can be split between
+// instances. Routes under other prefixes aren't loaded, and requests for
+// them are forwarded to peer, if there is one, or get missStatus.
+type routeShard struct {
+	prefixes   map[string]bool
+	peer       http.Handler
+	missStatus int
+
+	// miss handles requests which the shard doesn't own.
+	miss http.Handler
+}
+
+// newRouteShard creates a shard owning prefixes, which are top-level path
+// segments such as "government", or "/" for the root path. Misses are
+// handled through middleware. It returns nil, for no sharding, if there
+// aren't any prefixes.
+func newRouteShard(prefixes []string, peer http.Handler, missStatus int, middleware handlers.Middleware) *routeShard {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	s := &routeShard{prefixes: make(map[string]bool, len(prefixes)), peer: peer, missStatus: missStatus}
+	s.miss = middleware(http.HandlerFunc(s.serveMiss))
+	for _, prefix := range prefixes {
+		if prefix != shardRoot {
+			prefix = strings.Trim(prefix, "/")
+		}
+		s.prefixes[prefix] = true
+	}
+	return s
+}
+
+// owns reports whether path is under one of the shard's prefixes. Every
+// path is if there's no shard.
+func (s *routeShard) owns(path string) bool {
+	if s == nil {
+		return true
+	}
+	return s.prefixes[firstSegment(path)]
+}
+
+// ownsRoute reports whether route is under one of the shard's prefixes.
+// Routes with invalid paths are kept, to be skipped and logged when they're
+// loaded.
+func (s *routeShard) ownsRoute(route *Route) bool {
+	incomingURL, err := url.Parse(route.IncomingPath)
+	return err != nil || s.owns(incomingURL.Path)
+}
+
+// table returns table with only the routes which the shard owns. Route
+// sources which implement RouteFilterer leave the others out as they
+// load, in which case table is returned as it is.
+func (s *routeShard) table(table *RouteTable) *RouteTable {
+	if s == nil {
+		return table
+	}
+	owned := 0
+	for i := range table.Routes {
+		if s.ownsRoute(&table.Routes[i]) {
+			owned++
+		}
+	}
+	if owned == len(table.Routes) {
+		return table
+	}
+
+	filtered := *table
+	filtered.Routes = make([]Route, 0, owned)
+	for i := range table.Routes {
+		if s.ownsRoute(&table.Routes[i]) {
+			filtered.Routes = append(filtered.Routes, table.Routes[i])
+		}
+	}
+	return &filtered
+}
+
+// serveMiss handles a request which the shard doesn't own.
+func (s *routeShard) serveMiss(w http.ResponseWriter, req *http.Request) {
+	if s.peer == nil || req.Header.Get(shardForwardedHeader) != "" {
+		shardMissCountMetric.WithLabelValues("rejected").Inc()
+		handlers.WriteError(w, req, s.missStatus)
+		return
+	}
+	shardMissCountMetric.WithLabelValues("forwarded").Inc()
+	r2 := new(http.Request)
+	*r2 = *req
+	r2.Header = req.Header.Clone()
+	r2.Header.Set(shardForwardedHeader, "1")
+	s.peer.ServeHTTP(w, r2)
+}
+
+// firstSegment returns the first non-empty segment of path, in the same way
+// as the mux splits paths, or shardRoot if there isn't one.
+func firstSegment(path string) string {
+	path = strings.TrimLeft(path, "/")
+	if path == "" {
+		return shardRoot
+	}
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
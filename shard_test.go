@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/handlers"
+)
+
+var _ = Describe("Route shards", func() {
+	var (
+		rt       *Router
+		peer     *httptest.Server
+		received *http.Request
+	)
+
+	BeforeEach(func() {
+		peer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			w.Write([]byte("peer"))
+		}))
+		rt = newTestRouter()
+		rt.source = &fakeRouteSource{table: &RouteTable{
+			Checksum: "1",
+			Routes: []Route{
+				{IncomingPath: "/", RouteType: "exact", Handler: "gone"},
+				{IncomingPath: "/government", RouteType: "prefix", Handler: "gone"},
+				{IncomingPath: "/browse/tax", RouteType: "exact", Handler: "gone"},
+			},
+		}}
+	})
+
+	AfterEach(func() {
+		peer.Close()
+	})
+
+	shard := func(peerURL string, prefixes ...string) {
+		var peerHandler http.Handler
+		if peerURL != "" {
+			u, err := url.Parse(peerURL)
+			Expect(err).NotTo(HaveOccurred())
+			peerHandler = handlers.NewBackendHandler("shard-peer", u, time.Second, time.Second, nil, handlers.BackendOptions{})
+		}
+		rt.shard = newRouteShard(prefixes, peerHandler, http.StatusMisdirectedRequest, rt.middleware.globalChain)
+		rt.reloadRoutes()
+	}
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("should only load the routes under its prefixes", func() {
+		shard("", "government", "/")
+		Expect(rt.mux.RouteCount()).To(Equal(2))
+		Expect(serve(httptest.NewRequest("GET", "/government/news", nil)).Code).To(Equal(http.StatusGone))
+		Expect(serve(httptest.NewRequest("GET", "/", nil)).Code).To(Equal(http.StatusGone))
+	})
+
+	It("should leave a table it owns all of as it is", func() {
+		s := newRouteShard([]string{"government"}, nil, http.StatusNotFound, rt.middleware.globalChain)
+		owned := &RouteTable{Routes: []Route{{IncomingPath: "/government/news", RouteType: "prefix"}}}
+		Expect(s.table(owned)).To(BeIdenticalTo(owned))
+		Expect(s.ownsRoute(&Route{IncomingPath: "/browse"})).To(BeFalse())
+	})
+
+	It("should give requests for other prefixes the miss status without a peer", func() {
+		shard("", "/government/")
+		Expect(serve(httptest.NewRequest("GET", "/browse/tax", nil)).Code).To(Equal(http.StatusMisdirectedRequest))
+		Expect(serve(httptest.NewRequest("GET", "/", nil)).Code).To(Equal(http.StatusMisdirectedRequest))
+	})
+
+	It("should forward requests for other prefixes to the peer", func() {
+		shard(peer.URL, "government")
+		rw := serve(httptest.NewRequest("GET", "/browse/tax", nil))
+		Expect(rw.Body.String()).To(Equal("peer"))
+		Expect(received.URL.Path).To(Equal("/browse/tax"))
+		Expect(received.Header.Get("GOVUK-Router-Shard-Forwarded")).To(Equal("1"))
+	})
+
+	It("shouldn't forward requests which the peer forwarded", func() {
+		shard(peer.URL, "government")
+		req := httptest.NewRequest("GET", "/browse/tax", nil)
+		req.Header.Set("GOVUK-Router-Shard-Forwarded", "1")
+		Expect(serve(req).Code).To(Equal(http.StatusMisdirectedRequest))
+	})
+
+	It("should load every route without prefixes", func() {
+		shard("")
+		Expect(rt.shard).To(BeNil())
+		Expect(rt.mux.RouteCount()).To(Equal(3))
+	})
+
+	table.DescribeTable("finding the first segment of a path",
+		func(path, segment string) {
+			Expect(firstSegment(path)).To(Equal(segment))
+		},
+		table.Entry("root", "/", "/"),
+		table.Entry("one segment", "/government", "government"),
+		table.Entry("more segments", "/government/news", "government"),
+		table.Entry("repeated slashes", "//government//news", "government"),
+	)
+})
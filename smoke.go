@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// smokeCheck is a request for "router smoke" to make, and what it should
+// get back.
+type smokeCheck struct {
+	Line int
+	// URL is a path, or an absolute URL to also set the Host header.
+	URL    string
+	Status int
+	// Backend, if set, is the backend the request should be proxied to.
+	Backend string
+}
+
+// parseSmokeChecks reads checks, one per line, in the form
+//
+//	<path or URL> <status> [<backend ID>]
+//
+// Blank lines and lines starting with "#" are ignored.
+func parseSmokeChecks(r io.Reader) ([]smokeCheck, error) {
+	var checks []smokeCheck
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected a URL, a status and optionally a backend", line)
+		}
+		check := smokeCheck{Line: line, URL: fields[0]}
+		if u, err := url.Parse(check.URL); err != nil || (u.Host == "" && !strings.HasPrefix(u.Path, "/")) {
+			return nil, fmt.Errorf("line %d: %q isn't a path or an absolute URL", line, check.URL)
+		}
+		status, err := strconv.Atoi(fields[1])
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("line %d: %q isn't an HTTP status", line, fields[1])
+		}
+		check.Status = status
+		if len(fields) == 3 {
+			check.Backend = fields[2]
+		}
+		checks = append(checks, check)
+	}
+	return checks, scanner.Err()
+}
+
+// runSmoke implements "router smoke": it loads the routes from the route
+// source and makes each request in the file named by args through them, as
+// described for smoke, reporting the results to out. It returns the exit
+// status for the command.
+func runSmoke(o Options, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("router smoke", flag.ContinueOnError)
+	flags.SetOutput(out)
+	dryRun := flags.Bool("dry-run", false, "don't send requests to backends")
+	flags.Usage = func() {
+		fmt.Fprintln(out, "Usage: router smoke [-dry-run] <file, or - for stdin>")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	var in io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(out, "router smoke:", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	checks, err := parseSmokeChecks(in)
+	if err != nil {
+		fmt.Fprintln(out, "router smoke:", err)
+		return 1
+	}
+
+	rt, err := NewRouterWithOptions(o)
+	if err != nil {
+		fmt.Fprintln(out, "router smoke:", err)
+		return 1
+	}
+	table, err := loadRouteTable(context.Background(), rt.source)
+	if err != nil {
+		fmt.Fprintln(out, "router smoke: loading routes failed:", err)
+		return 1
+	}
+	return rt.smoke(table, checks, *dryRun, out)
+}
+
+// smokeBackendKey is the context key for where smoke records the backend a
+// request reached.
+type smokeBackendKey struct{}
+
+// smoke makes each check's request through the routes in table, and the
+// rules if there are any, reporting any which don't get the expected status
+// or reach the expected backend. With dryRun, requests which reach a backend
+// aren't sent on and their status isn't checked. It returns the exit status
+// for "router smoke".
+func (rt *Router) smoke(table *RouteTable, checks []smokeCheck, dryRun bool, out io.Writer) int {
+	backends, grpcBackends := rt.loadBackends(table.Backends)
+	for _, set := range []map[string]http.Handler{backends, grpcBackends} {
+		for id, handler := range set {
+			if dryRun {
+				handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			}
+			set[id] = recordSmokeBackend(id, handler)
+		}
+	}
+
+	var handler http.Handler = rt.buildMuxWithBackends(table, backends, grpcBackends)
+	if rt.rules != nil {
+		handler = rt.rules.file.current().Middleware(handler)
+	}
+
+	failed := 0
+	for _, check := range checks {
+		if problem := smokeRequest(handler, check, dryRun, out); problem != "" {
+			fmt.Fprintf(out, "router smoke: FAIL %s (line %d): %s\n", check.URL, check.Line, problem)
+			failed++
+		}
+	}
+
+	fmt.Fprintf(out, "router smoke: %d checks, %d failed\n", len(checks), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// smokeRequest makes a check's request, returning what was wrong with the
+// response, if anything.
+func smokeRequest(handler http.Handler, check smokeCheck, dryRun bool, out io.Writer) string {
+	req, err := http.NewRequest("GET", check.URL, nil)
+	if err != nil {
+		return err.Error()
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	var backend string
+	req = req.WithContext(context.WithValue(req.Context(), smokeBackendKey{}, &backend))
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if check.Backend != "" && backend != check.Backend {
+		if backend == "" {
+			return fmt.Sprintf("didn't reach a backend, expected %s (status %d)", check.Backend, rw.Code)
+		}
+		return fmt.Sprintf("reached backend %s, expected %s", backend, check.Backend)
+	}
+	if dryRun && backend != "" {
+		fmt.Fprintf(out, "router smoke: OK %s (would be proxied to %s)\n", check.URL, backend)
+		return ""
+	}
+	if rw.Code != check.Status {
+		return fmt.Sprintf("got status %d, expected %d", rw.Code, check.Status)
+	}
+
+	if backend != "" {
+		fmt.Fprintf(out, "router smoke: OK %s %d (from %s)\n", check.URL, rw.Code, backend)
+	} else {
+		fmt.Fprintf(out, "router smoke: OK %s %d\n", check.URL, rw.Code)
+	}
+	return ""
+}
+
+// recordSmokeBackend wraps a backend's handler to record that a request
+// reached it.
+func recordSmokeBackend(id string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if backend, ok := r.Context().Value(smokeBackendKey{}).(*string); ok {
+			*backend = id
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Smoke testing", func() {
+	var (
+		rt       *Router
+		backend  *httptest.Server
+		requests int
+		table    *RouteTable
+	)
+
+	BeforeEach(func() {
+		requests = 0
+		backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.URL.Path == "/missing" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		rt = newTestRouter()
+		table = &RouteTable{
+			Backends: []Backend{{BackendID: "frontend", BackendURL: backend.URL}},
+			Routes: []Route{
+				{IncomingPath: "/", RouteType: "prefix", Handler: "backend", BackendID: "frontend"},
+				{IncomingPath: "/old", RouteType: "exact", Handler: "redirect", RedirectTo: "/new"},
+				{IncomingPath: "/gone", RouteType: "exact", Handler: "gone"},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	smoke := func(file string, dryRun bool) (int, string) {
+		checks, err := parseSmokeChecks(strings.NewReader(file))
+		Expect(err).NotTo(HaveOccurred())
+		var out bytes.Buffer
+		status := rt.smoke(table, checks, dryRun, &out)
+		return status, out.String()
+	}
+
+	It("should parse checks, skipping comments and blank lines", func() {
+		checks, err := parseSmokeChecks(strings.NewReader("# Start pages\n\n/government 200 frontend\nhttps://www.gov.uk/old 301\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(checks).To(Equal([]smokeCheck{
+			{Line: 3, URL: "/government", Status: 200, Backend: "frontend"},
+			{Line: 4, URL: "https://www.gov.uk/old", Status: 301},
+		}))
+	})
+
+	It("should reject invalid checks", func() {
+		_, err := parseSmokeChecks(strings.NewReader("/government\n"))
+		Expect(err).To(MatchError(ContainSubstring("line 1")))
+		_, err = parseSmokeChecks(strings.NewReader("/government ok\n"))
+		Expect(err).To(MatchError(ContainSubstring(`"ok" isn't an HTTP status`)))
+		_, err = parseSmokeChecks(strings.NewReader("government 200\n"))
+		Expect(err).To(MatchError(ContainSubstring("isn't a path")))
+	})
+
+	It("should pass when every request gets what's expected", func() {
+		status, out := smoke("/government 200 frontend\n/missing 404\n/old 301\n/gone 410\n", false)
+		Expect(status).To(Equal(0))
+		Expect(out).To(ContainSubstring("OK /government 200 (from frontend)"))
+		Expect(out).To(ContainSubstring("4 checks, 0 failed"))
+		Expect(requests).To(Equal(2))
+	})
+
+	It("should report mismatched statuses and backends", func() {
+		status, out := smoke("/missing 200\n/old 301 frontend\n", false)
+		Expect(status).To(Equal(1))
+		Expect(out).To(ContainSubstring("FAIL /missing (line 1): got status 404, expected 200"))
+		Expect(out).To(ContainSubstring("FAIL /old (line 2): didn't reach a backend, expected frontend (status 301)"))
+		Expect(out).To(ContainSubstring("2 checks, 2 failed"))
+	})
+
+	It("should only check where requests go in a dry run", func() {
+		status, out := smoke("/missing 200 frontend\n/gone 410\n", true)
+		Expect(status).To(Equal(0))
+		Expect(out).To(ContainSubstring("OK /missing (would be proxied to frontend)"))
+		Expect(requests).To(Equal(0))
+
+		status, _ = smoke("/gone 404\n", true)
+		Expect(status).To(Equal(1))
+	})
+})
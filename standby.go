@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alphagov/router/triemux"
+)
+
+// errNoStandby is returned by rollback when there are no previous routes to
+// go back to.
+var errNoStandby = errors.New("there are no previous routes to roll back to")
+
+// standbyRoutes are the routes which the router served before its last
+// reload, kept so that they can be switched back to straight away if a bad
+// publish breaks routing.
+type standbyRoutes struct {
+	mux      *triemux.Mux
+	table    *RouteTable // nil unless the router keeps its route tables
+	counts   routeCounts
+	checksum string
+	replaced time.Time
+}
+
+// StandbyStatus describes the routes the router can roll back to.
+type StandbyStatus struct {
+	Available bool       `json:"available"`
+	Routes    int        `json:"routes,omitempty"`
+	Checksum  string     `json:"checksum,omitempty"`
+	Replaced  *time.Time `json:"replaced,omitempty"`
+
+	// ReplacedChecksum is the checksum of the routes the router last
+	// rolled back from, or replaced with an import, which it won't reload
+	// until the route source changes again.
+	ReplacedChecksum string `json:"replaced_checksum,omitempty"`
+}
+
+// keepsRouteTables reports whether the route tables which the router's
+// muxes were built from need to be kept, for the route archive API, the
+// decision log, shadow evaluation or purging the CDN. Otherwise only the
+// muxes are kept, to save memory.
+func (rt *Router) keepsRouteTables() bool {
+	return rt.routeArchives || rt.decisions != nil || rt.shadow != nil || rt.purgeQueue != nil
+}
+
+// keepStandby keeps the routes which a reload replaced, unless there are
+// more of them than the router's limit. It's called with rt.lock held.
+func (rt *Router) keepStandby(previous *triemux.Mux, table *RouteTable, counts routeCounts, checksum string) {
+	rt.standby = nil
+	if rt.standbyMaxRoutes <= 0 || previous.RouteCount() == 0 {
+		return
+	}
+	if previous.RouteCount() > rt.standbyMaxRoutes {
+		logInfo(fmt.Sprintf("router: not keeping the previous %d routes to roll back to (limit %d)",
+			previous.RouteCount(), rt.standbyMaxRoutes))
+		return
+	}
+	rt.standby = &standbyRoutes{
+		mux:      previous,
+		table:    table,
+		counts:   counts,
+		checksum: checksum,
+		replaced: time.Now(),
+	}
+}
+
+// rollback switches back to the routes the router served before its last
+// reload, keeping the ones it's switching from as the standby, so that a
+// second rollback undoes the first. The router won't reload the routes it
+// rolled back from, but reloads as usual once the route source changes
+// again.
+func (rt *Router) rollback() (StandbyStatus, error) {
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	rt.lock.Lock()
+	standby := rt.standby
+	if standby == nil {
+		rt.lock.Unlock()
+		return StandbyStatus{}, errNoStandby
+	}
+	rt.standby = &standbyRoutes{
+		mux:      rt.mux,
+		table:    rt.loadedTable,
+		counts:   rt.routeCounts,
+		checksum: rt.loadedChecksum,
+		replaced: time.Now(),
+	}
+	rt.mux = standby.mux
+	rt.routeCounts = standby.counts
+	rt.replacedChecksum = rt.loadedChecksum
+	rt.loadedChecksum = standby.checksum
+	rt.lock.Unlock()
+
+	if rt.keepsRouteTables() {
+		if rt.decisions != nil {
+			rt.decisions.setRoutes(standby.table.Routes)
+		}
+		rt.shadow.setPrimary(standby.mux, standby.table.Routes)
+		if rt.purgeQueue != nil {
+			rt.purgeQueue.enqueue(changedRoutePaths(rt.loadedTable.Routes, standby.table.Routes))
+		}
+	}
+	rt.loadedTable = standby.table
+
+	logWarn(fmt.Sprintf("router: rolled back to the previous %d routes (checksum: %x)",
+		standby.mux.RouteCount(), standby.mux.RouteChecksum()))
+	rt.updateRouteCountMetrics(standby.counts, rt.standby.counts)
+	return rt.standbyStatus(), nil
+}
+
+// standbyStatus describes the routes the router can roll back to.
+func (rt *Router) standbyStatus() StandbyStatus {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	status := StandbyStatus{ReplacedChecksum: rt.replacedChecksum}
+	if rt.standby != nil {
+		replaced := rt.standby.replaced
+		status.Available = true
+		status.Routes = rt.standby.mux.RouteCount()
+		status.Checksum = rt.standby.checksum
+		status.Replaced = &replaced
+	}
+	return status
+}
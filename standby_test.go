@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rolling back", func() {
+	var (
+		rt     *Router
+		source *fakeRouteSource
+	)
+
+	routes := func(checksum, path string) *RouteTable {
+		return &RouteTable{
+			Checksum: checksum,
+			Routes: []Route{
+				{IncomingPath: "/", RouteType: "exact", Handler: "gone"},
+				{IncomingPath: path, RouteType: "exact", Handler: "redirect", RedirectTo: "/elsewhere"},
+			},
+		}
+	}
+
+	status := func(path string) int {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw.Code
+	}
+
+	BeforeEach(func() {
+		source = &fakeRouteSource{table: routes("1", "/old")}
+		rt = newTestRouter()
+		rt.source = source
+		rt.standbyMaxRoutes = 10
+		rt.reloadRoutes()
+		source.table = routes("2", "/new")
+		rt.reloadRoutes()
+	})
+
+	It("should switch back to the routes before the last reload", func() {
+		Expect(status("/new")).To(Equal(http.StatusMovedPermanently))
+
+		s, err := rt.rollback()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Checksum).To(Equal("2"))
+		Expect(s.ReplacedChecksum).To(Equal("2"))
+		Expect(rt.loadedChecksum).To(Equal("1"))
+		Expect(status("/old")).To(Equal(http.StatusMovedPermanently))
+		Expect(status("/new")).To(Equal(http.StatusNotFound))
+	})
+
+	It("should undo a rollback with a second one", func() {
+		_, err := rt.rollback()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = rt.rollback()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.loadedChecksum).To(Equal("2"))
+		Expect(status("/new")).To(Equal(http.StatusMovedPermanently))
+	})
+
+	It("shouldn't reload the routes it rolled back from until they change", func() {
+		_, err := rt.rollback()
+		Expect(err).NotTo(HaveOccurred())
+
+		pollOnce(rt)
+		Expect(rt.loadedChecksum).To(Equal("1"))
+
+		source.table = routes("3", "/newer")
+		pollOnce(rt)
+		Expect(rt.loadedChecksum).To(Equal("3"))
+		Expect(rt.replacedChecksum).To(BeEmpty())
+		Expect(status("/newer")).To(Equal(http.StatusMovedPermanently))
+	})
+
+	It("shouldn't keep more routes than the limit", func() {
+		rt.standbyMaxRoutes = 1
+		source.table = routes("3", "/newer")
+		rt.reloadRoutes()
+		Expect(rt.standbyStatus().Available).To(BeFalse())
+
+		_, err := rt.rollback()
+		Expect(err).To(Equal(errNoStandby))
+	})
+
+	It("shouldn't keep any routes by default", func() {
+		rt = newTestRouter()
+		rt.source = source
+		rt.reloadRoutes()
+		source.table = routes("3", "/newer")
+		rt.reloadRoutes()
+		Expect(rt.standby).To(BeNil())
+	})
+
+	It("should show and roll back to the standby routes in the API", func() {
+		apiAuthToken = "token"
+		defer func() { apiAuthToken = "" }()
+		api, err := newAPIHandler(rt)
+		Expect(err).NotTo(HaveOccurred())
+
+		call := func(method string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "/rollback", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			rw := httptest.NewRecorder()
+			api.ServeHTTP(rw, req)
+			return rw
+		}
+
+		var s StandbyStatus
+		rw := call("GET")
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(json.Unmarshal(rw.Body.Bytes(), &s)).To(Succeed())
+		Expect(s.Available).To(BeTrue())
+		Expect(s.Routes).To(Equal(2))
+		Expect(s.Checksum).To(Equal("1"))
+
+		rw = call("POST")
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(status("/old")).To(Equal(http.StatusMovedPermanently))
+
+		rt.standby = nil
+		Expect(call("POST").Code).To(Equal(http.StatusConflict))
+	})
+})
+
+// pollOnce checks for changes to rt's routes once, as if the route source
+// had been notified of a change.
+func pollOnce(rt *Router) {
+	rt.ReloadChan = make(chan bool, 1)
+	rt.ReloadChan <- true
+	close(rt.ReloadChan)
+	rt.pollAndReload()
+}
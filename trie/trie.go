@@ -2,6 +2,20 @@
 // are slices of strings) to arbitrary data values (type interface{}).
 package trie
 
+import (
+	"sort"
+	"unsafe"
+)
+
+// Rough costs of a map and of each element it holds, on top of the key's
+// bytes, for estimating a Trie's memory use. Go's maps keep their elements
+// in buckets with some spare room, so this is more than the size of a key
+// and a pointer.
+const (
+	mapBytes        = 48
+	mapElementBytes = 40
+)
+
 type trieChildren map[string]*Trie
 
 type Trie struct {
@@ -116,6 +130,79 @@ func (t *Trie) Del(path []string) bool {
 	return res.Del(newpath)
 }
 
+// Walk calls fn for each element in the Trie, passing its path and value.
+// Elements are visited depth-first, with children in lexical order, so the
+// order is the same for Tries with the same contents.
+func (t *Trie) Walk(fn func(path []string, entry interface{})) {
+	t.walk(nil, fn)
+}
+
+func (t *Trie) walk(path []string, fn func(path []string, entry interface{})) {
+	if t.Leaf {
+		fn(path, t.Entry)
+	}
+
+	keys := make([]string, 0, len(t.Children))
+	for key := range t.Children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		// Copy the path so that fn may keep it
+		childPath := make([]string, len(path)+1)
+		copy(childPath, path)
+		childPath[len(path)] = key
+		t.Children[key].walk(childPath, fn)
+	}
+}
+
+// Stats describes the size and shape of a Trie.
+type Stats struct {
+	// Nodes counts every node, including the root and those which only
+	// lead to others.
+	Nodes int `json:"nodes"`
+	// Entries counts the nodes holding an element.
+	Entries int `json:"entries"`
+	// AverageDepth is the mean number of path segments to reach an
+	// element, and MaxDepth the most.
+	AverageDepth float64 `json:"average_depth"`
+	MaxDepth     int     `json:"max_depth"`
+	// EstimatedBytes is roughly how much memory the nodes and their keys
+	// use, not counting the elements themselves.
+	EstimatedBytes int64 `json:"estimated_bytes"`
+}
+
+// Stats walks the Trie to work out its Stats.
+func (t *Trie) Stats() Stats {
+	var stats Stats
+	totalDepth := 0
+	t.stats(0, &stats, &totalDepth)
+	if stats.Entries > 0 {
+		stats.AverageDepth = float64(totalDepth) / float64(stats.Entries)
+	}
+	return stats
+}
+
+func (t *Trie) stats(depth int, stats *Stats, totalDepth *int) {
+	stats.Nodes++
+	stats.EstimatedBytes += int64(unsafe.Sizeof(*t))
+	if t.Leaf {
+		stats.Entries++
+		*totalDepth += depth
+		if depth > stats.MaxDepth {
+			stats.MaxDepth = depth
+		}
+	}
+	if t.Children != nil {
+		stats.EstimatedBytes += mapBytes
+	}
+	for key, child := range t.Children {
+		stats.EstimatedBytes += mapElementBytes + int64(len(key))
+		child.stats(depth+1, stats, totalDepth)
+	}
+}
+
 func (t *Trie) setentry(value interface{}) {
 	t.Leaf = true
 	t.Entry = value
@@ -1,6 +1,8 @@
 package trie
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -201,6 +203,61 @@ func TestDelReturnsStatus(t *testing.T) {
 	}
 }
 
+func TestWalk(t *testing.T) {
+	trie := NewTrie()
+	trie.Set([]string{"foo", "bar"}, 2)
+	trie.Set([]string{}, 0)
+	trie.Set([]string{"baz"}, 3)
+	trie.Set([]string{"foo"}, 1)
+	trie.Set([]string{"foo", "qux"}, 4)
+	trie.Del([]string{"foo", "qux"})
+
+	var paths []string
+	var vals []interface{}
+	trie.Walk(func(path []string, entry interface{}) {
+		paths = append(paths, "/"+strings.Join(path, "/"))
+		vals = append(vals, entry)
+	})
+
+	expectedPaths := []string{"/", "/baz", "/foo", "/foo/bar"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("trie.Walk visited %v (expected %v)", paths, expectedPaths)
+	}
+	expectedVals := []interface{}{0, 3, 1, 2}
+	if !reflect.DeepEqual(vals, expectedVals) {
+		t.Errorf("trie.Walk found values %v (expected %v)", vals, expectedVals)
+	}
+}
+
+func TestStats(t *testing.T) {
+	trie := NewTrie()
+	trie.Set([]string{"foo", "bar"}, 2)
+	trie.Set([]string{"foo", "bar", "baz", "qux"}, 4)
+	trie.Set([]string{"quux"}, 1)
+
+	stats := trie.Stats()
+	if stats.Nodes != 6 {
+		t.Errorf("trie.Stats counted %d nodes (expected 6)", stats.Nodes)
+	}
+	if stats.Entries != 3 {
+		t.Errorf("trie.Stats counted %d entries (expected 3)", stats.Entries)
+	}
+	if stats.AverageDepth != 7.0/3 {
+		t.Errorf("trie.Stats gave an average depth of %v (expected %v)", stats.AverageDepth, 7.0/3)
+	}
+	if stats.MaxDepth != 4 {
+		t.Errorf("trie.Stats gave a max depth of %d (expected 4)", stats.MaxDepth)
+	}
+
+	empty := NewTrie().Stats()
+	if empty.Entries != 0 || empty.AverageDepth != 0 {
+		t.Errorf("trie.Stats gave %+v for an empty trie", empty)
+	}
+	if stats.EstimatedBytes <= empty.EstimatedBytes {
+		t.Errorf("trie.Stats estimated %d bytes, no more than an empty trie's %d", stats.EstimatedBytes, empty.EstimatedBytes)
+	}
+}
+
 func buildExampleTrie(t *testing.T, pairs []Pair) *Trie {
 	trie := NewTrie()
 	for _, p := range pairs {
@@ -0,0 +1,38 @@
+// +build gofuzz
+
+package triemux
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Fuzz is an entry point for go-fuzz (https://github.com/dvyukov/go-fuzz).
+// Each line of data is registered as a route, as a prefix route if it ends
+// with "*", and the mux must then pass Verify.
+func Fuzz(data []byte) int {
+	mux := NewMux()
+	handler := http.NotFoundHandler()
+
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		prefix := strings.HasSuffix(line, "*")
+		path := strings.TrimSuffix(line, "*")
+
+		// The same route path registered twice is reported by Verify, so
+		// only register each one once.
+		key := fmt.Sprintf("%v %v", splitpath(path), prefix)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		mux.Handle(path, prefix, handler)
+	}
+
+	if problems := mux.Verify(); len(problems) > 0 {
+		panic(fmt.Sprintf("%d problems verifying mux: %v", len(problems), problems))
+	}
+	return 1
+}
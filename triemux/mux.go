@@ -11,6 +11,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 
@@ -22,17 +23,57 @@ type Mux struct {
 	exactTrie  *trie.Trie
 	prefixTrie *trie.Trie
 	count      int
-	checksum   hash.Hash
+	// checksum caches RouteChecksum until another route is registered.
+	checksum *muxChecksum
+
+	// ChecksumHash creates the hash used by RouteChecksum. If nil, SHA-1 is
+	// used.
+	ChecksumHash func() hash.Hash
+
+	// NotFoundHandler handles requests which don't match any route. If nil,
+	// http.NotFound is used.
+	NotFoundHandler http.Handler
+
+	// UnavailableHandler handles every request while the routing table is
+	// empty. If nil, a 503 is returned with no body.
+	UnavailableHandler http.Handler
+
+	// Overlay is a mux of routes layered over this mux's routes. Requests
+	// which match an overlay route at least as specific as the route they
+	// match in this mux, if any, are passed to ServeOverlay along with the
+	// overlay route's handler and the handler this mux would otherwise use.
+	// If ServeOverlay is nil, the overlay route's handler is used.
+	Overlay      *Mux
+	ServeOverlay func(w http.ResponseWriter, r *http.Request, overlay, fallback http.Handler)
+
+	// Matched, if set, is called with the route each request matches
+	// before the request is passed to the route's handler, so that callers
+	// needn't look the route up again.
+	Matched func(r *http.Request, match Match)
 }
 
 type muxEntry struct {
+	path    string
 	prefix  bool
 	handler http.Handler
 }
 
+// muxChecksum is a route checksum, computed once by whichever caller of
+// RouteChecksum needs it first.
+type muxChecksum struct {
+	once sync.Once
+	sum  []byte
+}
+
+// Match describes the registered route which matches a path.
+type Match struct {
+	Path   string
+	Prefix bool
+}
+
 // NewMux makes a new empty Mux.
 func NewMux() *Mux {
-	return &Mux{exactTrie: trie.NewTrie(), prefixTrie: trie.NewTrie(), checksum: sha1.New()}
+	return &Mux{exactTrie: trie.NewTrie(), prefixTrie: trie.NewTrie(), checksum: &muxChecksum{}}
 }
 
 // ServeHTTP dispatches the request to a backend with a registered route
@@ -40,8 +81,12 @@ func NewMux() *Mux {
 //
 // If the routing table is empty, return a 503.
 func (mux *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if mux.count == 0 {
-		w.WriteHeader(http.StatusServiceUnavailable)
+	if mux.RouteCount() == 0 {
+		if mux.UnavailableHandler != nil {
+			mux.UnavailableHandler.ServeHTTP(w, r)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
 		logger.NotifySentry(logger.ReportableError{
 			Error: logger.RecoveredError{"Route table is empty!"},
 			Request: r,
@@ -54,18 +99,100 @@ func (mux *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	handler, ok := mux.lookup(r.URL.Path)
+	if mux.Overlay != nil {
+		if mux.serveOverlay(w, r) {
+			return
+		}
+	}
+
+	entry, ok := mux.find(r.URL.Path)
 	if !ok {
-		http.NotFound(w, r)
+		EntryNotFoundCountMetric.Inc()
+		if mux.NotFoundHandler != nil {
+			mux.NotFoundHandler.ServeHTTP(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
 		return
 	}
 
-	handler.ServeHTTP(w, r)
+	if mux.Matched != nil {
+		mux.Matched(r, entry.match())
+	}
+	entry.handler.ServeHTTP(w, r)
+}
+
+// serveOverlay serves the request through the overlay if it matches an
+// overlay route which takes precedence over this mux's routes, reporting
+// whether it did.
+func (mux *Mux) serveOverlay(w http.ResponseWriter, r *http.Request) bool {
+	over, ok := mux.Overlay.find(r.URL.Path)
+	if !ok {
+		return false
+	}
+	entry, ok := mux.find(r.URL.Path)
+	if ok && !over.overrides(entry) {
+		return false
+	}
+
+	var fallback http.Handler
+	switch {
+	case ok:
+		fallback = entry.handler
+	case mux.NotFoundHandler != nil:
+		fallback = mux.NotFoundHandler
+	default:
+		fallback = http.NotFoundHandler()
+	}
+	if mux.Matched != nil {
+		mux.Matched(r, over.match())
+	}
+	if mux.ServeOverlay == nil {
+		over.handler.ServeHTTP(w, r)
+	} else {
+		mux.ServeOverlay(w, r, over.handler, fallback)
+	}
+	return true
+}
+
+// overrides reports whether the entry is at least as specific as other, so
+// that it takes precedence when both match a path: exact routes over prefix
+// routes, and longer prefixes over shorter ones.
+func (entry muxEntry) overrides(other muxEntry) bool {
+	if entry.prefix != other.prefix {
+		return !entry.prefix
+	}
+	return len(splitpath(entry.path)) >= len(splitpath(other.path))
 }
 
 // lookup takes a path and looks up its registered entry in the mux trie,
 // returning the handler for that path, if any matches.
 func (mux *Mux) lookup(path string) (handler http.Handler, ok bool) {
+	entry, ok := mux.find(path)
+	if !ok {
+		EntryNotFoundCountMetric.Inc()
+		return nil, false
+	}
+
+	return entry.handler, ok
+}
+
+// Lookup returns the route which a request for path would be dispatched to,
+// if any. Unlike ServeHTTP, it doesn't count towards any metrics.
+func (mux *Mux) Lookup(path string) (match Match, ok bool) {
+	entry, ok := mux.find(path)
+	if !ok {
+		return Match{}, false
+	}
+
+	return entry.match(), true
+}
+
+func (entry muxEntry) match() Match {
+	return Match{Path: entry.path, Prefix: entry.prefix}
+}
+
+func (mux *Mux) find(path string) (entry muxEntry, ok bool) {
 	mux.mu.RLock()
 	defer mux.mu.RUnlock()
 
@@ -75,18 +202,16 @@ func (mux *Mux) lookup(path string) (handler http.Handler, ok bool) {
 		val, ok = mux.prefixTrie.GetLongestPrefix(pathSegments)
 	}
 	if !ok {
-		EntryNotFoundCountMetric.Inc()
-		return nil, false
+		return muxEntry{}, false
 	}
 
-	entry, ok := val.(muxEntry)
+	entry, ok = val.(muxEntry)
 	if !ok {
 		log.Printf("lookup: got value (%v) from trie that wasn't a muxEntry!", val)
-		EntryNotFoundCountMetric.Inc()
-		return nil, false
+		return muxEntry{}, false
 	}
 
-	return entry.handler, ok
+	return entry, true
 }
 
 // Handle registers the specified route (either an exact or a prefix route)
@@ -98,28 +223,100 @@ func (mux *Mux) Handle(path string, prefix bool, handler http.Handler) {
 
 	mux.addToStats(path, prefix)
 	if prefix {
-		mux.prefixTrie.Set(splitpath(path), muxEntry{prefix, handler})
+		mux.prefixTrie.Set(splitpath(path), muxEntry{path, prefix, handler})
 	} else {
-		mux.exactTrie.Set(splitpath(path), muxEntry{prefix, handler})
+		mux.exactTrie.Set(splitpath(path), muxEntry{path, prefix, handler})
 	}
 }
 
 func (mux *Mux) addToStats(path string, prefix bool) {
 	mux.count++
-	mux.checksum.Write([]byte(path))
-	if prefix {
-		mux.checksum.Write([]byte("(true)"))
-	} else {
-		mux.checksum.Write([]byte("(false)"))
-	}
+	mux.checksum = &muxChecksum{}
 }
 
+// RouteCount returns the number of routes registered, including those in the
+// overlay.
 func (mux *Mux) RouteCount() int {
+	if mux.Overlay != nil {
+		return mux.count + mux.Overlay.count
+	}
 	return mux.count
 }
 
+// RouteChecksum returns a checksum of the registered routes' paths and
+// types. The routes are hashed in order of path and then type, exact routes
+// first, so the checksum only depends on which routes are registered and not
+// the order they were registered in, and is comparable between muxes loaded
+// from different route sources. The overlay's routes are included.
+//
+// Each mux entry is hashed once, with the path it was last registered with,
+// so registering the same route again doesn't change the checksum even
+// though it changes RouteCount.
+//
+// The checksum is computed under the read lock, so lookups carry on while
+// it's worked out, and cached until another route is registered.
 func (mux *Mux) RouteChecksum() []byte {
-	return mux.checksum.Sum(nil)
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	checksum := mux.checksum
+	checksum.once.Do(func() {
+		checksum.sum = mux.computeChecksum()
+	})
+	return append([]byte(nil), checksum.sum...)
+}
+
+func (mux *Mux) computeChecksum() []byte {
+	var routes []Match
+	collect := func(_ []string, val interface{}) {
+		if entry, ok := val.(muxEntry); ok {
+			routes = append(routes, Match{Path: entry.path, Prefix: entry.prefix})
+		}
+	}
+	mux.exactTrie.Walk(collect)
+	mux.prefixTrie.Walk(collect)
+	if mux.Overlay != nil {
+		mux.Overlay.mu.RLock()
+		mux.Overlay.exactTrie.Walk(collect)
+		mux.Overlay.prefixTrie.Walk(collect)
+		mux.Overlay.mu.RUnlock()
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return !routes[i].Prefix && routes[j].Prefix
+	})
+
+	newHash := mux.ChecksumHash
+	if newHash == nil {
+		newHash = sha1.New
+	}
+	h := newHash()
+	for _, route := range routes {
+		h.Write([]byte(route.Path))
+		if route.Prefix {
+			h.Write([]byte("(true)"))
+		} else {
+			h.Write([]byte("(false)"))
+		}
+	}
+	return h.Sum(nil)
+}
+
+// Stats describes the tries holding the exact and prefix routes.
+type Stats struct {
+	Exact  trie.Stats `json:"exact"`
+	Prefix trie.Stats `json:"prefix"`
+}
+
+// Stats walks the mux's tries to work out their Stats, which takes time in
+// proportion to the number of routes.
+func (mux *Mux) Stats() Stats {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	return Stats{Exact: mux.exactTrie.Stats(), Prefix: mux.prefixTrie.Stats()}
 }
 
 // splitpath turns a slash-delimited string into a lookup path (a slice
@@ -1,11 +1,15 @@
 package triemux
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -217,6 +221,34 @@ func testLookup(t *testing.T, ex LookupExample) {
 	}
 }
 
+func TestExportedLookup(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", true, a)
+	mux.Handle("/foo/bar", false, b)
+
+	beforeCount := promtest.ToFloat64(EntryNotFoundCountMetric)
+
+	examples := []struct {
+		path  string
+		ok    bool
+		match Match
+	}{
+		{"/foo/baz", true, Match{Path: "/foo", Prefix: true}},
+		{"/foo/bar", true, Match{Path: "/foo/bar", Prefix: false}},
+		{"/qux", false, Match{}},
+	}
+	for _, ex := range examples {
+		match, ok := mux.Lookup(ex.path)
+		if ok != ex.ok || match != ex.match {
+			t.Errorf("Expected Lookup(%v) to be (%+v, %v), was (%+v, %v)", ex.path, ex.match, ex.ok, match, ok)
+		}
+	}
+
+	if afterCount := promtest.ToFloat64(EntryNotFoundCountMetric); afterCount != beforeCount {
+		t.Errorf("Expected Lookup not to count missing entries, but count went from %f to %f", beforeCount, afterCount)
+	}
+}
+
 var statsExample = []Registration{
 	{"/", false, a},
 	{"/foo", true, a},
@@ -236,10 +268,12 @@ func TestRouteCount(t *testing.T) {
 
 func TestChecksum(t *testing.T) {
 	mux := NewMux()
-	hash := sha1.New()
 	for _, reg := range statsExample {
 		mux.Handle(reg.path, reg.prefix, reg.handler)
-		hash.Write([]byte(fmt.Sprintf("%s(%v)", reg.path, reg.prefix)))
+	}
+	hash := sha1.New()
+	for _, route := range []string{"/(false)", "/bar(false)", "/foo(true)"} {
+		hash.Write([]byte(route))
 	}
 	expected := fmt.Sprintf("%x", hash.Sum(nil))
 	actual := fmt.Sprintf("%x", mux.RouteChecksum())
@@ -248,6 +282,172 @@ func TestChecksum(t *testing.T) {
 	}
 }
 
+func TestChecksumIgnoresRegistrationOrder(t *testing.T) {
+	mux := NewMux()
+	reversed := NewMux()
+	for i := range statsExample {
+		reg := statsExample[i]
+		mux.Handle(reg.path, reg.prefix, reg.handler)
+		reg = statsExample[len(statsExample)-1-i]
+		reversed.Handle(reg.path, reg.prefix, reg.handler)
+	}
+	if expected, actual := mux.RouteChecksum(), reversed.RouteChecksum(); !bytes.Equal(expected, actual) {
+		t.Errorf("Expected checksum to be %x whatever the order, was %x", expected, actual)
+	}
+
+	before := mux.RouteChecksum()
+	mux.Handle("/baz", false, a)
+	if after := mux.RouteChecksum(); bytes.Equal(before, after) {
+		t.Errorf("Expected checksum to change when a route was added, but it stayed %x", after)
+	}
+}
+
+func TestChecksumIgnoresDuplicates(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", false, a)
+	before := mux.RouteChecksum()
+	mux.Handle("/foo", false, b)
+	if after := mux.RouteChecksum(); !bytes.Equal(before, after) {
+		t.Errorf("Expected checksum to stay %x when a route was registered again, was %x", before, after)
+	}
+	if count := mux.RouteCount(); count != 2 {
+		t.Errorf("Expected count to be 2, was %d", count)
+	}
+}
+
+func TestChecksumWhileLookingUp(t *testing.T) {
+	mux := NewMux()
+	for _, reg := range statsExample {
+		mux.Handle(reg.path, reg.prefix, reg.handler)
+	}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			mux.Lookup("/foo/bar")
+		}
+		close(done)
+	}()
+	expected := mux.RouteChecksum()
+	for i := 0; i < 10; i++ {
+		if actual := mux.RouteChecksum(); !bytes.Equal(expected, actual) {
+			t.Errorf("Expected checksum to be %x, was %x", expected, actual)
+		}
+	}
+	<-done
+}
+
+func TestChecksumHash(t *testing.T) {
+	mux := NewMux()
+	mux.ChecksumHash = sha256.New
+	mux.Handle("/foo", false, a)
+	expected := sha256.Sum256([]byte("/foo(false)"))
+	if actual := mux.RouteChecksum(); !bytes.Equal(expected[:], actual) {
+		t.Errorf("Expected checksum to be %x, was %x", expected, actual)
+	}
+}
+
+type namedHandler string
+
+func (h namedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(h))
+}
+
+func serveBody(handler http.Handler, path string) string {
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+	return rw.Body.String()
+}
+
+func TestOverlay(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/", true, namedHandler("root"))
+	mux.Handle("/foo/bar", true, namedHandler("foo-bar"))
+	mux.Overlay = NewMux()
+	mux.Overlay.Handle("/foo", true, namedHandler("overlay-foo"))
+	mux.Overlay.Handle("/new", false, namedHandler("overlay-new"))
+
+	for path, expected := range map[string]string{
+		"/foo":       "overlay-foo",
+		"/foo/baz":   "overlay-foo",
+		"/foo/bar/x": "foo-bar",
+		"/new":       "overlay-new",
+		"/new/x":     "root",
+		"/other":     "root",
+	} {
+		if actual := serveBody(mux, path); actual != expected {
+			t.Errorf("Expected %s to be served by %s, was %s", path, expected, actual)
+		}
+	}
+
+	mux.ServeOverlay = func(w http.ResponseWriter, r *http.Request, overlay, fallback http.Handler) {
+		fallback.ServeHTTP(w, r)
+	}
+	if actual := serveBody(mux, "/foo/baz"); actual != "root" {
+		t.Errorf("Expected the fallback for /foo/baz to be root, was %s", actual)
+	}
+
+	if count := mux.RouteCount(); count != 4 {
+		t.Errorf("Expected count to include the overlay's routes and be 4, was %d", count)
+	}
+	flat := NewMux()
+	flat.Handle("/", true, a)
+	flat.Handle("/foo/bar", true, a)
+	flat.Handle("/foo", true, a)
+	flat.Handle("/new", false, a)
+	if expected, actual := flat.RouteChecksum(), mux.RouteChecksum(); !bytes.Equal(expected, actual) {
+		t.Errorf("Expected checksum to include the overlay's routes and be %x, was %x", expected, actual)
+	}
+}
+
+func TestOverlayWithoutRoutes(t *testing.T) {
+	mux := NewMux()
+	mux.Overlay = NewMux()
+	mux.Overlay.Handle("/new", false, namedHandler("overlay-new"))
+
+	if actual := serveBody(mux, "/new"); actual != "overlay-new" {
+		t.Errorf("Expected /new to be served by the overlay, was %s", actual)
+	}
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, httptest.NewRequest("GET", "/other", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for a path not in the overlay, was %d", rw.Code)
+	}
+}
+
+func TestMatched(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", true, namedHandler("foo"))
+	mux.Overlay = NewMux()
+	mux.Overlay.Handle("/foo/bar", false, namedHandler("overlay-foo-bar"))
+
+	var matches []Match
+	mux.Matched = func(r *http.Request, match Match) {
+		matches = append(matches, match)
+	}
+	for _, path := range []string{"/foo/baz", "/foo/bar", "/other"} {
+		serveBody(mux, path)
+	}
+
+	expected := []Match{{Path: "/foo", Prefix: true}, {Path: "/foo/bar", Prefix: false}}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("Expected the matches to be %+v, were %+v", expected, matches)
+	}
+}
+
+func TestStats(t *testing.T) {
+	mux := NewMux()
+	for _, reg := range statsExample {
+		mux.Handle(reg.path, reg.prefix, reg.handler)
+	}
+	stats := mux.Stats()
+	if stats.Exact.Entries != 2 || stats.Prefix.Entries != 1 {
+		t.Errorf("Expected 2 exact and 1 prefix entries, got %d and %d", stats.Exact.Entries, stats.Prefix.Entries)
+	}
+	if stats.Exact.Nodes != 2 || stats.Exact.MaxDepth != 1 {
+		t.Errorf("Expected 2 exact nodes with a max depth of 1, got %+v", stats.Exact)
+	}
+}
+
 func loadStrings(filename string) []string {
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
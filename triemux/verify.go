@@ -0,0 +1,99 @@
+package triemux
+
+import (
+	"fmt"
+	"strings"
+)
+
+// verifyProbeSegment is appended to prefix routes' paths to check that
+// requests below them are matched. It's a NUL byte, which real request paths
+// don't contain, so that it won't clash with a more specific route.
+const verifyProbeSegment = "\x00"
+
+// Verify checks the consistency of the mux, returning a description of each
+// problem found. It checks that:
+//
+//   - every registered route is found by a lookup of its own path, except
+//     that an exact route takes precedence over a prefix route for the same
+//     path
+//   - requests below a prefix route are matched by it
+//   - every entry is stored under the path it was registered with, in the
+//     trie for its route type
+//   - the route count matches the number of entries, which it won't if the
+//     same route was registered more than once
+//
+// The overlay, if there is one, is checked in the same way.
+//
+// Routes mustn't be added to the mux while it's being verified.
+func (mux *Mux) Verify() (problems []error) {
+	mux.mu.RLock()
+	exactTrie, prefixTrie, count := mux.exactTrie, mux.prefixTrie, mux.count
+	mux.mu.RUnlock()
+
+	entries := 0
+	check := func(inPrefixTrie bool) func([]string, interface{}) {
+		return func(segments []string, val interface{}) {
+			entries++
+			path := "/" + strings.Join(segments, "/")
+
+			entry, ok := val.(muxEntry)
+			if !ok {
+				problems = append(problems, fmt.Errorf("%s: trie contains %v, which isn't a muxEntry", path, val))
+				return
+			}
+			if entry.prefix != inPrefixTrie || !equalSegments(splitpath(entry.path), segments) {
+				problems = append(problems, fmt.Errorf("%s: entry for %s (prefix: %v) is in the wrong place",
+					path, entry.path, entry.prefix))
+			}
+
+			expected := Match{Path: entry.path, Prefix: entry.prefix}
+			if inPrefixTrie {
+				if exact, ok := exactTrie.Get(segments); ok {
+					if e, ok := exact.(muxEntry); ok {
+						expected = Match{Path: e.path, Prefix: false}
+					}
+				}
+			}
+			if match, ok := mux.Lookup(entry.path); !ok || match != expected {
+				problems = append(problems, fmt.Errorf("%s: lookup returned %+v (found: %v), expected %+v",
+					entry.path, match, ok, expected))
+			}
+
+			if inPrefixTrie {
+				probe := strings.TrimSuffix(entry.path, "/") + "/" + verifyProbeSegment
+				expected := Match{Path: entry.path, Prefix: true}
+				if match, ok := mux.Lookup(probe); !ok || match != expected {
+					problems = append(problems, fmt.Errorf("%s: lookup returned %+v (found: %v), expected %+v",
+						probe, match, ok, expected))
+				}
+			}
+		}
+	}
+
+	exactTrie.Walk(check(false))
+	prefixTrie.Walk(check(true))
+
+	if entries != count {
+		problems = append(problems, fmt.Errorf("route count is %d but there are %d routes in the mux; "+
+			"some routes may have been registered more than once", count, entries))
+	}
+	if mux.Overlay != nil {
+		for _, problem := range mux.Overlay.Verify() {
+			problems = append(problems, fmt.Errorf("overlay: %v", problem))
+		}
+	}
+
+	return problems
+}
+
+func equalSegments(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
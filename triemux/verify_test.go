@@ -0,0 +1,70 @@
+package triemux
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/", true, a)
+	mux.Handle("/foo", true, a)
+	mux.Handle("/foo", false, b)
+	mux.Handle("/foo/bar", false, c)
+	mux.Handle("/baz/", true, b)
+
+	if problems := mux.Verify(); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+}
+
+func TestVerifyDuplicateRoutes(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", false, a)
+	mux.Handle("/foo/", false, b)
+
+	problems := mux.Verify()
+	if len(problems) != 1 || !strings.Contains(problems[0].Error(), "more than once") {
+		t.Errorf("Expected a problem with the route count, got %v", problems)
+	}
+}
+
+func TestVerifyMisplacedEntries(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", false, a)
+	mux.exactTrie.Set([]string{"bar"}, muxEntry{"/baz", false, b})
+	mux.count++
+
+	problems := mux.Verify()
+	if len(problems) == 0 || !strings.Contains(problems[0].Error(), "wrong place") {
+		t.Errorf("Expected a problem with the misplaced entry, got %v", problems)
+	}
+}
+
+func TestVerifyRandomRoutes(t *testing.T) {
+	segments := []string{"government", "publications", "foo", "bar", "%20", "ümlaut", "1"}
+
+	for i := 0; i < 20; i++ {
+		mux := NewMux()
+		seen := make(map[string]bool)
+		for j := 0; j < 200; j++ {
+			parts := make([]string, rand.Intn(5))
+			for k := range parts {
+				parts[k] = segments[rand.Intn(len(segments))]
+			}
+			path := "/" + strings.Join(parts, "/")
+			prefix := rand.Intn(2) == 0
+
+			key := path + map[bool]string{true: "(true)", false: "(false)"}[prefix]
+			if !seen[key] {
+				seen[key] = true
+				mux.Handle(path, prefix, a)
+			}
+		}
+
+		if problems := mux.Verify(); len(problems) != 0 {
+			t.Fatalf("Expected no problems with random routes, got %v", problems)
+		}
+	}
+}
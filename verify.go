@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/alphagov/router/triemux"
+)
+
+// runVerify implements "router verify": it loads the routes from the route
+// source, checks them as described for verifyMux and reports any problems to
+// out. It returns the exit status for the command.
+func runVerify(o Options, out io.Writer) int {
+	rt, err := NewRouterWithOptions(o)
+	if err != nil {
+		fmt.Fprintln(out, "router verify:", err)
+		return 1
+	}
+
+	var problems []error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				problems = []error{fmt.Errorf("loading routes failed: %v", r)}
+			}
+		}()
+
+		table, err := loadRouteTable(context.Background(), rt.source)
+		if err != nil {
+			panic(err)
+		}
+		reloadedTable, err := loadRouteTable(context.Background(), rt.source)
+		if err != nil {
+			panic(err)
+		}
+		mux, _ := rt.buildMux(table)
+		reloaded, _ := rt.buildMux(reloadedTable)
+		problems = append(sharedEntryProblems(table.Routes), verifyMux(mux, reloaded)...)
+
+		if len(problems) == 0 {
+			fmt.Fprintf(out, "router verify: %d routes OK (checksum: %x)\n", mux.RouteCount(), mux.RouteChecksum())
+		}
+	}()
+
+	for _, problem := range problems {
+		fmt.Fprintln(out, "router verify:", problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(out, "router verify: %d problems found\n", len(problems))
+		return 1
+	}
+	return 0
+}
+
+// sharedEntryProblems describes each route which shares a mux entry with an
+// earlier one, such as /foo/ after /foo, and so replaces it when the routes
+// are loaded.
+func sharedEntryProblems(routes []Route) (problems []error) {
+	type entryKey struct {
+		path, routeType, extensions string
+	}
+	seen := make(map[entryKey]string, len(routes))
+	for i := range routes {
+		route := &routes[i]
+		incomingURL, err := url.Parse(route.IncomingPath)
+		if err != nil {
+			continue
+		}
+		key := entryKey{muxEntryPath(incomingURL.Path), route.RouteType, strings.Join(route.extensions(), ",")}
+		if first, ok := seen[key]; ok {
+			problems = append(problems, fmt.Errorf("route %s (%s) is registered more than once: it shares a mux entry with %s",
+				route.IncomingPath, route.RouteType, first))
+			continue
+		}
+		seen[key] = route.IncomingPath
+	}
+	return problems
+}
+
+// verifyMux checks the consistency of a mux (see triemux.Mux.Verify) and
+// that loading the same routes again gave the same result.
+func verifyMux(mux, reloaded *triemux.Mux) []error {
+	problems := mux.Verify()
+
+	if mux.RouteCount() != reloaded.RouteCount() {
+		problems = append(problems, fmt.Errorf("loaded %d routes the first time and %d the second",
+			mux.RouteCount(), reloaded.RouteCount()))
+	}
+	if !bytes.Equal(mux.RouteChecksum(), reloaded.RouteChecksum()) {
+		problems = append(problems, fmt.Errorf("route checksum isn't reproducible: got %x then %x",
+			mux.RouteChecksum(), reloaded.RouteChecksum()))
+	}
+
+	return problems
+}
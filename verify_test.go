@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/router/triemux"
+)
+
+var _ = Describe("Verifying routes", func() {
+	handler := http.NotFoundHandler()
+
+	build := func(paths ...string) *triemux.Mux {
+		mux := newMux()
+		for _, path := range paths {
+			mux.Handle(path, false, handler)
+		}
+		return mux
+	}
+
+	It("should pass when the routes load the same way twice", func() {
+		Expect(verifyMux(build("/foo", "/bar"), build("/foo", "/bar"))).To(BeEmpty())
+	})
+
+	It("should pass when the routes load in a different order", func() {
+		Expect(verifyMux(build("/foo", "/bar"), build("/bar", "/foo"))).To(BeEmpty())
+	})
+
+	It("should fail when the checksum isn't reproducible", func() {
+		problems := verifyMux(build("/foo", "/bar"), build("/foo", "/baz"))
+		Expect(problems).To(HaveLen(1))
+		Expect(problems[0].Error()).To(ContainSubstring("checksum isn't reproducible"))
+	})
+
+	It("should fail when the route count changes", func() {
+		problems := verifyMux(build("/foo", "/bar"), build("/foo"))
+		Expect(problems).To(HaveLen(2))
+		Expect(problems[0].Error()).To(ContainSubstring("loaded 2 routes the first time and 1 the second"))
+	})
+
+	It("should include problems found in the mux", func() {
+		problems := verifyMux(build("/foo", "/foo/"), build("/foo", "/foo/"))
+		Expect(problems).To(HaveLen(1))
+		Expect(problems[0].Error()).To(ContainSubstring("more than once"))
+	})
+
+	It("should load routes sharing a mux entry once, and report them", func() {
+		routes := []Route{
+			{IncomingPath: "/foo", RouteType: "exact", Handler: "gone"},
+			{IncomingPath: "/foo/", RouteType: "exact", Handler: "gone"},
+			{IncomingPath: "/foo", RouteType: "prefix", Handler: "gone"},
+			{IncomingPath: "/foo", RouteType: "exact", Handler: "gone", Extensions: []string{"json"}},
+		}
+		mux, _ := newTestRouter().buildMux(&RouteTable{Routes: routes})
+		Expect(mux.RouteCount()).To(Equal(2))
+		Expect(mux.Verify()).To(BeEmpty())
+
+		problems := sharedEntryProblems(routes)
+		Expect(problems).To(HaveLen(1))
+		Expect(problems[0].Error()).To(ContainSubstring("route /foo/ (exact) is registered more than once"))
+	})
+})
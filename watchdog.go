@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/alphagov/router/logger"
+)
+
+// watchdogStats is what the watchdog looks at in each check.
+type watchdogStats struct {
+	Goroutines int
+	HeapAlloc  uint64
+	// OpenFiles and MaxOpenFiles are zero if they can't be found.
+	OpenFiles    int
+	MaxOpenFiles int
+}
+
+func readWatchdogStats() watchdogStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := watchdogStats{Goroutines: runtime.NumGoroutine(), HeapAlloc: mem.HeapAlloc}
+	stats.OpenFiles, stats.MaxOpenFiles = openFiles()
+	return stats
+}
+
+// watchdog checks the router process for signs that it's degrading, such as
+// leaking goroutines, memory or file descriptors, since otherwise it only
+// becomes obvious when the process is killed or stops accepting
+// connections. When a problem starts it logs a warning, writes goroutine and
+// heap profiles to dumpDir for diagnosis, and optionally reports it to
+// Sentry. Each problem is only reported again once it's gone away.
+type watchdog struct {
+	interval time.Duration
+	// maxGoroutines is how many goroutines suggest a leak.
+	maxGoroutines int
+	// heapGrowthChecks is how many checks in a row the heap must grow
+	// for, to at least heapGrowthFactor times its size at the start.
+	heapGrowthChecks int
+	heapGrowthFactor float64
+	// maxOpenFilesFraction is how much of the open file limit may be used.
+	maxOpenFilesFraction float64
+	dumpDir              string
+	reportToSentry       bool
+	stats                func() watchdogStats
+
+	lastHeap, growthStart uint64
+	growthChecks          int
+	problems              map[string]bool
+}
+
+func newWatchdog(interval time.Duration, maxGoroutines int, dumpDir string, reportToSentry bool) *watchdog {
+	return &watchdog{
+		interval:             interval,
+		maxGoroutines:        maxGoroutines,
+		heapGrowthChecks:     10,
+		heapGrowthFactor:     1.5,
+		maxOpenFilesFraction: 0.8,
+		dumpDir:              dumpDir,
+		reportToSentry:       reportToSentry,
+		stats:                readWatchdogStats,
+		problems:             make(map[string]bool),
+	}
+}
+
+// check looks for problems, returning a description of each one which has
+// started since the last check.
+func (w *watchdog) check(stats watchdogStats) map[string]string {
+	current := make(map[string]string)
+
+	if w.maxGoroutines > 0 && stats.Goroutines > w.maxGoroutines {
+		current["goroutines"] = fmt.Sprintf("%d goroutines are running (limit %d), which suggests a leak",
+			stats.Goroutines, w.maxGoroutines)
+	}
+
+	if w.lastHeap > 0 && stats.HeapAlloc > w.lastHeap {
+		if w.growthChecks == 0 {
+			w.growthStart = w.lastHeap
+		}
+		w.growthChecks++
+	} else {
+		w.growthChecks = 0
+	}
+	w.lastHeap = stats.HeapAlloc
+	if w.growthChecks >= w.heapGrowthChecks && float64(stats.HeapAlloc) >= w.heapGrowthFactor*float64(w.growthStart) {
+		current["heap"] = fmt.Sprintf("the heap has grown for %d checks in a row, from %d to %d bytes",
+			w.growthChecks, w.growthStart, stats.HeapAlloc)
+	}
+
+	if stats.MaxOpenFiles > 0 && float64(stats.OpenFiles) > w.maxOpenFilesFraction*float64(stats.MaxOpenFiles) {
+		current["open_files"] = fmt.Sprintf("%d of the limit of %d file descriptors are open",
+			stats.OpenFiles, stats.MaxOpenFiles)
+	}
+
+	started := make(map[string]string)
+	for problem, description := range current {
+		if !w.problems[problem] {
+			started[problem] = description
+		}
+	}
+	for problem := range w.problems {
+		if _, ok := current[problem]; !ok {
+			logInfo("router: watchdog: problem has gone away:", problem)
+			watchdogProblemMetric.WithLabelValues(problem).Set(0)
+		}
+	}
+	w.problems = make(map[string]bool, len(current))
+	for problem := range current {
+		w.problems[problem] = true
+		watchdogProblemMetric.WithLabelValues(problem).Set(1)
+	}
+	return started
+}
+
+// run checks the process every interval. It doesn't return.
+func (w *watchdog) run() {
+	for range time.Tick(w.interval) {
+		for problem, description := range w.check(w.stats()) {
+			w.report(problem, description)
+		}
+	}
+}
+
+func (w *watchdog) report(problem, description string) {
+	msg := "router: watchdog: " + description
+	if w.dumpDir != "" {
+		if dumps, err := w.dump(problem); err != nil {
+			logWarn("router: watchdog: couldn't write diagnostic dumps:", err)
+		} else {
+			msg += fmt.Sprintf(" (diagnostics written to %v)", dumps)
+		}
+	}
+	logWarn(msg)
+
+	if w.reportToSentry {
+		logger.NotifySentry(logger.ReportableError{Error: fmt.Errorf("%s", msg)})
+	}
+}
+
+// dump writes goroutine and heap profiles, which can be read with
+// "go tool pprof", to files in dumpDir.
+func (w *watchdog) dump(problem string) ([]string, error) {
+	timestamp := time.Now().UTC().Format("20060102T150405Z")
+	var files []string
+	for _, profile := range []string{"goroutine", "heap"} {
+		name := filepath.Join(w.dumpDir, fmt.Sprintf("router-%s-%s-%s.pprof", problem, timestamp, profile))
+		f, err := os.Create(name)
+		if err != nil {
+			return files, err
+		}
+		err = pprof.Lookup(profile).WriteTo(f, 0)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return files, err
+		}
+		files = append(files, name)
+	}
+	return files, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watchdog", func() {
+	var w *watchdog
+
+	BeforeEach(func() {
+		w = newWatchdog(0, 100, "", false)
+	})
+
+	It("should report too many goroutines once, until the problem goes away", func() {
+		Expect(w.check(watchdogStats{Goroutines: 100})).To(BeEmpty())
+
+		started := w.check(watchdogStats{Goroutines: 101})
+		Expect(started).To(HaveKeyWithValue("goroutines", ContainSubstring("101 goroutines")))
+		Expect(w.check(watchdogStats{Goroutines: 150})).To(BeEmpty())
+
+		Expect(w.check(watchdogStats{Goroutines: 50})).To(BeEmpty())
+		Expect(w.check(watchdogStats{Goroutines: 150})).To(HaveKey("goroutines"))
+	})
+
+	It("should report a heap which keeps growing", func() {
+		heap := uint64(1000)
+		for i := 0; i < w.heapGrowthChecks; i++ {
+			Expect(w.check(watchdogStats{HeapAlloc: heap})).To(BeEmpty())
+			heap += 100
+		}
+		Expect(w.check(watchdogStats{HeapAlloc: heap})).To(HaveKeyWithValue("heap", ContainSubstring("from 1000 to 2000 bytes")))
+	})
+
+	It("should not report a heap which grows slowly or shrinks again", func() {
+		heap := uint64(1000)
+		for i := 0; i <= w.heapGrowthChecks; i++ {
+			Expect(w.check(watchdogStats{HeapAlloc: heap})).To(BeEmpty())
+			heap++
+		}
+
+		w = newWatchdog(0, 100, "", false)
+		for i := 0; i <= w.heapGrowthChecks; i++ {
+			if i == 5 {
+				heap = 1000
+			}
+			Expect(w.check(watchdogStats{HeapAlloc: heap})).To(BeEmpty())
+			heap *= 2
+		}
+	})
+
+	It("should report running out of file descriptors", func() {
+		Expect(w.check(watchdogStats{OpenFiles: 800, MaxOpenFiles: 1000})).To(BeEmpty())
+		Expect(w.check(watchdogStats{OpenFiles: 801, MaxOpenFiles: 1000})).To(HaveKey("open_files"))
+		Expect(w.check(watchdogStats{OpenFiles: 5000})).To(BeEmpty())
+	})
+
+	It("should write goroutine and heap profiles", func() {
+		dir, err := ioutil.TempDir("", "watchdog")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		w.dumpDir = dir
+
+		files, err := w.dump("goroutines")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(2))
+		for _, file := range files {
+			Expect(filepath.Dir(file)).To(Equal(dir))
+			Expect(filepath.Base(file)).To(HavePrefix("router-goroutines-"))
+			info, err := os.Stat(file)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Size()).To(BeNumerically(">", 0))
+		}
+	})
+})
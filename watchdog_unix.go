@@ -0,0 +1,28 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFiles returns how many file descriptors the process has open, and
+// the most it may have, or zeros if they can't be found.
+func openFiles() (open, max int) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, 0
+	}
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, 0
+	}
+	defer dir.Close()
+	fds, err := dir.Readdirnames(-1)
+	if err != nil {
+		return 0, 0
+	}
+	// Leave out the descriptor used to read the directory.
+	return len(fds) - 1, int(limit.Cur)
+}
@@ -0,0 +1,6 @@
+package main
+
+// openFiles isn't supported on Windows.
+func openFiles() (open, max int) {
+	return 0, 0
+}